@@ -2,11 +2,50 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"time"
 
 	"github.com/nerock/urlshort/grpc/proto"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	// DefaultRetries is how many times idempotent calls failing because the server is unavailable are retried
+	// by default
+	DefaultRetries = 2
+	// DefaultBackoff is the wait before the first retry by default, it doubles with every retry
+	DefaultBackoff = 100 * time.Millisecond
+
+	// watchingMetadata is the header the server sends once WatchRedirects streams start
+	watchingMetadata = "x-watching"
+)
+
+// Client is the api of the url shortener, implemented over gRPC by URLClient and over HTTP by HTTPClient
+// so callers can swap the transport. Errors can be checked with the errors of the package
+type Client interface {
+	CreateURL(ctx context.Context, url string, opts ...CreateOption) (string, string, error)
+	GetURL(ctx context.Context, id string, opts ...CallOption) (string, string, error)
+	UnlockURL(ctx context.Context, id, password string, opts ...CallOption) (string, string, error)
+	DeleteURL(ctx context.Context, id string, opts ...CallOption) error
+	RestoreURL(ctx context.Context, id string, opts ...CallOption) error
+	GetRedirectionCount(ctx context.Context, id string, opts ...CallOption) (string, int, error)
+	GetQRCode(ctx context.Context, id string, qrOpts QROptions, opts ...CallOption) ([]byte, string, error)
+	SetRules(ctx context.Context, id string, rules []Rule, opts ...CallOption) ([]Rule, error)
+	GetRules(ctx context.Context, id string, opts ...CallOption) ([]Rule, error)
+	SetVariants(ctx context.Context, id string, split Split, opts ...CallOption) (Split, error)
+	GetVariants(ctx context.Context, id string, opts ...CallOption) (Split, error)
+	GetStats(ctx context.Context, id string, opts ...CallOption) (Stats, error)
+	ListAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+	ListCampaignURLs(ctx context.Context, campaign string) ([]Link, error)
+	WatchRedirects(ctx context.Context, ids []string, opts ...CallOption) (<-chan Redirect, error)
+	Close() error
+}
+
+var (
+	_ Client = URLClient{}
+	_ Client = HTTPClient{}
 )
 
 // URLClient is a client to use the url shortener via gRPC
@@ -15,49 +54,193 @@ type URLClient struct {
 	client proto.UrlShortenerClient
 }
 
-// NewURLClient creates a new URLClient
-func NewURLClient(ctx context.Context, url string) (URLClient, error) {
-	conn, err := grpc.DialContext(ctx, url, grpc.WithBlock(), grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return URLClient{}, fmt.Errorf("create gRPC conn: %w", err)
+// Close closes the URLClient connection
+func (u URLClient) Close() error {
+	return u.conn.Close()
+}
+
+// CreateOption sets optional settings of a shortened url on creation
+type CreateOption func(*createOptions)
+
+// createOptions are the settings of a shortened url on creation shared by both transports
+type createOptions struct {
+	warn           bool
+	redirectType   int
+	forwardQuery   string
+	forwardPath    bool
+	campaign       *Campaign
+	password       string
+	maxClicks      int
+	notBefore      time.Time
+	domain         string
+	idempotencyKey string
+}
+
+// WithWarn makes the shortened url show an interstitial page before redirecting
+func WithWarn() CreateOption {
+	return func(o *createOptions) {
+		o.warn = true
 	}
+}
 
-	return URLClient{
-		conn:   conn,
-		client: proto.NewUrlShortenerClient(conn),
-	}, nil
+// WithRedirectType sets the HTTP status code used to redirect: 301, 302, 307 or 308
+func WithRedirectType(code int) CreateOption {
+	return func(o *createOptions) {
+		o.redirectType = code
+	}
 }
 
-// Close closes the URLClient connection
-func (u URLClient) Close() error {
-	return u.conn.Close()
+// WithForwardQuery forwards the visit query string to the long url merging it or overriding its params
+func WithForwardQuery(mode string) CreateOption {
+	return func(o *createOptions) {
+		o.forwardQuery = mode
+	}
+}
+
+// WithForwardPath appends the visit path after the short url id to the long url
+func WithForwardPath() CreateOption {
+	return func(o *createOptions) {
+		o.forwardPath = true
+	}
+}
+
+// WithCampaign merges the campaign UTM parameters into the url
+func WithCampaign(campaign Campaign) CreateOption {
+	return func(o *createOptions) {
+		o.campaign = &campaign
+	}
+}
+
+// WithPassword protects the shortened url with a password visitors must enter before being redirected
+func WithPassword(password string) CreateOption {
+	return func(o *createOptions) {
+		o.password = password
+	}
+}
+
+// WithMaxClicks makes the shortened url stop working after the number of redirections
+func WithMaxClicks(clicks int) CreateOption {
+	return func(o *createOptions) {
+		o.maxClicks = clicks
+	}
+}
+
+// WithNotBefore keeps the shortened url from working until the time, with a precision of seconds
+func WithNotBefore(t time.Time) CreateOption {
+	return func(o *createOptions) {
+		o.notBefore = t.Truncate(time.Second)
+	}
+}
+
+// WithDomain creates the shortened url on the short domain with the host instead of the default one
+func WithDomain(host string) CreateOption {
+	return func(o *createOptions) {
+		o.domain = host
+	}
+}
+
+// WithIdempotencyKey makes the creation idempotent, repeating it with the same key returns the url created first
+// while the server keeps the key and fails with ErrConflict when the url or its options change. The HTTP client
+// retries the requests with a key like the ones that only read urls
+func WithIdempotencyKey(key string) CreateOption {
+	return func(o *createOptions) {
+		o.idempotencyKey = key
+	}
+}
+
+func newCreateOptions(opts []CreateOption) createOptions {
+	var o createOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// CallOption sets optional settings of the calls to shortened urls by their id
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	domain string
+}
+
+// OnDomain addresses the shortened urls on the short domain with the host instead of the default one,
+// ids are only unique in their domain
+func OnDomain(host string) CallOption {
+	return func(o *callOptions) {
+		o.domain = host
+	}
+}
+
+func newCallOptions(opts []CallOption) callOptions {
+	var o callOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
 }
 
 // CreateURL sends a request to create a new shortened url
-func (u URLClient) CreateURL(ctx context.Context, url string) (string, string, error) {
-	res, err := u.client.CreateURL(ctx, &proto.CreateURLRequest{Url: url})
+func (u URLClient) CreateURL(ctx context.Context, url string, opts ...CreateOption) (string, string, error) {
+	o := newCreateOptions(opts)
+	req := &proto.CreateURLRequest{
+		Url:            url,
+		Warn:           o.warn,
+		RedirectType:   int32(o.redirectType),
+		ForwardQuery:   o.forwardQuery,
+		ForwardPath:    o.forwardPath,
+		Password:       o.password,
+		MaxClicks:      int32(o.maxClicks),
+		Domain:         o.domain,
+		IdempotencyKey: o.idempotencyKey,
+	}
+	if !o.notBefore.IsZero() {
+		req.NotBefore = o.notBefore.Unix()
+	}
+	if o.campaign != nil {
+		req.Campaign = &proto.Campaign{
+			Source:   o.campaign.Source,
+			Medium:   o.campaign.Medium,
+			Campaign: o.campaign.Name,
+			Term:     o.campaign.Term,
+			Content:  o.campaign.Content,
+		}
+	}
+
+	res, err := u.client.CreateURL(ctx, req)
 	if err != nil {
-		return "", "", fmt.Errorf("could not create url: %w", err)
+		return "", "", fmt.Errorf("could not create url: %w", fromStatus(err))
 	}
 
 	return res.Url, res.ShortUrl, nil
 }
 
 // GetURL sends a request to get a shortened url by its id
-func (u URLClient) GetURL(ctx context.Context, id string) (string, string, error) {
-	res, err := u.client.GetURL(ctx, &proto.URLRequest{Id: id})
+func (u URLClient) GetURL(ctx context.Context, id string, opts ...CallOption) (string, string, error) {
+	res, err := u.client.GetURL(ctx, &proto.URLRequest{Id: id, Domain: newCallOptions(opts).domain})
+	if err != nil {
+		return "", "", fmt.Errorf("could not get url: %w", fromStatus(err))
+	}
+
+	return res.Url, res.ShortUrl, nil
+}
+
+// UnlockURL sends a request to get a password protected shortened url by its id
+func (u URLClient) UnlockURL(ctx context.Context, id, password string, opts ...CallOption) (string, string, error) {
+	res, err := u.client.GetURL(ctx, &proto.URLRequest{Id: id, Password: password, Domain: newCallOptions(opts).domain})
 	if err != nil {
-		return "", "", fmt.Errorf("could not get url: %w", err)
+		return "", "", fmt.Errorf("could not unlock url: %w", fromStatus(err))
 	}
 
 	return res.Url, res.ShortUrl, nil
 }
 
 // GetURL sends a request to delete a shortened url by its id
-func (u URLClient) DeleteURL(ctx context.Context, id string) error {
-	res, err := u.client.DeleteURL(ctx, &proto.URLRequest{Id: id})
+func (u URLClient) DeleteURL(ctx context.Context, id string, opts ...CallOption) error {
+	res, err := u.client.DeleteURL(ctx, &proto.URLRequest{Id: id, Domain: newCallOptions(opts).domain})
 	if err != nil {
-		return fmt.Errorf("could not delete url: %w", err)
+		return fmt.Errorf("could not delete url: %w", fromStatus(err))
 	}
 
 	if !res.Ok {
@@ -67,12 +250,292 @@ func (u URLClient) DeleteURL(ctx context.Context, id string) error {
 	return nil
 }
 
+// RestoreURL sends a request to restore a deleted shortened url by its id
+func (u URLClient) RestoreURL(ctx context.Context, id string, opts ...CallOption) error {
+	res, err := u.client.RestoreURL(ctx, &proto.URLRequest{Id: id, Domain: newCallOptions(opts).domain})
+	if err != nil {
+		return fmt.Errorf("could not restore url: %w", fromStatus(err))
+	}
+
+	if !res.Ok {
+		return fmt.Errorf("could not restore url")
+	}
+
+	return nil
+}
+
 // GetRedirectionCount sends a request to get a shortened url redirection count
-func (u URLClient) GetRedirectionCount(ctx context.Context, id string) (string, int, error) {
-	res, err := u.client.GetRedirectionCount(ctx, &proto.URLRequest{Id: id})
+func (u URLClient) GetRedirectionCount(ctx context.Context, id string, opts ...CallOption) (string, int, error) {
+	res, err := u.client.GetRedirectionCount(ctx, &proto.URLRequest{Id: id, Domain: newCallOptions(opts).domain})
 	if err != nil {
-		return "", 0, fmt.Errorf("could not create url: %w", err)
+		return "", 0, fmt.Errorf("could not get redirection count: %w", fromStatus(err))
 	}
 
 	return res.Id, int(res.Count), nil
 }
+
+// GetQRCode sends a request to get the QR code image of a shortened url returning the image and its content type,
+// a zero margin uses the default one and a negative margin disables it
+func (u URLClient) GetQRCode(ctx context.Context, id string, qrOpts QROptions, opts ...CallOption) ([]byte, string, error) {
+	res, err := u.client.GetQRCode(ctx, &proto.QRCodeRequest{
+		Id:     id,
+		Format: qrOpts.Format,
+		Size:   int32(qrOpts.Size),
+		Level:  qrOpts.Level,
+		Margin: int32(qrOpts.Margin),
+		Domain: newCallOptions(opts).domain,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("could not get QR code: %w", fromStatus(err))
+	}
+
+	return res.Image, res.ContentType, nil
+}
+
+// SetRules sends a request to replace the routing rules of a shortened url returning the saved rules
+func (u URLClient) SetRules(ctx context.Context, id string, rules []Rule, opts ...CallOption) ([]Rule, error) {
+	req := &proto.SetRulesRequest{Id: id, Domain: newCallOptions(opts).domain}
+	for _, rule := range rules {
+		req.Rules = append(req.Rules, &proto.Rule{
+			Platform: rule.Platform,
+			Language: rule.Language,
+			Country:  rule.Country,
+			Url:      rule.URL,
+		})
+	}
+
+	res, err := u.client.SetRules(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("could not set rules: %w", fromStatus(err))
+	}
+
+	return fromProtoRules(res.Rules), nil
+}
+
+// GetRules sends a request to get the routing rules of a shortened url
+func (u URLClient) GetRules(ctx context.Context, id string, opts ...CallOption) ([]Rule, error) {
+	res, err := u.client.GetRules(ctx, &proto.URLRequest{Id: id, Domain: newCallOptions(opts).domain})
+	if err != nil {
+		return nil, fmt.Errorf("could not get rules: %w", fromStatus(err))
+	}
+
+	return fromProtoRules(res.Rules), nil
+}
+
+// SetVariants sends a request to replace the weighted variants of a shortened url returning the saved variants
+func (u URLClient) SetVariants(ctx context.Context, id string, split Split, opts ...CallOption) (Split, error) {
+	req := &proto.SetVariantsRequest{Id: id, Sticky: split.Sticky, Domain: newCallOptions(opts).domain}
+	for _, variant := range split.Variants {
+		req.Variants = append(req.Variants, &proto.Variant{
+			Name:   variant.Name,
+			Url:    variant.URL,
+			Weight: int32(variant.Weight),
+		})
+	}
+
+	res, err := u.client.SetVariants(ctx, req)
+	if err != nil {
+		return Split{}, fmt.Errorf("could not set variants: %w", fromStatus(err))
+	}
+
+	return Split{Sticky: res.Sticky, Variants: fromProtoVariants(res.Variants)}, nil
+}
+
+// GetVariants sends a request to get the weighted variants of a shortened url with their counts
+func (u URLClient) GetVariants(ctx context.Context, id string, opts ...CallOption) (Split, error) {
+	res, err := u.client.GetVariants(ctx, &proto.URLRequest{Id: id, Domain: newCallOptions(opts).domain})
+	if err != nil {
+		return Split{}, fmt.Errorf("could not get variants: %w", fromStatus(err))
+	}
+
+	return Split{Sticky: res.Sticky, Variants: fromProtoVariants(res.Variants)}, nil
+}
+
+// GetStats sends a request to get the redirection count of a shortened url and each of its variants
+func (u URLClient) GetStats(ctx context.Context, id string, opts ...CallOption) (Stats, error) {
+	res, err := u.client.GetStats(ctx, &proto.URLRequest{Id: id, Domain: newCallOptions(opts).domain})
+	if err != nil {
+		return Stats{}, fmt.Errorf("could not get stats: %w", fromStatus(err))
+	}
+
+	return Stats{
+		Count:     int(res.Count),
+		Remaining: int(res.RemainingClicks),
+		Variants:  fromProtoVariants(res.Variants),
+		Scheduled: res.Scheduled,
+		NotBefore: fromUnix(res.NotBefore),
+	}, nil
+}
+
+// ListAuditEntries sends a request to list the audit entries matching the filter, the next page starts after
+// the id of the last entry returned
+func (u URLClient) ListAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	req := &proto.AuditRequest{
+		Domain:  filter.Domain,
+		Id:      filter.URLID,
+		Actor:   filter.Actor,
+		AfterId: filter.AfterID,
+		Limit:   int32(filter.Limit),
+	}
+	if !filter.From.IsZero() {
+		req.From = filter.From.Unix()
+	}
+	if !filter.To.IsZero() {
+		req.To = filter.To.Unix()
+	}
+
+	res, err := u.client.ListAuditEntries(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("could not list audit entries: %w", fromStatus(err))
+	}
+
+	entries := make([]AuditEntry, 0, len(res.Entries))
+	for _, entry := range res.Entries {
+		auditEntry := AuditEntry{
+			ID:        entry.EntryId,
+			Time:      fromUnix(entry.Time),
+			Action:    entry.Action,
+			Domain:    entry.Domain,
+			URLID:     entry.Id,
+			Actor:     entry.Actor,
+			RequestID: entry.RequestId,
+			Protocol:  entry.Protocol,
+		}
+		if entry.Before != "" {
+			auditEntry.Before = []byte(entry.Before)
+		}
+		if entry.After != "" {
+			auditEntry.After = []byte(entry.After)
+		}
+		entries = append(entries, auditEntry)
+	}
+
+	return entries, nil
+}
+
+// ListCampaignURLs sends a request to list the shortened urls created for a campaign on every domain,
+// password protected urls have an empty long url
+func (u URLClient) ListCampaignURLs(ctx context.Context, campaign string) ([]Link, error) {
+	res, err := u.client.ListCampaignURLs(ctx, &proto.CampaignURLsRequest{Campaign: campaign})
+	if err != nil {
+		return nil, fmt.Errorf("could not list campaign urls: %w", fromStatus(err))
+	}
+
+	links := make([]Link, 0, len(res.Urls))
+	for _, link := range res.Urls {
+		l := Link{
+			Domain:    link.Domain,
+			ID:        link.Id,
+			URL:       link.Url,
+			ShortURL:  link.ShortUrl,
+			Count:     int(link.Count),
+			NotBefore: fromUnix(link.NotBefore),
+			Scheduled: link.Scheduled,
+		}
+		if link.Campaign != nil {
+			l.Campaign = Campaign{
+				Source:  link.Campaign.Source,
+				Medium:  link.Campaign.Medium,
+				Name:    link.Campaign.Campaign,
+				Term:    link.Campaign.Term,
+				Content: link.Campaign.Content,
+			}
+		}
+		links = append(links, l)
+	}
+
+	return links, nil
+}
+
+// WatchRedirects streams the redirections of the shortened urls, or of all of them when there are no ids,
+// as they happen. The channel is closed when the context is done or the stream ends
+func (u URLClient) WatchRedirects(ctx context.Context, ids []string, opts ...CallOption) (<-chan Redirect, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := u.client.WatchRedirects(ctx, &proto.WatchRedirectsRequest{Ids: ids, Domain: newCallOptions(opts).domain})
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("could not watch redirects: %w", fromStatus(err))
+	}
+
+	// The server sends the watching header once it started, a stream without it failed to start and ends with
+	// its error. Streams sending events without it are not watching the way the client expects
+	header, err := stream.Header()
+	if err == nil && len(header.Get(watchingMetadata)) == 0 {
+		if _, err = stream.Recv(); err == nil || errors.Is(err, io.EOF) {
+			err = fmt.Errorf("%w, the server did not send the %s header", ErrUnimplemented, watchingMetadata)
+		}
+	}
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("could not watch redirects: %w", fromStatus(err))
+	}
+
+	redirects := make(chan Redirect)
+	go func() {
+		defer cancel()
+		defer close(redirects)
+		for {
+			event, err := stream.Recv()
+			if err != nil {
+				return
+			}
+
+			redirect := Redirect{
+				Domain:   event.Domain,
+				ID:       event.Id,
+				Time:     fromUnix(event.Time),
+				Count:    int(event.Count),
+				URL:      event.Url,
+				Variant:  event.Variant,
+				Platform: event.Platform,
+				Language: event.Language,
+				Country:  event.Country,
+				Dropped:  event.Dropped,
+			}
+
+			select {
+			case redirects <- redirect:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return redirects, nil
+}
+
+func fromUnix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(sec, 0).UTC()
+}
+
+func fromProtoVariants(variants []*proto.Variant) []Variant {
+	res := make([]Variant, 0, len(variants))
+	for _, variant := range variants {
+		res = append(res, Variant{
+			Name:   variant.Name,
+			URL:    variant.Url,
+			Weight: int(variant.Weight),
+			Count:  int(variant.Count),
+		})
+	}
+
+	return res
+}
+
+func fromProtoRules(rules []*proto.Rule) []Rule {
+	res := make([]Rule, 0, len(rules))
+	for _, rule := range rules {
+		res = append(res, Rule{
+			Platform: rule.Platform,
+			Language: rule.Language,
+			Country:  rule.Country,
+			URL:      rule.Url,
+		})
+	}
+
+	return res
+}
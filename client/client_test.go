@@ -0,0 +1,277 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nerock/urlshort/client"
+	urlgrpc "github.com/nerock/urlshort/grpc"
+	"github.com/nerock/urlshort/grpc/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestURLClientRetries(t *testing.T) {
+	tests := map[string]struct {
+		failures int32
+		opts     []client.DialOption
+		create   bool
+		calls    int32
+		err      error
+	}{
+		"read retried": {
+			failures: 2,
+			calls:    3,
+		},
+		"read retries exhausted": {
+			failures: 5,
+			calls:    3,
+			err:      client.ErrUnavailable,
+		},
+		"retries disabled": {
+			failures: 1,
+			opts:     []client.DialOption{client.WithGRPCRetries(0, 0)},
+			calls:    1,
+			err:      client.ErrUnavailable,
+		},
+		"create not retried": {
+			failures: 1,
+			create:   true,
+			calls:    1,
+			err:      client.ErrUnavailable,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := &testServer{failures: tc.failures}
+			opts := append([]client.DialOption{client.WithGRPCRetries(2, time.Millisecond)}, tc.opts...)
+			c := newTestClient(t, map[string]*testServer{"a": srv}, "a", opts...)
+
+			var err error
+			if tc.create {
+				_, _, err = c.CreateURL(context.Background(), "https://www.example.com")
+			} else {
+				_, _, err = c.GetURL(context.Background(), "abc")
+			}
+			if !errors.Is(err, tc.err) {
+				t.Errorf("expected error %v, got %v", tc.err, err)
+			}
+			if calls := atomic.LoadInt32(&srv.calls); calls != tc.calls {
+				t.Errorf("expected %d calls, got %d", tc.calls, calls)
+			}
+		})
+	}
+}
+
+func TestURLClientDefaultTimeout(t *testing.T) {
+	c := newTestClient(t, map[string]*testServer{"a": {block: true}}, "a",
+		client.WithDefaultTimeout(50*time.Millisecond))
+
+	_, _, err := c.GetURL(context.Background(), "abc")
+	if status.Code(errors.Unwrap(err)) != codes.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+	}
+}
+
+func TestURLClientDomain(t *testing.T) {
+	c := newTestClient(t, map[string]*testServer{"a": {}}, "a")
+
+	if _, short, err := c.GetURL(context.Background(), "abc"); err != nil || short != "http://localhost:8080/abc" {
+		t.Errorf("wrong url on the default domain, got %s %v", short, err)
+	}
+	if _, short, err := c.GetURL(context.Background(), "abc", client.OnDomain("sho.rt")); err != nil ||
+		short != "http://sho.rt/abc" {
+		t.Errorf("wrong url on the other domain, got %s %v", short, err)
+	}
+}
+
+func TestURLClientRoundRobin(t *testing.T) {
+	servers := map[string]*testServer{"a": {}, "b": {}}
+	c := newTestClient(t, servers, "a", client.WithAddresses("b"),
+		client.WithKeepalive(urlgrpc.MinPingInterval, time.Second))
+
+	// Calls start once the first address is ready and are balanced when the other one is too
+	for i := 0; i < 100 && (atomic.LoadInt32(&servers["a"].calls) == 0 || atomic.LoadInt32(&servers["b"].calls) == 0); i++ {
+		if _, _, err := c.GetURL(context.Background(), "abc"); err != nil {
+			t.Fatalf("could not get url: %s", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for name, srv := range servers {
+		if atomic.LoadInt32(&srv.calls) == 0 {
+			t.Errorf("no calls balanced to %s", name)
+		}
+	}
+}
+
+func TestURLClientNonBlocking(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	dialer := client.WithDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.NewURLClient(ctx, "a", dialer); err == nil {
+		t.Fatal("expected blocking dial to fail before the server starts")
+	}
+
+	c, err := client.NewURLClient(context.Background(), "a", dialer, client.WithNonBlocking(),
+		client.WithDefaultTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+	defer c.Close()
+
+	startTestServer(t, lis, &testServer{})
+
+	if _, _, err := c.GetURL(context.Background(), "abc"); err != nil {
+		t.Errorf("could not get url once the server started: %s", err)
+	}
+}
+
+func TestURLClientWatchRedirects(t *testing.T) {
+	event := &proto.RedirectEvent{Id: "abc", Count: 3}
+	tests := map[string]struct {
+		watch func(proto.UrlShortener_WatchRedirectsServer) error
+
+		redirect client.Redirect
+		err      error
+	}{
+		"watching": {
+			watch: func(stream proto.UrlShortener_WatchRedirectsServer) error {
+				if err := stream.SendHeader(metadata.Pairs("x-watching", "true")); err != nil {
+					return err
+				}
+				return stream.Send(event)
+			},
+			redirect: client.Redirect{ID: "abc", Count: 3},
+		},
+		"failed to start": {
+			watch: func(proto.UrlShortener_WatchRedirectsServer) error {
+				return status.Error(codes.NotFound, "URL not found")
+			},
+			err: client.ErrNotFound,
+		},
+		"event without header": {
+			watch: func(stream proto.UrlShortener_WatchRedirectsServer) error {
+				return stream.Send(event)
+			},
+			err: client.ErrUnimplemented,
+		},
+		"ended without header": {
+			watch: func(proto.UrlShortener_WatchRedirectsServer) error {
+				return nil
+			},
+			err: client.ErrUnimplemented,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := newTestClient(t, map[string]*testServer{"a": {watch: tt.watch}}, "a")
+
+			redirects, err := c.WatchRedirects(context.Background(), []string{"abc"})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("wrong error returned\nexpected=%v\ngot=%v", tt.err, err)
+			}
+
+			if tt.err != nil {
+				return
+			}
+
+			if redirect := <-redirects; redirect != tt.redirect {
+				t.Errorf("wrong redirect received\nexpected=%+v\ngot=%+v", tt.redirect, redirect)
+			}
+		})
+	}
+}
+
+// newTestClient starts the servers on in-memory listeners with their names as addresses and connects to the url
+func newTestClient(t *testing.T, servers map[string]*testServer, url string, opts ...client.DialOption) client.URLClient {
+	t.Helper()
+
+	listeners := make(map[string]*bufconn.Listener, len(servers))
+	for name, srv := range servers {
+		lis := bufconn.Listen(1024 * 1024)
+		startTestServer(t, lis, srv)
+		listeners[name] = lis
+	}
+
+	opts = append(opts, client.WithDialer(func(ctx context.Context, address string) (net.Conn, error) {
+		lis, ok := listeners[address]
+		if !ok {
+			return nil, fmt.Errorf("unknown address %s", address)
+		}
+		return lis.DialContext(ctx)
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := client.NewURLClient(ctx, url, opts...)
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func startTestServer(t *testing.T, lis *bufconn.Listener, srv *testServer) {
+	t.Helper()
+
+	s := grpc.NewServer()
+	proto.RegisterUrlShortenerServer(s, srv)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+}
+
+// testServer fails its first calls as unavailable, or blocks them until they are done
+type testServer struct {
+	proto.UnimplementedUrlShortenerServer
+	failures int32
+	block    bool
+	calls    int32
+	// watch streams the WatchRedirects calls
+	watch func(proto.UrlShortener_WatchRedirectsServer) error
+}
+
+func (s *testServer) call(ctx context.Context, id string) (*proto.URLResponse, error) {
+	if atomic.AddInt32(&s.calls, 1) <= s.failures {
+		return nil, status.Error(codes.Unavailable, "server restarting")
+	}
+
+	if s.block {
+		<-ctx.Done()
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+
+	return &proto.URLResponse{Url: "https://www.example.com", ShortUrl: "http://localhost:8080/" + id}, nil
+}
+
+func (s *testServer) CreateURL(ctx context.Context, _ *proto.CreateURLRequest) (*proto.URLResponse, error) {
+	return s.call(ctx, "new")
+}
+
+func (s *testServer) GetURL(ctx context.Context, req *proto.URLRequest) (*proto.URLResponse, error) {
+	res, err := s.call(ctx, req.Id)
+	if err == nil && req.Domain != "" {
+		res.ShortUrl = "http://" + req.Domain + "/" + req.Id
+	}
+
+	return res, err
+}
+
+func (s *testServer) WatchRedirects(_ *proto.WatchRedirectsRequest, stream proto.UrlShortener_WatchRedirectsServer) error {
+	return s.watch(stream)
+}
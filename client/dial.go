@@ -0,0 +1,285 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nerock/urlshort/grpc/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+const (
+	// authorizationMetadata is the metadata the token is sent in
+	authorizationMetadata = "authorization"
+	// actorMetadata is the metadata the server reads the actor of audited changes from
+	actorMetadata = "x-actor"
+
+	// addressesScheme is the resolver scheme of the clients balancing several addresses
+	addressesScheme = "urlshort"
+	// maxRetryAttempts is the maximum number of attempts of a call gRPC allows in a retry policy
+	maxRetryAttempts = 5
+)
+
+// idempotentMethods are the methods retried when the server is unavailable, they only read urls
+var idempotentMethods = []string{
+	"GetURL", "GetRedirectionCount", "GetQRCode", "GetRules", "GetVariants", "GetStats", "ListAuditEntries",
+	"ListCampaignURLs",
+}
+
+// DialOption configures the connection of a URLClient
+type DialOption func(*dialOptions)
+
+type dialOptions struct {
+	tls         *tls.Config
+	token       string
+	actor       string
+	timeout     time.Duration
+	retries     int
+	backoff     time.Duration
+	addresses   []string
+	keepalive   *keepalive.ClientParameters
+	nonBlocking bool
+	dialer      func(context.Context, string) (net.Conn, error)
+}
+
+// WithTLS connects to the server over TLS with the config instead of an insecure connection
+func WithTLS(config *tls.Config) DialOption {
+	return func(o *dialOptions) {
+		o.tls = config
+	}
+}
+
+// WithToken sends the token as a bearer token in the authorization metadata of every call, the server checks it
+// against its grpc_token. It requires TLS, served by the server with grpc_tls_cert or by a proxy in front of it
+func WithToken(token string) DialOption {
+	return func(o *dialOptions) {
+		o.token = token
+	}
+}
+
+// WithActor sends the actor in the x-actor metadata of every call so the server audits the changes made by it
+func WithActor(actor string) DialOption {
+	return func(o *dialOptions) {
+		o.actor = actor
+	}
+}
+
+// WithDefaultTimeout sets the deadline of the calls whose context has none, including their retries.
+// It does not apply to WatchRedirects streams
+func WithDefaultTimeout(timeout time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithGRPCRetries sets how many times the calls that only read urls are retried when the server is unavailable
+// and the wait before the first retry, it doubles with every retry. gRPC allows up to 4 retries and 0 disables them,
+// changes are never retried
+func WithGRPCRetries(retries int, backoff time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.retries = retries
+		o.backoff = backoff
+	}
+}
+
+// WithAddresses balances the calls round-robin between the url and the addresses, urls resolving to several
+// addresses like dns:///urlshort.internal:50051 are balanced without it
+func WithAddresses(addresses ...string) DialOption {
+	return func(o *dialOptions) {
+		o.addresses = append(o.addresses, addresses...)
+	}
+}
+
+// WithKeepalive pings the server after the connection is idle for the interval and closes it when the ping is not
+// answered before the timeout, so broken connections are detected before calls fail. The server does not allow
+// intervals under 10 seconds
+func WithKeepalive(interval, timeout time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.keepalive = &keepalive.ClientParameters{Time: interval, Timeout: timeout, PermitWithoutStream: true}
+	}
+}
+
+// WithNonBlocking returns the client without waiting for the connection, it is made in the background and
+// reconnected when it breaks. Calls made before it is ready wait for it or fail with ErrUnavailable
+func WithNonBlocking() DialOption {
+	return func(o *dialOptions) {
+		o.nonBlocking = true
+	}
+}
+
+// WithDialer connects to the addresses with the dialer instead of TCP
+func WithDialer(dialer func(ctx context.Context, address string) (net.Conn, error)) DialOption {
+	return func(o *dialOptions) {
+		o.dialer = dialer
+	}
+}
+
+// NewURLClient creates a new URLClient, by default it waits for the connection until the context is done and
+// retries the calls that only read urls DefaultRetries times when the server is unavailable
+func NewURLClient(ctx context.Context, url string, opts ...DialOption) (URLClient, error) {
+	o := dialOptions{retries: DefaultRetries, backoff: DefaultBackoff}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	serviceConfig, err := o.serviceConfig()
+	if err != nil {
+		return URLClient{}, fmt.Errorf("create gRPC conn: %w", err)
+	}
+
+	creds := insecure.NewCredentials()
+	if o.tls != nil {
+		creds = credentials.NewTLS(o.tls)
+	}
+	dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(creds), grpc.WithDefaultServiceConfig(serviceConfig)}
+	if !o.nonBlocking {
+		dialOpts = append(dialOpts, grpc.WithBlock())
+	}
+	if o.token != "" || o.actor != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(metadataCredentials{
+			token: o.token,
+			actor: o.actor,
+		}))
+	}
+	if o.timeout > 0 {
+		dialOpts = append(dialOpts, grpc.WithUnaryInterceptor(timeoutInterceptor(o.timeout)))
+	}
+	if o.keepalive != nil {
+		dialOpts = append(dialOpts, grpc.WithKeepaliveParams(*o.keepalive))
+	}
+	if o.dialer != nil {
+		dialOpts = append(dialOpts, grpc.WithContextDialer(o.dialer))
+	}
+
+	target := url
+	if len(o.addresses) > 0 {
+		addresses := []resolver.Address{{Addr: url}}
+		for _, address := range o.addresses {
+			addresses = append(addresses, resolver.Address{Addr: address})
+		}
+
+		r := manual.NewBuilderWithScheme(addressesScheme)
+		r.InitialState(resolver.State{Addresses: addresses})
+		dialOpts = append(dialOpts, grpc.WithResolvers(r))
+		target = addressesScheme + ":///" + url
+	}
+
+	conn, err := grpc.DialContext(ctx, target, dialOpts...)
+	if err != nil {
+		return URLClient{}, fmt.Errorf("create gRPC conn: %w", err)
+	}
+
+	return URLClient{
+		conn:   conn,
+		client: proto.NewUrlShortenerClient(conn),
+	}, nil
+}
+
+// serviceConfig returns the gRPC service config balancing the calls round-robin and retrying the idempotent ones
+func (o dialOptions) serviceConfig() (string, error) {
+	type methodName struct {
+		Service string `json:"service"`
+		Method  string `json:"method"`
+	}
+	type retryPolicy struct {
+		MaxAttempts          int      `json:"maxAttempts"`
+		InitialBackoff       string   `json:"initialBackoff"`
+		MaxBackoff           string   `json:"maxBackoff"`
+		BackoffMultiplier    float64  `json:"backoffMultiplier"`
+		RetryableStatusCodes []string `json:"retryableStatusCodes"`
+	}
+	type methodConfig struct {
+		Name        []methodName `json:"name"`
+		RetryPolicy *retryPolicy `json:"retryPolicy,omitempty"`
+	}
+	config := struct {
+		LoadBalancingConfig []map[string]struct{} `json:"loadBalancingConfig"`
+		MethodConfig        []methodConfig        `json:"methodConfig,omitempty"`
+	}{
+		LoadBalancingConfig: []map[string]struct{}{{"round_robin": {}}},
+	}
+
+	if o.retries > 0 {
+		if o.backoff <= 0 {
+			return "", fmt.Errorf("invalid retry backoff %s, it must be positive", o.backoff)
+		}
+
+		attempts := o.retries + 1
+		if attempts > maxRetryAttempts {
+			attempts = maxRetryAttempts
+		}
+
+		names := make([]methodName, 0, len(idempotentMethods))
+		for _, method := range idempotentMethods {
+			names = append(names, methodName{Service: proto.UrlShortener_ServiceDesc.ServiceName, Method: method})
+		}
+		config.MethodConfig = []methodConfig{{
+			Name: names,
+			RetryPolicy: &retryPolicy{
+				MaxAttempts:          attempts,
+				InitialBackoff:       durationString(o.backoff),
+				MaxBackoff:           durationString(o.backoff << (attempts - 1)),
+				BackoffMultiplier:    2,
+				RetryableStatusCodes: []string{"UNAVAILABLE"},
+			},
+		}}
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// durationString formats a duration as the seconds of the gRPC service config
+func durationString(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+// timeoutInterceptor sets the deadline of the calls whose context has none
+func timeoutInterceptor(timeout time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// metadataCredentials adds the token and actor of the client to the metadata of every call
+type metadataCredentials struct {
+	token string
+	actor string
+}
+
+func (m metadataCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	md := make(map[string]string, 2)
+	if m.token != "" {
+		md[authorizationMetadata] = "Bearer " + m.token
+	}
+	if m.actor != "" {
+		md[actorMetadata] = m.actor
+	}
+
+	return md, nil
+}
+
+// RequireTransportSecurity keeps tokens from being sent over insecure connections
+func (m metadataCredentials) RequireTransportSecurity() bool {
+	return m.token != ""
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors returned by both clients, they can be checked with errors.Is regardless of the transport
+var (
+	ErrInvalidArgument  = errors.New("invalid argument")
+	ErrNotFound         = errors.New("not found")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrConflict         = errors.New("conflict")
+	ErrTooManyRequests  = errors.New("too many requests")
+	ErrUnimplemented    = errors.New("unimplemented")
+	ErrUnavailable      = errors.New("unavailable")
+)
+
+// Error is an error response of the HTTP api
+type Error struct {
+	// StatusCode is the HTTP status code of the response
+	StatusCode int
+	// Code is the status text of the response and Message the error of the server
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Is matches the error of the client for the status code
+func (e *Error) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType,
+		http.StatusUnprocessableEntity:
+		return target == ErrInvalidArgument
+	case http.StatusNotFound, http.StatusGone:
+		return target == ErrNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return target == ErrPermissionDenied
+	case http.StatusConflict:
+		return target == ErrConflict
+	case http.StatusTooManyRequests:
+		return target == ErrTooManyRequests
+	case http.StatusNotImplemented:
+		return target == ErrUnimplemented
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return target == ErrUnavailable
+	}
+
+	return false
+}
+
+// statusError is an error of a gRPC call matching the error of the client for its code,
+// it keeps the status so it can still be read with status.FromError and errors.As
+type statusError struct {
+	err error
+}
+
+// fromStatus wraps the error of a gRPC call so it matches the errors of the client
+func fromStatus(err error) error {
+	if _, ok := status.FromError(err); !ok {
+		return err
+	}
+
+	return statusError{err: err}
+}
+
+func (e statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e statusError) Unwrap() error {
+	return e.err
+}
+
+func (e statusError) GRPCStatus() *status.Status {
+	return status.Convert(e.err)
+}
+
+func (e statusError) Is(target error) bool {
+	switch status.Code(e.err) {
+	case codes.InvalidArgument:
+		return target == ErrInvalidArgument
+	case codes.NotFound, codes.FailedPrecondition:
+		// urls that are not working are not found over HTTP
+		return target == ErrNotFound
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return target == ErrPermissionDenied
+	case codes.AlreadyExists, codes.Aborted:
+		return target == ErrConflict
+	case codes.ResourceExhausted:
+		return target == ErrTooManyRequests
+	case codes.Unimplemented:
+		return target == ErrUnimplemented
+	case codes.Unavailable:
+		return target == ErrUnavailable
+	}
+
+	return false
+}
@@ -0,0 +1,676 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jsonContentType = "application/json"
+	countEvent      = "count"
+	// idempotencyKeyHeader is the header the idempotency key of create requests is sent in
+	idempotencyKeyHeader = "Idempotency-Key"
+)
+
+// HTTPOption configures optional HTTPClient behaviour
+type HTTPOption func(*HTTPClient)
+
+// WithHTTPClient sends the requests with the client instead of a default one, its timeout also applies to
+// the streams of WatchRedirects so it should be left unset in favour of WithTimeout
+func WithHTTPClient(client *http.Client) HTTPOption {
+	return func(h *HTTPClient) {
+		h.client = client
+	}
+}
+
+// WithRetries sets how many times idempotent requests failing with a server error or without response are retried
+// and the wait before the first retry, it doubles with every retry. Creating urls and other POST requests are
+// never retried, unless urls are created with an idempotency key
+func WithRetries(retries int, backoff time.Duration) HTTPOption {
+	return func(h *HTTPClient) {
+		h.retries = retries
+		h.backoff = backoff
+	}
+}
+
+// WithTimeout sets how long each call can take including its retries, calls are only limited by their context
+// without it
+func WithTimeout(timeout time.Duration) HTTPOption {
+	return func(h *HTTPClient) {
+		h.timeout = timeout
+	}
+}
+
+// WithHeader sends the header with every request, like the credentials of a proxy or the X-Actor the changes
+// are audited with
+func WithHeader(key, value string) HTTPOption {
+	return func(h *HTTPClient) {
+		h.header.Add(key, value)
+	}
+}
+
+// HTTPClient is a client to use the url shortener via its HTTP api, for services that can not use gRPC
+type HTTPClient struct {
+	base    *neturl.URL
+	client  *http.Client
+	header  http.Header
+	retries int
+	backoff time.Duration
+	timeout time.Duration
+	// retryPost retries POST requests too, they are idempotent
+	retryPost bool
+}
+
+// NewHTTPClient creates a new HTTPClient for the server with the base url, e.g. http://localhost:8080
+func NewHTTPClient(baseURL string, opts ...HTTPOption) (HTTPClient, error) {
+	base, err := neturl.Parse(baseURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return HTTPClient{}, fmt.Errorf("invalid base url %q, it must be an http or https url", baseURL)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+
+	h := HTTPClient{
+		base:    base,
+		client:  &http.Client{},
+		header:  make(http.Header),
+		retries: DefaultRetries,
+		backoff: DefaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(&h)
+	}
+
+	return h, nil
+}
+
+// Close closes the idle connections of the HTTPClient
+func (h HTTPClient) Close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+// CreateURL sends a request to create a new shortened url
+func (h HTTPClient) CreateURL(ctx context.Context, long string, opts ...CreateOption) (string, string, error) {
+	o := newCreateOptions(opts)
+	req := urlRequest{
+		URL:          long,
+		Warn:         o.warn,
+		RedirectType: o.redirectType,
+		ForwardQuery: o.forwardQuery,
+		ForwardPath:  o.forwardPath,
+		Password:     o.password,
+		MaxClicks:    o.maxClicks,
+		NotBefore:    o.notBefore,
+		Domain:       o.domain,
+	}
+	if o.campaign != nil {
+		req.Campaign = campaignRequest{
+			Source:   o.campaign.Source,
+			Medium:   o.campaign.Medium,
+			Campaign: o.campaign.Name,
+			Term:     o.campaign.Term,
+			Content:  o.campaign.Content,
+		}
+	}
+
+	if o.idempotencyKey != "" {
+		h = h.withIdempotencyKey(o.idempotencyKey)
+	}
+
+	var res urlResponse
+	if err := h.do(ctx, http.MethodPost, "/url", nil, req, &res); err != nil {
+		return "", "", fmt.Errorf("could not create url: %w", err)
+	}
+
+	return res.URL, res.ShortURL, nil
+}
+
+// GetURL sends a request to get a shortened url by its id
+func (h HTTPClient) GetURL(ctx context.Context, id string, opts ...CallOption) (string, string, error) {
+	var res urlResponse
+	if err := h.do(ctx, http.MethodGet, urlPath(id, ""), domainQuery(opts), nil, &res); err != nil {
+		return "", "", fmt.Errorf("could not get url: %w", err)
+	}
+
+	return res.URL, res.ShortURL, nil
+}
+
+// UnlockURL sends a request to get a password protected shortened url by its id
+func (h HTTPClient) UnlockURL(ctx context.Context, id, password string, opts ...CallOption) (string, string, error) {
+	var res urlResponse
+	err := h.do(ctx, http.MethodPost, urlPath(id, "/unlock"), domainQuery(opts), unlockRequest{Password: password}, &res)
+	if err != nil {
+		return "", "", fmt.Errorf("could not unlock url: %w", err)
+	}
+
+	return res.URL, res.ShortURL, nil
+}
+
+// DeleteURL sends a request to delete a shortened url by its id
+func (h HTTPClient) DeleteURL(ctx context.Context, id string, opts ...CallOption) error {
+	if err := h.do(ctx, http.MethodDelete, urlPath(id, ""), domainQuery(opts), nil, nil); err != nil {
+		return fmt.Errorf("could not delete url: %w", err)
+	}
+
+	return nil
+}
+
+// RestoreURL sends a request to restore a deleted shortened url by its id
+func (h HTTPClient) RestoreURL(ctx context.Context, id string, opts ...CallOption) error {
+	if err := h.do(ctx, http.MethodPost, urlPath(id, "/restore"), domainQuery(opts), nil, nil); err != nil {
+		return fmt.Errorf("could not restore url: %w", err)
+	}
+
+	return nil
+}
+
+// GetRedirectionCount sends a request to get a shortened url redirection count
+func (h HTTPClient) GetRedirectionCount(ctx context.Context, id string, opts ...CallOption) (string, int, error) {
+	var res urlCountResponse
+	if err := h.do(ctx, http.MethodGet, urlPath(id, "/count"), domainQuery(opts), nil, &res); err != nil {
+		return "", 0, fmt.Errorf("could not get redirection count: %w", err)
+	}
+
+	return res.ID, res.Count, nil
+}
+
+// GetQRCode sends a request to get the QR code image of a shortened url returning the image and its content type,
+// a zero margin uses the default one and a negative margin disables it
+func (h HTTPClient) GetQRCode(ctx context.Context, id string, qrOpts QROptions, opts ...CallOption) ([]byte, string, error) {
+	query := domainQuery(opts)
+	if qrOpts.Format != "" {
+		query.Set("format", qrOpts.Format)
+	}
+	if qrOpts.Level != "" {
+		query.Set("level", qrOpts.Level)
+	}
+	if qrOpts.Size != 0 {
+		query.Set("size", strconv.Itoa(qrOpts.Size))
+	}
+	switch {
+	case qrOpts.Margin < 0:
+		query.Set("margin", "0")
+	case qrOpts.Margin > 0:
+		query.Set("margin", strconv.Itoa(qrOpts.Margin))
+	}
+
+	header, img, err := h.send(ctx, http.MethodGet, urlPath(id, "/qr"), query, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not get QR code: %w", err)
+	}
+
+	return img, header.Get("Content-Type"), nil
+}
+
+// SetRules sends a request to replace the routing rules of a shortened url returning the saved rules
+func (h HTTPClient) SetRules(ctx context.Context, id string, rules []Rule, opts ...CallOption) ([]Rule, error) {
+	req := rulesRequest{Rules: make([]ruleJSON, 0, len(rules))}
+	for _, rule := range rules {
+		req.Rules = append(req.Rules, ruleJSON(rule))
+	}
+
+	var res rulesResponse
+	if err := h.do(ctx, http.MethodPut, urlPath(id, "/rules"), domainQuery(opts), req, &res); err != nil {
+		return nil, fmt.Errorf("could not set rules: %w", err)
+	}
+
+	return fromRuleResponses(res.Rules), nil
+}
+
+// GetRules sends a request to get the routing rules of a shortened url
+func (h HTTPClient) GetRules(ctx context.Context, id string, opts ...CallOption) ([]Rule, error) {
+	var res rulesResponse
+	if err := h.do(ctx, http.MethodGet, urlPath(id, "/rules"), domainQuery(opts), nil, &res); err != nil {
+		return nil, fmt.Errorf("could not get rules: %w", err)
+	}
+
+	return fromRuleResponses(res.Rules), nil
+}
+
+// SetVariants sends a request to replace the weighted variants of a shortened url returning the saved variants
+func (h HTTPClient) SetVariants(ctx context.Context, id string, split Split, opts ...CallOption) (Split, error) {
+	req := variantsRequest{Sticky: split.Sticky, Variants: make([]variantRequest, 0, len(split.Variants))}
+	for _, variant := range split.Variants {
+		req.Variants = append(req.Variants, variantRequest{
+			Name:   variant.Name,
+			URL:    variant.URL,
+			Weight: variant.Weight,
+		})
+	}
+
+	var res variantsResponse
+	if err := h.do(ctx, http.MethodPut, urlPath(id, "/variants"), domainQuery(opts), req, &res); err != nil {
+		return Split{}, fmt.Errorf("could not set variants: %w", err)
+	}
+
+	return Split{Sticky: res.Sticky, Variants: fromVariantResponses(res.Variants)}, nil
+}
+
+// GetVariants sends a request to get the weighted variants of a shortened url with their counts
+func (h HTTPClient) GetVariants(ctx context.Context, id string, opts ...CallOption) (Split, error) {
+	var res variantsResponse
+	if err := h.do(ctx, http.MethodGet, urlPath(id, "/variants"), domainQuery(opts), nil, &res); err != nil {
+		return Split{}, fmt.Errorf("could not get variants: %w", err)
+	}
+
+	return Split{Sticky: res.Sticky, Variants: fromVariantResponses(res.Variants)}, nil
+}
+
+// GetStats sends a request to get the redirection count of a shortened url and each of its variants
+func (h HTTPClient) GetStats(ctx context.Context, id string, opts ...CallOption) (Stats, error) {
+	var res statsResponse
+	if err := h.do(ctx, http.MethodGet, urlPath(id, "/stats"), domainQuery(opts), nil, &res); err != nil {
+		return Stats{}, fmt.Errorf("could not get stats: %w", err)
+	}
+
+	stats := Stats{
+		Count:     res.Count,
+		Remaining: UnlimitedClicks,
+		Variants:  fromVariantResponses(res.Variants),
+		Scheduled: res.Scheduled,
+	}
+	if res.RemainingClicks != nil {
+		stats.Remaining = *res.RemainingClicks
+	}
+	if res.NotBefore != nil {
+		stats.NotBefore = res.NotBefore.UTC()
+	}
+
+	return stats, nil
+}
+
+// ListAuditEntries sends a request to list the audit entries matching the filter, the next page starts after
+// the id of the last entry returned
+func (h HTTPClient) ListAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	query := make(neturl.Values)
+	if filter.Domain != "" {
+		query.Set("domain", filter.Domain)
+	}
+	if filter.URLID != "" {
+		query.Set("id", filter.URLID)
+	}
+	if filter.Actor != "" {
+		query.Set("actor", filter.Actor)
+	}
+	if !filter.From.IsZero() {
+		query.Set("from", filter.From.Format(time.RFC3339))
+	}
+	if !filter.To.IsZero() {
+		query.Set("to", filter.To.Format(time.RFC3339))
+	}
+	if filter.AfterID != 0 {
+		query.Set("after", strconv.FormatInt(filter.AfterID, 10))
+	}
+	if filter.Limit != 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+
+	var res auditResponse
+	if err := h.do(ctx, http.MethodGet, "/audit", query, nil, &res); err != nil {
+		return nil, fmt.Errorf("could not list audit entries: %w", err)
+	}
+
+	entries := make([]AuditEntry, 0, len(res.Entries))
+	for _, entry := range res.Entries {
+		entries = append(entries, AuditEntry{
+			ID:        entry.ID,
+			Time:      entry.Time.UTC(),
+			Action:    entry.Action,
+			Domain:    entry.Domain,
+			URLID:     entry.URLID,
+			Before:    rawOrNil(entry.Before),
+			After:     rawOrNil(entry.After),
+			Actor:     entry.Actor,
+			RequestID: entry.RequestID,
+			Protocol:  entry.Protocol,
+		})
+	}
+
+	return entries, nil
+}
+
+// ListCampaignURLs sends a request to list the shortened urls created for a campaign on every domain,
+// password protected urls have an empty long url
+func (h HTTPClient) ListCampaignURLs(ctx context.Context, campaign string) ([]Link, error) {
+	var res campaignResponse
+	if err := h.do(ctx, http.MethodGet, "/campaign/"+neturl.PathEscape(campaign), nil, nil, &res); err != nil {
+		return nil, fmt.Errorf("could not list campaign urls: %w", err)
+	}
+
+	links := make([]Link, 0, len(res.URLs))
+	for _, link := range res.URLs {
+		l := Link{
+			ID:       link.ID,
+			URL:      link.URL,
+			ShortURL: link.ShortURL,
+			Count:    link.Count,
+			Campaign: Campaign{
+				Source:  link.Source,
+				Medium:  link.Medium,
+				Name:    res.Campaign,
+				Term:    link.Term,
+				Content: link.Content,
+			},
+			Scheduled: link.Scheduled,
+		}
+		if link.NotBefore != nil {
+			l.NotBefore = link.NotBefore.UTC()
+		}
+		links = append(links, l)
+	}
+
+	return links, nil
+}
+
+// WatchRedirects streams the redirections of the shortened urls as they happen from their event streams.
+// Unlike over gRPC at least one id is required and Dropped is always 0, the channel is closed when the context
+// is done or every stream ends
+func (h HTTPClient) WatchRedirects(ctx context.Context, ids []string, opts ...CallOption) (<-chan Redirect, error) {
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("could not watch redirects: %w, the HTTP api needs the ids to watch", ErrUnimplemented)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	bodies := make([]io.ReadCloser, 0, len(ids))
+	for _, id := range ids {
+		query := domainQuery(opts)
+		query.Set("clicks", "1")
+		body, err := h.stream(ctx, urlPath(id, "/events"), query)
+		if err != nil {
+			cancel()
+			for _, body := range bodies {
+				body.Close()
+			}
+			return nil, fmt.Errorf("could not watch redirects: %w", err)
+		}
+		bodies = append(bodies, body)
+	}
+
+	var wg sync.WaitGroup
+	redirects := make(chan Redirect)
+	for _, body := range bodies {
+		wg.Add(1)
+		go func(body io.ReadCloser) {
+			defer wg.Done()
+			defer body.Close()
+			readCountEvents(ctx, body, redirects)
+		}(body)
+	}
+	go func() {
+		wg.Wait()
+		cancel()
+		close(redirects)
+	}()
+
+	return redirects, nil
+}
+
+// readCountEvents sends the redirections of the count events of an event stream until it ends
+func readCountEvents(ctx context.Context, body io.Reader, redirects chan<- Redirect) {
+	var event, data string
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			continue
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			continue
+		case line != "":
+			// Comments and event ids are not needed
+			continue
+		}
+
+		name, payload := event, data
+		event, data = "", ""
+		if name != countEvent {
+			continue
+		}
+
+		var res countEventResponse
+		if err := json.Unmarshal([]byte(payload), &res); err != nil || res.Click == nil {
+			// Events without click are the current count sent when the stream starts
+			continue
+		}
+
+		redirect := Redirect{
+			Domain:   res.Domain,
+			ID:       res.ID,
+			Time:     res.Click.Time.UTC(),
+			Count:    res.Count,
+			URL:      res.Click.URL,
+			Variant:  res.Click.Variant,
+			Platform: res.Click.Platform,
+			Language: res.Click.Language,
+			Country:  res.Click.Country,
+		}
+
+		select {
+		case redirects <- redirect:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// withIdempotencyKey returns a copy of the client sending the idempotency key with its requests and retrying them
+func (h HTTPClient) withIdempotencyKey(key string) HTTPClient {
+	h.header = h.header.Clone()
+	h.header.Set(idempotencyKeyHeader, key)
+	h.retryPost = true
+
+	return h
+}
+
+// do sends a request to the api path with the body as JSON, decoding the JSON response into res when not nil
+func (h HTTPClient) do(ctx context.Context, method, path string, query neturl.Values, body, res any) error {
+	_, b, err := h.send(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+
+	if res == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(b, res); err != nil {
+		return fmt.Errorf("could not decode response: %w", err)
+	}
+
+	return nil
+}
+
+// send sends a request to the api path with the body as JSON retrying idempotent requests, it returns the headers
+// and body of successful responses and an *Error for error responses
+func (h HTTPClient) send(ctx context.Context, method, path string, query neturl.Values, body any) (http.Header, []byte, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, nil, fmt.Errorf("could not encode request: %w", err)
+		}
+	}
+
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	retries := 0
+	if method != http.MethodPost || h.retryPost {
+		retries = h.retries
+	}
+
+	for attempt := 0; ; attempt++ {
+		header, b, err := h.attempt(ctx, method, path, query, payload)
+		if err == nil || attempt >= retries || !retryable(ctx, err) {
+			return header, b, err
+		}
+
+		wait := time.NewTimer(h.backoff << attempt)
+		select {
+		case <-wait.C:
+		case <-ctx.Done():
+			wait.Stop()
+			return nil, nil, err
+		}
+	}
+}
+
+// attempt sends a request once
+func (h HTTPClient) attempt(ctx context.Context, method, path string, query neturl.Values, payload []byte) (http.Header, []byte, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := h.newRequest(ctx, method, path, query, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", jsonContentType)
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read response: %w", err)
+	}
+
+	if res.StatusCode >= http.StatusBadRequest {
+		return nil, nil, decodeError(res.StatusCode, b)
+	}
+
+	return res.Header, b, nil
+}
+
+// stream starts a request to an event stream of the api returning its body
+func (h HTTPClient) stream(ctx context.Context, path string, query neturl.Values) (io.ReadCloser, error) {
+	req, err := h.newRequest(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= http.StatusBadRequest {
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return nil, decodeError(res.StatusCode, b)
+	}
+
+	return res.Body, nil
+}
+
+func (h HTTPClient) newRequest(ctx context.Context, method, path string, query neturl.Values, body io.Reader) (*http.Request, error) {
+	u := h.base.String() + "/api" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+	for key, values := range h.header {
+		req.Header[key] = values
+	}
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", jsonContentType)
+	}
+
+	return req, nil
+}
+
+// decodeError decodes the error rendered by the server, bodies of proxies that are not JSON are kept as message
+func decodeError(statusCode int, body []byte) *Error {
+	res := &Error{StatusCode: statusCode}
+	if err := json.Unmarshal(body, res); err != nil || res.Code == "" {
+		res.Code = http.StatusText(statusCode)
+		res.Message = strings.TrimSpace(string(body))
+	}
+	res.StatusCode = statusCode
+
+	return res
+}
+
+// retryable checks whether a failed attempt can be retried, server errors and requests without response can
+// unless the call is done
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= http.StatusInternalServerError && apiErr.StatusCode != http.StatusNotImplemented
+	}
+
+	return true
+}
+
+// urlPath returns the api path of a shortened url with the id escaped
+func urlPath(id, sub string) string {
+	return "/url/" + neturl.PathEscape(id) + sub
+}
+
+// domainQuery returns the query selecting the domain of the call options, it is empty for the default domain
+func domainQuery(opts []CallOption) neturl.Values {
+	query := make(neturl.Values)
+	if domain := newCallOptions(opts).domain; domain != "" {
+		query.Set("domain", domain)
+	}
+
+	return query
+}
+
+// rawOrNil returns nil for missing and null JSON values
+func rawOrNil(raw json.RawMessage) []byte {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+
+	return raw
+}
+
+func fromVariantResponses(variants []variantResponse) []Variant {
+	res := make([]Variant, 0, len(variants))
+	for _, variant := range variants {
+		res = append(res, Variant(variant))
+	}
+
+	return res
+}
+
+func fromRuleResponses(rules []ruleJSON) []Rule {
+	res := make([]Rule, 0, len(rules))
+	for _, rule := range rules {
+		res = append(res, Rule(rule))
+	}
+
+	return res
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The HTTP api bodies, they have no json tags since the api uses the field names as keys. The requests must not
+// have fields the api does not know since it rejects them
+
+type urlRequest struct {
+	URL          string
+	Warn         bool
+	RedirectType int
+	ForwardQuery string
+	ForwardPath  bool
+	Campaign     campaignRequest
+	Password     string
+	MaxClicks    int
+	NotBefore    time.Time
+	Domain       string
+}
+
+type campaignRequest struct {
+	Source   string
+	Medium   string
+	Campaign string
+	Term     string
+	Content  string
+}
+
+type unlockRequest struct {
+	Password string
+}
+
+type urlResponse struct {
+	URL      string
+	ShortURL string
+}
+
+type urlCountResponse struct {
+	ID    string
+	Count int
+}
+
+type ruleJSON struct {
+	Platform string
+	Language string
+	Country  string
+	URL      string
+}
+
+type rulesRequest struct {
+	Rules []ruleJSON
+}
+
+type rulesResponse struct {
+	ID    string
+	Rules []ruleJSON
+}
+
+type variantRequest struct {
+	Name   string
+	URL    string
+	Weight int
+}
+
+type variantsRequest struct {
+	Sticky   bool
+	Variants []variantRequest
+}
+
+type variantResponse struct {
+	Name   string
+	URL    string
+	Weight int
+	Count  int
+}
+
+type variantsResponse struct {
+	ID       string
+	Sticky   bool
+	Variants []variantResponse
+}
+
+type statsResponse struct {
+	ID              string
+	Count           int
+	RemainingClicks *int
+	Variants        []variantResponse
+	NotBefore       *time.Time
+	Scheduled       bool
+}
+
+type auditResponse struct {
+	Entries   []auditEntryResponse
+	NextAfter int64
+}
+
+type auditEntryResponse struct {
+	ID        int64
+	Time      time.Time
+	Action    string
+	Domain    string
+	URLID     string
+	Before    json.RawMessage
+	After     json.RawMessage
+	Actor     string
+	RequestID string
+	Protocol  string
+}
+
+type campaignResponse struct {
+	Campaign string
+	Count    int
+	URLs     []campaignURLResponse
+}
+
+type campaignURLResponse struct {
+	ID        string
+	URL       string
+	ShortURL  string
+	Count     int
+	Source    string
+	Medium    string
+	Term      string
+	Content   string
+	NotBefore *time.Time
+	Scheduled bool
+}
+
+type countEventResponse struct {
+	Domain string
+	ID     string
+	Count  int
+	Click  *clickResponse
+}
+
+type clickResponse struct {
+	Time     time.Time
+	URL      string
+	Variant  string
+	Platform string
+	Language string
+	Country  string
+}
@@ -0,0 +1,321 @@
+package client_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nerock/urlshort/client"
+	"github.com/nerock/urlshort/url"
+	"github.com/nerock/urlshort/url/feed"
+	"github.com/nerock/urlshort/url/router"
+	"github.com/nerock/urlshort/url/store"
+)
+
+func TestHTTPClient(t *testing.T) {
+	srv := startHTTPServer(t)
+	c, err := client.NewHTTPClient(srv.URL, client.WithHeader("X-Actor", "ci"))
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+
+	long, short, err := c.CreateURL(ctx, "https://www.example.com", client.WithMaxClicks(10),
+		client.WithCampaign(client.Campaign{Source: "newsletter", Name: "spring"}))
+	if err != nil {
+		t.Fatalf("could not create url: %s", err)
+	}
+	if long != "https://www.example.com" || short != "http://localhost:8080/ID1" {
+		t.Errorf("wrong url created, got %s %s", long, short)
+	}
+
+	if _, short, err := c.CreateURL(ctx, "https://www.example.org", client.WithIdempotencyKey("key")); err != nil ||
+		short != "http://localhost:8080/ID2" {
+		t.Errorf("wrong url created with idempotency key, got %s %v", short, err)
+	}
+	if _, short, err := c.CreateURL(ctx, "https://www.example.org", client.WithIdempotencyKey("key")); err != nil ||
+		short != "http://localhost:8080/ID2" {
+		t.Errorf("repeated creation not replayed, got %s %v", short, err)
+	}
+	if _, _, err := c.CreateURL(ctx, "https://www.example.net", client.WithIdempotencyKey("key")); !errors.Is(err, client.ErrConflict) {
+		t.Errorf("expected conflict error reusing the idempotency key, got %v", err)
+	}
+
+	if _, _, err := c.CreateURL(ctx, "not a url"); !errors.Is(err, client.ErrInvalidArgument) {
+		t.Errorf("expected invalid argument error creating an invalid url, got %v", err)
+	}
+
+	if long, _, err := c.GetURL(ctx, "ID1"); err != nil || long != "https://www.example.com?utm_campaign=spring&utm_source=newsletter" {
+		t.Errorf("wrong url returned, got %s %v", long, err)
+	}
+
+	stats, err := c.GetStats(ctx, "ID1")
+	if err != nil {
+		t.Fatalf("could not get stats: %s", err)
+	}
+	if stats.Count != 0 || stats.Remaining != 10 {
+		t.Errorf("wrong stats returned, got %+v", stats)
+	}
+
+	rules, err := c.SetRules(ctx, "ID1", []client.Rule{{Platform: "ios", URL: "https://apps.apple.com"}})
+	if err != nil || len(rules) != 1 || rules[0].URL != "https://apps.apple.com" {
+		t.Errorf("wrong rules returned, got %+v %v", rules, err)
+	}
+
+	links, err := c.ListCampaignURLs(ctx, "spring")
+	if err != nil || len(links) != 1 || links[0].ID != "ID1" || links[0].Campaign.Source != "newsletter" {
+		t.Errorf("wrong campaign urls returned, got %+v %v", links, err)
+	}
+
+	entries, err := c.ListAuditEntries(ctx, client.AuditFilter{URLID: "ID1"})
+	if err != nil || len(entries) != 2 || entries[0].Action != url.ActionCreate || entries[0].Actor != "ci" {
+		t.Errorf("wrong audit entries returned, got %+v %v", entries, err)
+	}
+
+	if err := c.DeleteURL(ctx, "ID1"); err != nil {
+		t.Fatalf("could not delete url: %s", err)
+	}
+
+	_, _, err = c.GetRedirectionCount(ctx, "ID1")
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.Code != "Not Found" {
+		t.Errorf("expected not found error, got %v", err)
+	}
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected error to match ErrNotFound, got %v", err)
+	}
+
+	if err := c.RestoreURL(ctx, "ID1"); err != nil {
+		t.Errorf("could not restore url: %s", err)
+	}
+
+	if _, short, err := c.CreateURL(ctx, "https://www.example.edu", client.WithDomain("sho.rt")); err != nil ||
+		short != "http://sho.rt/ID3" {
+		t.Fatalf("wrong url created on the other domain, got %s %v", short, err)
+	}
+	if _, _, err := c.GetURL(ctx, "ID3"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected not found error on the default domain, got %v", err)
+	}
+	if long, _, err := c.GetURL(ctx, "ID3", client.OnDomain("sho.rt")); err != nil || long != "https://www.example.edu" {
+		t.Errorf("wrong url returned on the other domain, got %s %v", long, err)
+	}
+	if stats, err := c.GetStats(ctx, "ID3", client.OnDomain("sho.rt")); err != nil || stats.Count != 0 {
+		t.Errorf("wrong stats returned on the other domain, got %+v %v", stats, err)
+	}
+	if err := c.DeleteURL(ctx, "ID3", client.OnDomain("sho.rt")); err != nil {
+		t.Errorf("could not delete url on the other domain: %s", err)
+	}
+	entries, err = c.ListAuditEntries(ctx, client.AuditFilter{Domain: "sho.rt"})
+	if err != nil || len(entries) != 2 || entries[0].URLID != "ID3" || entries[1].Action != url.ActionDelete {
+		t.Errorf("wrong audit entries returned on the other domain, got %+v %v", entries, err)
+	}
+}
+
+func TestHTTPClientWatchRedirects(t *testing.T) {
+	srv := startHTTPServer(t)
+	c, err := client.NewHTTPClient(srv.URL)
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := c.WatchRedirects(ctx, nil); !errors.Is(err, client.ErrUnimplemented) {
+		t.Errorf("expected unimplemented error watching every url, got %v", err)
+	}
+	if _, err := c.WatchRedirects(ctx, []string{"missing"}); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("expected not found error watching a missing url, got %v", err)
+	}
+
+	if _, _, err := c.CreateURL(ctx, "https://www.example.com"); err != nil {
+		t.Fatalf("could not create url: %s", err)
+	}
+
+	redirects, err := c.WatchRedirects(ctx, []string{"ID1"})
+	if err != nil {
+		t.Fatalf("could not watch redirects: %s", err)
+	}
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := noRedirect.Get(srv.URL + "/ID1")
+	if err != nil {
+		t.Fatalf("could not visit url: %s", err)
+	}
+	res.Body.Close()
+
+	select {
+	case redirect := <-redirects:
+		if redirect.ID != "ID1" || redirect.Count != 1 || redirect.URL != "https://www.example.com" {
+			t.Errorf("wrong redirect received, got %+v", redirect)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("redirect not received")
+	}
+
+	cancel()
+	for range redirects {
+	}
+}
+
+func TestHTTPClientRetries(t *testing.T) {
+	tests := map[string]struct {
+		statuses []int
+		create   bool
+		key      string
+		attempts int32
+		err      error
+	}{
+		"retried until success": {
+			statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK},
+			attempts: 3,
+		},
+		"retries exhausted": {
+			statuses: []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError},
+			attempts: 3,
+			err:      &client.Error{StatusCode: http.StatusInternalServerError, Code: "Internal Server Error", Message: "fail"},
+		},
+		"client error not retried": {
+			statuses: []int{http.StatusNotFound},
+			attempts: 1,
+			err:      client.ErrNotFound,
+		},
+		"not implemented not retried": {
+			statuses: []int{http.StatusNotImplemented},
+			attempts: 1,
+			err:      client.ErrUnimplemented,
+		},
+		"create not retried": {
+			statuses: []int{http.StatusServiceUnavailable},
+			create:   true,
+			attempts: 1,
+			err:      client.ErrUnavailable,
+		},
+		"create with idempotency key retried": {
+			statuses: []int{http.StatusServiceUnavailable, http.StatusCreated},
+			create:   true,
+			key:      "key",
+			attempts: 2,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var attempts int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tc.statuses[atomic.AddInt32(&attempts, 1)-1]
+				if key := r.Header.Get("Idempotency-Key"); key != tc.key {
+					status = http.StatusBadRequest
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				if status >= http.StatusBadRequest {
+					fmt.Fprintf(w, `{"Code":%q,"Message":"fail"}`, http.StatusText(status))
+					return
+				}
+				fmt.Fprint(w, `{"ID":"abc","Count":3,"URL":"https://www.example.com","ShortURL":"http://localhost/abc"}`)
+			}))
+			defer srv.Close()
+
+			c, err := client.NewHTTPClient(srv.URL, client.WithRetries(2, time.Millisecond))
+			if err != nil {
+				t.Fatalf("could not create client: %s", err)
+			}
+
+			switch {
+			case tc.key != "":
+				_, _, err = c.CreateURL(context.Background(), "https://www.example.com", client.WithIdempotencyKey(tc.key))
+			case tc.create:
+				_, _, err = c.CreateURL(context.Background(), "https://www.example.com")
+			default:
+				_, _, err = c.GetRedirectionCount(context.Background(), "abc")
+			}
+
+			var apiErr *client.Error
+			switch expected := tc.err.(type) {
+			case nil:
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+			case *client.Error:
+				if !errors.As(err, &apiErr) || *apiErr != *expected {
+					t.Errorf("expected error %v, got %v", expected, err)
+				}
+			default:
+				if !errors.Is(err, expected) {
+					t.Errorf("expected error %v, got %v", expected, err)
+				}
+			}
+			if got := atomic.LoadInt32(&attempts); got != tc.attempts {
+				t.Errorf("expected %d attempts, got %d", tc.attempts, got)
+			}
+		})
+	}
+}
+
+func TestHTTPClientTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	c, err := client.NewHTTPClient(srv.URL, client.WithTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+
+	if _, _, err := c.GetURL(context.Background(), "abc"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+	}
+}
+
+// startHTTPServer starts the HTTP api with a service on a new database
+func startHTTPServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "urlshort.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("could not open db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	urlStore, err := store.NewURLStore(db)
+	if err != nil {
+		t.Fatalf("could not create store: %s", err)
+	}
+	svc := url.NewService(url.MustParseBaseURL("localhost:8080"), &testGenerator{}, urlStore,
+		url.WithAuditLog(urlStore), url.WithIdempotency(urlStore, time.Hour),
+		url.WithDomains(url.MustParseBaseURL("sho.rt")))
+
+	r := chi.NewRouter()
+	router.NewURLRouter(svc, router.WithCountBots(true), router.WithRedirectFeed(feed.New(feed.DefaultBufferSize))).
+		Routes(r)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// testGenerator generates sequential ids
+type testGenerator struct {
+	n int32
+}
+
+func (g *testGenerator) Generate() (string, error) {
+	return fmt.Sprintf("ID%d", atomic.AddInt32(&g.n, 1)), nil
+}
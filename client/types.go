@@ -0,0 +1,128 @@
+package client
+
+import "time"
+
+// UnlimitedClicks is the Remaining clicks of the shortened urls without a maximum number of clicks
+const UnlimitedClicks = -1
+
+// Campaign are the UTM parameters merged into the long url of a shortened url
+type Campaign struct {
+	Source  string
+	Medium  string
+	Name    string
+	Term    string
+	Content string
+}
+
+// Rule is a routing rule sending the visits matching all its conditions to its URL,
+// empty conditions match every visit
+type Rule struct {
+	// Platform is ios, android, windows, macos or linux
+	Platform string
+	Language string
+	Country  string
+	URL      string
+}
+
+// Variant is a destination receiving a share of the visits relative to its weight,
+// Count is the number of redirections to it and is ignored when setting variants
+type Variant struct {
+	Name   string
+	URL    string
+	Weight int
+	Count  int
+}
+
+// Split are the weighted variants a shortened url splits its visits across, sticky splits keep sending
+// each visitor to the same variant
+type Split struct {
+	Sticky   bool
+	Variants []Variant
+}
+
+// Stats are the count of redirections of a shortened url and each of its variants
+type Stats struct {
+	Count int
+	// Remaining is the number of clicks left before the url stops working or UnlimitedClicks
+	Remaining int
+	Variants  []Variant
+	// NotBefore is the time the url starts working and Scheduled whether it is still in the future
+	NotBefore time.Time
+	Scheduled bool
+}
+
+// Link is a shortened url of a campaign
+type Link struct {
+	// Domain is the host of the short domain of the url, empty for the default domain
+	Domain string
+	ID     string
+	// URL is the long url, empty for password protected urls
+	URL       string
+	ShortURL  string
+	Count     int
+	Campaign  Campaign
+	NotBefore time.Time
+	Scheduled bool
+}
+
+// AuditFilter selects audit entries, empty fields match every entry
+type AuditFilter struct {
+	// Domain is the host of the short domain of the entries
+	Domain string
+	URLID  string
+	Actor  string
+	// From is inclusive and To exclusive
+	From time.Time
+	To   time.Time
+	// AfterID skips the entries up to this id to page through them
+	AfterID int64
+	Limit   int
+}
+
+// AuditEntry is a change made to a shortened url
+type AuditEntry struct {
+	ID     int64
+	Time   time.Time
+	Action string
+	// Domain is the host of the short domain of the url, empty for the default domain
+	Domain string
+	URLID  string
+	// Before and After are the JSON values changed by the action, nil when there is none
+	Before []byte
+	After  []byte
+	// Actor, RequestID and Protocol are the origin of the change
+	Actor     string
+	RequestID string
+	Protocol  string
+}
+
+// QROptions are the options of QR code images, zero values use the defaults of the server
+type QROptions struct {
+	// Format is png or svg
+	Format string
+	// Size is the width and height of the image in pixels
+	Size int
+	// Level is the error correction level: L, M, Q or H
+	Level string
+	// Margin is the width of the quiet zone around the code in modules, a negative margin disables it
+	Margin int
+}
+
+// Redirect is a redirection received from WatchRedirects
+type Redirect struct {
+	// Domain is the host of the short domain of the url, empty for the default domain
+	Domain string
+	ID     string
+	Time   time.Time
+	// Count is the number of redirections of the url including this one
+	Count int
+	// URL is the destination of the redirection, it is empty for password protected urls
+	URL string
+	// Variant is the name of the variant the visit was split to, if any
+	Variant  string
+	Platform string
+	Language string
+	Country  string
+	// Dropped is the number of redirections lost so far because they were not read fast enough
+	Dropped uint64
+}
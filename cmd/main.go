@@ -2,42 +2,63 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"errors"
+	"flag"
 	"fmt"
+	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/nerock/urlshort/grpc"
 
+	"github.com/nerock/urlshort/config"
 	"github.com/nerock/urlshort/docs"
 	"github.com/nerock/urlshort/server"
 	"github.com/nerock/urlshort/url"
+	"github.com/nerock/urlshort/url/feed"
 	urlgenerator "github.com/nerock/urlshort/url/generator"
+	"github.com/nerock/urlshort/url/geoip"
 	urlrouter "github.com/nerock/urlshort/url/router"
 	urlstore "github.com/nerock/urlshort/url/store"
+	"github.com/nerock/urlshort/url/webhook"
 )
 
 const (
-	defaultPort     = 8080
-	defaultGRPCPort = 50051
-	defaultDomain   = "localhost"
-	defaultDBConn   = "urlshort.db"
+	// purgeInterval is how often deleted urls past their retention and expired idempotency keys are purged
+	purgeInterval = time.Hour
+	// webhookInterval is how often the pending webhook deliveries are sent
+	webhookInterval = 5 * time.Second
 )
 
 func main() {
+	args := os.Args[1:]
+	if len(args) >= 2 && args[0] == "config" && args[1] == "print" {
+		printConfig(args[2:])
+		return
+	}
+
+	cfg, err := config.Load(args, os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Quit app signal notifier
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
 	// DB Connection
-	db, err := sql.Open("sqlite3", getDBConnection())
+	db, err := sql.Open("sqlite3", cfg.DBConn)
 	if err != nil {
 		log.Fatal("could not establish connection with sqlite db:", err)
 	}
@@ -52,15 +73,60 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	urlService := url.NewService(getDomain(), urlgenerator.URLGenerator{}, urlStore)
-	urlGrpc := urlrouter.NewURLgRPC(urlService)
-	urlRouter := urlrouter.NewURLRouter(urlService)
+	baseURL := cfg.BaseURL()
+	webhookNetworks := url.NewWebhookNetworks(net.DefaultResolver, cfg.WebhookNetworks()...)
+	urlService := url.NewService(baseURL, urlgenerator.URLGenerator{}, urlStore,
+		url.WithBlockedHosts(cfg.BlockedHosts...), url.WithRetention(cfg.TrashRetention), url.WithAuditLog(urlStore),
+		url.WithWebhooks(urlStore), url.WithWebhookNetworks(webhookNetworks), url.WithClickThresholds(cfg.ClickThresholds...),
+		url.WithDomains(cfg.ShortDomainURLs()...), url.WithIdempotency(urlStore, cfg.IdempotencyWindow))
+	redirects := feed.New(feed.DefaultBufferSize, feed.WithReplay(feed.DefaultReplaySize))
+	urlGrpc := urlrouter.NewURLgRPC(urlService, urlrouter.WithGRPCRedirectFeed(redirects))
+	routerOpts := []urlrouter.Option{
+		urlrouter.WithBasePath(baseURL.Path()),
+		urlrouter.WithCountBots(cfg.CountBots),
+		urlrouter.WithCountPrefetch(cfg.CountPrefetch),
+		urlrouter.WithRedirectFeed(redirects),
+		urlrouter.WithAdminToken(cfg.GRPCToken),
+	}
+	if cfg.GeoIPDB != "" {
+		countries, err := geoip.NewCountryResolver(cfg.GeoIPDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer countries.Close()
+
+		routerOpts = append(routerOpts, urlrouter.WithCountryResolver(countries))
+	}
+	if cfg.ComingSoonPage != "" {
+		tmpl, err := getComingSoonTemplate(cfg.ComingSoonPage)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		routerOpts = append(routerOpts, urlrouter.WithComingSoonPage(tmpl))
+	}
+	urlRouter := urlrouter.NewURLRouter(urlService, routerOpts...)
 
 	docsRouter := docs.Router{}
 
 	// Servers startup
-	httpSrv := server.NewHTTPServer(getHttpPort())
-	grpcSrv := grpc.NewGRPCServer(urlGrpc)
+	httpSrv := server.NewHTTPServer(cfg.HTTPPort)
+	var grpcOpts []grpc.Option
+	if cfg.GRPCTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.GRPCTLSCert, cfg.GRPCTLSKey)
+		if err != nil {
+			log.Fatal("could not load gRPC certificate:", err)
+		}
+
+		grpcOpts = append(grpcOpts, grpc.WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}))
+	}
+	if cfg.GRPCToken != "" {
+		if cfg.GRPCTLSCert == "" {
+			log.Println("gRPC is served without TLS, the grpc_token requires a TLS terminating proxy in front")
+		}
+		grpcOpts = append(grpcOpts, grpc.WithToken(cfg.GRPCToken))
+	}
+	grpcSrv := grpc.NewGRPCServer([]grpc.Service{urlGrpc}, grpcOpts...)
 	go func() {
 		if err := httpSrv.Run(urlRouter, docsRouter); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal("error running HTTP server:", err)
@@ -68,13 +134,20 @@ func main() {
 	}()
 
 	go func() {
-		if err := grpcSrv.RunServer(getGRPCPort()); err != nil {
+		if err := grpcSrv.RunServer(cfg.GRPCPort); err != nil {
 			log.Fatal("error running gRPC server:", err)
 		}
 	}()
 
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	go purge(jobsCtx, urlService)
+	go deliverWebhooks(jobsCtx, webhook.NewDispatcher(urlStore, webhook.WithNetworks(webhookNetworks)))
+
 	// Wait for quit signal
 	<-sig
+	stopJobs()
+	// Watch streams never end by themselves, so they are closed before the servers wait for them
+	redirects.Close()
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	go func() {
 		if err := httpSrv.Shutdown(ctx); err != nil {
@@ -93,38 +166,76 @@ func main() {
 	}
 }
 
-func getHttpPort() int {
-	if portStr := os.Getenv("PORT"); portStr != "" {
-		if port, err := strconv.Atoi(portStr); err == nil {
-			return port
-		}
+// printConfig prints the effective configuration for the flags with its secrets redacted
+func printConfig(args []string) {
+	cfg, err := config.Load(args, os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	return defaultPort
+	if err := cfg.Redacted().Print(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func getGRPCPort() int {
-	if portStr := os.Getenv("GRPC_PORT"); portStr != "" {
-		if port, err := strconv.Atoi(portStr); err == nil {
-			return port
-		}
+// getComingSoonTemplate parses the coming soon page template file, default uses the built-in page
+func getComingSoonTemplate(page string) (*template.Template, error) {
+	if page == "default" {
+		return urlrouter.ComingSoonTemplate, nil
 	}
 
-	return defaultGRPCPort
-}
-
-func getDomain() string {
-	if domain := os.Getenv("DOMAIN"); domain != "" {
-		return domain
+	tmpl, err := template.ParseFiles(page)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse coming soon page: %w", err)
 	}
 
-	return fmt.Sprintf("%s:%d/", defaultDomain, getHttpPort())
+	return tmpl, nil
 }
 
-func getDBConnection() string {
-	if dbConn := os.Getenv("DB_CONN"); dbConn != "" {
-		return dbConn
+// purge removes the deleted urls past their retention and the expired idempotency keys every purgeInterval until
+// the context is done
+func purge(ctx context.Context, svc url.Service) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := svc.PurgeDeletedURLs(ctx); err != nil {
+			log.Println(err)
+		} else if n > 0 {
+			log.Printf("purged %d deleted urls", n)
+		}
+
+		if n, err := svc.PurgeIdempotencyKeys(ctx); err != nil {
+			log.Println(err)
+		} else if n > 0 {
+			log.Printf("purged %d idempotency keys", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
+}
 
-	return defaultDBConn
+// deliverWebhooks sends the pending webhook deliveries every webhookInterval until the context is done
+func deliverWebhooks(ctx context.Context, dispatcher webhook.Dispatcher) {
+	ticker := time.NewTicker(webhookInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := dispatcher.DeliverPending(ctx); err != nil {
+			log.Println(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
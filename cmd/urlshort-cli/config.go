@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nerock/urlshort/client"
+	"github.com/nerock/urlshort/config"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// configEnv sets the path of the config file when it is not set with -config
+	configEnv = "URLSHORT_CLI_CONFIG"
+
+	defaultTimeout = 10 * time.Second
+)
+
+// Config is the configuration of the cli, read from a YAML file and overridden by the flags
+type Config struct {
+	// Address is the host and port of the gRPC server
+	Address string `yaml:"address"`
+	// TLS connects to the server over TLS, verifying it with the CA file when set or the system roots otherwise
+	TLS    bool   `yaml:"tls"`
+	CAFile string `yaml:"ca_file"`
+	// Token is sent as a bearer token on every call and must be the grpc_token of the server, it requires TLS
+	Token string `yaml:"token"`
+	// Actor is the name the changes made by the cli are audited with
+	Actor string `yaml:"actor"`
+	// Timeout is how long connecting and each call can take
+	Timeout time.Duration `yaml:"timeout"`
+	// Output is the default output format: table, json or short
+	Output string `yaml:"output"`
+}
+
+// defaultConfig returns the configuration used for the keys missing in the file
+func defaultConfig() Config {
+	return Config{
+		Address: fmt.Sprintf("localhost:%d", config.DefaultGRPCPort),
+		Timeout: defaultTimeout,
+		Output:  outputTable,
+	}
+}
+
+// defaultConfigPath returns the path of the config file read when none is set, it may not exist
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "urlshort", "cli.yaml")
+}
+
+// loadConfig reads the config file over the defaults, a missing file is only an error when it was set explicitly
+func loadConfig(path string, explicit bool) (Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return Config{}, fmt.Errorf("could not read config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return Config{}, fmt.Errorf("%w: %s: %s", errUsage, path, err)
+	}
+
+	return cfg, nil
+}
+
+// validate checks that the configuration values can be used
+func (c Config) validate() error {
+	if c.Address == "" {
+		return fmt.Errorf("%w: address is required", errUsage)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("%w: timeout must be positive", errUsage)
+	}
+	if c.Token != "" && !c.TLS {
+		return fmt.Errorf("%w: token requires tls", errUsage)
+	}
+
+	switch c.Output {
+	case outputTable, outputJSON, outputShort:
+	default:
+		return fmt.Errorf("%w: unknown output %q, it must be table, json or short", errUsage, c.Output)
+	}
+
+	return nil
+}
+
+// dialOptions returns the client options connecting with the configured transport and credentials
+func (c Config) dialOptions() ([]client.DialOption, error) {
+	var opts []client.DialOption
+	if c.TLS {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if c.CAFile != "" {
+			pem, err := os.ReadFile(c.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read CA file: %w", err)
+			}
+
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%w: no certificates in CA file %s", errUsage, c.CAFile)
+			}
+		}
+		opts = append(opts, client.WithTLS(tlsConfig))
+	}
+	if c.Token != "" {
+		opts = append(opts, client.WithToken(c.Token))
+	}
+	if c.Actor != "" {
+		opts = append(opts, client.WithActor(c.Actor))
+	}
+
+	return opts, nil
+}
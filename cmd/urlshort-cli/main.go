@@ -0,0 +1,487 @@
+// Command urlshort-cli manages shortened urls through the gRPC api of the url shortener
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nerock/urlshort/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Exit codes, failures of several urls exit with the code they share or exitError when they differ
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitInvalid  = 2
+	exitNotFound = 3
+)
+
+const usage = `Usage: urlshort-cli [flags] <command> [command flags] [args]
+
+Commands:
+  create [url...]     shorten the urls, or the urls read from stdin one per line without args or with -
+  get <id...>         get the long url of shortened urls
+  delete <id...>      delete shortened urls
+  count <id...>       get the redirection count of shortened urls
+  stats <id...>       get the redirection stats of shortened urls and their variants
+  list <campaign>     list the shortened urls of a campaign
+
+Flags:
+`
+
+// errUsage is returned for invalid flags, arguments and configuration
+var errUsage = errors.New("invalid input")
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// cli runs the commands with a connection to the server opened on first use
+type cli struct {
+	cfg    Config
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	client *client.URLClient
+}
+
+// command runs with its args and returns the exit code
+type command func(ctx context.Context, c *cli, args []string) int
+
+var commands = map[string]command{
+	"create": create,
+	"get":    get,
+	"delete": deleteURLs,
+	"count":  count,
+	"stats":  stats,
+	"list":   list,
+}
+
+// run executes the cli with the args and returns its exit code
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("urlshort-cli", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", "", "path of the YAML config file, defaults to $"+configEnv+" or "+
+		defaultConfigPath())
+	addr := fs.String("addr", "", "host and port of the gRPC server")
+	output := fs.String("output", "", "output format: table, json or short")
+	fs.StringVar(output, "o", "", "shorthand for -output")
+	useTLS := fs.Bool("tls", false, "connect over TLS")
+	timeout := fs.Duration("timeout", 0, "how long connecting and each call can take")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitInvalid
+	}
+
+	explicit := true
+	if *configPath == "" {
+		*configPath, explicit = os.Getenv(configEnv), os.Getenv(configEnv) != ""
+	}
+	if *configPath == "" {
+		*configPath = defaultConfigPath()
+	}
+	cfg, err := loadConfig(*configPath, explicit)
+	if err != nil {
+		return fail(stderr, err)
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Address = *addr
+		case "output", "o":
+			cfg.Output = *output
+		case "tls":
+			cfg.TLS = *useTLS
+		case "timeout":
+			cfg.Timeout = *timeout
+		}
+	})
+	if err := cfg.validate(); err != nil {
+		return fail(stderr, err)
+	}
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitInvalid
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "urlshort-cli: unknown command %q\n", fs.Arg(0))
+		fs.Usage()
+		return exitInvalid
+	}
+
+	c := &cli{cfg: cfg, stdin: stdin, stdout: stdout, stderr: stderr}
+	defer c.close()
+
+	return cmd(ctx, c, fs.Args()[1:])
+}
+
+// connect returns the client connected to the server, connecting on the first call
+func (c *cli) connect(ctx context.Context) (*client.URLClient, error) {
+	if c.client != nil {
+		return c.client, nil
+	}
+
+	opts, err := c.cfg.dialOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+
+	conn, err := client.NewURLClient(ctx, c.cfg.Address, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %w", c.cfg.Address, err)
+	}
+	c.client = &conn
+
+	return c.client, nil
+}
+
+func (c *cli) close() {
+	if c.client != nil {
+		c.client.Close()
+	}
+}
+
+// each connects and calls fn for every item with its own timeout, printing the results of the items that
+// succeed and the errors of those that fail
+func (c *cli) each(ctx context.Context, items []string, fn func(context.Context, *client.URLClient, string) (result, error)) int {
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return fail(c.stderr, err)
+	}
+
+	var (
+		results []result
+		code    exitStatus
+	)
+	for _, item := range items {
+		callCtx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+		res, err := fn(callCtx, conn, item)
+		cancel()
+		if err != nil {
+			code.add(fail(c.stderr, fmt.Errorf("%s: %w", item, err)))
+			continue
+		}
+		results = append(results, res)
+	}
+
+	if err := printResults(c.stdout, c.cfg.Output, results); err != nil {
+		code.add(fail(c.stderr, err))
+	}
+
+	return code.code
+}
+
+// exitStatus keeps the exit code of the failures of several items
+type exitStatus struct {
+	code int
+}
+
+func (s *exitStatus) add(code int) {
+	switch {
+	case code == exitOK:
+	case s.code == exitOK:
+		s.code = code
+	case s.code != code:
+		s.code = exitError
+	}
+}
+
+// fail prints the error and returns its exit code
+func fail(stderr io.Writer, err error) int {
+	fmt.Fprintf(stderr, "urlshort-cli: %s\n", err)
+	return exitCode(err)
+}
+
+// exitCode returns the exit code of an error of the cli or the server
+func exitCode(err error) int {
+	if errors.Is(err, errUsage) {
+		return exitInvalid
+	}
+
+	// Client errors wrap the status of the server
+	var statusErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &statusErr) {
+		switch statusErr.GRPCStatus().Code() {
+		case codes.NotFound:
+			return exitNotFound
+		case codes.InvalidArgument:
+			return exitInvalid
+		}
+	}
+
+	return exitError
+}
+
+// commandFlags returns the flag set of a command printing its usage
+func commandFlags(c *cli, name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(c.stderr, "Usage: urlshort-cli %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+// domainFlag adds the flag selecting the short domain of the urls of a command
+func domainFlag(fs *flag.FlagSet) *string {
+	return fs.String("domain", "", "host of the short domain of the urls, the default domain when empty")
+}
+
+// parseFlags parses the command flags returning its args and whether to exit with the code
+func parseFlags(fs *flag.FlagSet, args []string, minArgs int) ([]string, int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, exitOK, true
+		}
+		return nil, exitInvalid, true
+	}
+
+	if fs.NArg() < minArgs {
+		fs.Usage()
+		return nil, exitInvalid, true
+	}
+
+	return fs.Args(), exitOK, false
+}
+
+func create(ctx context.Context, c *cli, args []string) int {
+	fs := commandFlags(c, "create", "[url...]")
+	warn := fs.Bool("warn", false, "show an interstitial page before redirecting")
+	redirectType := fs.Int("redirect-type", 0, "HTTP status code used to redirect: 301, 302, 307 or 308")
+	forwardQuery := fs.String("forward-query", "", "forward the visit query string: merge or override")
+	forwardPath := fs.Bool("forward-path", false, "append the visit path after the id to the long url")
+	password := fs.String("password", "", "password visitors must enter before being redirected")
+	maxClicks := fs.Int("max-clicks", 0, "number of redirections before the url stops working")
+	notBefore := fs.String("not-before", "", "RFC 3339 time the url starts working")
+	domain := fs.String("domain", "", "host of the short domain to create the url on")
+	var campaign client.Campaign
+	fs.StringVar(&campaign.Source, "utm-source", "", "campaign source")
+	fs.StringVar(&campaign.Medium, "utm-medium", "", "campaign medium")
+	fs.StringVar(&campaign.Name, "utm-campaign", "", "campaign name")
+	fs.StringVar(&campaign.Term, "utm-term", "", "campaign term")
+	fs.StringVar(&campaign.Content, "utm-content", "", "campaign content")
+	urls, code, exit := parseFlags(fs, args, 0)
+	if exit {
+		return code
+	}
+
+	opts := []client.CreateOption{
+		client.WithRedirectType(*redirectType),
+		client.WithForwardQuery(*forwardQuery),
+		client.WithPassword(*password),
+		client.WithMaxClicks(*maxClicks),
+		client.WithDomain(*domain),
+		client.WithCampaign(campaign),
+	}
+	if *warn {
+		opts = append(opts, client.WithWarn())
+	}
+	if *forwardPath {
+		opts = append(opts, client.WithForwardPath())
+	}
+	if *notBefore != "" {
+		t, err := time.Parse(time.RFC3339, *notBefore)
+		if err != nil {
+			return fail(c.stderr, fmt.Errorf("%w: not-before must be an RFC 3339 time: %s", errUsage, err))
+		}
+		opts = append(opts, client.WithNotBefore(t))
+	}
+
+	if len(urls) == 0 || len(urls) == 1 && urls[0] == "-" {
+		var err error
+		if urls, err = readLines(c.stdin); err != nil {
+			return fail(c.stderr, err)
+		}
+		if len(urls) == 0 {
+			return fail(c.stderr, fmt.Errorf("%w: no urls to create", errUsage))
+		}
+	}
+
+	return c.each(ctx, urls, func(ctx context.Context, conn *client.URLClient, long string) (result, error) {
+		long, short, err := conn.CreateURL(ctx, long, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		return urlResult{ID: shortID(short), URL: long, ShortURL: short}, nil
+	})
+}
+
+func get(ctx context.Context, c *cli, args []string) int {
+	fs := commandFlags(c, "get", "<id...>")
+	password := fs.String("password", "", "password of protected urls")
+	domain := domainFlag(fs)
+	ids, code, exit := parseFlags(fs, args, 1)
+	if exit {
+		return code
+	}
+
+	return c.each(ctx, ids, func(ctx context.Context, conn *client.URLClient, id string) (result, error) {
+		var (
+			long, short string
+			err         error
+		)
+		if *password != "" {
+			long, short, err = conn.UnlockURL(ctx, id, *password, client.OnDomain(*domain))
+		} else {
+			long, short, err = conn.GetURL(ctx, id, client.OnDomain(*domain))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return urlResult{ID: id, URL: long, ShortURL: short}, nil
+	})
+}
+
+func deleteURLs(ctx context.Context, c *cli, args []string) int {
+	fs := commandFlags(c, "delete", "<id...>")
+	domain := domainFlag(fs)
+	ids, code, exit := parseFlags(fs, args, 1)
+	if exit {
+		return code
+	}
+
+	return c.each(ctx, ids, func(ctx context.Context, conn *client.URLClient, id string) (result, error) {
+		if err := conn.DeleteURL(ctx, id, client.OnDomain(*domain)); err != nil {
+			return nil, err
+		}
+
+		return deleteResult{ID: id, Deleted: true}, nil
+	})
+}
+
+func count(ctx context.Context, c *cli, args []string) int {
+	fs := commandFlags(c, "count", "<id...>")
+	domain := domainFlag(fs)
+	ids, code, exit := parseFlags(fs, args, 1)
+	if exit {
+		return code
+	}
+
+	return c.each(ctx, ids, func(ctx context.Context, conn *client.URLClient, id string) (result, error) {
+		_, count, err := conn.GetRedirectionCount(ctx, id, client.OnDomain(*domain))
+		if err != nil {
+			return nil, err
+		}
+
+		return countResult{ID: id, Count: count}, nil
+	})
+}
+
+func stats(ctx context.Context, c *cli, args []string) int {
+	fs := commandFlags(c, "stats", "<id...>")
+	domain := domainFlag(fs)
+	ids, code, exit := parseFlags(fs, args, 1)
+	if exit {
+		return code
+	}
+
+	return c.each(ctx, ids, func(ctx context.Context, conn *client.URLClient, id string) (result, error) {
+		stats, err := conn.GetStats(ctx, id, client.OnDomain(*domain))
+		if err != nil {
+			return nil, err
+		}
+
+		return statsResult{ID: id, Stats: stats}, nil
+	})
+}
+
+func list(ctx context.Context, c *cli, args []string) int {
+	fs := commandFlags(c, "list", "<campaign>")
+	campaigns, code, exit := parseFlags(fs, args, 1)
+	if exit {
+		return code
+	}
+	if len(campaigns) > 1 {
+		fs.Usage()
+		return exitInvalid
+	}
+
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return fail(c.stderr, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+
+	links, err := conn.ListCampaignURLs(ctx, campaigns[0])
+	if err != nil {
+		return fail(c.stderr, err)
+	}
+
+	results := make([]result, 0, len(links))
+	for _, link := range links {
+		results = append(results, linkResult{
+			ID:        link.ID,
+			Domain:    link.Domain,
+			URL:       link.URL,
+			ShortURL:  link.ShortURL,
+			Count:     link.Count,
+			NotBefore: link.NotBefore,
+			Scheduled: link.Scheduled,
+		})
+	}
+	if err := printResults(c.stdout, c.cfg.Output, results); err != nil {
+		return fail(c.stderr, err)
+	}
+
+	return exitOK
+}
+
+// readLines returns the non-empty lines of the reader without surrounding spaces
+func readLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read urls: %w", err)
+	}
+
+	return lines, nil
+}
+
+// shortID returns the id of a short url, the last segment of its path
+func shortID(short string) string {
+	u, err := neturl.Parse(short)
+	if err != nil {
+		return ""
+	}
+
+	return path.Base(u.Path)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nerock/urlshort/url"
+	"github.com/nerock/urlshort/url/router"
+	"github.com/nerock/urlshort/url/store"
+	"google.golang.org/grpc"
+)
+
+func TestRun(t *testing.T) {
+	addr := startServer(t, func(svc url.Service) {
+		ctx := context.Background()
+		if _, err := svc.CreateURL(ctx, "https://www.example.com", url.LinkOptions{
+			Campaign: url.Campaign{Source: "newsletter", Name: "spring"},
+		}); err != nil {
+			t.Fatalf("could not create url: %s", err)
+		}
+		if _, err := svc.CreateURL(url.WithDomain(ctx, "sho.rt"), "https://www.example.org", url.LinkOptions{}); err != nil {
+			t.Fatalf("could not create url on the other domain: %s", err)
+		}
+	})
+
+	tests := map[string]struct {
+		args   []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		"get": {
+			args:   []string{"get", "ID1"},
+			stdout: "ID   URL                                                                SHORT URL\nID1  https://www.example.com?utm_campaign=spring&utm_source=newsletter  http://localhost:8080/ID1\n",
+		},
+		"get short": {
+			args:   []string{"-o", "short", "get", "ID1"},
+			stdout: "http://localhost:8080/ID1\n",
+		},
+		"get not found": {
+			args:   []string{"get", "missing"},
+			code:   exitNotFound,
+			stderr: "urlshort-cli: missing: could not get url: rpc error: code = NotFound desc = URL not found\n",
+		},
+		"get some not found": {
+			args:   []string{"-o", "short", "get", "missing", "ID1"},
+			code:   exitNotFound,
+			stdout: "http://localhost:8080/ID1\n",
+			stderr: "urlshort-cli: missing: could not get url: rpc error: code = NotFound desc = URL not found\n",
+		},
+		"get on domain": {
+			args:   []string{"-o", "short", "get", "-domain", "sho.rt", "ID2"},
+			stdout: "http://sho.rt/ID2\n",
+		},
+		"get not on default domain": {
+			args:   []string{"-o", "short", "get", "ID2"},
+			code:   exitNotFound,
+			stderr: "urlshort-cli: ID2: could not get url: rpc error: code = NotFound desc = URL not found\n",
+		},
+		"count on domain": {
+			args:   []string{"-o", "json", "count", "-domain", "sho.rt", "ID2"},
+			stdout: "[\n  {\n    \"ID\": \"ID2\",\n    \"Count\": 0\n  }\n]\n",
+		},
+		"count json": {
+			args:   []string{"-output", "json", "count", "ID1"},
+			stdout: "[\n  {\n    \"ID\": \"ID1\",\n    \"Count\": 0\n  }\n]\n",
+		},
+		"stats": {
+			args:   []string{"stats", "ID1"},
+			stdout: "ID   COUNT  REMAINING  NOT BEFORE  SCHEDULED  VARIANTS\nID1  0      unlimited  -           false      -\n",
+		},
+		"list": {
+			args:   []string{"-o", "short", "list", "spring"},
+			stdout: "http://localhost:8080/ID1\n",
+		},
+		"list empty json": {
+			args:   []string{"-o", "json", "list", "summer"},
+			stdout: "[]\n",
+		},
+		"create invalid url": {
+			args:   []string{"create", "not a url"},
+			code:   exitInvalid,
+			stderr: "urlshort-cli: not a url: could not create url: rpc error: code = InvalidArgument desc = invalid URL provided\n",
+		},
+		"create invalid not before": {
+			args:   []string{"create", "-not-before", "tomorrow", "https://www.example.com"},
+			code:   exitInvalid,
+			stderr: "urlshort-cli: invalid input: not-before must be an RFC 3339 time: parsing time \"tomorrow\" as \"2006-01-02T15:04:05Z07:00\": cannot parse \"tomorrow\" as \"2006\"\n",
+		},
+		"invalid output": {
+			args:   []string{"-o", "xml", "get", "ID1"},
+			code:   exitInvalid,
+			stderr: "urlshort-cli: invalid input: unknown output \"xml\", it must be table, json or short\n",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			stdout, stderr, code := runCLI(t, addr, "", tc.args...)
+			if code != tc.code {
+				t.Errorf("expected exit code %d, got %d: %s", tc.code, code, stderr)
+			}
+			if stdout != tc.stdout {
+				t.Errorf("expected stdout %q, got %q", tc.stdout, stdout)
+			}
+			if stderr != tc.stderr {
+				t.Errorf("expected stderr %q, got %q", tc.stderr, stderr)
+			}
+		})
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	tests := map[string][]string{
+		"no command":      {},
+		"unknown command": {"shorten", "https://www.example.com"},
+		"get without ids": {"get"},
+		"list campaigns":  {"list", "spring", "summer"},
+		"unknown flag":    {"-verbose", "get", "ID1"},
+	}
+
+	for name, args := range tests {
+		t.Run(name, func(t *testing.T) {
+			// No server is needed, usage errors exit before connecting
+			_, stderr, code := runCLI(t, "127.0.0.1:1", "", args...)
+			if code != exitInvalid {
+				t.Errorf("expected exit code %d, got %d", exitInvalid, code)
+			}
+			if !strings.Contains(stderr, "Usage: urlshort-cli") {
+				t.Errorf("expected usage, got %q", stderr)
+			}
+		})
+	}
+}
+
+func TestCreateFromStdin(t *testing.T) {
+	addr := startServer(t, nil)
+
+	stdout, stderr, code := runCLI(t, addr, "https://www.example.com\n\n  https://www.example.org  \nnot a url\n",
+		"-o", "short", "create", "-warn")
+	if code != exitInvalid {
+		t.Errorf("expected exit code %d, got %d", exitInvalid, code)
+	}
+	if expected := "http://localhost:8080/ID1\nhttp://localhost:8080/ID2\n"; stdout != expected {
+		t.Errorf("expected stdout %q, got %q", expected, stdout)
+	}
+	if !strings.HasPrefix(stderr, "urlshort-cli: not a url: ") {
+		t.Errorf("expected the invalid url error, got %q", stderr)
+	}
+
+	if _, stderr, code := runCLI(t, addr, "", "delete", "ID1"); code != exitOK {
+		t.Fatalf("could not delete url: %s", stderr)
+	}
+	if _, _, code := runCLI(t, addr, "", "count", "ID1"); code != exitNotFound {
+		t.Errorf("expected exit code %d after deleting, got %d", exitNotFound, code)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	addr := startServer(t, nil)
+
+	path := filepath.Join(t.TempDir(), "cli.yaml")
+	config := fmt.Sprintf("address: %s\noutput: short\nactor: ci\n", addr)
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("could not write config: %s", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"-config", path, "create", "https://www.example.com"},
+		strings.NewReader(""), &stdout, &stderr)
+	if code != exitOK {
+		t.Fatalf("expected exit code %d, got %d: %s", exitOK, code, stderr.String())
+	}
+	if expected := "http://localhost:8080/ID1\n"; stdout.String() != expected {
+		t.Errorf("expected stdout %q, got %q", expected, stdout.String())
+	}
+
+	code = run(context.Background(), []string{"-config", filepath.Join(t.TempDir(), "missing.yaml"), "get", "ID1"},
+		strings.NewReader(""), &stdout, &stderr)
+	if code != exitError {
+		t.Errorf("expected exit code %d for a missing config file, got %d", exitError, code)
+	}
+}
+
+// runCLI runs the cli against the server address with a config dir without files
+func runCLI(t *testing.T, addr, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv(configEnv, "")
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), append([]string{"-addr", addr}, args...), strings.NewReader(stdin),
+		&stdout, &stderr)
+
+	return stdout.String(), stderr.String(), code
+}
+
+// startServer starts a gRPC server with a service on a new database, seeded by the function when not nil
+func startServer(t *testing.T, seed func(url.Service)) string {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "urlshort.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("could not open db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	urlStore, err := store.NewURLStore(db)
+	if err != nil {
+		t.Fatalf("could not create store: %s", err)
+	}
+	svc := url.NewService(url.MustParseBaseURL("localhost:8080"), &testGenerator{}, urlStore,
+		url.WithDomains(url.MustParseBaseURL("sho.rt")))
+	if seed != nil {
+		seed(svc)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+
+	srv := grpc.NewServer()
+	router.NewURLgRPC(svc).Register(srv)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	return lis.Addr().String()
+}
+
+// testGenerator generates sequential ids
+type testGenerator struct {
+	n int
+}
+
+func (g *testGenerator) Generate() (string, error) {
+	g.n++
+	return fmt.Sprintf("ID%d", g.n), nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nerock/urlshort/client"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputShort = "short"
+)
+
+// result is a row of the output of a command
+type result interface {
+	// header returns the names of the table columns
+	header() []string
+	// columns returns the values of the table columns
+	columns() []string
+	// short returns the value printed alone, usually the short url
+	short() string
+}
+
+// printResults writes the results in the output format, tables are skipped when there are no results
+func printResults(w io.Writer, output string, results []result) error {
+	switch output {
+	case outputJSON:
+		if results == nil {
+			results = []result{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	case outputShort:
+		for _, res := range results {
+			if _, err := fmt.Fprintln(w, res.short()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(results) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(results[0].header(), "\t"))
+	for _, res := range results {
+		fmt.Fprintln(tw, strings.Join(res.columns(), "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// urlResult is a shortened url
+type urlResult struct {
+	ID       string
+	URL      string
+	ShortURL string
+}
+
+func (r urlResult) header() []string  { return []string{"ID", "URL", "SHORT URL"} }
+func (r urlResult) columns() []string { return []string{r.ID, r.URL, r.ShortURL} }
+func (r urlResult) short() string     { return r.ShortURL }
+
+// deleteResult is a deleted shortened url
+type deleteResult struct {
+	ID      string
+	Deleted bool
+}
+
+func (r deleteResult) header() []string  { return []string{"ID", "DELETED"} }
+func (r deleteResult) columns() []string { return []string{r.ID, strconv.FormatBool(r.Deleted)} }
+func (r deleteResult) short() string     { return r.ID }
+
+// countResult is the redirection count of a shortened url
+type countResult struct {
+	ID    string
+	Count int
+}
+
+func (r countResult) header() []string  { return []string{"ID", "COUNT"} }
+func (r countResult) columns() []string { return []string{r.ID, strconv.Itoa(r.Count)} }
+func (r countResult) short() string     { return strconv.Itoa(r.Count) }
+
+// statsResult is the redirection count of a shortened url and each of its variants
+type statsResult struct {
+	ID string
+	client.Stats
+}
+
+func (r statsResult) header() []string {
+	return []string{"ID", "COUNT", "REMAINING", "NOT BEFORE", "SCHEDULED", "VARIANTS"}
+}
+
+func (r statsResult) columns() []string {
+	remaining := "unlimited"
+	if r.Remaining != client.UnlimitedClicks {
+		remaining = strconv.Itoa(r.Remaining)
+	}
+
+	variants := make([]string, 0, len(r.Variants))
+	for _, v := range r.Variants {
+		variants = append(variants, fmt.Sprintf("%s=%d", v.Name, v.Count))
+	}
+
+	return []string{
+		r.ID, strconv.Itoa(r.Count), remaining, formatTime(r.NotBefore), strconv.FormatBool(r.Scheduled),
+		orDash(strings.Join(variants, ",")),
+	}
+}
+
+func (r statsResult) short() string { return strconv.Itoa(r.Count) }
+
+// linkResult is a shortened url of a campaign
+type linkResult struct {
+	ID        string
+	Domain    string
+	URL       string
+	ShortURL  string
+	Count     int
+	NotBefore time.Time
+	Scheduled bool
+}
+
+func (r linkResult) header() []string {
+	return []string{"ID", "DOMAIN", "URL", "SHORT URL", "COUNT", "NOT BEFORE", "SCHEDULED"}
+}
+
+func (r linkResult) columns() []string {
+	return []string{
+		r.ID, orDash(r.Domain), orDash(r.URL), r.ShortURL, strconv.Itoa(r.Count), formatTime(r.NotBefore),
+		strconv.FormatBool(r.Scheduled),
+	}
+}
+
+func (r linkResult) short() string { return r.ShortURL }
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+// orDash keeps empty values from collapsing the table columns
+func orDash(v string) string {
+	if v == "" {
+		return "-"
+	}
+
+	return v
+}
@@ -0,0 +1,475 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nerock/urlshort/url"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultHTTPPort = 8080
+	DefaultGRPCPort = 50051
+	DefaultDBConn   = "urlshort.db"
+
+	// defaultHost is the host of the default domain, followed by the HTTP port
+	defaultHost = "localhost"
+
+	// apiPath is the prefix of the api routes, redirections can not be mounted under it
+	apiPath = "/api/"
+
+	// fileFlag and fileEnv set the path of the YAML configuration file
+	fileFlag = "config"
+	fileEnv  = "CONFIG_FILE"
+
+	redacted = "REDACTED"
+)
+
+// ErrInvalid is returned when a configuration value can not be parsed or is not valid
+var ErrInvalid = errors.New("invalid configuration")
+
+// secretParams are fragments of the names of connection string parameters redacted when printing
+var secretParams = []string{"pass", "secret", "token", "key"}
+
+// Config is the configuration of the app
+type Config struct {
+	HTTPPort int `yaml:"http_port"`
+	GRPCPort int `yaml:"grpc_port"`
+	// GRPCToken is the bearer token the gRPC calls and the admin routes of the REST api must send, both are open
+	// when it is not set
+	GRPCToken string `yaml:"grpc_token"`
+	// GRPCTLSCert and GRPCTLSKey are the paths of the PEM certificate and key the gRPC api is served over TLS with,
+	// clients only send the token over TLS so it needs them unless it is behind a TLS terminating proxy
+	GRPCTLSCert string `yaml:"grpc_tls_cert"`
+	GRPCTLSKey  string `yaml:"grpc_tls_key"`
+	// Domain is the base URL where the app is deployed to build short URLs, it can have a scheme, a port and a path
+	// prefix redirections are mounted under. It is http://localhost with the HTTP port by default
+	Domain string `yaml:"domain"`
+	// ShortDomains are other base URLs links can be created on, with the same path prefix as the domain
+	ShortDomains []string `yaml:"short_domains"`
+	DBConn       string   `yaml:"db_conn"`
+	// BlockedHosts are third-party URL shortener hosts that can not be shortened
+	BlockedHosts  []string `yaml:"blocked_hosts"`
+	CountBots     bool     `yaml:"count_bots"`
+	CountPrefetch bool     `yaml:"count_prefetch"`
+	// GeoIPDB is the path to a MaxMind country database file to evaluate country routing rules
+	GeoIPDB string `yaml:"geoip_db"`
+	// TrashRetention is how long deleted URLs can be restored before being purged
+	TrashRetention time.Duration `yaml:"trash_retention"`
+	// IdempotencyWindow is how long the URLs created with an idempotency key are returned for it
+	IdempotencyWindow time.Duration `yaml:"idempotency_window"`
+	// ComingSoonPage is default or the path to an HTML template shown when visiting scheduled URLs
+	ComingSoonPage string `yaml:"coming_soon_page"`
+	// ClickThresholds are the redirection counts sending click events to webhooks
+	ClickThresholds []int `yaml:"click_thresholds"`
+	// WebhookAllowedNetworks are the CIDR networks webhooks can be sent to even if they are private, loopback or
+	// link-local, like the ones of internal receivers
+	WebhookAllowedNetworks []string `yaml:"webhook_allowed_networks"`
+}
+
+// setting is a configuration value that can be set from env vars and flags
+type setting struct {
+	key   string
+	envs  []string
+	usage string
+	// boolean flags can be set without a value
+	boolean bool
+	set     func(*Config, string) error
+}
+
+// flagValue keeps the raw value of a flag so it is applied after the file and the env vars
+type flagValue struct {
+	key     string
+	boolean bool
+	values  map[string]string
+}
+
+func (f flagValue) String() string {
+	return f.values[f.key]
+}
+
+func (f flagValue) Set(v string) error {
+	f.values[f.key] = v
+	return nil
+}
+
+func (f flagValue) IsBoolFlag() bool {
+	return f.boolean
+}
+
+var settings = []setting{
+	{key: "http_port", envs: []string{"PORT"}, usage: "HTTP server port",
+		set: func(c *Config, v string) error { return parseInt(v, &c.HTTPPort) }},
+	{key: "grpc_port", envs: []string{"GRPC_PORT"}, usage: "gRPC server port",
+		set: func(c *Config, v string) error { return parseInt(v, &c.GRPCPort) }},
+	{key: "grpc_token", envs: []string{"GRPC_TOKEN"}, usage: "bearer token the gRPC calls and REST admin routes must send",
+		set: func(c *Config, v string) error { c.GRPCToken = v; return nil }},
+	{key: "grpc_tls_cert", envs: []string{"GRPC_TLS_CERT"}, usage: "path to the PEM certificate to serve gRPC over TLS",
+		set: func(c *Config, v string) error { c.GRPCTLSCert = v; return nil }},
+	{key: "grpc_tls_key", envs: []string{"GRPC_TLS_KEY"}, usage: "path to the PEM key of the gRPC certificate",
+		set: func(c *Config, v string) error { c.GRPCTLSKey = v; return nil }},
+	{key: "domain", envs: []string{"DOMAIN"}, usage: "domain where the app is deployed to build short URLs",
+		set: func(c *Config, v string) error { c.Domain = v; return nil }},
+	{key: "short_domains", envs: []string{"SHORT_DOMAINS"}, usage: "comma separated other domains to create URLs on",
+		set: func(c *Config, v string) error { c.ShortDomains = splitList(v); return nil }},
+	// DBCONN is still read for deployments that followed the old README
+	{key: "db_conn", envs: []string{"DB_CONN", "DBCONN"}, usage: "sqlite DB connection string",
+		set: func(c *Config, v string) error { c.DBConn = v; return nil }},
+	{key: "blocked_hosts", envs: []string{"BLOCKED_HOSTS"}, usage: "comma separated hosts that can not be shortened",
+		set: func(c *Config, v string) error { c.BlockedHosts = splitList(v); return nil }},
+	{key: "count_bots", envs: []string{"COUNT_BOTS"}, usage: "count redirections requested by bots and crawlers",
+		boolean: true, set: func(c *Config, v string) error { return parseBool(v, &c.CountBots) }},
+	{key: "count_prefetch", envs: []string{"COUNT_PREFETCH"}, usage: "count redirections requested by prefetches",
+		boolean: true, set: func(c *Config, v string) error { return parseBool(v, &c.CountPrefetch) }},
+	{key: "geoip_db", envs: []string{"GEOIP_DB"}, usage: "path to a MaxMind country database file",
+		set: func(c *Config, v string) error { c.GeoIPDB = v; return nil }},
+	{key: "trash_retention", envs: []string{"TRASH_RETENTION"}, usage: "how long deleted URLs can be restored",
+		set: func(c *Config, v string) error { return parseDuration(v, &c.TrashRetention) }},
+	{key: "idempotency_window", envs: []string{"IDEMPOTENCY_WINDOW"}, usage: "how long idempotency keys are kept",
+		set: func(c *Config, v string) error { return parseDuration(v, &c.IdempotencyWindow) }},
+	{key: "coming_soon_page", envs: []string{"COMING_SOON_PAGE"}, usage: "default or an HTML template for scheduled URLs",
+		set: func(c *Config, v string) error { c.ComingSoonPage = v; return nil }},
+	{key: "click_thresholds", envs: []string{"CLICK_THRESHOLDS"}, usage: "comma separated counts sending click events",
+		set: func(c *Config, v string) error { return parseInts(v, &c.ClickThresholds) }},
+	{key: "webhook_allowed_networks", envs: []string{"WEBHOOK_ALLOWED_NETWORKS"},
+		usage: "comma separated private networks webhooks can be sent to",
+		set:   func(c *Config, v string) error { c.WebhookAllowedNetworks = splitList(v); return nil }},
+}
+
+// Default returns the configuration used when nothing is set
+func Default() Config {
+	return Config{
+		HTTPPort:          DefaultHTTPPort,
+		GRPCPort:          DefaultGRPCPort,
+		DBConn:            DefaultDBConn,
+		TrashRetention:    url.DefaultRetention,
+		IdempotencyWindow: url.DefaultIdempotencyWindow,
+		ClickThresholds:   url.DefaultClickThresholds,
+	}
+}
+
+// Load reads the configuration from the YAML file set with the -config flag or CONFIG_FILE, the env vars and
+// the command line flags, each one overriding the previous ones, and validates it. Flags are named after the
+// file keys with dashes instead of underscores
+func Load(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	fs := flag.NewFlagSet("urlshort", flag.ContinueOnError)
+	file := fs.String(fileFlag, "", "path to a YAML configuration file")
+	flags := make(map[string]string)
+	for _, s := range settings {
+		fs.Var(flagValue{key: s.key, boolean: s.boolean, values: flags}, flagName(s.key), s.usage)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, fmt.Errorf("%w: unexpected argument %q", ErrInvalid, fs.Arg(0))
+	}
+
+	cfg := Default()
+	if *file == "" {
+		*file, _ = lookupEnv(fileEnv)
+	}
+	if *file != "" {
+		if err := cfg.readFile(*file); err != nil {
+			return Config{}, err
+		}
+	}
+
+	for _, s := range settings {
+		for _, env := range s.envs {
+			if v, ok := lookupEnv(env); ok && v != "" {
+				if err := s.set(&cfg, v); err != nil {
+					return Config{}, fmt.Errorf("%w: %s: %s", ErrInvalid, env, err)
+				}
+				break
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := flags[s.key]; ok {
+			if err := s.set(&cfg, v); err != nil {
+				return Config{}, fmt.Errorf("%w: -%s: %s", ErrInvalid, flagName(s.key), err)
+			}
+		}
+	}
+
+	if cfg.Domain == "" {
+		cfg.Domain = fmt.Sprintf("http://%s:%d/", defaultHost, cfg.HTTPPort)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+// readFile overrides the configuration with the keys set in the YAML file, unknown keys are rejected
+func (c *Config) readFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: %s: %s", ErrInvalid, path, err)
+	}
+
+	return nil
+}
+
+// Validate checks that the configuration values can be used
+func (c Config) Validate() error {
+	var errs []string
+	if c.HTTPPort < 1 || c.HTTPPort > 65535 {
+		errs = append(errs, fmt.Sprintf("http_port must be between 1 and 65535, got %d", c.HTTPPort))
+	}
+	if c.GRPCPort < 1 || c.GRPCPort > 65535 {
+		errs = append(errs, fmt.Sprintf("grpc_port must be between 1 and 65535, got %d", c.GRPCPort))
+	}
+	if c.HTTPPort == c.GRPCPort {
+		errs = append(errs, "http_port and grpc_port must be different")
+	}
+	if (c.GRPCTLSCert == "") != (c.GRPCTLSKey == "") {
+		errs = append(errs, "grpc_tls_cert and grpc_tls_key must be set together")
+	}
+
+	if err := validateDomain(c.Domain); err != nil {
+		errs = append(errs, err.Error())
+	} else if err := validateShortDomains(c.Domain, c.ShortDomains); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if c.DBConn == "" {
+		errs = append(errs, "db_conn must be set")
+	}
+
+	// Printed configurations have their secrets redacted, they must be set again before loading them
+	if strings.Contains(c.DBConn, redacted) {
+		errs = append(errs, "db_conn has redacted secrets")
+	}
+	if c.GRPCToken == redacted {
+		errs = append(errs, "grpc_token is redacted")
+	}
+
+	if c.TrashRetention < 0 {
+		errs = append(errs, "trash_retention can not be negative")
+	}
+
+	if c.IdempotencyWindow <= 0 {
+		errs = append(errs, "idempotency_window must be positive")
+	}
+
+	for _, threshold := range c.ClickThresholds {
+		if threshold < 1 {
+			errs = append(errs, fmt.Sprintf("click_thresholds must be positive, got %d", threshold))
+			break
+		}
+	}
+
+	for _, network := range c.WebhookAllowedNetworks {
+		if _, err := netip.ParsePrefix(network); err != nil {
+			errs = append(errs, fmt.Sprintf("webhook_allowed_networks must be CIDR networks, got %q", network))
+			break
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalid, strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// validateDomain checks the domain is a base url with an optional http or https scheme, a port and a path
+// prefix, the prefix can not be under the api routes
+func validateDomain(domain string) error {
+	if domain == "" {
+		return errors.New("domain must be set")
+	}
+
+	base, err := url.ParseBaseURL(domain)
+	if err != nil {
+		return fmt.Errorf("domain must be an http or https url with an optional port and path, got %q", domain)
+	}
+
+	if strings.HasPrefix(base.Path(), apiPath) {
+		return fmt.Errorf("domain path can not be under %s, got %q", apiPath, base.Path())
+	}
+
+	return nil
+}
+
+// validateShortDomains checks the short domains are base urls with the path prefix of the domain,
+// redirections of every domain are mounted under the same path
+func validateShortDomains(domain string, shortDomains []string) error {
+	base := url.MustParseBaseURL(domain)
+	hosts := map[string]bool{base.Host(): true}
+	for _, shortDomain := range shortDomains {
+		short, err := url.ParseBaseURL(shortDomain)
+		if err != nil {
+			return fmt.Errorf("short_domains must be http or https urls with an optional port and path, got %q",
+				shortDomain)
+		}
+
+		if short.Path() != base.Path() {
+			return fmt.Errorf("short_domains must have the path of the domain %s, got %q", base.Path(), shortDomain)
+		}
+
+		if hosts[short.Host()] {
+			return fmt.Errorf("short_domains must have different hosts, got %q twice", short.Host())
+		}
+		hosts[short.Host()] = true
+	}
+
+	return nil
+}
+
+// BaseURL returns the base url short urls are built from, the configuration must be valid
+func (c Config) BaseURL() url.BaseURL {
+	return url.MustParseBaseURL(c.Domain)
+}
+
+// ShortDomainURLs returns the base urls of the other short domains, the configuration must be valid
+func (c Config) ShortDomainURLs() []url.BaseURL {
+	domains := make([]url.BaseURL, 0, len(c.ShortDomains))
+	for _, domain := range c.ShortDomains {
+		domains = append(domains, url.MustParseBaseURL(domain))
+	}
+
+	return domains
+}
+
+// WebhookNetworks returns the networks webhooks can be sent to even if they are not public, the configuration
+// must be valid
+func (c Config) WebhookNetworks() []netip.Prefix {
+	networks := make([]netip.Prefix, 0, len(c.WebhookAllowedNetworks))
+	for _, network := range c.WebhookAllowedNetworks {
+		networks = append(networks, netip.MustParsePrefix(network))
+	}
+
+	return networks
+}
+
+// Redacted returns a copy of the configuration with the secrets hidden so it can be printed, it can not be loaded
+// back since the placeholders of the secrets fail validation
+func (c Config) Redacted() Config {
+	c.DBConn = redactConn(c.DBConn)
+	if c.GRPCToken != "" {
+		c.GRPCToken = redacted
+	}
+
+	return c
+}
+
+// Print writes the configuration as YAML, it can be used as a configuration file unless it is Redacted
+func (c Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return fmt.Errorf("could not encode config: %w", err)
+	}
+
+	return enc.Close()
+}
+
+// redactConn hides the password of the connection string and its parameters that look like secrets
+func redactConn(conn string) string {
+	base, query, found := strings.Cut(conn, "?")
+	if u, err := neturl.Parse(base); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = neturl.UserPassword(u.User.Username(), redacted)
+			base = u.String()
+		}
+	}
+	if !found {
+		return base
+	}
+
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		lower := strings.ToLower(name)
+		for _, secret := range secretParams {
+			if strings.Contains(lower, secret) {
+				params[i] = name + "=" + redacted
+				break
+			}
+		}
+	}
+
+	return base + "?" + strings.Join(params, "&")
+}
+
+func flagName(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
+
+func parseInt(v string, dst *int) error {
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return fmt.Errorf("%q is not a number", v)
+	}
+	*dst = n
+
+	return nil
+}
+
+func parseBool(v string, dst *bool) error {
+	b, err := strconv.ParseBool(strings.TrimSpace(v))
+	if err != nil {
+		return fmt.Errorf("%q is not a boolean", v)
+	}
+	*dst = b
+
+	return nil
+}
+
+func parseDuration(v string, dst *time.Duration) error {
+	d, err := time.ParseDuration(strings.TrimSpace(v))
+	if err != nil {
+		return fmt.Errorf("%q is not a duration", v)
+	}
+	*dst = d
+
+	return nil
+}
+
+func parseInts(v string, dst *[]int) error {
+	var ints []int
+	for _, value := range splitList(v) {
+		var n int
+		if err := parseInt(value, &n); err != nil {
+			return err
+		}
+		ints = append(ints, n)
+	}
+	*dst = ints
+
+	return nil
+}
+
+func splitList(v string) []string {
+	var values []string
+	for _, value := range strings.Split(v, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,277 @@
+package config_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nerock/urlshort/config"
+)
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "urlshort.yaml")
+	if err := os.WriteFile(file, []byte(`
+http_port: 9000
+domain: short.example.com/
+db_conn: file.db
+trash_retention: 48h
+click_thresholds: [5, 50]
+`), 0o600); err != nil {
+		t.Fatalf("could not write config file: %s", err)
+	}
+
+	defaults := config.Default()
+	defaults.Domain = "http://localhost:8080/"
+
+	tests := map[string]struct {
+		args []string
+		env  map[string]string
+
+		cfg config.Config
+		err error
+	}{
+		"defaults": {
+			cfg: defaults,
+		},
+		"file": {
+			args: []string{"-config", file},
+			cfg: config.Config{HTTPPort: 9000, GRPCPort: 50051, Domain: "short.example.com/", DBConn: "file.db",
+				TrashRetention: 48 * time.Hour, IdempotencyWindow: defaults.IdempotencyWindow,
+				ClickThresholds: []int{5, 50}},
+		},
+		"file from env": {
+			env: map[string]string{"CONFIG_FILE": file},
+			cfg: config.Config{HTTPPort: 9000, GRPCPort: 50051, Domain: "short.example.com/", DBConn: "file.db",
+				TrashRetention: 48 * time.Hour, IdempotencyWindow: defaults.IdempotencyWindow,
+				ClickThresholds: []int{5, 50}},
+		},
+		"env over file": {
+			args: []string{"-config", file},
+			env: map[string]string{"PORT": "9001", "DB_CONN": "env.db", "COUNT_BOTS": "true",
+				"BLOCKED_HOSTS": "bit.ly, t.co"},
+			cfg: config.Config{HTTPPort: 9001, GRPCPort: 50051, Domain: "short.example.com/", DBConn: "env.db",
+				BlockedHosts: []string{"bit.ly", "t.co"}, CountBots: true, TrashRetention: 48 * time.Hour,
+				IdempotencyWindow: defaults.IdempotencyWindow, ClickThresholds: []int{5, 50}},
+		},
+		"flags over env": {
+			args: []string{"-config", file, "-http-port", "9002", "-click-thresholds", "10", "-count-bots=false",
+				"-count-prefetch"},
+			env: map[string]string{"PORT": "9001", "COUNT_BOTS": "true"},
+			cfg: config.Config{HTTPPort: 9002, GRPCPort: 50051, Domain: "short.example.com/", DBConn: "file.db",
+				CountPrefetch: true, TrashRetention: 48 * time.Hour, IdempotencyWindow: defaults.IdempotencyWindow,
+				ClickThresholds: []int{10}},
+		},
+		"old db env": {
+			env: map[string]string{"DBCONN": "old.db"},
+			cfg: config.Config{HTTPPort: 8080, GRPCPort: 50051, Domain: "http://localhost:8080/", DBConn: "old.db",
+				TrashRetention: defaults.TrashRetention, IdempotencyWindow: defaults.IdempotencyWindow,
+				ClickThresholds: defaults.ClickThresholds},
+		},
+		"default domain port": {
+			args: []string{"-http-port", "9003"},
+			cfg: config.Config{HTTPPort: 9003, GRPCPort: 50051, Domain: "http://localhost:9003/", DBConn: "urlshort.db",
+				TrashRetention: defaults.TrashRetention, IdempotencyWindow: defaults.IdempotencyWindow,
+				ClickThresholds: defaults.ClickThresholds},
+		},
+		"invalid port": {
+			env: map[string]string{"PORT": "http"},
+			err: config.ErrInvalid,
+		},
+		"port out of range": {
+			args: []string{"-grpc-port", "70000"},
+			err:  config.ErrInvalid,
+		},
+		"same ports": {
+			args: []string{"-grpc-port", "8080"},
+			err:  config.ErrInvalid,
+		},
+		"domain with scheme and path": {
+			env: map[string]string{"DOMAIN": "https://short.example.com/s/"},
+			cfg: config.Config{HTTPPort: 8080, GRPCPort: 50051, Domain: "https://short.example.com/s/",
+				DBConn: "urlshort.db", TrashRetention: defaults.TrashRetention, IdempotencyWindow: defaults.IdempotencyWindow,
+				ClickThresholds: defaults.ClickThresholds},
+		},
+		"domain with invalid scheme": {
+			env: map[string]string{"DOMAIN": "ftp://short.example.com/"},
+			err: config.ErrInvalid,
+		},
+		"domain under api": {
+			env: map[string]string{"DOMAIN": "short.example.com/api/s"},
+			err: config.ErrInvalid,
+		},
+		"domain with query": {
+			env: map[string]string{"DOMAIN": "short.example.com/?a=b"},
+			err: config.ErrInvalid,
+		},
+		"invalid domain host": {
+			env: map[string]string{"DOMAIN": "short_example.com"},
+			err: config.ErrInvalid,
+		},
+		"short domains": {
+			env: map[string]string{"DOMAIN": "https://go.acme.com/s/", "SHORT_DOMAINS": "https://acme.link/s, acme.io/s/"},
+			cfg: config.Config{HTTPPort: 8080, GRPCPort: 50051, Domain: "https://go.acme.com/s/",
+				ShortDomains: []string{"https://acme.link/s", "acme.io/s/"}, DBConn: "urlshort.db",
+				TrashRetention: defaults.TrashRetention, IdempotencyWindow: defaults.IdempotencyWindow,
+				ClickThresholds: defaults.ClickThresholds},
+		},
+		"short domain with other path": {
+			env: map[string]string{"DOMAIN": "https://go.acme.com/s/", "SHORT_DOMAINS": "https://acme.link/"},
+			err: config.ErrInvalid,
+		},
+		"repeated short domain": {
+			env: map[string]string{"DOMAIN": "https://acme.link", "SHORT_DOMAINS": "http://acme.link"},
+			err: config.ErrInvalid,
+		},
+		"invalid short domain": {
+			env: map[string]string{"SHORT_DOMAINS": "acme_link"},
+			err: config.ErrInvalid,
+		},
+		"invalid bool": {
+			env: map[string]string{"COUNT_PREFETCH": "sometimes"},
+			err: config.ErrInvalid,
+		},
+		"negative retention": {
+			env: map[string]string{"TRASH_RETENTION": "-1h"},
+			err: config.ErrInvalid,
+		},
+		"idempotency window": {
+			env: map[string]string{"IDEMPOTENCY_WINDOW": "1h"},
+			cfg: config.Config{HTTPPort: 8080, GRPCPort: 50051, Domain: "http://localhost:8080/", DBConn: "urlshort.db",
+				TrashRetention: defaults.TrashRetention, IdempotencyWindow: time.Hour,
+				ClickThresholds: defaults.ClickThresholds},
+		},
+		"zero idempotency window": {
+			env: map[string]string{"IDEMPOTENCY_WINDOW": "0s"},
+			err: config.ErrInvalid,
+		},
+		"invalid threshold": {
+			env: map[string]string{"CLICK_THRESHOLDS": "10,0"},
+			err: config.ErrInvalid,
+		},
+		"webhook allowed networks": {
+			env: map[string]string{"WEBHOOK_ALLOWED_NETWORKS": "10.0.0.0/8, fd00::/8"},
+			cfg: config.Config{HTTPPort: 8080, GRPCPort: 50051, Domain: "http://localhost:8080/", DBConn: "urlshort.db",
+				TrashRetention: defaults.TrashRetention, IdempotencyWindow: defaults.IdempotencyWindow,
+				ClickThresholds: defaults.ClickThresholds, WebhookAllowedNetworks: []string{"10.0.0.0/8", "fd00::/8"}},
+		},
+		"grpc tls": {
+			env: map[string]string{"GRPC_TLS_CERT": "cert.pem", "GRPC_TLS_KEY": "key.pem"},
+			cfg: config.Config{HTTPPort: 8080, GRPCPort: 50051, GRPCTLSCert: "cert.pem", GRPCTLSKey: "key.pem",
+				Domain: "http://localhost:8080/", DBConn: "urlshort.db", TrashRetention: defaults.TrashRetention,
+				IdempotencyWindow: defaults.IdempotencyWindow, ClickThresholds: defaults.ClickThresholds},
+		},
+		"grpc tls cert without key": {
+			env: map[string]string{"GRPC_TLS_CERT": "cert.pem"},
+			err: config.ErrInvalid,
+		},
+		"invalid webhook network": {
+			env: map[string]string{"WEBHOOK_ALLOWED_NETWORKS": "10.0.0.1"},
+			err: config.ErrInvalid,
+		},
+		"unexpected argument": {
+			args: []string{"serve"},
+			err:  config.ErrInvalid,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := config.Load(tt.args, func(key string) (string, bool) {
+				v, ok := tt.env[key]
+				return v, ok
+			})
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("wrong error returned\nexpected=%v\ngot=%v", tt.err, err)
+			}
+
+			if !reflect.DeepEqual(cfg, tt.cfg) && tt.err == nil {
+				t.Errorf("wrong config loaded\nexpected=%+v\ngot=%+v", tt.cfg, cfg)
+			}
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	tests := map[string]string{
+		"unknown key":      "http_prot: 9000\n",
+		"invalid value":    "http_port: http\n",
+		"redacted db conn": "db_conn: file:test.db?_auth&_auth_user=admin&_auth_pass=REDACTED\n",
+		"redacted token":   "grpc_token: REDACTED\n",
+		"missing file":     "",
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "urlshort.yaml")
+			if content != "" {
+				if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+					t.Fatalf("could not write config file: %s", err)
+				}
+			}
+
+			_, err := config.Load([]string{"-config", file}, func(string) (string, bool) { return "", false })
+			if err == nil {
+				t.Error("config loaded from an invalid file")
+			}
+		})
+	}
+}
+
+func TestPrint(t *testing.T) {
+	tests := map[string]struct {
+		conn string
+
+		want string
+	}{
+		"no secrets": {conn: "file.db", want: "file.db"},
+		"sqlite auth": {
+			conn: "file:test.db?_auth&_auth_user=admin&_auth_pass=secret&cache=shared",
+			want: "file:test.db?_auth&_auth_user=admin&_auth_pass=REDACTED&cache=shared",
+		},
+		"url password": {
+			conn: "postgres://admin:secret@db/urlshort?sslkey=key.pem",
+			want: "postgres://admin:REDACTED@db/urlshort?sslkey=REDACTED",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.DBConn = tt.conn
+			cfg.GRPCToken = "secret"
+
+			var buf bytes.Buffer
+			if err := cfg.Redacted().Print(&buf); err != nil {
+				t.Fatalf("could not print config: %s", err)
+			}
+
+			if !strings.Contains(buf.String(), "db_conn: "+tt.want+"\n") || strings.Contains(buf.String(), "secret") {
+				t.Errorf("wrong config printed\nexpected db_conn: %s\ngot=%s", tt.want, buf.String())
+			}
+
+			if !strings.Contains(buf.String(), "grpc_token: REDACTED\n") {
+				t.Errorf("grpc token not redacted\ngot=%s", buf.String())
+			}
+
+			if !strings.Contains(buf.String(), "trash_retention: 720h0m0s\n") {
+				t.Errorf("wrong retention printed\ngot=%s", buf.String())
+			}
+
+			// The redacted output is not loaded back with the placeholders as secrets
+			file := filepath.Join(t.TempDir(), "urlshort.yaml")
+			if err := os.WriteFile(file, buf.Bytes(), 0o600); err != nil {
+				t.Fatalf("could not write config file: %s", err)
+			}
+			_, err := config.Load([]string{"-config", file}, func(string) (string, bool) { return "", false })
+			if !errors.Is(err, config.ErrInvalid) {
+				t.Errorf("redacted config loaded\nexpected=%s\ngot=%v", config.ErrInvalid, err)
+			}
+		})
+	}
+}
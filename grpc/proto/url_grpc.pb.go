@@ -21,7 +21,17 @@ type UrlShortenerClient interface {
 	CreateURL(ctx context.Context, in *CreateURLRequest, opts ...grpc.CallOption) (*URLResponse, error)
 	GetURL(ctx context.Context, in *URLRequest, opts ...grpc.CallOption) (*URLResponse, error)
 	DeleteURL(ctx context.Context, in *URLRequest, opts ...grpc.CallOption) (*DeleteURLResponse, error)
+	RestoreURL(ctx context.Context, in *URLRequest, opts ...grpc.CallOption) (*RestoreURLResponse, error)
 	GetRedirectionCount(ctx context.Context, in *URLRequest, opts ...grpc.CallOption) (*RedirectionCountResponse, error)
+	GetQRCode(ctx context.Context, in *QRCodeRequest, opts ...grpc.CallOption) (*QRCodeResponse, error)
+	SetRules(ctx context.Context, in *SetRulesRequest, opts ...grpc.CallOption) (*RulesResponse, error)
+	GetRules(ctx context.Context, in *URLRequest, opts ...grpc.CallOption) (*RulesResponse, error)
+	SetVariants(ctx context.Context, in *SetVariantsRequest, opts ...grpc.CallOption) (*VariantsResponse, error)
+	GetVariants(ctx context.Context, in *URLRequest, opts ...grpc.CallOption) (*VariantsResponse, error)
+	GetStats(ctx context.Context, in *URLRequest, opts ...grpc.CallOption) (*StatsResponse, error)
+	ListAuditEntries(ctx context.Context, in *AuditRequest, opts ...grpc.CallOption) (*AuditResponse, error)
+	WatchRedirects(ctx context.Context, in *WatchRedirectsRequest, opts ...grpc.CallOption) (UrlShortener_WatchRedirectsClient, error)
+	ListCampaignURLs(ctx context.Context, in *CampaignURLsRequest, opts ...grpc.CallOption) (*CampaignURLsResponse, error)
 }
 
 type urlShortenerClient struct {
@@ -59,6 +69,15 @@ func (c *urlShortenerClient) DeleteURL(ctx context.Context, in *URLRequest, opts
 	return out, nil
 }
 
+func (c *urlShortenerClient) RestoreURL(ctx context.Context, in *URLRequest, opts ...grpc.CallOption) (*RestoreURLResponse, error) {
+	out := new(RestoreURLResponse)
+	err := c.cc.Invoke(ctx, "/urlshort.UrlShortener/RestoreURL", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *urlShortenerClient) GetRedirectionCount(ctx context.Context, in *URLRequest, opts ...grpc.CallOption) (*RedirectionCountResponse, error) {
 	out := new(RedirectionCountResponse)
 	err := c.cc.Invoke(ctx, "/urlshort.UrlShortener/GetRedirectionCount", in, out, opts...)
@@ -68,6 +87,110 @@ func (c *urlShortenerClient) GetRedirectionCount(ctx context.Context, in *URLReq
 	return out, nil
 }
 
+func (c *urlShortenerClient) GetQRCode(ctx context.Context, in *QRCodeRequest, opts ...grpc.CallOption) (*QRCodeResponse, error) {
+	out := new(QRCodeResponse)
+	err := c.cc.Invoke(ctx, "/urlshort.UrlShortener/GetQRCode", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *urlShortenerClient) SetRules(ctx context.Context, in *SetRulesRequest, opts ...grpc.CallOption) (*RulesResponse, error) {
+	out := new(RulesResponse)
+	err := c.cc.Invoke(ctx, "/urlshort.UrlShortener/SetRules", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *urlShortenerClient) GetRules(ctx context.Context, in *URLRequest, opts ...grpc.CallOption) (*RulesResponse, error) {
+	out := new(RulesResponse)
+	err := c.cc.Invoke(ctx, "/urlshort.UrlShortener/GetRules", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *urlShortenerClient) SetVariants(ctx context.Context, in *SetVariantsRequest, opts ...grpc.CallOption) (*VariantsResponse, error) {
+	out := new(VariantsResponse)
+	err := c.cc.Invoke(ctx, "/urlshort.UrlShortener/SetVariants", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *urlShortenerClient) GetVariants(ctx context.Context, in *URLRequest, opts ...grpc.CallOption) (*VariantsResponse, error) {
+	out := new(VariantsResponse)
+	err := c.cc.Invoke(ctx, "/urlshort.UrlShortener/GetVariants", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *urlShortenerClient) GetStats(ctx context.Context, in *URLRequest, opts ...grpc.CallOption) (*StatsResponse, error) {
+	out := new(StatsResponse)
+	err := c.cc.Invoke(ctx, "/urlshort.UrlShortener/GetStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *urlShortenerClient) ListAuditEntries(ctx context.Context, in *AuditRequest, opts ...grpc.CallOption) (*AuditResponse, error) {
+	out := new(AuditResponse)
+	err := c.cc.Invoke(ctx, "/urlshort.UrlShortener/ListAuditEntries", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *urlShortenerClient) WatchRedirects(ctx context.Context, in *WatchRedirectsRequest, opts ...grpc.CallOption) (UrlShortener_WatchRedirectsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &UrlShortener_ServiceDesc.Streams[0], "/urlshort.UrlShortener/WatchRedirects", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &urlShortenerWatchRedirectsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type UrlShortener_WatchRedirectsClient interface {
+	Recv() (*RedirectEvent, error)
+	grpc.ClientStream
+}
+
+type urlShortenerWatchRedirectsClient struct {
+	grpc.ClientStream
+}
+
+func (x *urlShortenerWatchRedirectsClient) Recv() (*RedirectEvent, error) {
+	m := new(RedirectEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *urlShortenerClient) ListCampaignURLs(ctx context.Context, in *CampaignURLsRequest, opts ...grpc.CallOption) (*CampaignURLsResponse, error) {
+	out := new(CampaignURLsResponse)
+	err := c.cc.Invoke(ctx, "/urlshort.UrlShortener/ListCampaignURLs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // UrlShortenerServer is the server API for UrlShortener service.
 // All implementations must embed UnimplementedUrlShortenerServer
 // for forward compatibility
@@ -75,7 +198,17 @@ type UrlShortenerServer interface {
 	CreateURL(context.Context, *CreateURLRequest) (*URLResponse, error)
 	GetURL(context.Context, *URLRequest) (*URLResponse, error)
 	DeleteURL(context.Context, *URLRequest) (*DeleteURLResponse, error)
+	RestoreURL(context.Context, *URLRequest) (*RestoreURLResponse, error)
 	GetRedirectionCount(context.Context, *URLRequest) (*RedirectionCountResponse, error)
+	GetQRCode(context.Context, *QRCodeRequest) (*QRCodeResponse, error)
+	SetRules(context.Context, *SetRulesRequest) (*RulesResponse, error)
+	GetRules(context.Context, *URLRequest) (*RulesResponse, error)
+	SetVariants(context.Context, *SetVariantsRequest) (*VariantsResponse, error)
+	GetVariants(context.Context, *URLRequest) (*VariantsResponse, error)
+	GetStats(context.Context, *URLRequest) (*StatsResponse, error)
+	ListAuditEntries(context.Context, *AuditRequest) (*AuditResponse, error)
+	WatchRedirects(*WatchRedirectsRequest, UrlShortener_WatchRedirectsServer) error
+	ListCampaignURLs(context.Context, *CampaignURLsRequest) (*CampaignURLsResponse, error)
 	mustEmbedUnimplementedUrlShortenerServer()
 }
 
@@ -92,9 +225,39 @@ func (UnimplementedUrlShortenerServer) GetURL(context.Context, *URLRequest) (*UR
 func (UnimplementedUrlShortenerServer) DeleteURL(context.Context, *URLRequest) (*DeleteURLResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method DeleteURL not implemented")
 }
+func (UnimplementedUrlShortenerServer) RestoreURL(context.Context, *URLRequest) (*RestoreURLResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RestoreURL not implemented")
+}
 func (UnimplementedUrlShortenerServer) GetRedirectionCount(context.Context, *URLRequest) (*RedirectionCountResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetRedirectionCount not implemented")
 }
+func (UnimplementedUrlShortenerServer) GetQRCode(context.Context, *QRCodeRequest) (*QRCodeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetQRCode not implemented")
+}
+func (UnimplementedUrlShortenerServer) SetRules(context.Context, *SetRulesRequest) (*RulesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetRules not implemented")
+}
+func (UnimplementedUrlShortenerServer) GetRules(context.Context, *URLRequest) (*RulesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRules not implemented")
+}
+func (UnimplementedUrlShortenerServer) SetVariants(context.Context, *SetVariantsRequest) (*VariantsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetVariants not implemented")
+}
+func (UnimplementedUrlShortenerServer) GetVariants(context.Context, *URLRequest) (*VariantsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetVariants not implemented")
+}
+func (UnimplementedUrlShortenerServer) GetStats(context.Context, *URLRequest) (*StatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedUrlShortenerServer) ListAuditEntries(context.Context, *AuditRequest) (*AuditResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAuditEntries not implemented")
+}
+func (UnimplementedUrlShortenerServer) WatchRedirects(*WatchRedirectsRequest, UrlShortener_WatchRedirectsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchRedirects not implemented")
+}
+func (UnimplementedUrlShortenerServer) ListCampaignURLs(context.Context, *CampaignURLsRequest) (*CampaignURLsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListCampaignURLs not implemented")
+}
 func (UnimplementedUrlShortenerServer) mustEmbedUnimplementedUrlShortenerServer() {}
 
 // UnsafeUrlShortenerServer may be embedded to opt out of forward compatibility for this service.
@@ -162,6 +325,24 @@ func _UrlShortener_DeleteURL_Handler(srv interface{}, ctx context.Context, dec f
 	return interceptor(ctx, in, info, handler)
 }
 
+func _UrlShortener_RestoreURL_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(URLRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlShortenerServer).RestoreURL(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/urlshort.UrlShortener/RestoreURL",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlShortenerServer).RestoreURL(ctx, req.(*URLRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _UrlShortener_GetRedirectionCount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(URLRequest)
 	if err := dec(in); err != nil {
@@ -180,6 +361,171 @@ func _UrlShortener_GetRedirectionCount_Handler(srv interface{}, ctx context.Cont
 	return interceptor(ctx, in, info, handler)
 }
 
+func _UrlShortener_GetQRCode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QRCodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlShortenerServer).GetQRCode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/urlshort.UrlShortener/GetQRCode",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlShortenerServer).GetQRCode(ctx, req.(*QRCodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UrlShortener_SetRules_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetRulesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlShortenerServer).SetRules(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/urlshort.UrlShortener/SetRules",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlShortenerServer).SetRules(ctx, req.(*SetRulesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UrlShortener_GetRules_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(URLRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlShortenerServer).GetRules(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/urlshort.UrlShortener/GetRules",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlShortenerServer).GetRules(ctx, req.(*URLRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UrlShortener_SetVariants_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetVariantsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlShortenerServer).SetVariants(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/urlshort.UrlShortener/SetVariants",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlShortenerServer).SetVariants(ctx, req.(*SetVariantsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UrlShortener_GetVariants_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(URLRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlShortenerServer).GetVariants(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/urlshort.UrlShortener/GetVariants",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlShortenerServer).GetVariants(ctx, req.(*URLRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UrlShortener_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(URLRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlShortenerServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/urlshort.UrlShortener/GetStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlShortenerServer).GetStats(ctx, req.(*URLRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UrlShortener_ListAuditEntries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AuditRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlShortenerServer).ListAuditEntries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/urlshort.UrlShortener/ListAuditEntries",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlShortenerServer).ListAuditEntries(ctx, req.(*AuditRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UrlShortener_WatchRedirects_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRedirectsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(UrlShortenerServer).WatchRedirects(m, &urlShortenerWatchRedirectsServer{stream})
+}
+
+type UrlShortener_WatchRedirectsServer interface {
+	Send(*RedirectEvent) error
+	grpc.ServerStream
+}
+
+type urlShortenerWatchRedirectsServer struct {
+	grpc.ServerStream
+}
+
+func (x *urlShortenerWatchRedirectsServer) Send(m *RedirectEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _UrlShortener_ListCampaignURLs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CampaignURLsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UrlShortenerServer).ListCampaignURLs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/urlshort.UrlShortener/ListCampaignURLs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UrlShortenerServer).ListCampaignURLs(ctx, req.(*CampaignURLsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // UrlShortener_ServiceDesc is the grpc.ServiceDesc for UrlShortener service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -199,11 +545,53 @@ var UrlShortener_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "DeleteURL",
 			Handler:    _UrlShortener_DeleteURL_Handler,
 		},
+		{
+			MethodName: "RestoreURL",
+			Handler:    _UrlShortener_RestoreURL_Handler,
+		},
 		{
 			MethodName: "GetRedirectionCount",
 			Handler:    _UrlShortener_GetRedirectionCount_Handler,
 		},
+		{
+			MethodName: "GetQRCode",
+			Handler:    _UrlShortener_GetQRCode_Handler,
+		},
+		{
+			MethodName: "SetRules",
+			Handler:    _UrlShortener_SetRules_Handler,
+		},
+		{
+			MethodName: "GetRules",
+			Handler:    _UrlShortener_GetRules_Handler,
+		},
+		{
+			MethodName: "SetVariants",
+			Handler:    _UrlShortener_SetVariants_Handler,
+		},
+		{
+			MethodName: "GetVariants",
+			Handler:    _UrlShortener_GetVariants_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _UrlShortener_GetStats_Handler,
+		},
+		{
+			MethodName: "ListAuditEntries",
+			Handler:    _UrlShortener_ListAuditEntries_Handler,
+		},
+		{
+			MethodName: "ListCampaignURLs",
+			Handler:    _UrlShortener_ListCampaignURLs_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchRedirects",
+			Handler:       _UrlShortener_WatchRedirects_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/url.proto",
 }
@@ -1,11 +1,31 @@
 package grpc
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
+	"strings"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// MinPingInterval is the shortest interval clients can send keepalive pings at, also without active calls.
+	// Clients pinging more often are disconnected
+	MinPingInterval = 10 * time.Second
+
+	// authorizationMetadata is the metadata clients send the token in as a bearer token
+	authorizationMetadata = "authorization"
+	bearerPrefix          = "Bearer "
 )
 
 // Service is a service that can be registered in the argument provided grpc.Server
@@ -13,14 +33,55 @@ type Service interface {
 	Register(*grpc.Server)
 }
 
+// Option configures optional Server behaviour
+type Option func(*options)
+
+type options struct {
+	token string
+	tls   *tls.Config
+}
+
+// WithToken makes every call send the token as a bearer token in the authorization metadata, calls without it
+// or with another one fail with Unauthenticated
+func WithToken(token string) Option {
+	return func(o *options) {
+		o.token = token
+	}
+}
+
+// WithTLS serves the calls over TLS with the config instead of plain text, tokens must only be sent over TLS
+// so the Server needs it unless it is behind a TLS terminating proxy
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.tls = config
+	}
+}
+
 // Server is a gRPC server
 type Server struct {
 	srv *grpc.Server
 }
 
 // NewGRPCServer creates a new Server and registers all the provided Service
-func NewGRPCServer(services ...Service) Server {
-	srv := grpc.NewServer()
+func NewGRPCServer(services []Service, opts ...Option) Server {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	serverOpts := []grpc.ServerOption{grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		MinTime:             MinPingInterval,
+		PermitWithoutStream: true,
+	})}
+	if o.tls != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(o.tls)))
+	}
+	if o.token != "" {
+		serverOpts = append(serverOpts,
+			grpc.UnaryInterceptor(unaryToken(o.token)), grpc.StreamInterceptor(streamToken(o.token)))
+	}
+
+	srv := grpc.NewServer(serverOpts...)
 	for _, svc := range services {
 		svc.Register(srv)
 	}
@@ -31,7 +92,7 @@ func NewGRPCServer(services ...Service) Server {
 }
 
 // RunServer starts the Server in the provided port
-func (g Server) RunServer(port int, ) error {
+func (g Server) RunServer(port int) error {
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return fmt.Errorf("failed to listen: %s", err)
@@ -39,6 +100,11 @@ func (g Server) RunServer(port int, ) error {
 
 	log.Println("Running gRPC server on:", port)
 
+	return g.Serve(lis)
+}
+
+// Serve serves the calls accepted by the listener until the Server is shut down
+func (g Server) Serve(lis net.Listener) error {
 	return g.srv.Serve(lis)
 }
 
@@ -46,3 +112,40 @@ func (g Server) RunServer(port int, ) error {
 func (g Server) Shutdown() {
 	g.srv.GracefulStop()
 }
+
+// unaryToken rejects the unary calls without the bearer token
+func unaryToken(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := authorize(ctx, token); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// streamToken rejects the streams without the bearer token
+func streamToken(token string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := authorize(ss.Context(), token); err != nil {
+			return err
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+// authorize checks the call sent the token as a bearer token, comparing it in constant time
+func authorize(ctx context.Context, token string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(authorizationMetadata)
+	if len(values) == 0 || !strings.HasPrefix(values[0], bearerPrefix) {
+		return status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(values[0], bearerPrefix)), []byte(token)) != 1 {
+		return status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	return nil
+}
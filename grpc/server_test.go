@@ -0,0 +1,165 @@
+package grpc_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nerock/urlshort/grpc"
+	grpclib "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// healthService registers the standard health service to have something to call
+type healthService struct{}
+
+func (healthService) Register(srv *grpclib.Server) {
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+}
+
+func TestToken(t *testing.T) {
+	tests := map[string]struct {
+		token         string
+		authorization string
+
+		code codes.Code
+	}{
+		"no token":            {code: codes.OK},
+		"token not required":  {authorization: "Bearer other", code: codes.OK},
+		"valid":               {token: "secret", authorization: "Bearer secret", code: codes.OK},
+		"missing":             {token: "secret", code: codes.Unauthenticated},
+		"wrong":               {token: "secret", authorization: "Bearer other", code: codes.Unauthenticated},
+		"not bearer":          {token: "secret", authorization: "Basic secret", code: codes.Unauthenticated},
+		"prefix of the token": {token: "secret", authorization: "Bearer sec", code: codes.Unauthenticated},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var opts []grpc.Option
+			if tt.token != "" {
+				opts = append(opts, grpc.WithToken(tt.token))
+			}
+			client := startServer(t, opts...)
+
+			ctx := context.Background()
+			if tt.authorization != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "authorization", tt.authorization)
+			}
+
+			_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+			if status.Code(err) != tt.code {
+				t.Errorf("wrong code\nexpected=%s\ngot=%s", tt.code, status.Code(err))
+			}
+
+			// Streams are checked too
+			stream, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+			if err == nil {
+				_, err = stream.Recv()
+			}
+			if status.Code(err) != tt.code {
+				t.Errorf("wrong stream code\nexpected=%s\ngot=%s", tt.code, status.Code(err))
+			}
+		})
+	}
+}
+
+func TestTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+
+	srv := grpc.NewGRPCServer([]grpc.Service{healthService{}}, grpc.WithToken("secret"),
+		grpc.WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Shutdown)
+
+	tests := map[string]struct {
+		creds credentials.TransportCredentials
+
+		code codes.Code
+	}{
+		"tls":       {creds: credentials.NewTLS(&tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}), code: codes.OK},
+		"plaintext": {creds: insecure.NewCredentials(), code: codes.Unavailable},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			conn, err := grpclib.Dial(lis.Addr().String(), grpclib.WithTransportCredentials(tt.creds))
+			if err != nil {
+				t.Fatalf("could not dial: %s", err)
+			}
+			defer conn.Close()
+
+			ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+			_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+			if status.Code(err) != tt.code {
+				t.Errorf("wrong code\nexpected=%s\ngot=%s", tt.code, status.Code(err))
+			}
+		})
+	}
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1 and a pool trusting it
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse certificate: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+func startServer(t *testing.T, opts ...grpc.Option) grpc_health_v1.HealthClient {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+
+	srv := grpc.NewGRPCServer([]grpc.Service{healthService{}}, opts...)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Shutdown)
+
+	conn, err := grpclib.Dial(lis.Addr().String(), grpclib.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("could not dial: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return grpc_health_v1.NewHealthClient(conn)
+}
@@ -1,9 +1,12 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 
@@ -16,6 +19,8 @@ type Router interface {
 	Routes(*chi.Mux)
 }
 
+type shutdownKey struct{}
+
 // HTTPServer represents an HTTP Server
 type HTTPServer struct {
 	router *chi.Mux
@@ -24,19 +29,37 @@ type HTTPServer struct {
 
 // NewHTTPServer creates a new HTTPServer
 func NewHTTPServer(port int) HTTPServer {
+	shuttingDown, shutdown := context.WithCancel(context.Background())
+
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
 	r.Use(middleware.Logger)
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), shutdownKey{}, shuttingDown.Done())))
+		})
+	})
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: r,
+	}
+	srv.RegisterOnShutdown(shutdown)
 
 	return HTTPServer{
 		router: r,
-		srv: &http.Server{
-			Addr:    fmt.Sprintf(":%d", port),
-			Handler: r,
-		},
+		srv:    srv,
 	}
 }
 
+// ShuttingDown returns a channel closed once the HTTPServer handling the request starts shutting down,
+// long lived responses like event streams must end then since the server waits for them. It is nil, so it is
+// never closed, for requests not served by an HTTPServer
+func ShuttingDown(ctx context.Context) <-chan struct{} {
+	done, _ := ctx.Value(shutdownKey{}).(<-chan struct{})
+	return done
+}
+
 // Run adds all the routes provided and then runs the HTTPServer
 func (s HTTPServer) Run(routers ...Router) error {
 	for _, r := range routers {
@@ -63,7 +86,23 @@ func RenderSuccess(w http.ResponseWriter, res any, code int) {
 	}
 }
 
-// RenderError renders an error as JSON
+// RenderHTML renders an HTML template with the provided data
+func RenderHTML(w http.ResponseWriter, tmpl *template.Template, data any, code int) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		http.Error(w, "could not render page", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Println("could not write page:", err)
+	}
+}
+
+// RenderError renders an error as JSON, with the invalid fields of a *ValidationError as Fields
 func RenderError(w http.ResponseWriter, err error, code int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
@@ -71,11 +110,17 @@ func RenderError(w http.ResponseWriter, err error, code int) {
 	res := struct {
 		Code    string
 		Message string
+		Fields  []FieldError `json:",omitempty"`
 	}{
 		Code:    http.StatusText(code),
 		Message: err.Error(),
 	}
 
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		res.Fields = validationErr.Fields
+	}
+
 	if err := json.NewEncoder(w).Encode(res); err != nil {
 		http.Error(w, "could not encode response", http.StatusInternalServerError)
 	}
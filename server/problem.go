@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+const (
+	// ProblemContentType is the media type of the RFC 7807 problem details rendered by RenderProblem
+	ProblemContentType = "application/problem+json"
+
+	// serverErrorDetail is the detail of the server errors, their error is logged instead of rendered
+	serverErrorDetail = "something went wrong, try again later"
+)
+
+// Envelope is the body of the successful responses of the versioned api, Data is the resource and Meta the
+// details of the response that are not part of it, like the totals of a list
+type Envelope struct {
+	Data any `json:"data"`
+	Meta any `json:"meta,omitempty"`
+}
+
+// Problem is an RFC 7807 problem details error of the versioned api
+type Problem struct {
+	// Type is about:blank since the status code already identifies the problem
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Errors are the invalid fields of a *ValidationError
+	Errors []ProblemField `json:"errors,omitempty"`
+}
+
+// ProblemField is an invalid field of a request in a Problem
+type ProblemField struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// RenderData renders a successful JSON response with the data and meta in an Envelope
+func RenderData(w http.ResponseWriter, data, meta any, code int) {
+	RenderSuccess(w, Envelope{Data: data, Meta: meta}, code)
+}
+
+// RenderProblem renders an error as RFC 7807 problem details of the request. Server errors are logged and
+// rendered with a generic detail so their causes are not exposed
+func RenderProblem(w http.ResponseWriter, r *http.Request, err error, code int) {
+	problem := Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(code),
+		Status:   code,
+		Detail:   err.Error(),
+		Instance: r.URL.Path,
+	}
+	if code >= http.StatusInternalServerError {
+		log.Printf("%s %s: %s", r.Method, r.URL.Path, err)
+		problem.Detail = serverErrorDetail
+	}
+
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		for _, field := range validationErr.Fields {
+			problem.Errors = append(problem.Errors, ProblemField{Field: field.Field, Message: field.Message})
+		}
+	}
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(problem); err != nil {
+		http.Error(w, "could not encode response", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxBodySize is the maximum size in bytes of the request bodies decoded by default
+const DefaultMaxBodySize = 1 << 20
+
+var (
+	ErrUnsupportedMediaType = errors.New("request body must be application/json")
+	ErrEmptyBody            = errors.New("request body must not be empty")
+	ErrTrailingData         = errors.New("request body must contain a single JSON value")
+)
+
+// FieldError is a field of a request body that is not valid, nested fields are separated by dots and
+// list items are indexed like Rules[0].URL
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// ValidationError is the error of a request body with invalid fields, RenderError renders them as Fields
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		fields = append(fields, field.Field+" "+field.Message)
+	}
+
+	return "invalid request: " + strings.Join(fields, ", ")
+}
+
+// Validator is a request body checking its own fields once it is decoded
+type Validator interface {
+	// Validate returns the fields that are not valid, none when the request is valid
+	Validate() []FieldError
+}
+
+// DecodeJSON decodes the JSON body of the request into v and validates it when it is a Validator. Bodies that are
+// not application/json, larger than maxBytes, with fields v does not have or more than one value are rejected.
+// It returns the status code the error must be rendered with
+func DecodeJSON(r *http.Request, v any, maxBytes int64) (int, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return http.StatusUnsupportedMediaType, ErrUnsupportedMediaType
+	}
+
+	// One byte more than allowed is read to tell bodies at the limit from larger ones
+	body := &io.LimitedReader{R: r.Body, N: maxBytes + 1}
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+
+	err = dec.Decode(v)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = ErrTrailingData
+	}
+	if body.N <= 0 {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("request body must be at most %d bytes", maxBytes)
+	}
+	if err != nil {
+		return http.StatusBadRequest, decodeError(err)
+	}
+
+	if validator, ok := v.(Validator); ok {
+		if fields := validator.Validate(); len(fields) > 0 {
+			return http.StatusBadRequest, &ValidationError{Fields: fields}
+		}
+	}
+
+	return 0, nil
+}
+
+// decodeError describes an error decoding a JSON body, the fields of the wrong type or unknown are reported
+// as invalid fields
+func decodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return ErrEmptyBody
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("request body is not valid JSON: unexpected end")
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("request body is not valid JSON at offset %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Errorf("request body must be a JSON object, got %s", typeErr.Value)
+		}
+		return &ValidationError{Fields: []FieldError{{
+			Field:   typeErr.Field,
+			Message: fmt.Sprintf("must be a %s, got %s", jsonType(typeErr.Type), typeErr.Value),
+		}}}
+	}
+
+	// The json package has no type for unknown fields, only its message tells them apart
+	if field := strings.TrimPrefix(err.Error(), "json: unknown field "); field != err.Error() {
+		if name, unquoteErr := strconv.Unquote(field); unquoteErr == nil {
+			return &ValidationError{Fields: []FieldError{{Field: name, Message: "is not a known field"}}}
+		}
+	}
+
+	return err
+}
+
+// jsonType names the JSON type values of the Go type are decoded from
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8,
+		reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice, reflect.Array:
+		return "list"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	}
+
+	return t.Kind().String()
+}
@@ -0,0 +1,225 @@
+package url
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Actions recorded in the audit log
+const (
+	ActionCreate      = "create"
+	ActionSetRules    = "set_rules"
+	ActionSetVariants = "set_variants"
+	ActionDelete      = "delete"
+	ActionRestore     = "restore"
+	ActionPurge       = "purge"
+)
+
+// Protocols a Service call can come from
+const (
+	ProtocolHTTP   = "http"
+	ProtocolGRPC   = "grpc"
+	ProtocolSystem = "system"
+)
+
+const (
+	// DefaultAuditLimit is the number of audit entries listed when the filter does not set a limit
+	DefaultAuditLimit = 100
+	// MaxAuditLimit is the maximum number of audit entries listed at once
+	MaxAuditLimit = 1000
+)
+
+// AuditLog is the append-only storage of audit entries
+type AuditLog interface {
+	AddAuditEntry(ctx context.Context, entry AuditEntry) error
+	// ListAuditEntries lists the entries matching the filter from the oldest
+	ListAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+}
+
+// AuditEntry records a change made to a shortened url
+type AuditEntry struct {
+	ID     int64
+	Time   time.Time
+	Action string
+	// Domain is the host of the short domain of the url, empty for the default domain
+	Domain string
+	Short  string
+	// Before and After are the JSON values changed by the action, null when there is none
+	Before json.RawMessage
+	After  json.RawMessage
+	Origin
+}
+
+// AuditFilter selects audit entries, empty fields match every entry
+type AuditFilter struct {
+	// Domain is the host of the short domain of the entries, nil matches every domain. The Service replaces it
+	// with the domain stored in the entries, empty for the default domain
+	Domain *string
+	Short  string
+	Actor  string
+	// From is inclusive and To exclusive
+	From time.Time
+	To   time.Time
+	// AfterID skips the entries up to this id to page through them
+	AfterID int64
+	Limit   int
+}
+
+// Origin is who made a Service call and how, it is carried in the context and recorded in the audit log
+type Origin struct {
+	Actor     string
+	RequestID string
+	Protocol  string
+}
+
+type originKey struct{}
+
+// WithOrigin returns a copy of the context carrying the origin of the Service calls made with it
+func WithOrigin(ctx context.Context, origin Origin) context.Context {
+	return context.WithValue(ctx, originKey{}, origin)
+}
+
+// OriginFromContext returns the origin carried in the context, calls without one come from the system
+func OriginFromContext(ctx context.Context) Origin {
+	if origin, ok := ctx.Value(originKey{}).(Origin); ok {
+		return origin
+	}
+
+	return Origin{Actor: ProtocolSystem, Protocol: ProtocolSystem}
+}
+
+// auditLink is the audited value of a link, its password hash is left out
+type auditLink struct {
+	Long         string
+	Warn         bool
+	RedirectType int
+	ForwardQuery string
+	ForwardPath  bool
+	Campaign     Campaign
+	Protected    bool
+	MaxClicks    int
+	NotBefore    time.Time
+}
+
+func toAuditLink(link Link) auditLink {
+	return auditLink{
+		Long:         link.Long,
+		Warn:         link.Warn,
+		RedirectType: link.RedirectType,
+		ForwardQuery: link.ForwardQuery,
+		ForwardPath:  link.ForwardPath,
+		Campaign:     link.Campaign,
+		Protected:    link.Protected(),
+		MaxClicks:    link.MaxClicks,
+		NotBefore:    link.NotBefore,
+	}
+}
+
+// audit records an action of the context origin, the change is already made so failures are only logged
+func (s Service) audit(ctx context.Context, action, domain, short string, before, after any) {
+	if s.auditLog == nil {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:   s.now().UTC(),
+		Action: action,
+		Domain: domain,
+		Short:  short,
+		Before: auditValue(before),
+		After:  auditValue(after),
+		Origin: OriginFromContext(ctx),
+	}
+	if err := s.auditLog.AddAuditEntry(ctx, entry); err != nil {
+		log.Printf("could not record audit entry %s of %s: %s", action, short, err)
+	}
+}
+
+func auditValue(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+
+	value, err := json.Marshal(v)
+	if err != nil || string(value) == "null" {
+		return nil
+	}
+
+	return value
+}
+
+func validAuditFilter(filter AuditFilter) (AuditFilter, error) {
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return AuditFilter{}, ErrInvalidAuditFilter
+	}
+
+	if filter.AfterID < 0 || filter.Limit < 0 || filter.Limit > MaxAuditLimit {
+		return AuditFilter{}, ErrInvalidAuditFilter
+	}
+
+	if filter.Limit == 0 {
+		filter.Limit = DefaultAuditLimit
+	}
+
+	return filter, nil
+}
+
+// ListAuditEntries lists the audit entries matching the filter from the oldest
+func (s Service) ListAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	if s.auditLog == nil {
+		return nil, ErrAuditDisabled
+	}
+
+	filter, err := validAuditFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.Domain != nil {
+		domain := s.auditDomain(*filter.Domain)
+		filter.Domain = &domain
+	}
+
+	entries, err := s.auditLog.ListAuditEntries(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve audit entries from database: %w", err)
+	}
+
+	return entries, nil
+}
+
+// auditDomain returns the stored domain of the entries of a host, hosts of domains no longer configured are
+// stored as they were
+func (s Service) auditDomain(host string) string {
+	if domain, _, ok := s.lookupDomain(host, ""); ok {
+		return domain
+	}
+
+	return normalizeHost(host, "")
+}
+
+// ExportAuditEntries calls fn with every audit entry matching the filter from the oldest, ignoring its limit,
+// reading them in pages so they do not need to fit in memory
+func (s Service) ExportAuditEntries(ctx context.Context, filter AuditFilter, fn func(AuditEntry) error) error {
+	filter.Limit = MaxAuditLimit
+	for {
+		entries, err := s.ListAuditEntries(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+
+		if len(entries) < filter.Limit {
+			return nil
+		}
+		filter.AfterID = entries[len(entries)-1].ID
+	}
+}
@@ -0,0 +1,118 @@
+package url
+
+import (
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// BaseURL is the absolute url short urls are built from: a scheme, a host with an optional port
+// and a path prefix ending with a slash, e.g. https://go.example.com/s/
+type BaseURL struct {
+	scheme string
+	host   string
+	path   string
+}
+
+// ParseBaseURL parses the url where the app is deployed, http is used when it has no scheme
+func ParseBaseURL(raw string) (BaseURL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil ||
+		strings.ContainsAny(raw, "?#") {
+		return BaseURL{}, ErrInvalidBaseURL
+	}
+
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return BaseURL{}, ErrInvalidBaseURL
+		}
+	}
+
+	if host := u.Hostname(); net.ParseIP(host) == nil && !validHostname(host) {
+		return BaseURL{}, ErrInvalidBaseURL
+	}
+
+	prefix := path.Clean("/" + u.Path)
+	if prefix != "/" {
+		prefix += "/"
+	}
+
+	return BaseURL{scheme: u.Scheme, host: strings.ToLower(u.Host), path: prefix}, nil
+}
+
+// MustParseBaseURL parses the base url like ParseBaseURL, it panics when it is not valid
+func MustParseBaseURL(raw string) BaseURL {
+	b, err := ParseBaseURL(raw)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+// String returns the base url, a zero BaseURL is the root path
+func (b BaseURL) String() string {
+	if b.host == "" {
+		return b.Path()
+	}
+
+	return b.scheme + "://" + b.host + b.path
+}
+
+// Host returns the host of the base url with its port, if any
+func (b BaseURL) Host() string {
+	return b.host
+}
+
+// Path returns the path prefix of the base url, starting and ending with a slash
+func (b BaseURL) Path() string {
+	if b.path == "" {
+		return "/"
+	}
+
+	return b.path
+}
+
+// ShortURL returns the absolute short url of the short url id
+func (b BaseURL) ShortURL(short string) string {
+	return b.String() + url.PathEscape(short)
+}
+
+// short returns the short url id of an url of the base url host, it is false for any other path
+func (b BaseURL) short(u *url.URL) (string, bool) {
+	if !strings.HasPrefix(u.Path, b.Path()) {
+		return "", false
+	}
+
+	short := strings.Trim(strings.TrimPrefix(u.Path, b.Path()), "/")
+	if short == "" || strings.Contains(short, "/") {
+		return "", false
+	}
+
+	return short, true
+}
+
+func validHostname(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
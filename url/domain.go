@@ -0,0 +1,105 @@
+package url
+
+import "context"
+
+type domainKey struct{}
+
+// domainSelection is the host selecting the short domain in a context, requests made to hosts that are not
+// a short domain fall back to the default one
+type domainSelection struct {
+	host     string
+	fallback bool
+}
+
+// WithDomain returns a copy of the context selecting the short domain of the Service calls made with it by its host,
+// calls without one use the default domain and calls with a host that is not a short domain of the Service
+// fail with ErrUnknownDomain
+func WithDomain(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, domainKey{}, domainSelection{host: host})
+}
+
+// WithHost returns a copy of the context selecting the short domain by the host the request was made to, like
+// the Host header of the redirections. Hosts that are not a short domain of the Service use the default domain
+func WithHost(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, domainKey{}, domainSelection{host: host, fallback: true})
+}
+
+// DomainFromContext returns the host of the short domain selected by the context, empty when it selects none
+func DomainFromContext(ctx context.Context) string {
+	selection, _ := ctx.Value(domainKey{}).(domainSelection)
+	return selection.host
+}
+
+// WithDomains adds short domains to the Service besides the default one of its base url,
+// links are created on one of them and their ids are unique per domain
+func WithDomains(domains ...BaseURL) Option {
+	return func(s *Service) {
+		for _, domain := range domains {
+			if host := normalizeHost(domain.host, domain.scheme); host != "" && host != s.baseHost {
+				s.domains[host] = domain
+			}
+		}
+	}
+}
+
+// domain returns the short domain selected by the context, the default one when it selects none.
+// Domains selected with WithDomain that are not short domains of the Service return ErrUnknownDomain
+func (s Service) domain(ctx context.Context) (string, BaseURL, error) {
+	selection, _ := ctx.Value(domainKey{}).(domainSelection)
+	domain, base, ok := s.lookupDomain(selection.host, "")
+	if !ok && selection.host != "" && !selection.fallback {
+		return "", BaseURL{}, ErrUnknownDomain
+	}
+
+	return domain, base, nil
+}
+
+// Domain returns the short domain selected by the context as it is stored in the links, empty for the default one
+func (s Service) Domain(ctx context.Context) (string, error) {
+	domain, _, err := s.domain(ctx)
+	return domain, err
+}
+
+// lookupDomain returns the stored domain of the host of an url with the scheme and its base url, it is false when
+// the host is not a short domain of the Service. Links of the default domain are stored without domain so they
+// do not change with it
+func (s Service) lookupDomain(host, scheme string) (string, BaseURL, bool) {
+	if scheme == "" {
+		// Hosts without scheme, like the Host header, may have the default port of either scheme
+		for _, scheme := range []string{"http", "https"} {
+			if domain, base, ok := s.lookupDomain(host, scheme); ok {
+				return domain, base, true
+			}
+		}
+
+		return "", s.base, false
+	}
+
+	host = normalizeHost(host, scheme)
+	if host == "" {
+		return "", s.base, false
+	}
+
+	if host == s.baseHost {
+		return "", s.base, true
+	}
+
+	if base, ok := s.domains[host]; ok {
+		return host, base, true
+	}
+
+	return "", s.base, false
+}
+
+// baseURL returns the base url of a stored domain, links of domains no longer configured keep their host
+func (s Service) baseURL(domain string) BaseURL {
+	if domain == "" {
+		return s.base
+	}
+
+	if base, ok := s.domains[domain]; ok {
+		return base
+	}
+
+	return BaseURL{scheme: s.base.scheme, host: domain, path: s.base.path}
+}
@@ -0,0 +1,243 @@
+package feed
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nerock/urlshort/url"
+)
+
+const (
+	// DefaultBufferSize is the number of redirections kept for each subscriber until it reads them
+	DefaultBufferSize = 64
+	// DefaultReplaySize is the number of past redirections kept to resume interrupted subscriptions
+	DefaultReplaySize = 1024
+)
+
+// Redirect is a counted redirection of a shortened url
+type Redirect struct {
+	// Seq is the position of the redirection in the feed, starting at 1
+	Seq uint64
+	// Domain is the short domain of the url as stored in its link, empty for the default domain
+	Domain string
+	ID     string
+	Time   time.Time
+	// Count is the number of redirections of the url including this one
+	Count int
+	// URL is the destination of the redirection, it is empty for password protected urls
+	URL string
+	// Variant is the name of the variant the visit was split to, if any
+	Variant string
+	url.Visit
+}
+
+// Option configures optional Feed behaviour
+type Option func(*Feed)
+
+// WithReplay keeps the last size redirections so subscriptions can resume after the last one they received
+func WithReplay(size int) Option {
+	return func(f *Feed) {
+		f.replaySize = size
+	}
+}
+
+// Feed fans the redirections out to its subscribers. Publishing never blocks, a subscriber with a full buffer
+// loses its oldest redirections so slow consumers can not delay redirections
+type Feed struct {
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	size   int
+	closed bool
+
+	seq        uint64
+	replay     []Redirect
+	replaySize int
+}
+
+// New creates a Feed keeping up to bufferSize redirections for each subscriber
+func New(bufferSize int, opts ...Option) *Feed {
+	if bufferSize < 1 {
+		bufferSize = DefaultBufferSize
+	}
+
+	f := &Feed{subs: make(map[*Subscription]struct{}), size: bufferSize}
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	return f
+}
+
+// Subscribe starts receiving the redirections of the short url ids on the domain, or of all of them on every
+// domain when there are none. The subscription must be closed once it is not used
+func (f *Feed) Subscribe(domain string, ids ...string) *Subscription {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.subscribe(domain, ids)
+}
+
+// Resume subscribes like Subscribe returning the kept redirections of the ids published after the seq one.
+// It reports whether they are all of them, they are not when older redirections were already discarded
+// or the seq does not belong to this feed
+func (f *Feed) Resume(seq uint64, domain string, ids ...string) (*Subscription, []Redirect, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub := f.subscribe(domain, ids)
+	if seq > f.seq {
+		return sub, nil, false
+	}
+
+	complete := seq == f.seq || (len(f.replay) > 0 && f.replay[0].Seq <= seq+1)
+
+	var missed []Redirect
+	for _, redirect := range f.replay {
+		if redirect.Seq > seq && sub.matches(redirect.Domain, redirect.ID) {
+			missed = append(missed, redirect)
+		}
+	}
+
+	return sub, missed, complete
+}
+
+func (f *Feed) subscribe(domain string, ids []string) *Subscription {
+	sub := &Subscription{feed: f, events: make(chan Redirect, f.size)}
+	if len(ids) > 0 {
+		sub.links = make(map[link]struct{}, len(ids))
+		for _, id := range ids {
+			sub.links[link{domain: domain, id: id}] = struct{}{}
+		}
+	}
+
+	if f.closed {
+		close(sub.events)
+		return sub
+	}
+	f.subs[sub] = struct{}{}
+
+	return sub
+}
+
+// Watched checks if the redirections of the short url id on the domain are needed by a subscriber or to be
+// replayed, so redirections nobody listens to are not built
+func (f *Feed) Watched(domain, id string) bool {
+	if f.replaySize > 0 {
+		return true
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for sub := range f.subs {
+		if sub.matches(domain, id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Publish numbers the redirection and sends it to the subscribers of its domain and short url id without waiting
+// for them
+func (f *Feed) Publish(redirect Redirect) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return
+	}
+
+	f.seq++
+	redirect.Seq = f.seq
+	if f.replaySize > 0 {
+		if len(f.replay) >= f.replaySize {
+			f.replay = f.replay[1:]
+		}
+		f.replay = append(f.replay, redirect)
+	}
+
+	for sub := range f.subs {
+		if sub.matches(redirect.Domain, redirect.ID) {
+			sub.send(redirect)
+		}
+	}
+}
+
+// Close ends every subscription, closing their channels, and makes new ones end right away
+func (f *Feed) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	for sub := range f.subs {
+		delete(f.subs, sub)
+		close(sub.events)
+	}
+}
+
+// Subscription receives the redirections published to a Feed
+type Subscription struct {
+	// dropped is first so it is aligned for atomic operations on 32 bit platforms
+	dropped uint64
+
+	feed *Feed
+	// links are the short urls watched, nil watches all of them
+	links  map[link]struct{}
+	events chan Redirect
+}
+
+// link identifies a short url, ids are only unique per domain
+type link struct {
+	domain string
+	id     string
+}
+
+// Events is the channel receiving the redirections, it is closed when the subscription or the feed are closed
+func (s *Subscription) Events() <-chan Redirect {
+	return s.events
+}
+
+// Dropped is the number of redirections lost because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stops receiving redirections, it can be called more than once
+func (s *Subscription) Close() {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+
+	if _, ok := s.feed.subs[s]; ok {
+		delete(s.feed.subs, s)
+		close(s.events)
+	}
+}
+
+func (s *Subscription) matches(domain, id string) bool {
+	if s.links == nil {
+		return true
+	}
+
+	_, ok := s.links[link{domain: domain, id: id}]
+	return ok
+}
+
+// send buffers the redirection dropping the oldest one when the buffer is full,
+// the caller holds the feed lock so there is a single sender and the channel can not be closed meanwhile
+func (s *Subscription) send(redirect Redirect) {
+	for {
+		select {
+		case s.events <- redirect:
+			return
+		default:
+		}
+
+		select {
+		case <-s.events:
+			atomic.AddUint64(&s.dropped, 1)
+		default:
+		}
+	}
+}
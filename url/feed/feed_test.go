@@ -0,0 +1,194 @@
+package feed_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/nerock/urlshort/url/feed"
+)
+
+func TestPublish(t *testing.T) {
+	tests := map[string]struct {
+		domain string
+		ids    []string
+
+		received []string
+	}{
+		"all urls":     {received: []string{"/a", "/b", "/a", "acme.link/a"}},
+		"one url":      {ids: []string{"a"}, received: []string{"/a", "/a"}},
+		"several url":  {ids: []string{"b", "c"}, received: []string{"/b"}},
+		"no match":     {ids: []string{"c"}},
+		"other domain": {domain: "acme.link", ids: []string{"a", "b"}, received: []string{"acme.link/a"}},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			f := feed.New(10)
+			sub := f.Subscribe(tt.domain, tt.ids...)
+			defer sub.Close()
+
+			for _, redirect := range []feed.Redirect{{ID: "a"}, {ID: "b"}, {ID: "a"}, {Domain: "acme.link", ID: "a"}} {
+				f.Publish(redirect)
+			}
+			f.Close()
+
+			var received []string
+			for redirect := range sub.Events() {
+				received = append(received, redirect.Domain+"/"+redirect.ID)
+			}
+
+			if !equal(received, tt.received) {
+				t.Errorf("wrong redirections received\nexpected=%v\ngot=%v", tt.received, received)
+			}
+		})
+	}
+}
+
+func TestPublishSlowSubscriber(t *testing.T) {
+	f := feed.New(2)
+	slow := f.Subscribe("")
+	defer slow.Close()
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		f.Publish(feed.Redirect{ID: id})
+	}
+
+	if got := slow.Dropped(); got != 2 {
+		t.Errorf("wrong dropped count\nexpected=2\ngot=%d", got)
+	}
+
+	for _, want := range []string{"c", "d"} {
+		if got := <-slow.Events(); got.ID != want {
+			t.Errorf("wrong redirection received\nexpected=%s\ngot=%s", want, got.ID)
+		}
+	}
+}
+
+func TestPublishConcurrent(t *testing.T) {
+	f := feed.New(1)
+	sub := f.Subscribe("")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				f.Publish(feed.Redirect{ID: "a"})
+			}
+		}()
+	}
+	wg.Wait()
+	sub.Close()
+
+	received := uint64(0)
+	for range sub.Events() {
+		received++
+	}
+
+	if received+sub.Dropped() != 800 {
+		t.Errorf("wrong redirections\nexpected=800\ngot=%d received and %d dropped", received, sub.Dropped())
+	}
+}
+
+func TestResume(t *testing.T) {
+	tests := map[string]struct {
+		seq uint64
+		ids []string
+
+		missed   []uint64
+		complete bool
+	}{
+		"up to date":       {seq: 5, complete: true},
+		"kept":             {seq: 3, missed: []uint64{4, 5}, complete: true},
+		"oldest kept":      {seq: 2, missed: []uint64{3, 4, 5}, complete: true},
+		"discarded":        {seq: 1, missed: []uint64{3, 4, 5}},
+		"other feed":       {seq: 9},
+		"watched url":      {seq: 2, ids: []string{"a"}, missed: []uint64{3, 5}, complete: true},
+		"discarded others": {seq: 0, ids: []string{"b"}, missed: []uint64{4}},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			f := feed.New(feed.DefaultBufferSize, feed.WithReplay(3))
+			for _, id := range []string{"a", "b", "a", "b", "a"} {
+				f.Publish(feed.Redirect{ID: id})
+			}
+
+			sub, missed, complete := f.Resume(tt.seq, "", tt.ids...)
+			defer sub.Close()
+
+			var seqs []uint64
+			for _, redirect := range missed {
+				seqs = append(seqs, redirect.Seq)
+			}
+
+			if len(seqs) != len(tt.missed) || complete != tt.complete {
+				t.Fatalf("wrong redirections replayed\nexpected=%v complete=%t\ngot=%v complete=%t",
+					tt.missed, tt.complete, seqs, complete)
+			}
+
+			for i := range seqs {
+				if seqs[i] != tt.missed[i] {
+					t.Errorf("wrong redirections replayed\nexpected=%v\ngot=%v", tt.missed, seqs)
+				}
+			}
+
+			f.Publish(feed.Redirect{ID: "b"})
+			if !f.Watched("", "c") {
+				t.Error("url not watched with replay")
+			}
+
+			if tt.ids == nil || tt.ids[0] == "b" {
+				if redirect := <-sub.Events(); redirect.Seq != 6 {
+					t.Errorf("wrong redirection received after resuming\nexpected=6\ngot=%d", redirect.Seq)
+				}
+			}
+		})
+	}
+}
+
+func TestWatched(t *testing.T) {
+	f := feed.New(feed.DefaultBufferSize)
+	if f.Watched("", "a") {
+		t.Error("url watched without subscribers")
+	}
+
+	sub := f.Subscribe("", "a")
+	if !f.Watched("", "a") || f.Watched("", "b") || f.Watched("acme.link", "a") {
+		t.Error("wrong urls watched by the subscriber")
+	}
+
+	sub.Close()
+	sub.Close()
+	if f.Watched("", "a") {
+		t.Error("url watched after closing the subscription")
+	}
+}
+
+func TestSubscribeClosed(t *testing.T) {
+	f := feed.New(feed.DefaultBufferSize)
+	f.Close()
+
+	sub := f.Subscribe("")
+	defer sub.Close()
+	f.Publish(feed.Redirect{ID: "a"})
+
+	if _, ok := <-sub.Events(); ok {
+		t.Error("subscription to a closed feed receives redirections")
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
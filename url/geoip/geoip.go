@@ -0,0 +1,45 @@
+package geoip
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// CountryResolver resolves the country of IP addresses with an offline MaxMind DB file
+// such as GeoLite2-Country.mmdb
+type CountryResolver struct {
+	db *maxminddb.Reader
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// NewCountryResolver opens the MaxMind DB file in the provided path
+func NewCountryResolver(path string) (*CountryResolver, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open geoip database: %w", err)
+	}
+
+	return &CountryResolver{db: db}, nil
+}
+
+// Country returns the ISO 3166-1 alpha-2 country code of the IP address, empty when it is unknown
+func (c *CountryResolver) Country(ip net.IP) (string, error) {
+	var record countryRecord
+	if err := c.db.Lookup(ip, &record); err != nil {
+		return "", fmt.Errorf("lookup ip country: %w", err)
+	}
+
+	return record.Country.ISOCode, nil
+}
+
+// Close closes the MaxMind DB file
+func (c *CountryResolver) Close() error {
+	return c.db.Close()
+}
@@ -0,0 +1,166 @@
+package url
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// DefaultIdempotencyWindow is how long the urls created with an idempotency key are returned for it by default
+	DefaultIdempotencyWindow = 24 * time.Hour
+	// MaxIdempotencyKeyLength is the maximum length in bytes of idempotency keys
+	MaxIdempotencyKeyLength = 255
+	// IdempotencyLease is how long a request with an idempotency key keeps it while it is in progress, keys of
+	// requests that never finished, like the ones of a server that crashed, can be used again after it
+	IdempotencyLease = time.Minute
+)
+
+// IdempotencyStore keeps the urls created by the requests with an idempotency key
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey saves the record unless its key was saved at or after since, or after leaseSince while
+	// it is in progress, returning the saved record and whether it was saved by this call. Older records of the key
+	// are replaced
+	ReserveIdempotencyKey(ctx context.Context, record IdempotencyRecord, since, leaseSince time.Time) (IdempotencyRecord, bool, error)
+	// CompleteIdempotencyKey saves the domain and short of the record while its request still holds the key, the
+	// saved record having its request hash and creation time, it returns ErrIdempotencyConflict otherwise
+	CompleteIdempotencyKey(ctx context.Context, record IdempotencyRecord) error
+	// ReleaseIdempotencyKey removes the key of a request that failed so it can be retried
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+	// PurgeIdempotencyKeys removes the records saved before the time returning how many were removed
+	PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int, error)
+}
+
+// IdempotencyRecord is the url created by the first request with an idempotency key
+type IdempotencyRecord struct {
+	Key string
+	// RequestHash identifies the request the key was first used with
+	RequestHash string
+	// Domain and Short identify the url created, Short is empty while the request is in progress
+	Domain string
+	Short  string
+	// CreatedAt is when the key was reserved, the request reserving it completes it only while it is unchanged
+	CreatedAt time.Time
+}
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey returns a copy of the context making the CreateURL calls made with it idempotent:
+// repeated calls with the key return the url created by the first one while it is kept.
+// Keys are shared by every caller, they must be unique like random UUIDs so calls of different callers do not
+// collide. They are not scoped by the actor of the origin since it can change between retries of the same call
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// IdempotencyKeyFromContext returns the idempotency key of the context, empty when it has none
+func IdempotencyKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKey{}).(string)
+	return key
+}
+
+// WithIdempotency keeps the urls created with an idempotency key in the store for the window,
+// keys are ignored without it
+func WithIdempotency(store IdempotencyStore, window time.Duration) Option {
+	return func(s *Service) {
+		s.idempotency = store
+		s.idempotencyWindow = window
+	}
+}
+
+// PurgeIdempotencyKeys removes the idempotency keys older than the window, returning how many were removed
+func (s Service) PurgeIdempotencyKeys(ctx context.Context) (int, error) {
+	if s.idempotency == nil {
+		return 0, nil
+	}
+
+	n, err := s.idempotency.PurgeIdempotencyKeys(ctx, s.now().UTC().Add(-s.idempotencyWindow))
+	if err != nil {
+		return 0, fmt.Errorf("could not purge idempotency keys from database: %w", err)
+	}
+
+	return n, nil
+}
+
+// reserveIdempotencyKey reserves the key of the context for the request, it returns the short url of the first
+// request with the key when it is repeated. The key of the record reserved is empty when there is nothing to
+// reserve
+func (s Service) reserveIdempotencyKey(ctx context.Context, long, domain string, opts LinkOptions) (IdempotencyRecord, string, error) {
+	key := IdempotencyKeyFromContext(ctx)
+	if s.idempotency == nil || key == "" {
+		return IdempotencyRecord{}, "", nil
+	}
+
+	if len(key) > MaxIdempotencyKeyLength {
+		return IdempotencyRecord{}, "", ErrInvalidIdempotencyKey
+	}
+
+	hash, err := requestHash(key, long, domain, opts)
+	if err != nil {
+		return IdempotencyRecord{}, "", fmt.Errorf("could not hash request: %w", err)
+	}
+
+	now := s.now().UTC()
+	record, reserved, err := s.idempotency.ReserveIdempotencyKey(ctx, IdempotencyRecord{
+		Key:         key,
+		RequestHash: hash,
+		CreatedAt:   now,
+	}, now.Add(-s.idempotencyWindow), now.Add(-IdempotencyLease))
+	switch {
+	case err != nil:
+		return IdempotencyRecord{}, "", fmt.Errorf("could not reserve idempotency key in database: %w", err)
+	case reserved:
+		return record, "", nil
+	case record.RequestHash != hash:
+		return IdempotencyRecord{}, "", ErrIdempotencyConflict
+	case record.Short == "":
+		return IdempotencyRecord{}, "", ErrIdempotencyInProgress
+	}
+
+	return IdempotencyRecord{}, s.baseURL(record.Domain).ShortURL(record.Short), nil
+}
+
+// completeIdempotencyKey saves the url created for the key reserved, or releases the key when it could not be
+// created. The url is not saved when the key was taken over by another request after the lease
+func (s Service) completeIdempotencyKey(ctx context.Context, record IdempotencyRecord, link Link, created bool) {
+	if record.Key == "" {
+		return
+	}
+
+	if !created {
+		if err := s.idempotency.ReleaseIdempotencyKey(ctx, record.Key); err != nil {
+			log.Printf("could not release idempotency key %s: %s", record.Key, err)
+		}
+		return
+	}
+
+	record.Domain, record.Short = link.Domain, link.Short
+	if err := s.idempotency.CompleteIdempotencyKey(ctx, record); err != nil {
+		log.Printf("could not save idempotency key %s of %s: %s", record.Key, link.Short, err)
+	}
+}
+
+// requestHash identifies a create request by its url, domain and options, passwords included so a request with
+// another password is another request. The hash is keyed with the idempotency key so passwords can not be looked
+// up in precomputed tables of hashes
+func requestHash(key, long, domain string, opts LinkOptions) (string, error) {
+	opts.Domain = ""
+	opts.NotBefore = opts.NotBefore.UTC()
+	b, err := json.Marshal(struct {
+		URL     string
+		Domain  string
+		Options LinkOptions
+	}{long, domain, opts})
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
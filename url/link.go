@@ -0,0 +1,190 @@
+package url
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultRedirectType is the redirect status code used when a link does not set one
+const DefaultRedirectType = http.StatusTemporaryRedirect
+
+// UnlimitedClicks is the remaining clicks of links without a maximum number of clicks
+const UnlimitedClicks = -1
+
+// Forwarding modes of the query string of a visit to the long url
+const (
+	// QueryMerge adds the visit params missing from the long url
+	QueryMerge = "merge"
+	// QueryOverride adds the visit params replacing the long url ones with the same name
+	QueryOverride = "override"
+)
+
+// Link is a shortened url with its details
+type Link struct {
+	// Domain is the host of the short domain of the link, empty for the default domain
+	Domain    string
+	Short     string
+	Long      string
+	ShortURL  string
+	Count     int
+	CreatedAt time.Time
+
+	// Warn shows an interstitial page before redirecting
+	Warn bool
+	// RedirectType is the HTTP status code used to redirect: 301, 302, 307 or 308
+	RedirectType int
+	// ForwardQuery is the forwarding mode of the visit query string, empty drops it
+	ForwardQuery string
+	// ForwardPath appends the visit path after the short url id to the long url
+	ForwardPath bool
+	// Campaign are the UTM parameters merged into the long url on creation
+	Campaign Campaign
+	// Rules route visits to other targets, the long url is the fallback when none matches
+	Rules []Rule
+	// Split spreads the visits not matching any rule across weighted variants
+	Split Split
+	// PasswordHash is the bcrypt hash of the password needed to follow the link, empty when it has none
+	PasswordHash string
+	// MaxClicks is the number of redirections after which the link stops working, 0 is unlimited
+	MaxClicks int
+	// NotBefore is the time the link starts working, zero when it works since its creation
+	NotBefore time.Time
+	// Scheduled is set by the Service when the link is not active yet because of NotBefore
+	Scheduled bool
+}
+
+// Exhausted checks if the link reached its maximum number of clicks
+func (l Link) Exhausted() bool {
+	return l.MaxClicks > 0 && l.Count >= l.MaxClicks
+}
+
+// LinkOptions are the optional settings of a shortened url
+type LinkOptions struct {
+	// Domain is the host of the short domain the link is created on, empty for the one selected by the context
+	Domain       string
+	Warn         bool
+	RedirectType int
+	ForwardQuery string
+	ForwardPath  bool
+	Campaign     Campaign
+	// Password protects the link, only its hash is stored
+	Password  string
+	MaxClicks int
+	NotBefore time.Time
+}
+
+// Campaign are the UTM parameters used to track the marketing campaign a link belongs to
+type Campaign struct {
+	Source  string
+	Medium  string
+	Name    string
+	Term    string
+	Content string
+}
+
+// IsZero checks if no campaign parameter is set
+func (c Campaign) IsZero() bool {
+	return c == Campaign{}
+}
+
+// apply sets the campaign UTM parameters in the long url replacing the existing ones
+func (c Campaign) apply(long string) (string, error) {
+	u, err := url.Parse(long)
+	if err != nil {
+		return "", ErrInvalidURL
+	}
+
+	params := u.Query()
+	for name, value := range map[string]string{
+		"utm_source":   c.Source,
+		"utm_medium":   c.Medium,
+		"utm_campaign": c.Name,
+		"utm_term":     c.Term,
+		"utm_content":  c.Content,
+	} {
+		if value != "" {
+			params.Set(name, value)
+		}
+	}
+	u.RawQuery = params.Encode()
+
+	return u.String(), nil
+}
+
+func validCampaign(c Campaign) (Campaign, error) {
+	c = Campaign{
+		Source:  strings.TrimSpace(c.Source),
+		Medium:  strings.TrimSpace(c.Medium),
+		Name:    strings.TrimSpace(c.Name),
+		Term:    strings.TrimSpace(c.Term),
+		Content: strings.TrimSpace(c.Content),
+	}
+
+	if !c.IsZero() && c.Source == "" {
+		return Campaign{}, ErrInvalidCampaign
+	}
+
+	return c, nil
+}
+
+// Destination builds the url a visit is redirected to from the sub path following the short url id
+// and the query string of the visit, depending on the link forwarding settings
+func (l Link) Destination(subPath string, query url.Values) (string, error) {
+	forwardQuery := l.ForwardQuery != "" && len(query) > 0
+	forwardPath := l.ForwardPath && strings.Trim(subPath, "/") != ""
+	if !forwardQuery && !forwardPath {
+		return l.Long, nil
+	}
+
+	u, err := url.Parse(l.Long)
+	if err != nil {
+		return "", ErrInvalidURL
+	}
+
+	if forwardPath {
+		// Cleaning a rooted path keeps the sub path from escaping the long url path
+		sub := strings.TrimPrefix(path.Clean("/"+subPath), "/")
+		if strings.HasSuffix(subPath, "/") {
+			sub += "/"
+		}
+
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + sub
+		u.RawPath = ""
+	}
+
+	if forwardQuery {
+		params := u.Query()
+		for name, values := range query {
+			if _, ok := params[name]; ok && l.ForwardQuery == QueryMerge {
+				continue
+			}
+			params[name] = values
+		}
+		u.RawQuery = params.Encode()
+	}
+
+	return u.String(), nil
+}
+
+func validRedirectType(code int) (int, error) {
+	switch code {
+	case 0:
+		return DefaultRedirectType, nil
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return code, nil
+	default:
+		return 0, ErrInvalidRedirectType
+	}
+}
+
+func validQueryMode(mode string) error {
+	switch mode {
+	case "", QueryMerge, QueryOverride:
+		return nil
+	default:
+		return ErrInvalidQueryMode
+	}
+}
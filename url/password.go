@@ -0,0 +1,112 @@
+package url
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// MinPasswordLength and MaxPasswordLength are the limits in bytes of link passwords,
+	// bcrypt ignores anything after 72 bytes
+	MinPasswordLength = 4
+	MaxPasswordLength = 72
+
+	// DefaultPasswordAttempts is the number of password attempts allowed for a link in DefaultPasswordWindow
+	DefaultPasswordAttempts = 5
+	DefaultPasswordWindow   = 5 * time.Minute
+)
+
+// Protected checks if the link needs a password to be followed
+func (l Link) Protected() bool {
+	return l.PasswordHash != ""
+}
+
+// CheckPassword checks the password against the link password hash, links without password accept any password
+func (l Link) CheckPassword(password string) bool {
+	if !l.Protected() {
+		return true
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(l.PasswordHash), []byte(password)) == nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return "", ErrInvalidPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// attempts throttles the password attempts of each link to a maximum in a time window
+type attempts struct {
+	mu       sync.Mutex
+	max      int
+	window   time.Duration
+	byLink   map[string]window
+	lastTidy time.Time
+}
+
+type window struct {
+	count int
+	start time.Time
+}
+
+func newAttempts(max int, period time.Duration) *attempts {
+	return &attempts{
+		max:    max,
+		window: period,
+		byLink: make(map[string]window),
+	}
+}
+
+// try registers an attempt for the link returning false when it exceeds the maximum of the current window
+func (a *attempts) try(short string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.tidy(now)
+
+	w, ok := a.byLink[short]
+	if !ok || now.Sub(w.start) >= a.window {
+		w = window{start: now}
+	}
+
+	if w.count >= a.max {
+		return false
+	}
+
+	w.count++
+	a.byLink[short] = w
+
+	return true
+}
+
+// reset forgets the attempts of the link after a successful one
+func (a *attempts) reset(short string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.byLink, short)
+}
+
+// tidy removes the expired windows once per window so the map does not grow forever
+func (a *attempts) tidy(now time.Time) {
+	if now.Sub(a.lastTidy) < a.window {
+		return
+	}
+	a.lastTidy = now
+
+	for short, w := range a.byLink {
+		if now.Sub(w.start) >= a.window {
+			delete(a.byLink, short)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	PNG = "png"
+	SVG = "svg"
+
+	DefaultSize   = 256
+	DefaultLevel  = "M"
+	DefaultMargin = 4
+
+	MinSize   = 32
+	MaxSize   = 2048
+	MaxMargin = 16
+)
+
+var (
+	ErrInvalidOptions = errors.New("invalid QR code options")
+	ErrInvalidFormat  = fmt.Errorf("%w: format must be png or svg", ErrInvalidOptions)
+	ErrInvalidSize    = fmt.Errorf("%w: size must be between %d and %d and fit the code", ErrInvalidOptions, MinSize, MaxSize)
+	ErrInvalidLevel   = fmt.Errorf("%w: error correction level must be L, M, Q or H", ErrInvalidOptions)
+	ErrInvalidMargin  = fmt.Errorf("%w: margin must be between 0 and %d", ErrInvalidOptions, MaxMargin)
+)
+
+var levels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// Options are the settings of a generated QR code, zero Format, Size and Level use the defaults
+type Options struct {
+	Format string
+	// Size is the width and height of the image in pixels
+	Size int
+	// Level is the error correction level: L, M, Q or H
+	Level string
+	// Margin is the width of the quiet zone around the code in modules
+	Margin int
+}
+
+// Encode generates the QR code image of the content returning its bytes and content type
+func Encode(content string, opts Options) ([]byte, string, error) {
+	opts = opts.withDefaults()
+
+	level, ok := levels[opts.Level]
+	if !ok {
+		return nil, "", ErrInvalidLevel
+	}
+
+	if opts.Size < MinSize || opts.Size > MaxSize {
+		return nil, "", ErrInvalidSize
+	}
+
+	if opts.Margin < 0 || opts.Margin > MaxMargin {
+		return nil, "", ErrInvalidMargin
+	}
+
+	code, err := qrcode.New(content, level)
+	if err != nil {
+		return nil, "", fmt.Errorf("encode QR code: %w", err)
+	}
+	code.DisableBorder = true
+	bitmap := code.Bitmap()
+
+	switch opts.Format {
+	case PNG:
+		img, err := encodePNG(bitmap, opts.Size, opts.Margin)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return img, "image/png", nil
+	case SVG:
+		return encodeSVG(bitmap, opts.Size, opts.Margin), "image/svg+xml", nil
+	default:
+		return nil, "", ErrInvalidFormat
+	}
+}
+
+func (o Options) withDefaults() Options {
+	o.Format = strings.ToLower(o.Format)
+	if o.Format == "" {
+		o.Format = PNG
+	}
+
+	o.Level = strings.ToUpper(o.Level)
+	if o.Level == "" {
+		o.Level = DefaultLevel
+	}
+
+	if o.Size == 0 {
+		o.Size = DefaultSize
+	}
+
+	return o
+}
+
+func encodePNG(bitmap [][]bool, size, margin int) ([]byte, error) {
+	modules := len(bitmap) + 2*margin
+	scale := size / modules
+	if scale == 0 {
+		return nil, ErrInvalidSize
+	}
+	// Center the code spreading the pixels that do not fit a whole module around it
+	offset := (size-modules*scale)/2 + margin*scale
+
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.White, color.Black})
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+
+			for py := 0; py < scale; py++ {
+				for px := 0; px < scale; px++ {
+					img.SetColorIndex(offset+x*scale+px, offset+y*scale+py, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("encode png: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func encodeSVG(bitmap [][]bool, size, margin int) []byte {
+	modules := len(bitmap) + 2*margin
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, modules, modules)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, modules, modules)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+margin, y+margin)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+
+	return buf.Bytes()
+}
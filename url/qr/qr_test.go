@@ -0,0 +1,78 @@
+package qr_test
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"testing"
+
+	"github.com/nerock/urlshort/url/qr"
+)
+
+func TestEncode(t *testing.T) {
+	content := "https://localhost:8080/ID"
+
+	tests := map[string]struct {
+		opts qr.Options
+
+		contentType string
+		err         error
+	}{
+		"invalid format": {
+			opts: qr.Options{Format: "gif"},
+			err:  qr.ErrInvalidFormat,
+		},
+		"invalid level": {
+			opts: qr.Options{Level: "X"},
+			err:  qr.ErrInvalidLevel,
+		},
+		"size too big": {
+			opts: qr.Options{Size: qr.MaxSize + 1},
+			err:  qr.ErrInvalidSize,
+		},
+		"size does not fit the code": {
+			opts: qr.Options{Size: qr.MinSize, Margin: qr.MaxMargin},
+			err:  qr.ErrInvalidSize,
+		},
+		"invalid margin": {
+			opts: qr.Options{Margin: -1},
+			err:  qr.ErrInvalidMargin,
+		},
+		"png": {
+			opts:        qr.Options{Size: 300, Level: "q", Margin: qr.DefaultMargin},
+			contentType: "image/png",
+		},
+		"svg": {
+			opts:        qr.Options{Format: "SVG", Margin: qr.DefaultMargin},
+			contentType: "image/svg+xml",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			img, contentType, err := qr.Encode(content, tt.opts)
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if contentType != tt.contentType {
+				t.Errorf("wrong content type returned\nexpected=%s\ngot=%s", tt.contentType, contentType)
+			}
+
+			if contentType != "image/png" {
+				return
+			}
+
+			cfg, err := png.DecodeConfig(bytes.NewReader(img))
+			if err != nil {
+				t.Errorf("could not decode png: %s", err)
+				return
+			}
+
+			if cfg.Width != tt.opts.Size || cfg.Height != tt.opts.Size {
+				t.Errorf("wrong image size\nexpected=%dx%d\ngot=%dx%d", tt.opts.Size, tt.opts.Size, cfg.Width, cfg.Height)
+			}
+		})
+	}
+}
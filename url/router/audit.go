@@ -0,0 +1,210 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/nerock/urlshort/server"
+	"github.com/nerock/urlshort/url"
+)
+
+const (
+	// actorHeader is the header with the actor of the API requests recorded in the audit log,
+	// requests without it are recorded with their remote address
+	actorHeader     = "X-Actor"
+	requestIDHeader = "X-Request-Id"
+	maxActorLength  = 128
+
+	// actorMetadata and requestIDMetadata are the gRPC metadata keys of the actor and request id of the calls
+	actorMetadata     = "x-actor"
+	requestIDMetadata = "x-request-id"
+	// idempotencyKeyMetadata is the gRPC metadata key of the idempotency key of CreateURL calls, the request field
+	// takes precedence over it
+	idempotencyKeyMetadata = "idempotency-key"
+
+	ndjsonContentType = "application/x-ndjson"
+)
+
+var errInvalidAuditQuery = errors.New("invalid audit query, times must be RFC 3339 and after and limit numbers")
+
+// AuditResponse is the response with a page of audit entries, NextAfter is the After param of the next page
+type AuditResponse struct {
+	Entries   []AuditEntryResponse
+	NextAfter int64
+}
+
+// AuditEntryResponse is the response with the details of a change made to a shortened url
+type AuditEntryResponse struct {
+	ID     int64
+	Time   time.Time
+	Action string
+	// Domain is the host of the short domain of the URL, empty for the default domain
+	Domain string
+	URLID  string
+	// Before and After are the values changed by the action, null when there is none
+	Before    json.RawMessage
+	After     json.RawMessage
+	Actor     string
+	RequestID string
+	Protocol  string
+}
+
+// originHTTP adds the origin of the request to its context so the changes it makes are audited
+func originHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor := strings.TrimSpace(r.Header.Get(actorHeader))
+		if actor == "" {
+			actor = remoteHost(r.RemoteAddr)
+		}
+		if len(actor) > maxActorLength {
+			actor = actor[:maxActorLength]
+		}
+
+		requestID := middleware.GetReqID(r.Context())
+		if requestID == "" {
+			requestID = r.Header.Get(requestIDHeader)
+		}
+
+		ctx := url.WithOrigin(r.Context(), url.Origin{Actor: actor, RequestID: requestID, Protocol: url.ProtocolHTTP})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
+
+func (ur URLRouter) listAuditEntries(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	entries, err := ur.urlSvc.ListAuditEntries(r.Context(), filter)
+	switch {
+	case errors.Is(err, url.ErrInvalidAuditFilter):
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
+	case errors.Is(err, url.ErrAuditDisabled):
+		server.RenderError(w, err, http.StatusNotImplemented)
+		return
+	case err != nil:
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	res := AuditResponse{Entries: make([]AuditEntryResponse, 0, len(entries)), NextAfter: filter.AfterID}
+	for _, entry := range entries {
+		res.Entries = append(res.Entries, toAuditEntryResponse(entry))
+		res.NextAfter = entry.ID
+	}
+
+	server.RenderSuccess(w, res, http.StatusOK)
+}
+
+// exportAuditEntries streams every audit entry matching the query as newline delimited JSON
+func (ur URLRouter) exportAuditEntries(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	// The first entry is read before writing the headers so errors can still be rendered
+	started := false
+	enc := json.NewEncoder(w)
+	err = ur.urlSvc.ExportAuditEntries(r.Context(), filter, func(entry url.AuditEntry) error {
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", ndjsonContentType)
+			w.Header().Set("Content-Disposition", `attachment; filename="audit.ndjson"`)
+			w.WriteHeader(http.StatusOK)
+		}
+
+		return enc.Encode(toAuditEntryResponse(entry))
+	})
+	switch {
+	case started && err != nil:
+		log.Println("could not export audit entries:", err)
+		return
+	case errors.Is(err, url.ErrInvalidAuditFilter):
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
+	case errors.Is(err, url.ErrAuditDisabled):
+		server.RenderError(w, err, http.StatusNotImplemented)
+		return
+	case err != nil:
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return
+	case !started:
+		w.Header().Set("Content-Type", ndjsonContentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.ndjson"`)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func parseAuditFilter(query neturl.Values) (url.AuditFilter, error) {
+	filter := url.AuditFilter{
+		Short: query.Get("id"),
+		Actor: query.Get("actor"),
+	}
+	if domain := query.Get("domain"); domain != "" {
+		filter.Domain = &domain
+	}
+
+	for param, t := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := query.Get(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return url.AuditFilter{}, errInvalidAuditQuery
+			}
+			*t = parsed
+		}
+	}
+
+	if after := query.Get("after"); after != "" {
+		n, err := strconv.ParseInt(after, 10, 64)
+		if err != nil {
+			return url.AuditFilter{}, errInvalidAuditQuery
+		}
+		filter.AfterID = n
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return url.AuditFilter{}, errInvalidAuditQuery
+		}
+		filter.Limit = n
+	}
+
+	return filter, nil
+}
+
+func toAuditEntryResponse(entry url.AuditEntry) AuditEntryResponse {
+	return AuditEntryResponse{
+		ID:        entry.ID,
+		Time:      entry.Time,
+		Action:    entry.Action,
+		Domain:    entry.Domain,
+		URLID:     entry.Short,
+		Before:    entry.Before,
+		After:     entry.After,
+		Actor:     entry.Actor,
+		RequestID: entry.RequestID,
+		Protocol:  entry.Protocol,
+	}
+}
@@ -0,0 +1,72 @@
+package router
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/nerock/urlshort/server"
+)
+
+const (
+	// authorizationHeader is the header admin requests send the admin token in as a bearer token
+	authorizationHeader = "Authorization"
+	bearerPrefix        = "Bearer "
+)
+
+var (
+	errMissingToken = errors.New("missing bearer token")
+	errInvalidToken = errors.New("invalid token")
+)
+
+// WithAdminToken makes the admin routes, deleting and restoring URLs, the audit log and the webhooks, require the
+// token as a bearer token in the Authorization header. They are open when it is not set
+func WithAdminToken(token string) Option {
+	return func(ur *URLRouter) {
+		ur.adminToken = token
+	}
+}
+
+// admin rejects the requests without the admin token with 401 Unauthorized
+func (ur URLRouter) admin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := ur.authorize(w, r); err != nil {
+			server.RenderError(w, err, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminV2 rejects the requests without the admin token with 401 Unauthorized problem details
+func (ur URLRouter) adminV2(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := ur.authorize(w, r); err != nil {
+			server.RenderProblem(w, r, err, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize checks the request sent the admin token as a bearer token, comparing it in constant time, and asks
+// for it in the WWW-Authenticate header when it did not
+func (ur URLRouter) authorize(w http.ResponseWriter, r *http.Request) error {
+	if ur.adminToken == "" {
+		return nil
+	}
+
+	header := r.Header.Get(authorizationHeader)
+	if !strings.HasPrefix(header, bearerPrefix) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return errMissingToken
+	}
+
+	if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, bearerPrefix)), []byte(ur.adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return errInvalidToken
+	}
+
+	return nil
+}
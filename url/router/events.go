@@ -0,0 +1,187 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nerock/urlshort/server"
+	"github.com/nerock/urlshort/url"
+	"github.com/nerock/urlshort/url/feed"
+)
+
+const (
+	// DefaultHeartbeat is how often comments are sent to keep idle event streams open through proxies
+	DefaultHeartbeat = 15 * time.Second
+
+	countEvent         = "count"
+	clicksParam        = "clicks"
+	lastEventIDHeader  = "Last-Event-ID"
+	eventStreamContent = "text/event-stream"
+)
+
+var (
+	errEventsDisabled     = errors.New("live events are not enabled")
+	errStreamNotSupported = errors.New("streaming is not supported")
+)
+
+// CountEventResponse is the data of the count events sent by the event stream of a shortened url
+type CountEventResponse struct {
+	// Domain is the short domain of the url, empty for the default domain
+	Domain string
+	ID     string
+	Count  int
+	// Click is null unless the stream was requested with clicks=1 and the count changed because of a redirection
+	Click *ClickResponse
+}
+
+// ClickResponse is the response with the details of a redirection
+type ClickResponse struct {
+	Time time.Time
+	// URL is the destination of the redirection, it is empty for password protected URLs
+	URL      string
+	Variant  string
+	Platform string
+	Language string
+	Country  string
+}
+
+// WithEventsHeartbeat sets how often idle event streams send a comment to keep the connection open
+func WithEventsHeartbeat(heartbeat time.Duration) Option {
+	return func(ur *URLRouter) {
+		ur.heartbeat = heartbeat
+	}
+}
+
+// streamEvents sends a count event every time the shortened url is redirected as Server-Sent Events.
+// Streams start with the current count, reconnections with a Last-Event-ID get the redirections they missed
+// instead while they are still kept by the feed
+func (ur URLRouter) streamEvents(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if ur.redirects == nil {
+		server.RenderError(w, errEventsDisabled, http.StatusNotImplemented)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		server.RenderError(w, errStreamNotSupported, http.StatusInternalServerError)
+		return
+	}
+
+	// Ids are only unique per domain, the redirections are watched on the stored domain of the links
+	domain, err := ur.urlSvc.Domain(r.Context())
+	switch {
+	case errors.Is(err, url.ErrUnknownDomain):
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		sub      *feed.Subscription
+		missed   []feed.Redirect
+		complete bool
+	)
+	if seq, err := strconv.ParseUint(r.Header.Get(lastEventIDHeader), 10, 64); err == nil {
+		sub, missed, complete = ur.redirects.Resume(seq, domain, id)
+	} else {
+		sub = ur.redirects.Subscribe(domain, id)
+	}
+	defer sub.Close()
+
+	// The count is read after subscribing so no redirection is lost in between
+	count, err := ur.urlSvc.GetRedirectionCount(r.Context(), id)
+	switch {
+	case errors.Is(err, url.ErrNotFound):
+		server.RenderError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	clicks := r.URL.Query().Get(clicksParam) == "1"
+
+	w.Header().Set("Content-Type", eventStreamContent)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, redirect := range missed {
+		if err := writeCountEvent(w, redirect.Seq, toCountEvent(redirect, clicks)); err != nil {
+			return
+		}
+	}
+	if !complete {
+		if err := writeCountEvent(w, 0, CountEventResponse{Domain: domain, ID: id, Count: count}); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(ur.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-server.ShuttingDown(r.Context()):
+			return
+		case <-heartbeat.C:
+			_, err = io.WriteString(w, ": heartbeat\n\n")
+		case redirect, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			err = writeCountEvent(w, redirect.Seq, toCountEvent(redirect, clicks))
+		}
+
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeCountEvent writes a count event with the data as JSON, events without seq do not change the last event id
+func writeCountEvent(w io.Writer, seq uint64, data CountEventResponse) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if seq > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", seq); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", countEvent, b)
+	return err
+}
+
+func toCountEvent(redirect feed.Redirect, clicks bool) CountEventResponse {
+	res := CountEventResponse{Domain: redirect.Domain, ID: redirect.ID, Count: redirect.Count}
+	if clicks {
+		res.Click = &ClickResponse{
+			Time:     redirect.Time,
+			URL:      redirect.URL,
+			Variant:  redirect.Variant,
+			Platform: redirect.Platform,
+			Language: redirect.Language,
+			Country:  redirect.Country,
+		}
+	}
+
+	return res
+}
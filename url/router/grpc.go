@@ -2,20 +2,52 @@ package router
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/nerock/urlshort/grpc/proto"
+	"github.com/nerock/urlshort/url"
+	"github.com/nerock/urlshort/url/feed"
+	"github.com/nerock/urlshort/url/qr"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
+// watchingMetadata is the header sent once WatchRedirects streams start, the client package checks it
+const watchingMetadata = "x-watching"
+
+// GRPCOption configures optional URLgRPC behaviour
+type GRPCOption func(*URLgRPC)
+
+// WithGRPCRedirectFeed streams the redirections of the feed to WatchRedirects calls,
+// they are unimplemented without it
+func WithGRPCRedirectFeed(redirects *feed.Feed) GRPCOption {
+	return func(u *URLgRPC) {
+		u.redirects = redirects
+	}
+}
+
 type URLgRPC struct {
 	proto.UnimplementedUrlShortenerServer
-	svc URLService
+	svc       URLService
+	redirects *feed.Feed
 }
 
-func NewURLgRPC(svc URLService) *URLgRPC {
-	return &URLgRPC{
+func NewURLgRPC(svc URLService, opts ...GRPCOption) *URLgRPC {
+	u := &URLgRPC{
 		svc: svc,
 	}
+	for _, opt := range opts {
+		opt(u)
+	}
+
+	return u
 }
 
 func (u *URLgRPC) Register(srv *grpc.Server) {
@@ -23,9 +55,30 @@ func (u *URLgRPC) Register(srv *grpc.Server) {
 }
 
 func (u URLgRPC) CreateURL(ctx context.Context, request *proto.CreateURLRequest) (*proto.URLResponse, error) {
-	shortUrl, err := u.svc.CreateURL(ctx, request.Url)
+	ctx = originGRPC(ctx)
+	if key := idempotencyKeyGRPC(ctx, request.IdempotencyKey); key != "" {
+		ctx = url.WithIdempotencyKey(ctx, key)
+	}
+
+	shortUrl, err := u.svc.CreateURL(ctx, request.Url, url.LinkOptions{
+		Warn:         request.Warn,
+		RedirectType: int(request.RedirectType),
+		ForwardQuery: request.ForwardQuery,
+		ForwardPath:  request.ForwardPath,
+		Campaign: url.Campaign{
+			Source:  request.GetCampaign().GetSource(),
+			Medium:  request.GetCampaign().GetMedium(),
+			Name:    request.GetCampaign().GetCampaign(),
+			Term:    request.GetCampaign().GetTerm(),
+			Content: request.GetCampaign().GetContent(),
+		},
+		Password:  request.Password,
+		MaxClicks: int(request.MaxClicks),
+		NotBefore: fromUnix(request.NotBefore),
+		Domain:    request.Domain,
+	})
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
 	}
 
 	return &proto.URLResponse{
@@ -34,10 +87,18 @@ func (u URLgRPC) CreateURL(ctx context.Context, request *proto.CreateURLRequest)
 	}, nil
 }
 
+// GetURL returns the url of a password protected url only when the request has the right password
 func (u URLgRPC) GetURL(ctx context.Context, request *proto.URLRequest) (*proto.URLResponse, error) {
-	longURL, shortURL, err := u.svc.GetURL(ctx, request.Id)
+	getURL := u.svc.GetURL
+	if request.Password != "" {
+		getURL = func(ctx context.Context, id string) (string, string, error) {
+			return u.svc.UnlockURL(ctx, id, request.Password)
+		}
+	}
+
+	longURL, shortURL, err := getURL(url.WithDomain(ctx, request.Domain), request.Id)
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
 	}
 
 	return &proto.URLResponse{
@@ -47,9 +108,10 @@ func (u URLgRPC) GetURL(ctx context.Context, request *proto.URLRequest) (*proto.
 }
 
 func (u URLgRPC) DeleteURL(ctx context.Context, request *proto.URLRequest) (*proto.DeleteURLResponse, error) {
+	ctx = url.WithDomain(originGRPC(ctx), request.Domain)
 	err := u.svc.DeleteURL(ctx, request.Id)
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
 	}
 
 	return &proto.DeleteURLResponse{
@@ -57,10 +119,22 @@ func (u URLgRPC) DeleteURL(ctx context.Context, request *proto.URLRequest) (*pro
 	}, nil
 }
 
+// RestoreURL takes a deleted url out of the trash, urls that were purged are not found
+func (u URLgRPC) RestoreURL(ctx context.Context, request *proto.URLRequest) (*proto.RestoreURLResponse, error) {
+	ctx = url.WithDomain(originGRPC(ctx), request.Domain)
+	if err := u.svc.RestoreURL(ctx, request.Id); err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &proto.RestoreURLResponse{
+		Ok: true,
+	}, nil
+}
+
 func (u URLgRPC) GetRedirectionCount(ctx context.Context, request *proto.URLRequest) (*proto.RedirectionCountResponse, error) {
-	count, err := u.svc.GetRedirectionCount(ctx, request.Id)
+	count, err := u.svc.GetRedirectionCount(url.WithDomain(ctx, request.Domain), request.Id)
 	if err != nil {
-		return nil, err
+		return nil, toStatus(err)
 	}
 
 	return &proto.RedirectionCountResponse{
@@ -68,3 +142,342 @@ func (u URLgRPC) GetRedirectionCount(ctx context.Context, request *proto.URLRequ
 		Count: int32(count),
 	}, nil
 }
+
+func (u URLgRPC) GetQRCode(ctx context.Context, request *proto.QRCodeRequest) (*proto.QRCodeResponse, error) {
+	link, err := u.svc.GetLink(url.WithDomain(ctx, request.Domain), request.Id)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	margin := int(request.Margin)
+	switch {
+	case margin == 0:
+		margin = qr.DefaultMargin
+	case margin < 0:
+		margin = 0
+	}
+
+	img, contentType, err := qr.Encode(link.ShortURL, qr.Options{
+		Format: request.Format,
+		Size:   int(request.Size),
+		Level:  request.Level,
+		Margin: margin,
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &proto.QRCodeResponse{
+		Image:       img,
+		ContentType: contentType,
+		Etag:        fmt.Sprintf(`"%x"`, sha256.Sum256(img)),
+	}, nil
+}
+
+func (u URLgRPC) SetRules(ctx context.Context, request *proto.SetRulesRequest) (*proto.RulesResponse, error) {
+	ctx = url.WithDomain(originGRPC(ctx), request.Domain)
+	rules := make([]url.Rule, 0, len(request.Rules))
+	for _, rule := range request.Rules {
+		rules = append(rules, url.Rule{
+			Platform: rule.Platform,
+			Language: rule.Language,
+			Country:  rule.Country,
+			Target:   rule.Url,
+		})
+	}
+
+	if err := u.svc.SetRules(ctx, request.Id, rules); err != nil {
+		return nil, toStatus(err)
+	}
+
+	return u.GetRules(ctx, &proto.URLRequest{Id: request.Id, Domain: request.Domain})
+}
+
+func (u URLgRPC) GetRules(ctx context.Context, request *proto.URLRequest) (*proto.RulesResponse, error) {
+	rules, err := u.svc.GetRules(url.WithDomain(ctx, request.Domain), request.Id)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	res := &proto.RulesResponse{Id: request.Id}
+	for _, rule := range rules {
+		res.Rules = append(res.Rules, &proto.Rule{
+			Platform: rule.Platform,
+			Language: rule.Language,
+			Country:  rule.Country,
+			Url:      rule.Target,
+		})
+	}
+
+	return res, nil
+}
+
+func (u URLgRPC) SetVariants(ctx context.Context, request *proto.SetVariantsRequest) (*proto.VariantsResponse, error) {
+	ctx = url.WithDomain(originGRPC(ctx), request.Domain)
+	split := url.Split{Sticky: request.Sticky, Variants: make([]url.Variant, 0, len(request.Variants))}
+	for _, variant := range request.Variants {
+		split.Variants = append(split.Variants, url.Variant{
+			Name:   variant.Name,
+			Target: variant.Url,
+			Weight: int(variant.Weight),
+		})
+	}
+
+	if err := u.svc.SetSplit(ctx, request.Id, split); err != nil {
+		return nil, toStatus(err)
+	}
+
+	return u.GetVariants(ctx, &proto.URLRequest{Id: request.Id, Domain: request.Domain})
+}
+
+func (u URLgRPC) GetVariants(ctx context.Context, request *proto.URLRequest) (*proto.VariantsResponse, error) {
+	split, err := u.svc.GetSplit(url.WithDomain(ctx, request.Domain), request.Id)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &proto.VariantsResponse{
+		Id:       request.Id,
+		Sticky:   split.Sticky,
+		Variants: toProtoVariants(split.Variants),
+	}, nil
+}
+
+func (u URLgRPC) GetStats(ctx context.Context, request *proto.URLRequest) (*proto.StatsResponse, error) {
+	stats, err := u.svc.GetStats(url.WithDomain(ctx, request.Domain), request.Id)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &proto.StatsResponse{
+		Id:              request.Id,
+		Count:           int32(stats.Count),
+		Variants:        toProtoVariants(stats.Variants),
+		RemainingClicks: int32(stats.Remaining),
+		Scheduled:       stats.Scheduled,
+		NotBefore:       toUnix(stats.NotBefore),
+	}, nil
+}
+
+// ListCampaignURLs returns the shortened urls of a campaign with their total count of redirections
+func (u URLgRPC) ListCampaignURLs(ctx context.Context, request *proto.CampaignURLsRequest) (*proto.CampaignURLsResponse, error) {
+	if request.Campaign == "" {
+		return nil, status.Error(codes.InvalidArgument, "campaign is required")
+	}
+
+	links, err := u.svc.ListURLsByCampaign(ctx, request.Campaign)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	res := &proto.CampaignURLsResponse{Campaign: request.Campaign, Urls: make([]*proto.CampaignURL, 0, len(links))}
+	for _, link := range links {
+		res.Count += int32(link.Count)
+		res.Urls = append(res.Urls, &proto.CampaignURL{
+			Id:       link.Short,
+			Url:      link.Long,
+			ShortUrl: link.ShortURL,
+			Count:    int32(link.Count),
+			Campaign: &proto.Campaign{
+				Source:   link.Campaign.Source,
+				Medium:   link.Campaign.Medium,
+				Campaign: link.Campaign.Name,
+				Term:     link.Campaign.Term,
+				Content:  link.Campaign.Content,
+			},
+			NotBefore: toUnix(link.NotBefore),
+			Scheduled: link.Scheduled,
+			Domain:    link.Domain,
+		})
+	}
+
+	return res, nil
+}
+
+// fromUnix converts unix seconds to a time, 0 is the zero time
+func fromUnix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(sec, 0).UTC()
+}
+
+// toUnix converts a time to unix seconds, the zero time is 0
+func toUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+func toProtoVariants(variants []url.Variant) []*proto.Variant {
+	res := make([]*proto.Variant, 0, len(variants))
+	for _, variant := range variants {
+		res = append(res, &proto.Variant{
+			Name:   variant.Name,
+			Url:    variant.Target,
+			Weight: int32(variant.Weight),
+			Count:  int32(variant.Count),
+		})
+	}
+
+	return res
+}
+
+func (u URLgRPC) ListAuditEntries(ctx context.Context, request *proto.AuditRequest) (*proto.AuditResponse, error) {
+	filter := url.AuditFilter{
+		Short:   request.Id,
+		Actor:   request.Actor,
+		From:    fromUnix(request.From),
+		To:      fromUnix(request.To),
+		AfterID: request.AfterId,
+		Limit:   int(request.Limit),
+	}
+	if request.Domain != "" {
+		filter.Domain = &request.Domain
+	}
+	entries, err := u.svc.ListAuditEntries(ctx, filter)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	res := &proto.AuditResponse{Entries: make([]*proto.AuditEntry, 0, len(entries)), NextAfterId: request.AfterId}
+	for _, entry := range entries {
+		res.Entries = append(res.Entries, &proto.AuditEntry{
+			EntryId:   entry.ID,
+			Time:      toUnix(entry.Time),
+			Action:    entry.Action,
+			Id:        entry.Short,
+			Before:    string(entry.Before),
+			After:     string(entry.After),
+			Actor:     entry.Actor,
+			RequestId: entry.RequestID,
+			Protocol:  entry.Protocol,
+			Domain:    entry.Domain,
+		})
+		res.NextAfterId = entry.ID
+	}
+
+	return res, nil
+}
+
+// WatchRedirects streams the redirections of the requested short urls on the domain, or of all of them, as they
+// happen. Clients not reading fast enough lose the oldest ones, the events carry the number lost so far
+func (u URLgRPC) WatchRedirects(request *proto.WatchRedirectsRequest, stream proto.UrlShortener_WatchRedirectsServer) error {
+	if u.redirects == nil {
+		return status.Error(codes.Unimplemented, "redirect feed is not enabled")
+	}
+
+	// Ids are only unique per domain, they are watched on the stored domain of the links
+	domain, err := u.svc.Domain(url.WithDomain(stream.Context(), request.Domain))
+	if err != nil {
+		return toStatus(err)
+	}
+
+	sub := u.redirects.Subscribe(domain, request.Ids...)
+	defer sub.Close()
+
+	// Headers tell the client the stream started before any redirection happens
+	if err := stream.SendHeader(metadata.Pairs(watchingMetadata, "true")); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case redirect, ok := <-sub.Events():
+			if !ok {
+				return status.Error(codes.Unavailable, "redirect feed closed")
+			}
+
+			if err := stream.Send(&proto.RedirectEvent{
+				Domain:   redirect.Domain,
+				Id:       redirect.ID,
+				Time:     toUnix(redirect.Time),
+				Count:    int32(redirect.Count),
+				Url:      redirect.URL,
+				Variant:  redirect.Variant,
+				Platform: redirect.Platform,
+				Language: redirect.Language,
+				Country:  redirect.Country,
+				Dropped:  sub.Dropped(),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// originGRPC adds the origin of the call to the context so the changes it makes are audited, the actor and
+// request id are read from the x-actor and x-request-id metadata, the actor defaults to the peer address
+func originGRPC(ctx context.Context) context.Context {
+	origin := url.Origin{Protocol: url.ProtocolGRPC}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if actor := md.Get(actorMetadata); len(actor) > 0 {
+			origin.Actor = strings.TrimSpace(actor[0])
+		}
+		if requestID := md.Get(requestIDMetadata); len(requestID) > 0 {
+			origin.RequestID = requestID[0]
+		}
+	}
+
+	if origin.Actor == "" {
+		if p, ok := peer.FromContext(ctx); ok {
+			origin.Actor = remoteHost(p.Addr.String())
+		}
+	}
+	if len(origin.Actor) > maxActorLength {
+		origin.Actor = origin.Actor[:maxActorLength]
+	}
+
+	return url.WithOrigin(ctx, origin)
+}
+
+// idempotencyKeyGRPC returns the idempotency key of a call, the key of the request or the idempotency-key metadata
+func idempotencyKeyGRPC(ctx context.Context, key string) string {
+	if key != "" {
+		return key
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if key := md.Get(idempotencyKeyMetadata); len(key) > 0 {
+			return key[0]
+		}
+	}
+
+	return ""
+}
+
+// toStatus converts service errors to gRPC status errors with their matching code
+func toStatus(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, url.ErrNotFound):
+		code = codes.NotFound
+	case errors.Is(err, url.ErrPasswordRequired), errors.Is(err, url.ErrWrongPassword):
+		code = codes.PermissionDenied
+	case errors.Is(err, url.ErrTooManyAttempts):
+		code = codes.ResourceExhausted
+	case errors.Is(err, url.ErrExhausted), errors.Is(err, url.ErrNotActive):
+		code = codes.FailedPrecondition
+	case errors.Is(err, url.ErrAuditDisabled):
+		code = codes.Unimplemented
+	case errors.Is(err, url.ErrIdempotencyConflict):
+		code = codes.AlreadyExists
+	case errors.Is(err, url.ErrIdempotencyInProgress):
+		code = codes.Aborted
+	case errors.Is(err, url.ErrInvalidURL), errors.Is(err, url.ErrSelfReference), errors.Is(err, url.ErrBlockedHost),
+		errors.Is(err, url.ErrInvalidRedirectType), errors.Is(err, url.ErrInvalidQueryMode),
+		errors.Is(err, url.ErrInvalidCampaign), errors.Is(err, url.ErrInvalidPassword),
+		errors.Is(err, url.ErrInvalidMaxClicks), errors.Is(err, url.ErrInvalidRule), errors.Is(err, url.ErrTooManyRules),
+		errors.Is(err, url.ErrInvalidVariant), errors.Is(err, url.ErrTooManyVariants),
+		errors.Is(err, url.ErrInvalidAuditFilter), errors.Is(err, qr.ErrInvalidOptions),
+		errors.Is(err, url.ErrUnknownDomain), errors.Is(err, url.ErrInvalidIdempotencyKey):
+		code = codes.InvalidArgument
+	}
+
+	return status.Error(code, err.Error())
+}
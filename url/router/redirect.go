@@ -0,0 +1,393 @@
+package router
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nerock/urlshort/server"
+	"github.com/nerock/urlshort/url"
+	"github.com/nerock/urlshort/url/feed"
+)
+
+const (
+	// previewSuffix appended to a short url id shows its preview instead of redirecting
+	previewSuffix = "+"
+	previewParam  = "preview"
+	confirmParam  = "confirm"
+
+	// domainParam selects the short domain of the urls of api requests by its host
+	domainParam = "domain"
+
+	// permanentRedirectMaxAge limits how long clients cache permanent redirections,
+	// cached redirections are not counted and keep working after the link is deleted
+	permanentRedirectMaxAge = 24 * time.Hour
+
+	// variantCookie prefixes the cookie keeping the variant of a sticky split, followed by the short url id
+	variantCookie       = "urlshort_variant_"
+	variantCookieMaxAge = 30 * 24 * time.Hour
+
+	// passwordField is the form field with the password of a protected link
+	passwordField       = "password"
+	maxPasswordFormSize = 4 << 10
+)
+
+// botAgents are user agent fragments of bots, crawlers and link unfurlers
+var botAgents = []string{
+	"bot", "crawl", "spider", "slurp", "facebookexternalhit", "preview", "embedly", "whatsapp", "headless",
+}
+
+func (ur URLRouter) redirectTo(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		server.RenderError(w, errors.New("could not read id"), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	preview := strings.HasSuffix(id, previewSuffix) || query.Get(previewParam) == "1"
+	confirmed := query.Get(confirmParam) == "1"
+	id = strings.TrimSuffix(id, previewSuffix)
+	subPath := chi.URLParam(r, "*")
+	if r.URL.RawPath != "" { // chi routes with the escaped path when there is one
+		if unescaped, err := neturl.PathUnescape(subPath); err == nil {
+			subPath = unescaped
+		}
+	}
+	query.Del(previewParam)
+	query.Del(confirmParam)
+
+	link, err := ur.urlSvc.GetLink(r.Context(), id)
+	switch {
+	case errors.Is(err, url.ErrNotFound):
+		server.RenderError(w, err, http.StatusNotFound)
+		return
+	case err != nil:
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if subPath != "" && !link.ForwardPath {
+		server.RenderError(w, url.ErrNotFound, http.StatusNotFound)
+		return
+	}
+
+	if link.Scheduled {
+		ur.renderScheduled(w, link)
+		return
+	}
+
+	if link.Exhausted() {
+		server.RenderError(w, url.ErrExhausted, http.StatusGone)
+		return
+	}
+
+	if link.Protected() {
+		if !ur.unlock(w, r, id, link) {
+			return
+		}
+		// The password form already stopped the visit before leaving
+		preview, confirmed = false, true
+	} else if r.Method == http.MethodPost {
+		w.Header().Set("Allow", "GET, HEAD")
+		server.RenderError(w, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if preview || (link.Warn && !confirmed) {
+		renderPreview(w, link, ur.continueURL(id, subPath, query))
+		return
+	}
+
+	matched := false
+	if len(link.Rules) > 0 {
+		var target string
+		if target, matched = url.MatchRules(link.Rules, ur.visit(r)); matched {
+			link.Long = target
+		}
+	}
+
+	var variant url.Variant
+	if !matched && len(link.Split.Variants) > 0 {
+		var ok bool
+		if variant, ok = ur.pickVariant(w, r, id, link.Split); ok {
+			link.Long = variant.Target
+		}
+	}
+
+	destination, err := link.Destination(subPath, query)
+	if err != nil {
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if ur.shouldCount(r) {
+		count, err := ur.urlSvc.IncrementRedirectionCount(r.Context(), id)
+		switch {
+		case errors.Is(err, url.ErrExhausted):
+			server.RenderError(w, err, http.StatusGone)
+			return
+		case err != nil && link.MaxClicks > 0: // the visit can not be redirected without using a click
+			server.RenderError(w, err, http.StatusInternalServerError)
+			return
+		case err != nil:
+			log.Println(err)
+		}
+
+		if variant.Name != "" {
+			if err := ur.urlSvc.IncrementVariantCount(r.Context(), id, variant.Name); err != nil {
+				log.Println(err)
+			}
+		}
+
+		if err == nil {
+			ur.publishRedirect(r, id, count, link, destination, variant)
+		}
+	} else if link.MaxClicks > 0 {
+		// Visits that are not counted would redirect without using any of the limited clicks
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	redirectType := link.RedirectType
+	switch {
+	case r.Method == http.MethodPost: // any other code makes the browser post the password to the destination
+		redirectType = http.StatusSeeOther
+	case redirectType == 0:
+		redirectType = url.DefaultRedirectType
+	}
+
+	w.Header().Set("Cache-Control", cacheControl(redirectType, link))
+	http.Redirect(w, r, destination, redirectType)
+}
+
+// publishRedirect sends the counted redirection to the feed when someone is watching the short url
+func (ur URLRouter) publishRedirect(r *http.Request, id string, count int, link url.Link, destination string,
+	variant url.Variant) {
+	if ur.redirects == nil || !ur.redirects.Watched(link.Domain, id) {
+		return
+	}
+
+	if link.Protected() {
+		destination = ""
+	}
+
+	ur.redirects.Publish(feed.Redirect{
+		Domain:  link.Domain,
+		ID:      id,
+		Time:    time.Now().UTC(),
+		Count:   count,
+		URL:     destination,
+		Variant: variant.Name,
+		Visit:   ur.visit(r),
+	})
+}
+
+// unlock renders the password form of a protected link, it returns true once the visit posts the right password
+func (ur URLRouter) unlock(w http.ResponseWriter, r *http.Request, id string, link url.Link) bool {
+	if r.Method != http.MethodPost {
+		renderPassword(w, link, "", http.StatusOK)
+		return false
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxPasswordFormSize)
+	if err := r.ParseForm(); err != nil {
+		renderPassword(w, link, "The form could not be read", http.StatusBadRequest)
+		return false
+	}
+
+	_, _, err := ur.urlSvc.UnlockURL(r.Context(), id, r.PostForm.Get(passwordField))
+	switch {
+	case errors.Is(err, url.ErrWrongPassword):
+		renderPassword(w, link, "Wrong password", http.StatusForbidden)
+		return false
+	case errors.Is(err, url.ErrTooManyAttempts):
+		renderPassword(w, link, "Too many attempts, try again later", http.StatusTooManyRequests)
+		return false
+	case errors.Is(err, url.ErrNotFound):
+		server.RenderError(w, err, http.StatusNotFound)
+		return false
+	case err != nil:
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	return true
+}
+
+// renderScheduled renders the coming soon page of a link that is not active yet, or not found when there is none
+// so the link can not be told apart from a missing one
+func (ur URLRouter) renderScheduled(w http.ResponseWriter, link url.Link) {
+	w.Header().Set("Cache-Control", "no-store")
+	if ur.comingSoon == nil {
+		server.RenderError(w, url.ErrNotFound, http.StatusNotFound)
+		return
+	}
+
+	server.RenderHTML(w, ur.comingSoon, struct {
+		ShortURL  string
+		NotBefore time.Time
+	}{
+		ShortURL:  link.ShortURL,
+		NotBefore: link.NotBefore,
+	}, http.StatusOK)
+}
+
+func renderPassword(w http.ResponseWriter, link url.Link, message string, code int) {
+	w.Header().Set("Cache-Control", "no-store")
+	server.RenderHTML(w, passwordTemplate, struct {
+		ShortURL string
+		Error    string
+	}{
+		ShortURL: link.ShortURL,
+		Error:    message,
+	}, code)
+}
+
+// pickVariant chooses the variant of the visit, sticky splits keep the variant of returning visitors in a cookie
+func (ur URLRouter) pickVariant(w http.ResponseWriter, r *http.Request, id string, split url.Split) (url.Variant, bool) {
+	if split.Sticky {
+		if cookie, err := r.Cookie(variantCookie + id); err == nil {
+			if variant, ok := split.Variant(cookie.Value); ok {
+				return variant, true
+			}
+		}
+	}
+
+	variant, ok := split.Pick(ur.intn)
+	if ok && split.Sticky {
+		http.SetCookie(w, &http.Cookie{
+			Name:     variantCookie + id,
+			Value:    variant.Name,
+			Path:     ur.shortPath(id),
+			MaxAge:   int(variantCookieMaxAge.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	return variant, ok
+}
+
+// hostDomain selects the short domain of the redirections by the Host header of the request
+func hostDomain(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(url.WithHost(r.Context(), r.Host)))
+	})
+}
+
+// paramDomain selects the short domain of the api requests by their domain query param, the default domain
+// is used without it
+func paramDomain(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if domain := r.URL.Query().Get(domainParam); domain != "" {
+			r = r.WithContext(url.WithDomain(r.Context(), domain))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shortPath is the path of the short url under the base path
+func (ur URLRouter) shortPath(id string) string {
+	return strings.TrimSuffix(ur.basePath, "/") + "/" + id
+}
+
+// randomIntn returns a random number in [0, n) safe for concurrent use
+func randomIntn(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0
+	}
+
+	return int(i.Int64())
+}
+
+func renderPreview(w http.ResponseWriter, link url.Link, continueURL string) {
+	w.Header().Set("Cache-Control", "no-store")
+	server.RenderHTML(w, previewTemplate, struct {
+		url.Link
+		ContinueURL string
+	}{
+		Link:        link,
+		ContinueURL: continueURL,
+	}, http.StatusOK)
+}
+
+// continueURL is the url of the visit skipping the preview, keeping its sub path and query string
+func (ur URLRouter) continueURL(id, subPath string, query neturl.Values) string {
+	u := neturl.URL{Path: ur.shortPath(id)}
+	if subPath != "" {
+		u.Path += "/" + subPath
+	}
+
+	continueQuery := neturl.Values{}
+	for name, values := range query {
+		continueQuery[name] = values
+	}
+	continueQuery.Set(confirmParam, "1")
+	u.RawQuery = continueQuery.Encode()
+
+	return u.String()
+}
+
+// shouldCount checks if a redirection request counts as a visit
+func (ur URLRouter) shouldCount(r *http.Request) bool {
+	if r.Method == http.MethodHead {
+		return false
+	}
+
+	if !ur.countPrefetch && isPrefetch(r) {
+		return false
+	}
+
+	if !ur.countBots && isBot(r) {
+		return false
+	}
+
+	return true
+}
+
+func isPrefetch(r *http.Request) bool {
+	for _, header := range []string{"Purpose", "Sec-Purpose", "X-Purpose", "X-Moz"} {
+		purpose := strings.ToLower(r.Header.Get(header))
+		if strings.Contains(purpose, "prefetch") || strings.Contains(purpose, "preview") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isBot(r *http.Request) bool {
+	agent := strings.ToLower(r.UserAgent())
+	for _, bot := range botAgents {
+		if strings.Contains(agent, bot) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cacheControl returns the Cache-Control header for a redirection, temporary redirections and links
+// with limited clicks are never cached so every visit reaches the server and is counted. Redirections
+// that depend on the visitor because of routing rules or variants are not cached by shared caches
+func cacheControl(redirectType int, link url.Link) string {
+	switch {
+	case redirectType != http.StatusMovedPermanently && redirectType != http.StatusPermanentRedirect,
+		link.MaxClicks > 0:
+		return "private, no-store"
+	case len(link.Rules) > 0 || len(link.Split.Variants) > 0:
+		return "private, max-age=" + strconv.Itoa(int(permanentRedirectMaxAge.Seconds()))
+	default:
+		return "public, max-age=" + strconv.Itoa(int(permanentRedirectMaxAge.Seconds()))
+	}
+}
@@ -2,28 +2,112 @@ package router
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"html/template"
 	"log"
 	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/nerock/urlshort/server"
 	"github.com/nerock/urlshort/url"
+	"github.com/nerock/urlshort/url/feed"
+	"github.com/nerock/urlshort/url/qr"
 )
 
+// idempotencyKeyHeader is the header making create requests idempotent, repeated requests with the same key
+// return the URL created by the first one
+const idempotencyKeyHeader = "Idempotency-Key"
+
 // URLService is the interface for the url service this router will use
 type URLService interface {
-	CreateURL(context.Context, string) (string, error)
+	CreateURL(context.Context, string, url.LinkOptions) (string, error)
 	GetURL(context.Context, string) (string, string, error)
+	UnlockURL(context.Context, string, string) (string, string, error)
+	GetLink(context.Context, string) (url.Link, error)
+	ListURLsByCampaign(context.Context, string) ([]url.Link, error)
+	SetRules(context.Context, string, []url.Rule) error
+	GetRules(context.Context, string) ([]url.Rule, error)
+	SetSplit(context.Context, string, url.Split) error
+	GetSplit(context.Context, string) (url.Split, error)
+	IncrementVariantCount(context.Context, string, string) error
+	GetStats(context.Context, string) (url.Stats, error)
 	DeleteURL(context.Context, string) error
-	IncrementRedirectionCount(context.Context, string) error
+	RestoreURL(context.Context, string) error
+	ListAuditEntries(context.Context, url.AuditFilter) ([]url.AuditEntry, error)
+	ExportAuditEntries(context.Context, url.AuditFilter, func(url.AuditEntry) error) error
+	AddWebhook(context.Context, url.Webhook) (url.Webhook, error)
+	ListWebhooks(context.Context) ([]url.Webhook, error)
+	DeleteWebhook(context.Context, int64) error
+	ListDeliveries(context.Context, int64, url.DeliveryFilter) ([]url.Delivery, error)
+	ListDeliveryAttempts(context.Context, int64, int64) ([]url.DeliveryAttempt, error)
+	IncrementRedirectionCount(context.Context, string) (int, error)
 	GetRedirectionCount(context.Context, string) (int, error)
+	// Domain returns the stored domain of the links selected by the context, used to watch their redirections
+	Domain(context.Context) (string, error)
 }
 
 // URLRequest is the request to create a new URL
 type URLRequest struct {
-	URL string
+	URL          string
+	Warn         bool
+	RedirectType int
+	ForwardQuery string
+	ForwardPath  bool
+	Campaign     CampaignRequest
+	// Password protects the URL, visits must enter it before being redirected
+	Password string
+	// MaxClicks is the number of redirections after which the URL stops working, 0 is unlimited
+	MaxClicks int
+	// NotBefore is the time the URL starts working, it works right away when it is not set
+	NotBefore time.Time
+	// Domain is the host of the short domain the URL is created on, the default domain when it is not set
+	Domain string
+}
+
+// UnlockRequest is the request to get a password protected URL
+type UnlockRequest struct {
+	Password string
+}
+
+// CampaignRequest are the UTM parameters merged into the long url of a new URL
+type CampaignRequest struct {
+	Source   string
+	Medium   string
+	Campaign string
+	Term     string
+	Content  string
+}
+
+// RulesRequest is the request to replace the routing rules of a shortened url
+type RulesRequest struct {
+	Rules []RuleRequest
+}
+
+// RuleRequest is a routing rule sending the visits matching all its conditions to its URL
+type RuleRequest struct {
+	Platform string
+	Language string
+	Country  string
+	URL      string
+}
+
+// VariantsRequest is the request to replace the weighted variants a shortened url splits its visits across
+type VariantsRequest struct {
+	Sticky   bool
+	Variants []VariantRequest
+}
+
+// VariantRequest is a destination receiving a share of the visits relative to its weight
+type VariantRequest struct {
+	Name   string
+	URL    string
+	Weight int
 }
 
 // URLResponse is the response with the details of a shortened url
@@ -38,101 +122,345 @@ type URLCountResponse struct {
 	Count int
 }
 
+// VariantsResponse is the response with the weighted variants of a shortened url
+type VariantsResponse struct {
+	ID       string
+	Sticky   bool
+	Variants []VariantResponse
+}
+
+// VariantResponse is the response with the details of a variant and its count of redirections
+type VariantResponse struct {
+	Name   string
+	URL    string
+	Weight int
+	Count  int
+}
+
+// StatsResponse is the response with the count of redirections of a shortened url and each of its variants
+type StatsResponse struct {
+	ID    string
+	Count int
+	// RemainingClicks is null for URLs without a maximum number of clicks
+	RemainingClicks *int
+	Variants        []VariantResponse
+	// NotBefore is null for URLs working since their creation
+	NotBefore *time.Time
+	Scheduled bool
+}
+
+// Option configures optional URLRouter behaviour
+type Option func(*URLRouter)
+
+// WithCountBots sets whether redirections requested by bots and crawlers are counted
+func WithCountBots(count bool) Option {
+	return func(ur *URLRouter) {
+		ur.countBots = count
+	}
+}
+
+// WithCountPrefetch sets whether redirections requested by browser prefetches and link previews are counted
+func WithCountPrefetch(count bool) Option {
+	return func(ur *URLRouter) {
+		ur.countPrefetch = count
+	}
+}
+
+// RulesResponse is the response with the routing rules of a shortened url in evaluation order
+type RulesResponse struct {
+	ID    string
+	Rules []RuleRequest
+}
+
+// CampaignResponse is the response with the shortened urls of a campaign and their total count of redirections
+type CampaignResponse struct {
+	Campaign string
+	Count    int
+	URLs     []CampaignURLResponse
+}
+
+// CampaignURLResponse is the response with the details of a shortened url of a campaign
+type CampaignURLResponse struct {
+	ID       string
+	URL      string
+	ShortURL string
+	Count    int
+	Source   string
+	Medium   string
+	Term     string
+	Content  string
+	// NotBefore is null for URLs working since their creation
+	NotBefore *time.Time
+	Scheduled bool
+}
+
+// WithCountryResolver resolves the country of visits to evaluate the country routing rules
+func WithCountryResolver(countries CountryResolver) Option {
+	return func(ur *URLRouter) {
+		ur.countries = countries
+	}
+}
+
+// WithComingSoonPage renders the template instead of a not found error when visiting a URL that is not active yet,
+// the template data has the ShortURL and the NotBefore time of the URL
+func WithComingSoonPage(tmpl *template.Template) Option {
+	return func(ur *URLRouter) {
+		ur.comingSoon = tmpl
+	}
+}
+
+// WithRedirectFeed publishes the counted redirections to the feed, which also streams them to the event streams
+// of the shortened urls
+func WithRedirectFeed(redirects *feed.Feed) Option {
+	return func(ur *URLRouter) {
+		ur.redirects = redirects
+	}
+}
+
+// WithBasePath mounts the redirections under the path prefix of the base url instead of the root path,
+// the api routes are not affected
+func WithBasePath(prefix string) Option {
+	return func(ur *URLRouter) {
+		ur.basePath = "/" + strings.Trim(prefix, "/")
+	}
+}
+
+// WithMaxBodySize sets the maximum size in bytes of the JSON request bodies of the api, larger ones are rejected
+// with 413 Request Entity Too Large
+func WithMaxBodySize(size int64) Option {
+	return func(ur *URLRouter) {
+		ur.maxBodySize = size
+	}
+}
+
 // URLRouter is the router for url endpoints
 type URLRouter struct {
 	urlSvc URLService
+
+	// basePath is the path prefix redirections are mounted under, without a trailing slash
+	basePath string
+
+	countBots     bool
+	countPrefetch bool
+	countries     CountryResolver
+	comingSoon    *template.Template
+	redirects     *feed.Feed
+	heartbeat     time.Duration
+	// maxBodySize is the maximum size in bytes of the JSON request bodies
+	maxBodySize int64
+	// adminToken is the bearer token of the admin routes, they are open when it is empty
+	adminToken string
+
+	// intn returns a random number in [0, n) to pick variants
+	intn func(n int) int
 }
 
 // NewURLRouter initializes a new URLRouter
-func NewURLRouter(urlSvc URLService) URLRouter {
-	return URLRouter{urlSvc: urlSvc}
+func NewURLRouter(urlSvc URLService, opts ...Option) URLRouter {
+	ur := URLRouter{urlSvc: urlSvc, basePath: "/", intn: randomIntn, heartbeat: DefaultHeartbeat,
+		maxBodySize: server.DefaultMaxBodySize}
+	for _, opt := range opts {
+		opt(&ur)
+	}
+
+	return ur
 }
 
 // Routes adds url routes to the main router
 func (ur URLRouter) Routes(r *chi.Mux) {
-	r.Get("/{id}", ur.redirectTo)
+	redirects := func(r chi.Router) {
+		r = r.With(hostDomain)
+		r.Get("/{id}", ur.redirectTo)
+		r.Head("/{id}", ur.redirectTo)
+		r.Get("/{id}/*", ur.redirectTo)
+		r.Head("/{id}/*", ur.redirectTo)
+		r.Post("/{id}", ur.redirectTo)
+		r.Post("/{id}/*", ur.redirectTo)
+	}
+	if ur.basePath == "/" {
+		redirects(r)
+	} else {
+		r.Route(ur.basePath, redirects)
+	}
 	r.Route("/api/url", func(r chi.Router) {
+		r.Use(originHTTP, paramDomain)
 		r.Post("/", ur.createURL)
 		r.Route("/{id}", func(r chi.Router) {
 			r.Get("/", ur.getURL)
-			r.Delete("/", ur.deleteURL)
+			r.With(ur.admin).Delete("/", ur.deleteURL)
+			r.With(ur.admin).Post("/restore", ur.restoreURL)
+			r.Post("/unlock", ur.unlockURL)
 			r.Get("/count", ur.getCount)
+			r.Get("/qr", ur.getQRCode)
+			r.Get("/rules", ur.getRules)
+			r.Put("/rules", ur.setRules)
+			r.Get("/variants", ur.getVariants)
+			r.Put("/variants", ur.setVariants)
+			r.Get("/stats", ur.getStats)
+			r.Get("/events", ur.streamEvents)
 		})
 	})
+	r.Route("/api/v2", ur.routesV2)
+	r.Get("/api/campaign/{campaign}", ur.listCampaignURLs)
+	r.With(ur.admin).Get("/api/audit", ur.listAuditEntries)
+	r.With(ur.admin).Get("/api/audit/export", ur.exportAuditEntries)
+	r.Route("/api/webhooks", func(r chi.Router) {
+		r.Use(ur.admin)
+		r.Post("/", ur.addWebhook)
+		r.Get("/", ur.listWebhooks)
+		r.Delete("/{webhookID}", ur.deleteWebhook)
+		r.Get("/{webhookID}/deliveries", ur.listDeliveries)
+		r.Get("/{webhookID}/deliveries/{deliveryID}/attempts", ur.listDeliveryAttempts)
+	})
 }
 
-func (ur URLRouter) redirectTo(w http.ResponseWriter, r *http.Request) {
+func (ur URLRouter) createURL(w http.ResponseWriter, r *http.Request) {
+	var req URLRequest
+	if code, err := server.DecodeJSON(r, &req, ur.maxBodySize); err != nil {
+		server.RenderError(w, err, code)
+		return
+	}
+
+	ctx := r.Context()
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		ctx = url.WithIdempotencyKey(ctx, key)
+	}
+
+	shortURL, err := ur.urlSvc.CreateURL(ctx, req.URL, url.LinkOptions{
+		Warn:         req.Warn,
+		RedirectType: req.RedirectType,
+		ForwardQuery: req.ForwardQuery,
+		ForwardPath:  req.ForwardPath,
+		Campaign: url.Campaign{
+			Source:  req.Campaign.Source,
+			Medium:  req.Campaign.Medium,
+			Name:    req.Campaign.Campaign,
+			Term:    req.Campaign.Term,
+			Content: req.Campaign.Content,
+		},
+		Password:  req.Password,
+		MaxClicks: req.MaxClicks,
+		NotBefore: req.NotBefore,
+		Domain:    req.Domain,
+	})
+	switch {
+	case errors.Is(err, url.ErrInvalidURL), errors.Is(err, url.ErrSelfReference), errors.Is(err, url.ErrBlockedHost),
+		errors.Is(err, url.ErrInvalidRedirectType), errors.Is(err, url.ErrInvalidQueryMode),
+		errors.Is(err, url.ErrInvalidCampaign), errors.Is(err, url.ErrInvalidPassword),
+		errors.Is(err, url.ErrInvalidMaxClicks), errors.Is(err, url.ErrUnknownDomain),
+		errors.Is(err, url.ErrInvalidIdempotencyKey):
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
+	case errors.Is(err, url.ErrIdempotencyConflict), errors.Is(err, url.ErrIdempotencyInProgress):
+		server.RenderError(w, err, http.StatusConflict)
+		return
+	case err != nil:
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	server.RenderSuccess(w, URLResponse{req.URL, shortURL}, http.StatusCreated)
+}
+
+func (ur URLRouter) getURL(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	if id == "" {
 		server.RenderError(w, errors.New("could not read id"), http.StatusBadRequest)
+		return
 	}
 
-	longURL, _, err := ur.urlSvc.GetURL(r.Context(), id)
+	longURL, shortURL, err := ur.urlSvc.GetURL(r.Context(), id)
 	switch {
-	case errors.Is(err, url.ErrNotFound):
+	case errors.Is(err, url.ErrNotFound), errors.Is(err, url.ErrNotActive):
 		server.RenderError(w, err, http.StatusNotFound)
 		return
+	case errors.Is(err, url.ErrUnknownDomain):
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
+	case errors.Is(err, url.ErrPasswordRequired):
+		server.RenderError(w, err, http.StatusForbidden)
+		return
 	case err != nil:
 		server.RenderError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	if err := ur.urlSvc.IncrementRedirectionCount(r.Context(), id); err != nil {
-		log.Println(err)
-	}
-
-	http.Redirect(w, r, longURL, http.StatusTemporaryRedirect)
+	server.RenderSuccess(w, URLResponse{longURL, shortURL}, http.StatusOK)
 }
 
-func (ur URLRouter) createURL(w http.ResponseWriter, r *http.Request) {
-	var req URLRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		server.RenderError(w, err, http.StatusBadRequest)
+func (ur URLRouter) unlockURL(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		server.RenderError(w, errors.New("could not read id"), http.StatusBadRequest)
+		return
 	}
 
-	shortURL, err := ur.urlSvc.CreateURL(r.Context(), req.URL)
+	var req UnlockRequest
+	if code, err := server.DecodeJSON(r, &req, ur.maxBodySize); err != nil {
+		server.RenderError(w, err, code)
+		return
+	}
+
+	longURL, shortURL, err := ur.urlSvc.UnlockURL(r.Context(), id, req.Password)
 	switch {
-	case errors.Is(err, url.ErrInvalidURL):
+	case errors.Is(err, url.ErrNotFound), errors.Is(err, url.ErrNotActive):
+		server.RenderError(w, err, http.StatusNotFound)
+		return
+	case errors.Is(err, url.ErrUnknownDomain):
 		server.RenderError(w, err, http.StatusBadRequest)
 		return
+	case errors.Is(err, url.ErrWrongPassword):
+		server.RenderError(w, err, http.StatusForbidden)
+		return
+	case errors.Is(err, url.ErrTooManyAttempts):
+		server.RenderError(w, err, http.StatusTooManyRequests)
+		return
 	case err != nil:
 		server.RenderError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	server.RenderSuccess(w, URLResponse{req.URL, shortURL}, http.StatusCreated)
+	server.RenderSuccess(w, URLResponse{longURL, shortURL}, http.StatusOK)
 }
 
-func (ur URLRouter) getURL(w http.ResponseWriter, r *http.Request) {
+func (ur URLRouter) deleteURL(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	if id == "" {
 		server.RenderError(w, errors.New("could not read id"), http.StatusBadRequest)
+		return
 	}
 
-	longURL, shortURL, err := ur.urlSvc.GetURL(r.Context(), id)
+	err := ur.urlSvc.DeleteURL(r.Context(), id)
 	switch {
 	case errors.Is(err, url.ErrNotFound):
 		server.RenderError(w, err, http.StatusNotFound)
 		return
+	case errors.Is(err, url.ErrUnknownDomain):
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
 	case err != nil:
 		server.RenderError(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	server.RenderSuccess(w, URLResponse{longURL, shortURL}, http.StatusOK)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (ur URLRouter) deleteURL(w http.ResponseWriter, r *http.Request) {
+func (ur URLRouter) restoreURL(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	if id == "" {
 		server.RenderError(w, errors.New("could not read id"), http.StatusBadRequest)
+		return
 	}
 
-	err := ur.urlSvc.DeleteURL(r.Context(), id)
+	err := ur.urlSvc.RestoreURL(r.Context(), id)
 	switch {
 	case errors.Is(err, url.ErrNotFound):
 		server.RenderError(w, err, http.StatusNotFound)
 		return
+	case errors.Is(err, url.ErrUnknownDomain):
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
 	case err != nil:
 		server.RenderError(w, err, http.StatusInternalServerError)
 		return
@@ -145,6 +473,7 @@ func (ur URLRouter) getCount(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	if id == "" {
 		server.RenderError(w, errors.New("could not read id"), http.StatusBadRequest)
+		return
 	}
 
 	count, err := ur.urlSvc.GetRedirectionCount(r.Context(), id)
@@ -152,6 +481,9 @@ func (ur URLRouter) getCount(w http.ResponseWriter, r *http.Request) {
 	case errors.Is(err, url.ErrNotFound):
 		server.RenderError(w, err, http.StatusNotFound)
 		return
+	case errors.Is(err, url.ErrUnknownDomain):
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
 	case err != nil:
 		server.RenderError(w, err, http.StatusInternalServerError)
 		return
@@ -159,3 +491,327 @@ func (ur URLRouter) getCount(w http.ResponseWriter, r *http.Request) {
 
 	server.RenderSuccess(w, URLCountResponse{id, count}, http.StatusOK)
 }
+
+func (ur URLRouter) getRules(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		server.RenderError(w, errors.New("could not read id"), http.StatusBadRequest)
+		return
+	}
+
+	rules, err := ur.urlSvc.GetRules(r.Context(), id)
+	switch {
+	case errors.Is(err, url.ErrNotFound):
+		server.RenderError(w, err, http.StatusNotFound)
+		return
+	case errors.Is(err, url.ErrUnknownDomain):
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	server.RenderSuccess(w, RulesResponse{id, toRuleResponses(rules)}, http.StatusOK)
+}
+
+func (ur URLRouter) setRules(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		server.RenderError(w, errors.New("could not read id"), http.StatusBadRequest)
+		return
+	}
+
+	var req RulesRequest
+	if code, err := server.DecodeJSON(r, &req, ur.maxBodySize); err != nil {
+		server.RenderError(w, err, code)
+		return
+	}
+
+	rules := make([]url.Rule, 0, len(req.Rules))
+	for _, rule := range req.Rules {
+		rules = append(rules, url.Rule{
+			Platform: rule.Platform,
+			Language: rule.Language,
+			Country:  rule.Country,
+			Target:   rule.URL,
+		})
+	}
+
+	err := ur.urlSvc.SetRules(r.Context(), id, rules)
+	switch {
+	case errors.Is(err, url.ErrNotFound):
+		server.RenderError(w, err, http.StatusNotFound)
+		return
+	case errors.Is(err, url.ErrInvalidRule), errors.Is(err, url.ErrTooManyRules), errors.Is(err, url.ErrInvalidURL),
+		errors.Is(err, url.ErrSelfReference), errors.Is(err, url.ErrBlockedHost),
+		errors.Is(err, url.ErrUnknownDomain):
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	ur.getRules(w, r)
+}
+
+func toRuleResponses(rules []url.Rule) []RuleRequest {
+	res := make([]RuleRequest, 0, len(rules))
+	for _, rule := range rules {
+		res = append(res, RuleRequest{
+			Platform: rule.Platform,
+			Language: rule.Language,
+			Country:  rule.Country,
+			URL:      rule.Target,
+		})
+	}
+
+	return res
+}
+
+func (ur URLRouter) getVariants(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		server.RenderError(w, errors.New("could not read id"), http.StatusBadRequest)
+		return
+	}
+
+	split, err := ur.urlSvc.GetSplit(r.Context(), id)
+	switch {
+	case errors.Is(err, url.ErrNotFound):
+		server.RenderError(w, err, http.StatusNotFound)
+		return
+	case errors.Is(err, url.ErrUnknownDomain):
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	server.RenderSuccess(w, VariantsResponse{id, split.Sticky, toVariantResponses(split.Variants)}, http.StatusOK)
+}
+
+func (ur URLRouter) setVariants(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		server.RenderError(w, errors.New("could not read id"), http.StatusBadRequest)
+		return
+	}
+
+	var req VariantsRequest
+	if code, err := server.DecodeJSON(r, &req, ur.maxBodySize); err != nil {
+		server.RenderError(w, err, code)
+		return
+	}
+
+	split := url.Split{Sticky: req.Sticky, Variants: make([]url.Variant, 0, len(req.Variants))}
+	for _, variant := range req.Variants {
+		split.Variants = append(split.Variants, url.Variant{
+			Name:   variant.Name,
+			Target: variant.URL,
+			Weight: variant.Weight,
+		})
+	}
+
+	err := ur.urlSvc.SetSplit(r.Context(), id, split)
+	switch {
+	case errors.Is(err, url.ErrNotFound):
+		server.RenderError(w, err, http.StatusNotFound)
+		return
+	case errors.Is(err, url.ErrInvalidVariant), errors.Is(err, url.ErrTooManyVariants), errors.Is(err, url.ErrInvalidURL),
+		errors.Is(err, url.ErrSelfReference), errors.Is(err, url.ErrBlockedHost),
+		errors.Is(err, url.ErrUnknownDomain):
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	ur.getVariants(w, r)
+}
+
+func (ur URLRouter) getStats(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		server.RenderError(w, errors.New("could not read id"), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := ur.urlSvc.GetStats(r.Context(), id)
+	switch {
+	case errors.Is(err, url.ErrNotFound):
+		server.RenderError(w, err, http.StatusNotFound)
+		return
+	case errors.Is(err, url.ErrUnknownDomain):
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	res := StatsResponse{
+		ID:        id,
+		Count:     stats.Count,
+		Variants:  toVariantResponses(stats.Variants),
+		NotBefore: optionalTime(stats.NotBefore),
+		Scheduled: stats.Scheduled,
+	}
+	if stats.Remaining != url.UnlimitedClicks {
+		res.RemainingClicks = &stats.Remaining
+	}
+
+	server.RenderSuccess(w, res, http.StatusOK)
+}
+
+func toVariantResponses(variants []url.Variant) []VariantResponse {
+	res := make([]VariantResponse, 0, len(variants))
+	for _, variant := range variants {
+		res = append(res, VariantResponse{
+			Name:   variant.Name,
+			URL:    variant.Target,
+			Weight: variant.Weight,
+			Count:  variant.Count,
+		})
+	}
+
+	return res
+}
+
+// optionalTime returns nil for the zero time so it is rendered as null
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+func (ur URLRouter) listCampaignURLs(w http.ResponseWriter, r *http.Request) {
+	campaign := chi.URLParam(r, "campaign")
+	if campaign == "" {
+		server.RenderError(w, errors.New("could not read campaign"), http.StatusBadRequest)
+		return
+	}
+
+	links, err := ur.urlSvc.ListURLsByCampaign(r.Context(), campaign)
+	if err != nil {
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	res := CampaignResponse{
+		Campaign: campaign,
+		URLs:     make([]CampaignURLResponse, 0, len(links)),
+	}
+	for _, link := range links {
+		res.Count += link.Count
+		res.URLs = append(res.URLs, CampaignURLResponse{
+			ID:       link.Short,
+			URL:      link.Long,
+			ShortURL: link.ShortURL,
+			Count:    link.Count,
+			Source:   link.Campaign.Source,
+			Medium:   link.Campaign.Medium,
+			Term:     link.Campaign.Term,
+			Content:  link.Campaign.Content,
+
+			NotBefore: optionalTime(link.NotBefore),
+			Scheduled: link.Scheduled,
+		})
+	}
+
+	server.RenderSuccess(w, res, http.StatusOK)
+}
+
+func (ur URLRouter) getQRCode(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		server.RenderError(w, errors.New("could not read id"), http.StatusBadRequest)
+		return
+	}
+
+	opts, err := parseQROptions(r.URL.Query())
+	if err != nil {
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	link, err := ur.urlSvc.GetLink(r.Context(), id)
+	switch {
+	case errors.Is(err, url.ErrNotFound):
+		server.RenderError(w, err, http.StatusNotFound)
+		return
+	case errors.Is(err, url.ErrUnknownDomain):
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	img, contentType, err := qr.Encode(link.ShortURL, opts)
+	switch {
+	case errors.Is(err, qr.ErrInvalidOptions):
+		server.RenderError(w, err, http.StatusBadRequest)
+		return
+	case err != nil:
+		server.RenderError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(img))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(img); err != nil {
+		log.Println("could not write QR code:", err)
+	}
+}
+
+func parseQROptions(query neturl.Values) (qr.Options, error) {
+	opts := qr.Options{
+		Format: query.Get("format"),
+		Level:  query.Get("level"),
+		Margin: qr.DefaultMargin,
+	}
+
+	if size := query.Get("size"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return qr.Options{}, qr.ErrInvalidSize
+		}
+		opts.Size = n
+	}
+
+	if margin := query.Get("margin"); margin != "" {
+		n, err := strconv.Atoi(margin)
+		if err != nil {
+			return qr.Options{}, qr.ErrInvalidMargin
+		}
+		opts.Margin = n
+	}
+
+	return opts, nil
+}
+
+// etagMatches checks the If-None-Match header against the etag of the current response
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,30 +1,92 @@
 package router_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"database/sql"
 	"errors"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	neturl "net/url"
 	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/nerock/urlshort/url"
+	"github.com/nerock/urlshort/url/feed"
+	"github.com/nerock/urlshort/url/qr"
 	"github.com/nerock/urlshort/url/router"
+	"github.com/nerock/urlshort/url/store"
 )
 
 var errSvc = errors.New("service error")
 
+// noRedirectClient returns redirection responses instead of following them
+var noRedirectClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
 type testService struct {
-	id    string
-	url   string
-	count int
-	err   error
+	id           string
+	url          string
+	count        int
+	warn         bool
+	redirectType int
+	forwardQuery string
+	forwardPath  bool
+	links        []url.Link
+	rules        []url.Rule
+	split        url.Split
+	// variantCounts are the redirections counted to each variant
+	variantCounts map[string]int
+	// password protects the link when set, unlockErr is returned by UnlockURL instead of checking it
+	password  string
+	unlockErr error
+	maxClicks int
+	// notBefore is the activation time of the link, scheduled tells whether it is still in the future
+	notBefore time.Time
+	scheduled bool
+	// createdAt is the creation time of the link, getLinkErr is returned by GetLink instead of err
+	createdAt  time.Time
+	getLinkErr error
+	// audit are the audit entries listed and exported, auditFilter the filter of the last listed, origin is the
+	// origin of the last change
+	audit       []url.AuditEntry
+	auditFilter url.AuditFilter
+	origin      url.Origin
+	// domain is the short domain of the last url created or redirection counted, linkDomain the stored one of the link
+	domain     string
+	linkDomain string
+	// idempotencyKey is the idempotency key of the last url created, created counts the urls created
+	idempotencyKey string
+	created        int
+	// webhooks, deliveries and attempts are the webhooks and their history listed
+	webhooks   []url.Webhook
+	deliveries []url.Delivery
+	attempts   []url.DeliveryAttempt
+	err        error
 }
 
-func (t testService) CreateURL(ctx context.Context, s string) (string, error) {
+func (t *testService) CreateURL(ctx context.Context, s string, opts url.LinkOptions) (string, error) {
+	t.origin = url.OriginFromContext(ctx)
+	t.idempotencyKey = url.IdempotencyKeyFromContext(ctx)
+	t.created++
+	t.domain = opts.Domain
+	if t.domain == "" {
+		t.domain = url.DomainFromContext(ctx)
+	}
+
 	return t.id, t.err
 }
 
@@ -32,33 +94,2453 @@ func (t testService) GetURL(ctx context.Context, s string) (string, string, erro
 	return t.url, t.id, t.err
 }
 
+func (t testService) UnlockURL(ctx context.Context, s, password string) (string, string, error) {
+	switch {
+	case t.err != nil:
+		return "", "", t.err
+	case t.unlockErr != nil:
+		return "", "", t.unlockErr
+	case password != t.password:
+		return "", "", url.ErrWrongPassword
+	}
+
+	return t.url, t.id, nil
+}
+
+func (t testService) GetLink(ctx context.Context, s string) (url.Link, error) {
+	err := t.err
+	if t.getLinkErr != nil {
+		err = t.getLinkErr
+	}
+
+	var passwordHash string
+	if t.password != "" {
+		passwordHash = "hash"
+	}
+
+	return url.Link{
+		Domain:       t.linkDomain,
+		Short:        s,
+		Long:         t.url,
+		ShortURL:     t.id,
+		Count:        t.count,
+		Warn:         t.warn,
+		RedirectType: t.redirectType,
+		ForwardQuery: t.forwardQuery,
+		ForwardPath:  t.forwardPath,
+		Rules:        t.rules,
+		Split:        t.split,
+		PasswordHash: passwordHash,
+		MaxClicks:    t.maxClicks,
+		NotBefore:    t.notBefore,
+		Scheduled:    t.scheduled,
+		CreatedAt:    t.createdAt,
+	}, err
+}
+
+func (t testService) ListURLsByCampaign(ctx context.Context, s string) ([]url.Link, error) {
+	return t.links, t.err
+}
+
+func (t *testService) SetRules(ctx context.Context, s string, rules []url.Rule) error {
+	if t.err == nil {
+		t.rules = rules
+	}
+
+	return t.err
+}
+
+func (t testService) GetRules(ctx context.Context, s string) ([]url.Rule, error) {
+	return t.rules, t.err
+}
+
+func (t *testService) SetSplit(ctx context.Context, s string, split url.Split) error {
+	if t.err == nil {
+		t.split = split
+	}
+
+	return t.err
+}
+
+func (t testService) GetSplit(ctx context.Context, s string) (url.Split, error) {
+	return t.split, t.err
+}
+
+func (t *testService) IncrementVariantCount(ctx context.Context, s, variant string) error {
+	if t.variantCounts == nil {
+		t.variantCounts = make(map[string]int)
+	}
+	t.variantCounts[variant]++
+
+	return t.err
+}
+
+func (t testService) GetStats(ctx context.Context, s string) (url.Stats, error) {
+	remaining := url.UnlimitedClicks
+	if t.maxClicks > 0 {
+		remaining = t.maxClicks - t.count
+	}
+
+	return url.Stats{
+		Count:     t.count,
+		Remaining: remaining,
+		Variants:  t.split.Variants,
+		NotBefore: t.notBefore,
+		Scheduled: t.scheduled,
+	}, t.err
+}
+
+type testCountries string
+
+func (t testCountries) Country(net.IP) (string, error) {
+	return string(t), nil
+}
+
+func (t testService) Domain(ctx context.Context) (string, error) {
+	return url.DomainFromContext(ctx), nil
+}
+
 func (t testService) DeleteURL(ctx context.Context, s string) error {
 	return t.err
 }
 
-func (t *testService) IncrementRedirectionCount(ctx context.Context, s string) error {
-	t.count++
-	return t.err
-}
+func (t testService) RestoreURL(ctx context.Context, s string) error {
+	return t.err
+}
+
+func (t *testService) ListAuditEntries(ctx context.Context, filter url.AuditFilter) ([]url.AuditEntry, error) {
+	t.auditFilter = filter
+	return t.audit, t.err
+}
+
+func (t testService) ExportAuditEntries(ctx context.Context, filter url.AuditFilter, fn func(url.AuditEntry) error) error {
+	if t.err != nil {
+		return t.err
+	}
+
+	for _, entry := range t.audit {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t testService) AddWebhook(ctx context.Context, webhook url.Webhook) (url.Webhook, error) {
+	if t.err != nil {
+		return url.Webhook{}, t.err
+	}
+
+	webhook.ID = 1
+	webhook.CreatedAt = time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	if webhook.Secret == "" {
+		webhook.Secret = "generated"
+	}
+
+	return webhook, nil
+}
+
+func (t testService) ListWebhooks(ctx context.Context) ([]url.Webhook, error) {
+	return t.webhooks, t.err
+}
+
+func (t testService) DeleteWebhook(ctx context.Context, id int64) error {
+	return t.err
+}
+
+func (t testService) ListDeliveries(ctx context.Context, webhookID int64, filter url.DeliveryFilter) ([]url.Delivery, error) {
+	return t.deliveries, t.err
+}
+
+func (t testService) ListDeliveryAttempts(ctx context.Context, webhookID, deliveryID int64) ([]url.DeliveryAttempt, error) {
+	return t.attempts, t.err
+}
+
+func (t *testService) IncrementRedirectionCount(ctx context.Context, s string) (int, error) {
+	t.domain = url.DomainFromContext(ctx)
+	if t.maxClicks > 0 && t.count >= t.maxClicks {
+		return 0, url.ErrExhausted
+	}
+
+	t.count++
+	return t.count, t.err
+}
+
+func (t testService) GetRedirectionCount(ctx context.Context, s string) (int, error) {
+	return t.count, t.err
+}
+
+func TestRedirect(t *testing.T) {
+	tests := map[string]struct {
+		testSvc testService
+
+		wantStatus       int
+		wantCacheControl string
+		wantBody         []byte
+	}{
+		"id not found": {
+			testSvc: testService{
+				err: url.ErrNotFound,
+			},
+			wantStatus: http.StatusNotFound,
+			wantBody:   []byte(`{"Code":"Not Found","Message":"` + url.ErrNotFound.Error() + `"}`),
+		},
+		"svc error": {
+			testSvc: testService{
+				err: errSvc,
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   []byte(`{"Code":"Internal Server Error","Message":"` + errSvc.Error() + `"}`),
+		},
+		"success": {
+			testSvc: testService{
+				count: 10,
+				url:   "https://www.google.es",
+			},
+			wantStatus:       http.StatusTemporaryRedirect,
+			wantCacheControl: "private, no-store",
+		},
+		"success found": {
+			testSvc: testService{
+				url:          "https://www.google.es",
+				redirectType: http.StatusFound,
+			},
+			wantStatus:       http.StatusFound,
+			wantCacheControl: "private, no-store",
+		},
+		"success moved permanently": {
+			testSvc: testService{
+				url:          "https://www.google.es",
+				redirectType: http.StatusMovedPermanently,
+			},
+			wantStatus:       http.StatusMovedPermanently,
+			wantCacheControl: "public, max-age=86400",
+		},
+		"success permanent redirect": {
+			testSvc: testService{
+				url:          "https://www.google.es",
+				redirectType: http.StatusPermanentRedirect,
+			},
+			wantStatus:       http.StatusPermanentRedirect,
+			wantCacheControl: "public, max-age=86400",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			initialCount := tt.testSvc.count
+
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+			res, err := noRedirectClient.Get(srv.URL + path.Join("/ID"))
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+
+			if tt.wantBody != nil {
+				if initialCount != tt.testSvc.count {
+					t.Errorf("redirection count should not change\nexpected=%d\ngot=%d", initialCount, tt.testSvc.count)
+				}
+
+				checkResponse(t, res, tt.wantStatus, tt.wantBody)
+				return
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("wrong status code returned\nexpected=%d\ngot=%d", tt.wantStatus, res.StatusCode)
+			}
+
+			if res.Header.Get("Location") != tt.testSvc.url {
+				t.Errorf("wrong redirection location\nexpected=%s\ngot=%s", tt.testSvc.url, res.Header.Get("Location"))
+			}
+
+			if res.Header.Get("Cache-Control") != tt.wantCacheControl {
+				t.Errorf("wrong cache control\nexpected=%s\ngot=%s", tt.wantCacheControl, res.Header.Get("Cache-Control"))
+			}
+
+			if initialCount+1 != tt.testSvc.count {
+				t.Errorf("redirection count should have incremented by one\nexpected=%d\ngot=%d", initialCount+1, tt.testSvc.count)
+			}
+		})
+	}
+}
+
+func TestRedirectCounting(t *testing.T) {
+	tests := map[string]struct {
+		method  string
+		headers map[string]string
+		opts    []router.Option
+
+		wantIncrease int
+	}{
+		"visit": {
+			method:       http.MethodGet,
+			wantIncrease: 1,
+		},
+		"head": {
+			method: http.MethodHead,
+		},
+		"bot": {
+			method:  http.MethodGet,
+			headers: map[string]string{"User-Agent": "Mozilla/5.0 (compatible; Googlebot/2.1)"},
+		},
+		"bot counted": {
+			method:       http.MethodGet,
+			headers:      map[string]string{"User-Agent": "Mozilla/5.0 (compatible; Googlebot/2.1)"},
+			opts:         []router.Option{router.WithCountBots(true)},
+			wantIncrease: 1,
+		},
+		"prefetch": {
+			method:  http.MethodGet,
+			headers: map[string]string{"Purpose": "prefetch"},
+		},
+		"speculative prefetch": {
+			method:  http.MethodGet,
+			headers: map[string]string{"Sec-Purpose": "prefetch;prerender"},
+		},
+		"prefetch counted": {
+			method:       http.MethodGet,
+			headers:      map[string]string{"Purpose": "prefetch"},
+			opts:         []router.Option{router.WithCountPrefetch(true)},
+			wantIncrease: 1,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			testSvc := testService{url: "https://www.google.es"}
+
+			srv := httptest.NewServer(getRouter(&testSvc, tt.opts...))
+			req, err := http.NewRequest(tt.method, srv.URL+"/ID", nil)
+			if err != nil {
+				t.Errorf("could not create request: %s", err)
+				return
+			}
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+
+			res, err := noRedirectClient.Do(req)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusTemporaryRedirect {
+				t.Errorf("wrong status code returned\nexpected=%d\ngot=%d", http.StatusTemporaryRedirect, res.StatusCode)
+			}
+
+			if testSvc.count != tt.wantIncrease {
+				t.Errorf("wrong redirection count\nexpected=%d\ngot=%d", tt.wantIncrease, testSvc.count)
+			}
+		})
+	}
+}
+
+func TestRedirectPassthrough(t *testing.T) {
+	tests := map[string]struct {
+		testSvc testService
+		path    string
+
+		wantStatus   int
+		wantLocation string
+	}{
+		"query dropped": {
+			testSvc: testService{
+				url: "https://docs.example.com/guide?lang=en",
+			},
+			path:         "/ID?utm_source=x&lang=es",
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantLocation: "https://docs.example.com/guide?lang=en",
+		},
+		"query merged": {
+			testSvc: testService{
+				url:          "https://docs.example.com/guide?lang=en",
+				forwardQuery: url.QueryMerge,
+			},
+			path:         "/ID?utm_source=x&lang=es",
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantLocation: "https://docs.example.com/guide?lang=en&utm_source=x",
+		},
+		"query overridden": {
+			testSvc: testService{
+				url:          "https://docs.example.com/guide?lang=en",
+				forwardQuery: url.QueryOverride,
+			},
+			path:         "/ID?utm_source=x&lang=es",
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantLocation: "https://docs.example.com/guide?lang=es&utm_source=x",
+		},
+		"query without control params": {
+			testSvc: testService{
+				url:          "https://docs.example.com/guide",
+				forwardQuery: url.QueryOverride,
+				warn:         true,
+			},
+			path:         "/ID?confirm=1&lang=es",
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantLocation: "https://docs.example.com/guide?lang=es",
+		},
+		"path not forwarded": {
+			testSvc: testService{
+				url: "https://docs.example.com/v1",
+			},
+			path:       "/ID/api/client.html",
+			wantStatus: http.StatusNotFound,
+		},
+		"path forwarded": {
+			testSvc: testService{
+				url:         "https://docs.example.com/v1/",
+				forwardPath: true,
+			},
+			path:         "/ID/api/client.html",
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantLocation: "https://docs.example.com/v1/api/client.html",
+		},
+		"path forwarded with trailing slash": {
+			testSvc: testService{
+				url:         "https://docs.example.com/v1",
+				forwardPath: true,
+			},
+			path:         "/ID/api/",
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantLocation: "https://docs.example.com/v1/api/",
+		},
+		"path forwarded without escaping the long url": {
+			testSvc: testService{
+				url:         "https://docs.example.com/v1",
+				forwardPath: true,
+			},
+			path:         "/ID/../../admin",
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantLocation: "https://docs.example.com/v1/admin",
+		},
+		"path and query forwarded": {
+			testSvc: testService{
+				url:          "https://docs.example.com/v1?lang=en",
+				forwardPath:  true,
+				forwardQuery: url.QueryMerge,
+			},
+			path:         "/ID/api?page=2",
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantLocation: "https://docs.example.com/v1/api?lang=en&page=2",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+			res, err := noRedirectClient.Get(srv.URL + tt.path)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("wrong status code returned\nexpected=%d\ngot=%d", tt.wantStatus, res.StatusCode)
+			}
+
+			if location := res.Header.Get("Location"); location != tt.wantLocation {
+				t.Errorf("wrong redirection location\nexpected=%s\ngot=%s", tt.wantLocation, location)
+			}
+		})
+	}
+}
+
+func TestRedirectBasePath(t *testing.T) {
+	tests := map[string]struct {
+		basePath string
+		path     string
+
+		wantStatus   int
+		wantLocation string
+	}{
+		"root": {
+			basePath:     "/",
+			path:         "/ID",
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantLocation: "https://docs.example.com/v1",
+		},
+		"prefix": {
+			basePath:     "/s/",
+			path:         "/s/ID",
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantLocation: "https://docs.example.com/v1",
+		},
+		"prefix with forwarded path": {
+			basePath:     "/go/s/",
+			path:         "/go/s/ID/api?page=2",
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantLocation: "https://docs.example.com/v1/api",
+		},
+		"outside prefix": {
+			basePath:   "/s/",
+			path:       "/ID",
+			wantStatus: http.StatusNotFound,
+		},
+		"api outside prefix": {
+			basePath:   "/s/",
+			path:       "/api/url/ID",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			testSvc := testService{url: "https://docs.example.com/v1", forwardPath: true}
+
+			srv := httptest.NewServer(getRouter(&testSvc, router.WithBasePath(tt.basePath)))
+			res, err := noRedirectClient.Get(srv.URL + tt.path)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("wrong status code returned\nexpected=%d\ngot=%d", tt.wantStatus, res.StatusCode)
+			}
+
+			if location := res.Header.Get("Location"); location != tt.wantLocation {
+				t.Errorf("wrong redirection location\nexpected=%s\ngot=%s", tt.wantLocation, location)
+			}
+		})
+	}
+}
+
+func TestDomain(t *testing.T) {
+	tests := map[string]struct {
+		method string
+		path   string
+		host   string
+		body   string
+
+		wantDomain string
+	}{
+		"redirect by host": {
+			method:     http.MethodGet,
+			path:       "/ID",
+			host:       "acme.link",
+			wantDomain: "acme.link",
+		},
+		"redirect by host with port": {
+			method:     http.MethodGet,
+			path:       "/ID",
+			host:       "go.acme.com:8080",
+			wantDomain: "go.acme.com:8080",
+		},
+		"create on default domain": {
+			method: http.MethodPost,
+			path:   "/api/url",
+			host:   "acme.link",
+			body:   `{"URL":"https://www.google.es"}`,
+		},
+		"create by param": {
+			method:     http.MethodPost,
+			path:       "/api/url?domain=acme.link",
+			body:       `{"URL":"https://www.google.es"}`,
+			wantDomain: "acme.link",
+		},
+		"create by body": {
+			method:     http.MethodPost,
+			path:       "/api/url?domain=acme.link",
+			body:       `{"URL":"https://www.google.es","Domain":"go.acme.com"}`,
+			wantDomain: "go.acme.com",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			testSvc := testService{id: "ID", url: "https://www.google.es"}
+
+			srv := httptest.NewServer(getRouter(&testSvc))
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Errorf("could not create request: %s", err)
+				return
+			}
+			req.Host = tt.host
+			req.Header.Set("Content-Type", "application/json")
+
+			res, err := noRedirectClient.Do(req)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+			res.Body.Close()
+
+			if testSvc.domain != tt.wantDomain {
+				t.Errorf("wrong domain\nexpected=%s\ngot=%s", tt.wantDomain, testSvc.domain)
+			}
+		})
+	}
+}
+
+func TestRedirectRules(t *testing.T) {
+	rules := []url.Rule{
+		{Platform: url.PlatformIOS, Target: "https://apps.apple.com/app/id1"},
+		{Platform: url.PlatformAndroid, Target: "https://play.google.com/store/apps/details?id=app"},
+		{Country: "ES", Target: "https://www.example.es"},
+		{Language: "fr", Target: "https://www.example.fr"},
+	}
+
+	tests := map[string]struct {
+		headers   map[string]string
+		countries router.CountryResolver
+
+		wantLocation string
+	}{
+		"ios": {
+			headers:      map[string]string{"User-Agent": "Mozilla/5.0 (iPhone; CPU iPhone OS 16_0 like Mac OS X) Safari/604.1"},
+			wantLocation: "https://apps.apple.com/app/id1",
+		},
+		"android client hint": {
+			headers:      map[string]string{"Sec-CH-UA-Platform": `"Android"`},
+			wantLocation: "https://play.google.com/store/apps/details?id=app",
+		},
+		"country": {
+			headers:      map[string]string{"User-Agent": "Mozilla/5.0 (Windows NT 10.0; Win64; x64)"},
+			countries:    testCountries("ES"),
+			wantLocation: "https://www.example.es",
+		},
+		"language": {
+			headers:      map[string]string{"Accept-Language": "en;q=0.5, fr-CA, fr;q=0.9"},
+			countries:    testCountries("CA"),
+			wantLocation: "https://www.example.fr",
+		},
+		"fallback": {
+			headers:      map[string]string{"User-Agent": "Mozilla/5.0 (X11; Linux x86_64)", "Accept-Language": "en"},
+			wantLocation: "https://www.google.es",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			testSvc := testService{url: "https://www.google.es", rules: rules}
+
+			var opts []router.Option
+			if tt.countries != nil {
+				opts = append(opts, router.WithCountryResolver(tt.countries))
+			}
+
+			srv := httptest.NewServer(getRouter(&testSvc, opts...))
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/ID", nil)
+			if err != nil {
+				t.Errorf("could not create request: %s", err)
+				return
+			}
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+
+			res, err := noRedirectClient.Do(req)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+			res.Body.Close()
+
+			if location := res.Header.Get("Location"); location != tt.wantLocation {
+				t.Errorf("wrong redirection location\nexpected=%s\ngot=%s", tt.wantLocation, location)
+			}
+		})
+	}
+}
+
+func TestRedirectVariants(t *testing.T) {
+	variants := []url.Variant{
+		{Name: "a", Target: "https://www.google.es/a", Weight: 1},
+		{Name: "b", Target: "https://www.google.es/b"},
+	}
+
+	tests := map[string]struct {
+		split  url.Split
+		rules  []url.Rule
+		cookie *http.Cookie
+
+		wantLocation string
+		wantCookie   string
+		wantCounts   map[string]int
+	}{
+		"weighted pick": {
+			split:        url.Split{Variants: variants},
+			wantLocation: "https://www.google.es/a",
+			wantCounts:   map[string]int{"a": 1},
+		},
+		"sticky first visit": {
+			split:        url.Split{Sticky: true, Variants: variants},
+			wantLocation: "https://www.google.es/a",
+			wantCookie:   "a",
+			wantCounts:   map[string]int{"a": 1},
+		},
+		"sticky returning visit": {
+			split: url.Split{Sticky: true, Variants: []url.Variant{
+				{Name: "a", Target: "https://www.google.es/a", Weight: 1},
+				{Name: "b", Target: "https://www.google.es/b", Weight: 1},
+			}},
+			cookie:       &http.Cookie{Name: "urlshort_variant_ID", Value: "b"},
+			wantLocation: "https://www.google.es/b",
+			wantCounts:   map[string]int{"b": 1},
+		},
+		"sticky paused variant": {
+			split:        url.Split{Sticky: true, Variants: variants},
+			cookie:       &http.Cookie{Name: "urlshort_variant_ID", Value: "b"},
+			wantLocation: "https://www.google.es/a",
+			wantCookie:   "a",
+			wantCounts:   map[string]int{"a": 1},
+		},
+		"not sticky ignores cookie": {
+			split:        url.Split{Variants: variants},
+			cookie:       &http.Cookie{Name: "urlshort_variant_ID", Value: "b"},
+			wantLocation: "https://www.google.es/a",
+			wantCounts:   map[string]int{"a": 1},
+		},
+		"matching rule wins": {
+			split:        url.Split{Variants: variants},
+			rules:        []url.Rule{{Language: "es", Target: "https://www.google.es/es"}},
+			wantLocation: "https://www.google.es/es",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			testSvc := testService{url: "https://www.google.es", split: tt.split, rules: tt.rules}
+
+			srv := httptest.NewServer(getRouter(&testSvc))
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/ID", nil)
+			if err != nil {
+				t.Errorf("could not create request: %s", err)
+				return
+			}
+			req.Header.Set("Accept-Language", "es-ES")
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+
+			res, err := noRedirectClient.Do(req)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+			res.Body.Close()
+
+			if location := res.Header.Get("Location"); location != tt.wantLocation {
+				t.Errorf("wrong redirection location\nexpected=%s\ngot=%s", tt.wantLocation, location)
+			}
+
+			var cookie string
+			for _, c := range res.Cookies() {
+				if c.Name == "urlshort_variant_ID" {
+					cookie = c.Value
+				}
+			}
+			if cookie != tt.wantCookie {
+				t.Errorf("wrong variant cookie\nexpected=%s\ngot=%s", tt.wantCookie, cookie)
+			}
+
+			if len(testSvc.variantCounts) != len(tt.wantCounts) {
+				t.Errorf("wrong variant counts\nexpected=%v\ngot=%v", tt.wantCounts, testSvc.variantCounts)
+			}
+			for variant, count := range tt.wantCounts {
+				if testSvc.variantCounts[variant] != count {
+					t.Errorf("wrong variant counts\nexpected=%v\ngot=%v", tt.wantCounts, testSvc.variantCounts)
+				}
+			}
+		})
+	}
+}
+
+func TestRedirectClickLimit(t *testing.T) {
+	tests := map[string]struct {
+		testSvc testService
+		method  string
+		headers map[string]string
+
+		wantStatus       int
+		wantLocation     string
+		wantCacheControl string
+		wantCount        int
+	}{
+		"unlimited": {
+			testSvc:          testService{url: "https://www.google.es", count: 10},
+			method:           http.MethodGet,
+			wantStatus:       http.StatusTemporaryRedirect,
+			wantLocation:     "https://www.google.es",
+			wantCacheControl: "private, no-store",
+			wantCount:        11,
+		},
+		"one time link": {
+			testSvc:          testService{url: "https://www.google.es", maxClicks: 1},
+			method:           http.MethodGet,
+			wantStatus:       http.StatusTemporaryRedirect,
+			wantLocation:     "https://www.google.es",
+			wantCacheControl: "private, no-store",
+			wantCount:        1,
+		},
+		"permanent redirect not cached": {
+			testSvc: testService{
+				url:          "https://www.google.es",
+				maxClicks:    5,
+				redirectType: http.StatusMovedPermanently,
+			},
+			method:           http.MethodGet,
+			wantStatus:       http.StatusMovedPermanently,
+			wantLocation:     "https://www.google.es",
+			wantCacheControl: "private, no-store",
+			wantCount:        1,
+		},
+		"exhausted": {
+			testSvc:    testService{url: "https://www.google.es", maxClicks: 1, count: 1},
+			method:     http.MethodGet,
+			wantStatus: http.StatusGone,
+			wantCount:  1,
+		},
+		"exhausted preview": {
+			testSvc:    testService{url: "https://www.google.es", maxClicks: 1, count: 1, warn: true},
+			method:     http.MethodGet,
+			wantStatus: http.StatusGone,
+			wantCount:  1,
+		},
+		"head does not use a click": {
+			testSvc:          testService{url: "https://www.google.es", maxClicks: 1},
+			method:           http.MethodHead,
+			wantStatus:       http.StatusNoContent,
+			wantCacheControl: "no-store",
+		},
+		"bot does not use a click": {
+			testSvc:          testService{url: "https://www.google.es", maxClicks: 1},
+			method:           http.MethodGet,
+			headers:          map[string]string{"User-Agent": "Slackbot-LinkExpanding 1.0"},
+			wantStatus:       http.StatusNoContent,
+			wantCacheControl: "no-store",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+			req, err := http.NewRequest(tt.method, srv.URL+"/ID", nil)
+			if err != nil {
+				t.Errorf("could not create request: %s", err)
+				return
+			}
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+
+			res, err := noRedirectClient.Do(req)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("wrong status code returned\nexpected=%d\ngot=%d", tt.wantStatus, res.StatusCode)
+			}
+
+			if location := res.Header.Get("Location"); location != tt.wantLocation {
+				t.Errorf("wrong redirection location\nexpected=%s\ngot=%s", tt.wantLocation, location)
+			}
+
+			if tt.wantCacheControl != "" && res.Header.Get("Cache-Control") != tt.wantCacheControl {
+				t.Errorf("wrong cache control\nexpected=%s\ngot=%s", tt.wantCacheControl, res.Header.Get("Cache-Control"))
+			}
+
+			if tt.testSvc.count != tt.wantCount {
+				t.Errorf("wrong redirection count\nexpected=%d\ngot=%d", tt.wantCount, tt.testSvc.count)
+			}
+		})
+	}
+}
+
+func TestRedirectScheduled(t *testing.T) {
+	notBefore := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		testSvc testService
+		opts    []router.Option
+
+		wantStatus   int
+		wantLocation string
+		wantContains string
+		wantCount    int
+	}{
+		"not found": {
+			testSvc:      testService{id: "localhost:8080/ID", url: "https://www.google.es", notBefore: notBefore, scheduled: true},
+			wantStatus:   http.StatusNotFound,
+			wantContains: url.ErrNotFound.Error(),
+		},
+		"coming soon page": {
+			testSvc:      testService{id: "localhost:8080/ID", url: "https://www.google.es", notBefore: notBefore, scheduled: true},
+			opts:         []router.Option{router.WithComingSoonPage(router.ComingSoonTemplate)},
+			wantStatus:   http.StatusOK,
+			wantContains: "2022-03-01 12:00 UTC",
+		},
+		"scheduled preview": {
+			testSvc:    testService{id: "localhost:8080/ID", url: "https://www.google.es", notBefore: notBefore, scheduled: true, warn: true},
+			wantStatus: http.StatusNotFound,
+		},
+		"active": {
+			testSvc:      testService{id: "localhost:8080/ID", url: "https://www.google.es", notBefore: notBefore},
+			opts:         []router.Option{router.WithComingSoonPage(router.ComingSoonTemplate)},
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantLocation: "https://www.google.es",
+			wantCount:    1,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(getRouter(&tt.testSvc, tt.opts...))
+			res, err := noRedirectClient.Get(srv.URL + "/ID")
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("wrong status code returned\nexpected=%d\ngot=%d", tt.wantStatus, res.StatusCode)
+			}
+
+			if location := res.Header.Get("Location"); location != tt.wantLocation {
+				t.Errorf("wrong redirection location\nexpected=%s\ngot=%s", tt.wantLocation, location)
+			}
+
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Errorf("could not read body: %s", err)
+				return
+			}
+
+			if !strings.Contains(string(body), tt.wantContains) {
+				t.Errorf("wrong body returned\nexpected to contain=%s\ngot=%s", tt.wantContains, body)
+			}
+
+			if tt.testSvc.count != tt.wantCount {
+				t.Errorf("wrong redirection count\nexpected=%d\ngot=%d", tt.wantCount, tt.testSvc.count)
+			}
+		})
+	}
+}
+
+func TestRedirectPassword(t *testing.T) {
+	tests := map[string]struct {
+		testSvc  testService
+		method   string
+		password string
+
+		wantStatus   int
+		wantLocation string
+		wantContains string
+		wantCount    int
+	}{
+		"form": {
+			testSvc:      testService{url: "https://www.google.es", password: "secret"},
+			method:       http.MethodGet,
+			wantStatus:   http.StatusOK,
+			wantContains: `<form method="post">`,
+		},
+		"wrong password": {
+			testSvc:      testService{url: "https://www.google.es", password: "secret"},
+			method:       http.MethodPost,
+			password:     "guess",
+			wantStatus:   http.StatusForbidden,
+			wantContains: "Wrong password",
+		},
+		"too many attempts": {
+			testSvc:      testService{url: "https://www.google.es", password: "secret", unlockErr: url.ErrTooManyAttempts},
+			method:       http.MethodPost,
+			password:     "secret",
+			wantStatus:   http.StatusTooManyRequests,
+			wantContains: "Too many attempts",
+		},
+		"right password": {
+			testSvc:      testService{url: "https://www.google.es", password: "secret"},
+			method:       http.MethodPost,
+			password:     "secret",
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "https://www.google.es",
+			wantCount:    1,
+		},
+		"right password skips warning": {
+			testSvc:      testService{url: "https://www.google.es", password: "secret", warn: true},
+			method:       http.MethodPost,
+			password:     "secret",
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "https://www.google.es",
+			wantCount:    1,
+		},
+		"not protected": {
+			testSvc:    testService{url: "https://www.google.es"},
+			method:     http.MethodPost,
+			password:   "secret",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+
+			var body io.Reader
+			if tt.method == http.MethodPost {
+				body = strings.NewReader(neturl.Values{"password": {tt.password}}.Encode())
+			}
+			req, err := http.NewRequest(tt.method, srv.URL+"/ID", body)
+			if err != nil {
+				t.Errorf("could not create request: %s", err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			res, err := noRedirectClient.Do(req)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("wrong status code returned\nexpected=%d\ngot=%d", tt.wantStatus, res.StatusCode)
+			}
+
+			if location := res.Header.Get("Location"); location != tt.wantLocation {
+				t.Errorf("wrong redirection location\nexpected=%s\ngot=%s", tt.wantLocation, location)
+			}
+
+			resBody, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Errorf("could not read response body: %s", err)
+				return
+			}
+
+			if !strings.Contains(string(resBody), tt.wantContains) {
+				t.Errorf("response body does not contain %q\ngot=%s", tt.wantContains, resBody)
+			}
+
+			if strings.Contains(string(resBody), "google.es") {
+				t.Errorf("response body reveals the destination\ngot=%s", resBody)
+			}
+
+			if tt.testSvc.count != tt.wantCount {
+				t.Errorf("wrong redirection count\nexpected=%d\ngot=%d", tt.wantCount, tt.testSvc.count)
+			}
+		})
+	}
+}
+
+func TestRedirectFeed(t *testing.T) {
+	tests := map[string]struct {
+		testSvc     testService
+		watchDomain string
+		watch       []string
+		agent       string
+		// password is posted to unlock protected urls
+		password string
+
+		want []feed.Redirect
+	}{
+		"redirection": {
+			testSvc: testService{url: "https://www.google.es"},
+			agent:   "Mozilla/5.0 (iPhone; CPU iPhone OS 15_0 like Mac OS X)",
+			want: []feed.Redirect{{Seq: 1, ID: "ID", Count: 1, URL: "https://www.google.es",
+				Visit: url.Visit{Platform: url.PlatformIOS}}},
+		},
+		"watched url": {
+			testSvc: testService{url: "https://www.google.es"},
+			watch:   []string{"ID"},
+			want:    []feed.Redirect{{Seq: 1, ID: "ID", Count: 1, URL: "https://www.google.es"}},
+		},
+		"other url": {
+			testSvc: testService{url: "https://www.google.es"},
+			watch:   []string{"other"},
+		},
+		"watched url on domain": {
+			testSvc:     testService{url: "https://www.google.es", linkDomain: "acme.link"},
+			watchDomain: "acme.link",
+			watch:       []string{"ID"},
+			want: []feed.Redirect{{Seq: 1, Domain: "acme.link", ID: "ID", Count: 1,
+				URL: "https://www.google.es"}},
+		},
+		"same id on other domain": {
+			testSvc: testService{url: "https://www.google.es", linkDomain: "acme.link"},
+			watch:   []string{"ID"},
+		},
+		"not counted": {
+			testSvc: testService{url: "https://www.google.es"},
+			agent:   "Googlebot/2.1",
+		},
+		"variant": {
+			testSvc: testService{url: "https://www.google.es", split: url.Split{Variants: []url.Variant{
+				{Name: "a", Target: "https://a.com", Weight: 1}}}},
+			want: []feed.Redirect{{Seq: 1, ID: "ID", Count: 1, URL: "https://a.com", Variant: "a"}},
+		},
+		"protected": {
+			testSvc:  testService{url: "https://www.google.es", password: "secret"},
+			password: "secret",
+			want:     []feed.Redirect{{Seq: 1, ID: "ID", Count: 1}},
+		},
+		"locked": {
+			testSvc: testService{url: "https://www.google.es", password: "secret"},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			redirects := feed.New(feed.DefaultBufferSize)
+			sub := redirects.Subscribe(tt.watchDomain, tt.watch...)
+			defer sub.Close()
+
+			srv := httptest.NewServer(getRouter(&tt.testSvc, router.WithRedirectFeed(redirects)))
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/ID", nil)
+			if tt.password != "" {
+				req, err = http.NewRequest(http.MethodPost, srv.URL+"/ID",
+					strings.NewReader(neturl.Values{"password": {tt.password}}.Encode()))
+			}
+			if err != nil {
+				t.Errorf("could not create request: %s", err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("User-Agent", tt.agent)
+
+			res, err := noRedirectClient.Do(req)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+			res.Body.Close()
+			redirects.Close()
+
+			var got []feed.Redirect
+			for redirect := range sub.Events() {
+				if redirect.Time.IsZero() {
+					t.Errorf("redirection published without time")
+				}
+				redirect.Time = time.Time{}
+				got = append(got, redirect)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("wrong redirections published\nexpected=%+v\ngot=%+v", tt.want, got)
+			}
+
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("wrong redirection published\nexpected=%+v\ngot=%+v", tt.want[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	tests := map[string]struct {
+		testSvc     testService
+		noFeed      bool
+		query       string
+		lastEventID string
+		// visits are redirected before connecting to the stream
+		visits int
+
+		wantStatus int
+		// wantEvents are the events sent on connection followed by the one sent after a redirection,
+		// events with clicks are compared up to their time
+		wantEvents []string
+	}{
+		"count": {
+			testSvc:    testService{url: "https://www.google.es", count: 5},
+			wantStatus: http.StatusOK,
+			wantEvents: []string{
+				"event: count\ndata: {\"Domain\":\"\",\"ID\":\"ID\",\"Count\":5,\"Click\":null}",
+				"id: 1\nevent: count\ndata: {\"Domain\":\"\",\"ID\":\"ID\",\"Count\":6,\"Click\":null}",
+			},
+		},
+		"clicks": {
+			testSvc:    testService{url: "https://www.google.es"},
+			query:      "?clicks=1",
+			wantStatus: http.StatusOK,
+			wantEvents: []string{
+				"event: count\ndata: {\"Domain\":\"\",\"ID\":\"ID\",\"Count\":0,\"Click\":null}",
+				"id: 1\nevent: count\ndata: {\"Domain\":\"\",\"ID\":\"ID\",\"Count\":1,\"Click\":{\"Time\":",
+			},
+		},
+		"resume": {
+			testSvc:     testService{url: "https://www.google.es"},
+			lastEventID: "1",
+			visits:      3,
+			wantStatus:  http.StatusOK,
+			wantEvents: []string{
+				"id: 2\nevent: count\ndata: {\"Domain\":\"\",\"ID\":\"ID\",\"Count\":2,\"Click\":null}",
+				"id: 3\nevent: count\ndata: {\"Domain\":\"\",\"ID\":\"ID\",\"Count\":3,\"Click\":null}",
+				"id: 4\nevent: count\ndata: {\"Domain\":\"\",\"ID\":\"ID\",\"Count\":4,\"Click\":null}",
+			},
+		},
+		"resume discarded": {
+			testSvc:     testService{url: "https://www.google.es"},
+			lastEventID: "7",
+			visits:      1,
+			wantStatus:  http.StatusOK,
+			wantEvents: []string{
+				"event: count\ndata: {\"Domain\":\"\",\"ID\":\"ID\",\"Count\":1,\"Click\":null}",
+				"id: 2\nevent: count\ndata: {\"Domain\":\"\",\"ID\":\"ID\",\"Count\":2,\"Click\":null}",
+			},
+		},
+		"domain": {
+			testSvc:    testService{url: "https://www.google.es", linkDomain: "acme.link"},
+			query:      "?domain=acme.link",
+			wantStatus: http.StatusOK,
+			wantEvents: []string{
+				"event: count\ndata: {\"Domain\":\"acme.link\",\"ID\":\"ID\",\"Count\":0,\"Click\":null}",
+				"id: 1\nevent: count\ndata: {\"Domain\":\"acme.link\",\"ID\":\"ID\",\"Count\":1,\"Click\":null}",
+			},
+		},
+		"not found": {
+			testSvc:    testService{err: url.ErrNotFound},
+			wantStatus: http.StatusNotFound,
+		},
+		"disabled": {
+			testSvc:    testService{url: "https://www.google.es"},
+			noFeed:     true,
+			wantStatus: http.StatusNotImplemented,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var opts []router.Option
+			if !tt.noFeed {
+				opts = append(opts, router.WithRedirectFeed(feed.New(feed.DefaultBufferSize, feed.WithReplay(10))))
+			}
+			srv := httptest.NewServer(getRouter(&tt.testSvc, opts...))
+			defer srv.Close()
+
+			for i := 0; i < tt.visits; i++ {
+				visit(t, srv.URL+"/ID")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/url/ID/events"+tt.query, nil)
+			if err != nil {
+				t.Fatalf("could not create request: %s", err)
+			}
+			if tt.lastEventID != "" {
+				req.Header.Set("Last-Event-ID", tt.lastEventID)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("could not send request: %v", err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Fatalf("wrong status code returned\nexpected=%d\ngot=%d", tt.wantStatus, res.StatusCode)
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			if contentType := res.Header.Get("Content-Type"); contentType != "text/event-stream" {
+				t.Errorf("wrong content type\nexpected=text/event-stream\ngot=%s", contentType)
+			}
+
+			body := bufio.NewReader(res.Body)
+			for i, want := range tt.wantEvents {
+				if i == len(tt.wantEvents)-1 {
+					visit(t, srv.URL+"/ID")
+				}
+
+				event, err := readEvent(body)
+				if err != nil {
+					t.Fatalf("could not read event: %s", err)
+				}
+
+				if !strings.HasPrefix(event, want) {
+					t.Errorf("wrong event\nexpected=%s\ngot=%s", want, event)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamEventsHeartbeat(t *testing.T) {
+	testSvc := testService{url: "https://www.google.es"}
+	srv := httptest.NewServer(getRouter(&testSvc, router.WithRedirectFeed(feed.New(feed.DefaultBufferSize)),
+		router.WithEventsHeartbeat(time.Millisecond)))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/url/ID/events", nil)
+	if err != nil {
+		t.Fatalf("could not create request: %s", err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	defer res.Body.Close()
+
+	body := bufio.NewReader(res.Body)
+	for _, want := range []string{"event: count", ": heartbeat"} {
+		event, err := readEvent(body)
+		if err != nil {
+			t.Fatalf("could not read event: %s", err)
+		}
+
+		if !strings.HasPrefix(event, want) {
+			t.Errorf("wrong event\nexpected=%s\ngot=%s", want, event)
+		}
+	}
+}
+
+// readEvent reads the lines of the next Server-Sent Event
+func readEvent(r *bufio.Reader) (string, error) {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return strings.Join(lines, "\n"), nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+func visit(t *testing.T, u string) {
+	t.Helper()
+
+	res, err := noRedirectClient.Get(u)
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	res.Body.Close()
+}
+
+func TestPreview(t *testing.T) {
+	tests := map[string]struct {
+		testSvc testService
+		path    string
+
+		wantStatus   int
+		wantPreview  bool
+		wantIncrease int
+	}{
+		"not found": {
+			testSvc: testService{
+				err: url.ErrNotFound,
+			},
+			path:       "/ID+",
+			wantStatus: http.StatusNotFound,
+		},
+		"preview suffix": {
+			testSvc: testService{
+				url: "https://www.google.es",
+			},
+			path:        "/ID+",
+			wantStatus:  http.StatusOK,
+			wantPreview: true,
+		},
+		"preview param": {
+			testSvc: testService{
+				url: "https://www.google.es",
+			},
+			path:        "/ID?preview=1",
+			wantStatus:  http.StatusOK,
+			wantPreview: true,
+		},
+		"warn interstitial": {
+			testSvc: testService{
+				url:  "https://www.google.es",
+				warn: true,
+			},
+			path:        "/ID",
+			wantStatus:  http.StatusOK,
+			wantPreview: true,
+		},
+		"warn confirmed": {
+			testSvc: testService{
+				url:  "https://www.google.es",
+				warn: true,
+			},
+			path:         "/ID?confirm=1",
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantIncrease: 1,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			initialCount := tt.testSvc.count
+
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+			res, err := noRedirectClient.Get(srv.URL + tt.path)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("wrong status code returned\nexpected=%d\ngot=%d", tt.wantStatus, res.StatusCode)
+			}
+
+			if initialCount+tt.wantIncrease != tt.testSvc.count {
+				t.Errorf("wrong redirection count\nexpected=%d\ngot=%d", initialCount+tt.wantIncrease, tt.testSvc.count)
+			}
+
+			if !tt.wantPreview {
+				return
+			}
+
+			if contentType := res.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+				t.Errorf("wrong content type returned\nexpected=text/html\ngot=%s", contentType)
+			}
+
+			body, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Errorf("could not read body: %s", err)
+				return
+			}
+
+			if !bytes.Contains(body, []byte(tt.testSvc.url)) {
+				t.Errorf("preview does not contain the destination %s", tt.testSvc.url)
+			}
+
+			if !bytes.Contains(body, []byte(`href="/ID?confirm=1"`)) {
+				t.Errorf("preview does not contain the continue link")
+			}
+		})
+	}
+}
+
+func TestCreateURL(t *testing.T) {
+	tests := map[string]struct {
+		testSvc        testService
+		requestBody    []byte
+		idempotencyKey string
+
+		wantStatus int
+		wantBody   []byte
+	}{
+		"invalid url": {
+			requestBody: []byte(`{"URL":"url"}`),
+			testSvc: testService{
+				err: url.ErrInvalidURL,
+				url: "url",
+			},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"` + url.ErrInvalidURL.Error() + `"}`),
+		},
+		"self reference": {
+			requestBody: []byte(`{"URL":"http://localhost:8080/ID"}`),
+			testSvc: testService{
+				err: url.ErrSelfReference,
+			},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"` + url.ErrSelfReference.Error() + `"}`),
+		},
+		"blocked host": {
+			requestBody: []byte(`{"URL":"https://bit.ly/ID"}`),
+			testSvc: testService{
+				err: url.ErrBlockedHost,
+			},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"` + url.ErrBlockedHost.Error() + `"}`),
+		},
+		"svc error": {
+			requestBody: []byte(`{"URL":"url"}`),
+			testSvc: testService{
+				err: errSvc,
+				url: "url",
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   []byte(`{"Code":"Internal Server Error","Message":"` + errSvc.Error() + `"}`),
+		},
+		"success": {
+			requestBody: []byte(`{"URL":"url"}`),
+			testSvc: testService{
+				id:  "id",
+				url: "url",
+			},
+			wantStatus: http.StatusCreated,
+			wantBody:   []byte(`{"URL":"url","ShortURL":"id"}`),
+		},
+		"idempotent": {
+			requestBody:    []byte(`{"URL":"url"}`),
+			idempotencyKey: "key",
+			testSvc: testService{
+				id:  "id",
+				url: "url",
+			},
+			wantStatus: http.StatusCreated,
+			wantBody:   []byte(`{"URL":"url","ShortURL":"id"}`),
+		},
+		"invalid idempotency key": {
+			requestBody:    []byte(`{"URL":"url"}`),
+			idempotencyKey: "key",
+			testSvc: testService{
+				err: url.ErrInvalidIdempotencyKey,
+			},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"` + url.ErrInvalidIdempotencyKey.Error() + `"}`),
+		},
+		"idempotency conflict": {
+			requestBody:    []byte(`{"URL":"url"}`),
+			idempotencyKey: "key",
+			testSvc: testService{
+				err: url.ErrIdempotencyConflict,
+			},
+			wantStatus: http.StatusConflict,
+			wantBody:   []byte(`{"Code":"Conflict","Message":"` + url.ErrIdempotencyConflict.Error() + `"}`),
+		},
+		"idempotent request in progress": {
+			requestBody:    []byte(`{"URL":"url"}`),
+			idempotencyKey: "key",
+			testSvc: testService{
+				err: url.ErrIdempotencyInProgress,
+			},
+			wantStatus: http.StatusConflict,
+			wantBody:   []byte(`{"Code":"Conflict","Message":"` + url.ErrIdempotencyInProgress.Error() + `"}`),
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+			req, err := http.NewRequest(http.MethodPost, srv.URL+path.Join("/api/url"), bytes.NewReader(tt.requestBody))
+			if err != nil {
+				t.Fatalf("could not create request: %v", err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if tt.idempotencyKey != "" {
+				req.Header.Set("Idempotency-Key", tt.idempotencyKey)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+
+			checkResponse(t, res, tt.wantStatus, tt.wantBody)
+
+			if tt.testSvc.idempotencyKey != tt.idempotencyKey {
+				t.Errorf("wrong idempotency key\nexpected=%s\ngot=%s", tt.idempotencyKey, tt.testSvc.idempotencyKey)
+			}
+		})
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	tests := map[string]struct {
+		method      string
+		path        string
+		contentType string
+		body        string
+
+		wantStatus int
+		wantBody   []byte
+	}{
+		"malformed": {
+			path:       "/api/url",
+			body:       `{"URL":"url",}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"request body is not valid JSON at offset 14"}`),
+		},
+		"truncated": {
+			path:       "/api/url",
+			body:       `{"URL":`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"request body is not valid JSON: unexpected end"}`),
+		},
+		"empty": {
+			path:       "/api/url",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"request body must not be empty"}`),
+		},
+		"trailing data": {
+			path:       "/api/url",
+			body:       `{"URL":"url"} {"URL":"url"}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"request body must contain a single JSON value"}`),
+		},
+		"oversized": {
+			path:       "/api/url",
+			body:       `{"URL":"https://www.google.es/` + strings.Repeat("a", 100) + `"}`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantBody:   []byte(`{"Code":"Request Entity Too Large","Message":"request body must be at most 128 bytes"}`),
+		},
+		"wrong type": {
+			path:       "/api/url",
+			body:       `{"URL":"url","MaxClicks":"ten"}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: []byte(`{"Code":"Bad Request","Message":"invalid request: MaxClicks must be a number, got string",` +
+				`"Fields":[{"Field":"MaxClicks","Message":"must be a number, got string"}]}`),
+		},
+		"wrong nested type": {
+			path:       "/api/url",
+			body:       `{"URL":"url","Campaign":{"Source":1}}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: []byte(`{"Code":"Bad Request","Message":"invalid request: Campaign.Source must be a string, got number",` +
+				`"Fields":[{"Field":"Campaign.Source","Message":"must be a string, got number"}]}`),
+		},
+		"not an object": {
+			path:       "/api/url",
+			body:       `["url"]`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"request body must be a JSON object, got array"}`),
+		},
+		"unknown field": {
+			path:       "/api/url",
+			body:       `{"URL":"url","Tags":["a"]}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: []byte(`{"Code":"Bad Request","Message":"invalid request: Tags is not a known field",` +
+				`"Fields":[{"Field":"Tags","Message":"is not a known field"}]}`),
+		},
+		"missing field": {
+			path:       "/api/url",
+			body:       `{"Warn":true}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: []byte(`{"Code":"Bad Request","Message":"invalid request: URL is required",` +
+				`"Fields":[{"Field":"URL","Message":"is required"}]}`),
+		},
+		"missing nested fields": {
+			method:     http.MethodPut,
+			path:       "/api/url/ID/rules",
+			body:       `{"Rules":[{"Platform":"ios","URL":"url"},{"Platform":"android"},{"Country":"ES"}]}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody: []byte(`{"Code":"Bad Request",` +
+				`"Message":"invalid request: Rules[1].URL is required, Rules[2].URL is required",` +
+				`"Fields":[{"Field":"Rules[1].URL","Message":"is required"},` +
+				`{"Field":"Rules[2].URL","Message":"is required"}]}`),
+		},
+		"no content type": {
+			path:        "/api/url",
+			contentType: "-",
+			body:        `{"URL":"url"}`,
+			wantStatus:  http.StatusUnsupportedMediaType,
+			wantBody:    []byte(`{"Code":"Unsupported Media Type","Message":"request body must be application/json"}`),
+		},
+		"form content type": {
+			method:      http.MethodPost,
+			path:        "/api/webhooks",
+			contentType: "application/x-www-form-urlencoded",
+			body:        `URL=https://www.example.com`,
+			wantStatus:  http.StatusUnsupportedMediaType,
+			wantBody:    []byte(`{"Code":"Unsupported Media Type","Message":"request body must be application/json"}`),
+		},
+		"content type with charset": {
+			path:        "/api/url",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"URL":"url"}`,
+			wantStatus:  http.StatusCreated,
+			wantBody:    []byte(`{"URL":"url","ShortURL":"id"}`),
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			testSvc := testService{id: "id"}
+			srv := httptest.NewServer(getRouter(&testSvc, router.WithMaxBodySize(128)))
+			defer srv.Close()
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req, err := http.NewRequest(method, srv.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("could not create request: %v", err)
+			}
+			switch tt.contentType {
+			case "":
+				req.Header.Set("Content-Type", "application/json")
+			case "-":
+			default:
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("could not send request: %v", err)
+			}
+
+			checkResponse(t, res, tt.wantStatus, tt.wantBody)
+
+			if created := tt.wantStatus == http.StatusCreated; (testSvc.created > 0) != created {
+				t.Errorf("wrong urls created\nexpected=%t\ngot=%d", created, testSvc.created)
+			}
+		})
+	}
+}
+
+func TestAPIV2(t *testing.T) {
+	notBefore := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	createdAt := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		testSvc testService
+		method  string
+		path    string
+		body    string
+
+		wantStatus      int
+		wantContentType string
+		wantLocation    string
+		wantBody        []byte
+	}{
+		"create": {
+			testSvc:         testService{id: "id", url: "https://www.google.es", maxClicks: 10, createdAt: createdAt},
+			method:          http.MethodPost,
+			path:            "/api/v2/links",
+			body:            `{"url":"https://www.google.es","maxClicks":10}`,
+			wantStatus:      http.StatusCreated,
+			wantContentType: "application/json",
+			wantLocation:    "/api/v2/links/id",
+			wantBody: []byte(`{"data":{"id":"id","shortUrl":"id","longUrl":"https://www.google.es",` +
+				`"createdAt":"2022-03-01T12:00:00Z","clicks":0,"maxClicks":10,"remainingClicks":10,"redirectType":307,` +
+				`"warn":false,"forwardPath":false,"protected":false,"scheduled":false}}`),
+		},
+		"create on domain": {
+			testSvc: testService{id: "https://acme.link/id", url: "https://www.google.es", linkDomain: "acme.link",
+				createdAt: createdAt},
+			method:          http.MethodPost,
+			path:            "/api/v2/links",
+			body:            `{"url":"https://www.google.es","domain":"acme.link"}`,
+			wantStatus:      http.StatusCreated,
+			wantContentType: "application/json",
+			wantLocation:    "/api/v2/links/id?domain=acme.link",
+			wantBody: []byte(`{"data":{"id":"id","domain":"acme.link","shortUrl":"https://acme.link/id",` +
+				`"longUrl":"https://www.google.es","createdAt":"2022-03-01T12:00:00Z","clicks":0,"redirectType":307,` +
+				`"warn":false,"forwardPath":false,"protected":false,"scheduled":false}}`),
+		},
+		"create not read back": {
+			testSvc: testService{id: "http://localhost:8080/id", url: "https://www.google.es", createdAt: createdAt,
+				getLinkErr: errSvc},
+			method:          http.MethodPost,
+			path:            "/api/v2/links",
+			body:            `{"url":"https://www.google.es","warn":true,"password":"secret","maxClicks":10,"notBefore":"2030-01-01T00:00:00Z"}`,
+			wantStatus:      http.StatusCreated,
+			wantContentType: "application/json",
+			wantLocation:    "/api/v2/links/id",
+			wantBody: []byte(`{"data":{"id":"id","shortUrl":"http://localhost:8080/id","clicks":0,"maxClicks":10,` +
+				`"remainingClicks":10,"redirectType":307,"warn":true,"forwardPath":false,"protected":true,` +
+				`"notBefore":"2030-01-01T00:00:00Z","scheduled":false}}`),
+		},
+		"create server error": {
+			testSvc:         testService{err: errSvc},
+			method:          http.MethodPost,
+			path:            "/api/v2/links",
+			body:            `{"url":"https://www.google.es"}`,
+			wantStatus:      http.StatusInternalServerError,
+			wantContentType: "application/problem+json",
+			wantBody: []byte(`{"type":"about:blank","title":"Internal Server Error","status":500,` +
+				`"detail":"something went wrong, try again later","instance":"/api/v2/links"}`),
+		},
+		"create invalid url": {
+			testSvc:         testService{err: url.ErrInvalidURL},
+			method:          http.MethodPost,
+			path:            "/api/v2/links",
+			body:            `{"url":"url"}`,
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/problem+json",
+			wantBody: []byte(`{"type":"about:blank","title":"Bad Request","status":400,` +
+				`"detail":"` + url.ErrInvalidURL.Error() + `","instance":"/api/v2/links"}`),
+		},
+		"create without url": {
+			method:          http.MethodPost,
+			path:            "/api/v2/links",
+			body:            `{"warn":true}`,
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/problem+json",
+			wantBody: []byte(`{"type":"about:blank","title":"Bad Request","status":400,` +
+				`"detail":"invalid request: url is required","instance":"/api/v2/links",` +
+				`"errors":[{"field":"url","message":"is required"}]}`),
+		},
+		"create idempotency conflict": {
+			testSvc:         testService{err: url.ErrIdempotencyConflict},
+			method:          http.MethodPost,
+			path:            "/api/v2/links",
+			body:            `{"url":"https://www.google.es"}`,
+			wantStatus:      http.StatusConflict,
+			wantContentType: "application/problem+json",
+			wantBody: []byte(`{"type":"about:blank","title":"Conflict","status":409,` +
+				`"detail":"` + url.ErrIdempotencyConflict.Error() + `","instance":"/api/v2/links"}`),
+		},
+		"get": {
+			testSvc: testService{id: "http://localhost:8080/ID", url: "https://www.google.es", count: 3,
+				password: "secret", notBefore: notBefore, scheduled: true, createdAt: createdAt,
+				rules: []url.Rule{{Platform: url.PlatformIOS, Target: "https://apps.apple.com"}},
+				split: url.Split{Variants: []url.Variant{{Name: "a", Target: "https://a.example.com", Weight: 1, Count: 2}}}},
+			method:          http.MethodGet,
+			path:            "/api/v2/links/ID",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBody: []byte(`{"data":{"id":"ID","shortUrl":"http://localhost:8080/ID","createdAt":"2022-03-01T12:00:00Z",` +
+				`"clicks":3,"redirectType":307,"warn":false,"forwardPath":false,"protected":true,` +
+				`"notBefore":"2030-01-01T00:00:00Z","scheduled":true,` +
+				`"rules":[{"platform":"ios"}],"variants":[{"name":"a","weight":1,"clicks":2}]}}`),
+		},
+		"get not protected": {
+			testSvc: testService{id: "http://localhost:8080/ID", url: "https://www.google.es", createdAt: createdAt,
+				rules: []url.Rule{{Platform: url.PlatformIOS, Target: "https://apps.apple.com"}},
+				split: url.Split{Variants: []url.Variant{{Name: "a", Target: "https://a.example.com", Weight: 1, Count: 2}}}},
+			method:          http.MethodGet,
+			path:            "/api/v2/links/ID",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBody: []byte(`{"data":{"id":"ID","shortUrl":"http://localhost:8080/ID","longUrl":"https://www.google.es",` +
+				`"createdAt":"2022-03-01T12:00:00Z","clicks":0,"redirectType":307,"warn":false,"forwardPath":false,` +
+				`"protected":false,"scheduled":false,"rules":[{"platform":"ios","url":"https://apps.apple.com"}],` +
+				`"variants":[{"name":"a","url":"https://a.example.com","weight":1,"clicks":2}]}}`),
+		},
+		"get not found": {
+			testSvc:         testService{err: url.ErrNotFound},
+			method:          http.MethodGet,
+			path:            "/api/v2/links/ID",
+			wantStatus:      http.StatusNotFound,
+			wantContentType: "application/problem+json",
+			wantBody: []byte(`{"type":"about:blank","title":"Not Found","status":404,` +
+				`"detail":"` + url.ErrNotFound.Error() + `","instance":"/api/v2/links/ID"}`),
+		},
+		"delete": {
+			method:     http.MethodDelete,
+			path:       "/api/v2/links/ID",
+			wantStatus: http.StatusNoContent,
+			wantBody:   []byte{},
+		},
+		"restore": {
+			testSvc:         testService{id: "ID", url: "https://www.google.es"},
+			method:          http.MethodPost,
+			path:            "/api/v2/links/ID/restore",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBody: []byte(`{"data":{"id":"ID","shortUrl":"ID","longUrl":"https://www.google.es",` +
+				`"clicks":0,"redirectType":307,"warn":false,"forwardPath":false,"protected":false,"scheduled":false}}`),
+		},
+		"campaign links": {
+			testSvc: testService{links: []url.Link{
+				{Short: "A", Long: "https://www.google.es", ShortURL: "http://localhost:8080/A", Count: 2,
+					RedirectType: http.StatusMovedPermanently, Campaign: url.Campaign{Source: "newsletter", Name: "spring"}},
+				{Short: "B", Domain: "acme.link", ShortURL: "https://acme.link/B", Count: 3, PasswordHash: "hash",
+					Campaign: url.Campaign{Source: "ads", Name: "spring"}},
+			}},
+			method:          http.MethodGet,
+			path:            "/api/v2/campaigns/spring/links",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBody: []byte(`{"data":[{"id":"A","shortUrl":"http://localhost:8080/A","longUrl":"https://www.google.es",` +
+				`"clicks":2,"redirectType":301,"warn":false,"forwardPath":false,` +
+				`"campaign":{"source":"newsletter","name":"spring"},"protected":false,"scheduled":false},` +
+				`{"id":"B","domain":"acme.link","shortUrl":"https://acme.link/B",` +
+				`"clicks":3,"redirectType":307,"warn":false,"forwardPath":false,` +
+				`"campaign":{"source":"ads","name":"spring"},"protected":true,"scheduled":false}],` +
+				`"meta":{"campaign":"spring","count":2,"clicks":5}}`),
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+			defer srv.Close()
+
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("could not create request: %v", err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("could not send request: %v", err)
+			}
+
+			if contentType := res.Header.Get("Content-Type"); contentType != tt.wantContentType {
+				t.Errorf("wrong content type\nexpected=%s\ngot=%s", tt.wantContentType, contentType)
+			}
+			if location := res.Header.Get("Location"); location != tt.wantLocation {
+				t.Errorf("wrong location\nexpected=%s\ngot=%s", tt.wantLocation, location)
+			}
+
+			checkResponse(t, res, tt.wantStatus, tt.wantBody)
+		})
+	}
+}
+
+func TestGetURL(t *testing.T) {
+	tests := map[string]struct {
+		testSvc testService
+
+		wantStatus int
+		wantBody   []byte
+	}{
+		"id not found": {
+			testSvc: testService{
+				err: url.ErrNotFound,
+			},
+			wantStatus: http.StatusNotFound,
+			wantBody:   []byte(`{"Code":"Not Found","Message":"` + url.ErrNotFound.Error() + `"}`),
+		},
+		"svc error": {
+			testSvc: testService{
+				err: errSvc,
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   []byte(`{"Code":"Internal Server Error","Message":"` + errSvc.Error() + `"}`),
+		},
+		"password protected": {
+			testSvc: testService{
+				err: url.ErrPasswordRequired,
+			},
+			wantStatus: http.StatusForbidden,
+			wantBody:   []byte(`{"Code":"Forbidden","Message":"` + url.ErrPasswordRequired.Error() + `"}`),
+		},
+		"success": {
+			testSvc: testService{
+				url: "url",
+				id:  "ID",
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   []byte(`{"URL":"url","ShortURL":"ID"}`),
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+			res, err := http.Get(srv.URL + path.Join("/api/url/ID"))
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+
+			checkResponse(t, res, tt.wantStatus, tt.wantBody)
+		})
+	}
+}
+
+func TestUnlockURL(t *testing.T) {
+	tests := map[string]struct {
+		testSvc     testService
+		requestBody []byte
+
+		wantStatus int
+		wantBody   []byte
+	}{
+		"id not found": {
+			testSvc: testService{
+				err: url.ErrNotFound,
+			},
+			requestBody: []byte(`{"Password":"secret"}`),
+			wantStatus:  http.StatusNotFound,
+			wantBody:    []byte(`{"Code":"Not Found","Message":"` + url.ErrNotFound.Error() + `"}`),
+		},
+		"wrong password": {
+			testSvc: testService{
+				password: "secret",
+			},
+			requestBody: []byte(`{"Password":"guess"}`),
+			wantStatus:  http.StatusForbidden,
+			wantBody:    []byte(`{"Code":"Forbidden","Message":"` + url.ErrWrongPassword.Error() + `"}`),
+		},
+		"too many attempts": {
+			testSvc: testService{
+				password:  "secret",
+				unlockErr: url.ErrTooManyAttempts,
+			},
+			requestBody: []byte(`{"Password":"secret"}`),
+			wantStatus:  http.StatusTooManyRequests,
+			wantBody:    []byte(`{"Code":"Too Many Requests","Message":"` + url.ErrTooManyAttempts.Error() + `"}`),
+		},
+		"success": {
+			testSvc: testService{
+				url:      "url",
+				id:       "ID",
+				password: "secret",
+			},
+			requestBody: []byte(`{"Password":"secret"}`),
+			wantStatus:  http.StatusOK,
+			wantBody:    []byte(`{"URL":"url","ShortURL":"ID"}`),
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+			res, err := http.Post(srv.URL+path.Join("/api/url/ID/unlock"), "application/json",
+				bytes.NewReader(tt.requestBody))
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+
+			checkResponse(t, res, tt.wantStatus, tt.wantBody)
+		})
+	}
+}
+
+func TestDeleteURL(t *testing.T) {
+	tests := map[string]struct {
+		testSvc testService
+
+		wantStatus int
+		wantBody   []byte
+	}{
+		"id not found": {
+			testSvc: testService{
+				err: url.ErrNotFound,
+			},
+			wantStatus: http.StatusNotFound,
+			wantBody:   []byte(`{"Code":"Not Found","Message":"` + url.ErrNotFound.Error() + `"}`),
+		},
+		"svc error": {
+			testSvc: testService{
+				err: errSvc,
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   []byte(`{"Code":"Internal Server Error","Message":"` + errSvc.Error() + `"}`),
+		},
+		"success": {
+			testSvc: testService{
+				url: "url",
+			},
+			wantStatus: http.StatusNoContent,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+			req, err := http.NewRequest(http.MethodDelete, srv.URL+path.Join("/api/url/ID"), nil)
+			if err != nil {
+				t.Errorf("could not create request: %s", err)
+				return
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+
+			checkResponse(t, res, tt.wantStatus, tt.wantBody)
+		})
+	}
+}
+
+type testGenerator string
+
+func (t testGenerator) Generate() (string, error) {
+	return string(t), nil
+}
+
+func TestDeleteURLOnDomain(t *testing.T) {
+	tests := map[string]struct {
+		domain string
+
+		wantStatus int
+		wantFound  bool
+	}{
+		"default domain": {wantStatus: http.StatusNoContent},
+		"known domain":   {domain: "acme.link", wantStatus: http.StatusNotFound, wantFound: true},
+		"unknown domain": {domain: "typo.link", wantStatus: http.StatusBadRequest, wantFound: true},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "urlshort.db"))
+			if err != nil {
+				t.Fatalf("could not open db: %s", err)
+			}
+			defer db.Close()
+
+			urlStore, err := store.NewURLStore(db)
+			if err != nil {
+				t.Fatalf("could not create store: %s", err)
+			}
+
+			svc := url.NewService(url.MustParseBaseURL("http://localhost:8080"), testGenerator("ID"), urlStore,
+				url.WithDomains(url.MustParseBaseURL("https://acme.link")))
+			if _, err := svc.CreateURL(context.Background(), "https://www.google.es", url.LinkOptions{}); err != nil {
+				t.Fatalf("could not create url: %s", err)
+			}
+
+			srv := httptest.NewServer(getRouter(svc))
+			defer srv.Close()
+
+			req, err := http.NewRequest(http.MethodDelete, srv.URL+"/api/url/ID?domain="+tt.domain, nil)
+			if err != nil {
+				t.Fatalf("could not create request: %s", err)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("could not send request: %v", err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("wrong status code returned\nexpected=%d\ngot=%d", tt.wantStatus, res.StatusCode)
+			}
+
+			_, err = svc.GetLink(context.Background(), "ID")
+			if found := err == nil; found != tt.wantFound {
+				t.Errorf("wrong default domain link\nexpected found=%t\ngot=%v", tt.wantFound, err)
+			}
+		})
+	}
+}
+
+func TestRestoreURL(t *testing.T) {
+	tests := map[string]struct {
+		testSvc testService
+
+		wantStatus int
+		wantBody   []byte
+	}{
+		"id not found": {
+			testSvc: testService{
+				err: url.ErrNotFound,
+			},
+			wantStatus: http.StatusNotFound,
+			wantBody:   []byte(`{"Code":"Not Found","Message":"` + url.ErrNotFound.Error() + `"}`),
+		},
+		"svc error": {
+			testSvc: testService{
+				err: errSvc,
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   []byte(`{"Code":"Internal Server Error","Message":"` + errSvc.Error() + `"}`),
+		},
+		"success": {
+			wantStatus: http.StatusNoContent,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+			res, err := http.Post(srv.URL+path.Join("/api/url/ID/restore"), "", nil)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+
+			checkResponse(t, res, tt.wantStatus, tt.wantBody)
+		})
+	}
+}
+
+func TestGetCount(t *testing.T) {
+	tests := map[string]struct {
+		testSvc testService
+
+		wantStatus int
+		wantBody   []byte
+	}{
+		"id not found": {
+			testSvc: testService{
+				err: url.ErrNotFound,
+			},
+			wantStatus: http.StatusNotFound,
+			wantBody:   []byte(`{"Code":"Not Found","Message":"` + url.ErrNotFound.Error() + `"}`),
+		},
+		"svc error": {
+			testSvc: testService{
+				err: errSvc,
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   []byte(`{"Code":"Internal Server Error","Message":"` + errSvc.Error() + `"}`),
+		},
+		"success": {
+			testSvc: testService{
+				count: 10,
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   []byte(`{"ID":"ID","Count":10}`),
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+			res, err := http.Get(srv.URL + path.Join("/api/url/ID/count"))
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+
+			checkResponse(t, res, tt.wantStatus, tt.wantBody)
+		})
+	}
+}
+
+func TestGetRules(t *testing.T) {
+	tests := map[string]struct {
+		testSvc testService
+
+		wantStatus int
+		wantBody   []byte
+	}{
+		"id not found": {
+			testSvc: testService{
+				err: url.ErrNotFound,
+			},
+			wantStatus: http.StatusNotFound,
+			wantBody:   []byte(`{"Code":"Not Found","Message":"` + url.ErrNotFound.Error() + `"}`),
+		},
+		"svc error": {
+			testSvc: testService{
+				err: errSvc,
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   []byte(`{"Code":"Internal Server Error","Message":"` + errSvc.Error() + `"}`),
+		},
+		"no rules": {
+			wantStatus: http.StatusOK,
+			wantBody:   []byte(`{"ID":"ID","Rules":[]}`),
+		},
+		"success": {
+			testSvc: testService{
+				rules: []url.Rule{{Platform: url.PlatformIOS, Target: "url"}},
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   []byte(`{"ID":"ID","Rules":[{"Platform":"ios","Language":"","Country":"","URL":"url"}]}`),
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+			res, err := http.Get(srv.URL + path.Join("/api/url/ID/rules"))
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+
+			checkResponse(t, res, tt.wantStatus, tt.wantBody)
+		})
+	}
+}
+
+func TestSetRules(t *testing.T) {
+	tests := map[string]struct {
+		testSvc     testService
+		requestBody []byte
+
+		wantStatus int
+		wantBody   []byte
+	}{
+		"id not found": {
+			testSvc: testService{
+				err: url.ErrNotFound,
+			},
+			requestBody: []byte(`{"Rules":[{"Platform":"ios","URL":"url"}]}`),
+			wantStatus:  http.StatusNotFound,
+			wantBody:    []byte(`{"Code":"Not Found","Message":"` + url.ErrNotFound.Error() + `"}`),
+		},
+		"invalid rule": {
+			testSvc: testService{
+				err: url.ErrInvalidRule,
+			},
+			requestBody: []byte(`{"Rules":[{"URL":"url"}]}`),
+			wantStatus:  http.StatusBadRequest,
+			wantBody:    []byte(`{"Code":"Bad Request","Message":"` + url.ErrInvalidRule.Error() + `"}`),
+		},
+		"svc error": {
+			testSvc: testService{
+				err: errSvc,
+			},
+			requestBody: []byte(`{"Rules":[{"Platform":"ios","URL":"url"}]}`),
+			wantStatus:  http.StatusInternalServerError,
+			wantBody:    []byte(`{"Code":"Internal Server Error","Message":"` + errSvc.Error() + `"}`),
+		},
+		"success": {
+			requestBody: []byte(`{"Rules":[{"Platform":"ios","URL":"url"},{"Country":"ES","URL":"url-es"}]}`),
+			wantStatus:  http.StatusOK,
+			wantBody: []byte(`{"ID":"ID","Rules":[{"Platform":"ios","Language":"","Country":"","URL":"url"},` +
+				`{"Platform":"","Language":"","Country":"ES","URL":"url-es"}]}`),
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+			req, err := http.NewRequest(http.MethodPut, srv.URL+path.Join("/api/url/ID/rules"),
+				bytes.NewReader(tt.requestBody))
+			if err != nil {
+				t.Errorf("could not create request: %s", err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+
+			checkResponse(t, res, tt.wantStatus, tt.wantBody)
+		})
+	}
+}
+
+func TestSetVariants(t *testing.T) {
+	tests := map[string]struct {
+		testSvc     testService
+		requestBody []byte
+
+		wantStatus int
+		wantBody   []byte
+	}{
+		"id not found": {
+			testSvc: testService{
+				err: url.ErrNotFound,
+			},
+			requestBody: []byte(`{"Variants":[{"URL":"url","Weight":1}]}`),
+			wantStatus:  http.StatusNotFound,
+			wantBody:    []byte(`{"Code":"Not Found","Message":"` + url.ErrNotFound.Error() + `"}`),
+		},
+		"invalid variant": {
+			testSvc: testService{
+				err: url.ErrInvalidVariant,
+			},
+			requestBody: []byte(`{"Variants":[{"URL":"url","Weight":-1}]}`),
+			wantStatus:  http.StatusBadRequest,
+			wantBody:    []byte(`{"Code":"Bad Request","Message":"` + url.ErrInvalidVariant.Error() + `"}`),
+		},
+		"svc error": {
+			testSvc: testService{
+				err: errSvc,
+			},
+			requestBody: []byte(`{"Variants":[{"URL":"url","Weight":1}]}`),
+			wantStatus:  http.StatusInternalServerError,
+			wantBody:    []byte(`{"Code":"Internal Server Error","Message":"` + errSvc.Error() + `"}`),
+		},
+		"success": {
+			requestBody: []byte(`{"Sticky":true,"Variants":[{"Name":"a","URL":"url-a","Weight":70},` +
+				`{"Name":"b","URL":"url-b","Weight":30}]}`),
+			wantStatus: http.StatusOK,
+			wantBody: []byte(`{"ID":"ID","Sticky":true,"Variants":[{"Name":"a","URL":"url-a","Weight":70,"Count":0},` +
+				`{"Name":"b","URL":"url-b","Weight":30,"Count":0}]}`),
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+			req, err := http.NewRequest(http.MethodPut, srv.URL+path.Join("/api/url/ID/variants"),
+				bytes.NewReader(tt.requestBody))
+			if err != nil {
+				t.Errorf("could not create request: %s", err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+
+			checkResponse(t, res, tt.wantStatus, tt.wantBody)
+		})
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	tests := map[string]struct {
+		testSvc testService
+
+		wantStatus int
+		wantBody   []byte
+	}{
+		"id not found": {
+			testSvc: testService{
+				err: url.ErrNotFound,
+			},
+			wantStatus: http.StatusNotFound,
+			wantBody:   []byte(`{"Code":"Not Found","Message":"` + url.ErrNotFound.Error() + `"}`),
+		},
+		"svc error": {
+			testSvc: testService{
+				err: errSvc,
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   []byte(`{"Code":"Internal Server Error","Message":"` + errSvc.Error() + `"}`),
+		},
+		"without variants": {
+			testSvc: testService{
+				count: 3,
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   []byte(`{"ID":"ID","Count":3,"RemainingClicks":null,"Variants":[],"NotBefore":null,"Scheduled":false}`),
+		},
+		"limited clicks": {
+			testSvc: testService{
+				count:     3,
+				maxClicks: 5,
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   []byte(`{"ID":"ID","Count":3,"RemainingClicks":2,"Variants":[],"NotBefore":null,"Scheduled":false}`),
+		},
+		"scheduled": {
+			testSvc: testService{
+				notBefore: time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC),
+				scheduled: true,
+			},
+			wantStatus: http.StatusOK,
+			wantBody: []byte(`{"ID":"ID","Count":0,"RemainingClicks":null,"Variants":[],` +
+				`"NotBefore":"2022-03-01T12:00:00Z","Scheduled":true}`),
+		},
+		"success": {
+			testSvc: testService{
+				count: 10,
+				split: url.Split{Variants: []url.Variant{
+					{Name: "a", Target: "url-a", Weight: 70, Count: 7},
+					{Name: "b", Target: "url-b", Weight: 30, Count: 3},
+				}},
+			},
+			wantStatus: http.StatusOK,
+			wantBody: []byte(`{"ID":"ID","Count":10,"RemainingClicks":null,"Variants":[{"Name":"a","URL":"url-a","Weight":70,"Count":7},` +
+				`{"Name":"b","URL":"url-b","Weight":30,"Count":3}],"NotBefore":null,"Scheduled":false}`),
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(getRouter(&tt.testSvc))
+			res, err := http.Get(srv.URL + path.Join("/api/url/ID/stats"))
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
 
-func (t testService) GetRedirectionCount(ctx context.Context, s string) (int, error) {
-	return t.count, t.err
+			checkResponse(t, res, tt.wantStatus, tt.wantBody)
+		})
+	}
 }
 
-func TestRedirect(t *testing.T) {
+func TestListCampaignURLs(t *testing.T) {
 	tests := map[string]struct {
 		testSvc testService
 
 		wantStatus int
 		wantBody   []byte
 	}{
-		"id not found": {
-			testSvc: testService{
-				err: url.ErrNotFound,
-			},
-			wantStatus: http.StatusNotFound,
-			wantBody:   []byte(`{"Code":"Not Found","Message":"` + url.ErrNotFound.Error() + `"}`),
-		},
 		"svc error": {
 			testSvc: testService{
 				err: errSvc,
@@ -66,153 +2548,411 @@ func TestRedirect(t *testing.T) {
 			wantStatus: http.StatusInternalServerError,
 			wantBody:   []byte(`{"Code":"Internal Server Error","Message":"` + errSvc.Error() + `"}`),
 		},
+		"empty": {
+			wantStatus: http.StatusOK,
+			wantBody:   []byte(`{"Campaign":"spring","Count":0,"URLs":[]}`),
+		},
 		"success": {
 			testSvc: testService{
-				count: 10,
-				url:   "https://www.google.es",
+				links: []url.Link{
+					{
+						Short:    "A",
+						Long:     "url?utm_source=mail",
+						ShortURL: "localhost/A",
+						Count:    3,
+						Campaign: url.Campaign{Source: "mail", Name: "spring"},
+					},
+					{
+						Short:     "C",
+						Long:      "url?utm_source=mail&utm_content=launch",
+						ShortURL:  "localhost/C",
+						Campaign:  url.Campaign{Source: "mail", Name: "spring", Content: "launch"},
+						NotBefore: time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC),
+						Scheduled: true,
+					},
+					{
+						Short:    "B",
+						Long:     "url?utm_source=ads",
+						ShortURL: "localhost/B",
+						Count:    2,
+						Campaign: url.Campaign{Source: "ads", Medium: "cpc", Name: "spring"},
+					},
+				},
 			},
 			wantStatus: http.StatusOK,
-			wantBody:   []byte(`{"ID":"ID","Count":10}`),
+			wantBody: []byte(`{"Campaign":"spring","Count":5,"URLs":[` +
+				`{"ID":"A","URL":"url?utm_source=mail","ShortURL":"localhost/A","Count":3,"Source":"mail","Medium":"","Term":"","Content":"",` +
+				`"NotBefore":null,"Scheduled":false},` +
+				`{"ID":"C","URL":"url?utm_source=mail\u0026utm_content=launch","ShortURL":"localhost/C","Count":0,"Source":"mail","Medium":"",` +
+				`"Term":"","Content":"launch","NotBefore":"2022-03-01T12:00:00Z","Scheduled":true},` +
+				`{"ID":"B","URL":"url?utm_source=ads","ShortURL":"localhost/B","Count":2,"Source":"ads","Medium":"cpc","Term":"","Content":"",` +
+				`"NotBefore":null,"Scheduled":false}]}`),
 		},
 	}
 
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
-			initialCount := tt.testSvc.count
-
 			srv := httptest.NewServer(getRouter(&tt.testSvc))
-			res, err := http.Get(srv.URL + path.Join("/ID"))
+			res, err := http.Get(srv.URL + path.Join("/api/campaign/spring"))
 			if err != nil {
 				t.Errorf("could not send request: %v", err)
 				return
 			}
 
-			if res.StatusCode != http.StatusOK {
-				if initialCount != tt.testSvc.count {
-					t.Errorf("redirection count should not change\nexpected=%d\ngot=%d", initialCount, tt.testSvc.count)
-				}
-
-				checkResponse(t, res, tt.wantStatus, tt.wantBody)
-			} else { // If status code was 200 it redirected correctly
-				if initialCount+1 != tt.testSvc.count {
-					t.Errorf("redirection count should have incremented by one\nexpected=%d\ngot=%d", initialCount+1, tt.testSvc.count)
-				}
-			}
+			checkResponse(t, res, tt.wantStatus, tt.wantBody)
 		})
 	}
 }
 
-func TestCreateURL(t *testing.T) {
+func TestGetQRCode(t *testing.T) {
 	tests := map[string]struct {
-		testSvc     testService
-		requestBody []byte
+		testSvc testService
+		query   string
 
-		wantStatus int
-		wantBody   []byte
+		wantStatus      int
+		wantContentType string
+		wantBody        []byte
 	}{
-		"invalid url": {
-			requestBody: []byte(`{"URL":"url"}`),
+		"id not found": {
 			testSvc: testService{
-				err: url.ErrInvalidURL,
-				url: "url",
+				err: url.ErrNotFound,
 			},
-			wantStatus: http.StatusBadRequest,
-			wantBody:   []byte(`{"Code":"Bad Request","Message":"` + url.ErrInvalidURL.Error() + `"}`),
+			wantStatus:      http.StatusNotFound,
+			wantContentType: "application/json",
+			wantBody:        []byte(`{"Code":"Not Found","Message":"` + url.ErrNotFound.Error() + `"}`),
 		},
-		"svc error": {
-			requestBody: []byte(`{"URL":"url"}`),
+		"invalid size": {
 			testSvc: testService{
-				err: errSvc,
-				url: "url",
+				id: "localhost:8080/ID",
 			},
-			wantStatus: http.StatusInternalServerError,
-			wantBody:   []byte(`{"Code":"Internal Server Error","Message":"` + errSvc.Error() + `"}`),
+			query:           "?size=big",
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json",
+			wantBody:        []byte(`{"Code":"Bad Request","Message":"` + qr.ErrInvalidSize.Error() + `"}`),
 		},
-		"success": {
-			requestBody: []byte(`{"URL":"url"}`),
+		"invalid level": {
 			testSvc: testService{
-				id:  "id",
-				url: "url",
+				id: "localhost:8080/ID",
 			},
-			wantStatus: http.StatusCreated,
-			wantBody:   []byte(`{"URL":"url","ShortURL":"id"}`),
+			query:           "?level=X",
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json",
+			wantBody:        []byte(`{"Code":"Bad Request","Message":"` + qr.ErrInvalidLevel.Error() + `"}`),
+		},
+		"png": {
+			testSvc: testService{
+				id: "localhost:8080/ID",
+			},
+			wantStatus:      http.StatusOK,
+			wantContentType: "image/png",
+		},
+		"svg": {
+			testSvc: testService{
+				id: "localhost:8080/ID",
+			},
+			query:           "?format=svg&size=512&level=H&margin=0",
+			wantStatus:      http.StatusOK,
+			wantContentType: "image/svg+xml",
 		},
 	}
 
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
 			srv := httptest.NewServer(getRouter(&tt.testSvc))
-			res, err := http.Post(srv.URL+path.Join("/api/url"), "application/json",
-				bytes.NewReader(tt.requestBody))
+			res, err := http.Get(srv.URL + "/api/url/ID/qr" + tt.query)
 			if err != nil {
 				t.Errorf("could not send request: %v", err)
 				return
 			}
 
-			checkResponse(t, res, tt.wantStatus, tt.wantBody)
+			if contentType := res.Header.Get("Content-Type"); contentType != tt.wantContentType {
+				t.Errorf("wrong content type returned\nexpected=%s\ngot=%s", tt.wantContentType, contentType)
+			}
+
+			if tt.wantStatus != http.StatusOK {
+				checkResponse(t, res, tt.wantStatus, tt.wantBody)
+				return
+			}
+			res.Body.Close()
+
+			etag := res.Header.Get("ETag")
+			if res.StatusCode != http.StatusOK || etag == "" {
+				t.Errorf("expected a QR code with an ETag\ngot status=%d etag=%q", res.StatusCode, etag)
+				return
+			}
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/url/ID/qr"+tt.query, nil)
+			if err != nil {
+				t.Errorf("could not create request: %s", err)
+				return
+			}
+			req.Header.Set("If-None-Match", etag)
+
+			res, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+
+			checkResponse(t, res, http.StatusNotModified, nil)
 		})
 	}
 }
 
-func TestGetURL(t *testing.T) {
+func TestOrigin(t *testing.T) {
+	tests := map[string]struct {
+		headers map[string]string
+
+		origin url.Origin
+	}{
+		"actor header": {
+			headers: map[string]string{"X-Actor": "alice", "X-Request-Id": "req-1"},
+			origin:  url.Origin{Actor: "alice", RequestID: "req-1", Protocol: url.ProtocolHTTP},
+		},
+		"remote address": {
+			origin: url.Origin{Actor: "127.0.0.1", Protocol: url.ProtocolHTTP},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			testSvc := testService{id: "ID"}
+			srv := httptest.NewServer(getRouter(&testSvc))
+			req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/url", strings.NewReader(`{"URL":"url"}`))
+			if err != nil {
+				t.Errorf("could not create request: %s", err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+			res.Body.Close()
+
+			if testSvc.origin != tt.origin {
+				t.Errorf("wrong origin\nexpected=%+v\ngot=%+v", tt.origin, testSvc.origin)
+			}
+		})
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	tests := map[string]struct {
+		token         string
+		method        string
+		path          string
+		authorization string
+
+		wantStatus int
+	}{
+		"no token": {
+			method:     http.MethodDelete,
+			path:       "/api/url/ID",
+			wantStatus: http.StatusNoContent,
+		},
+		"valid": {
+			token:         "secret",
+			method:        http.MethodDelete,
+			path:          "/api/url/ID",
+			authorization: "Bearer secret",
+			wantStatus:    http.StatusNoContent,
+		},
+		"missing": {
+			token:      "secret",
+			method:     http.MethodDelete,
+			path:       "/api/url/ID",
+			wantStatus: http.StatusUnauthorized,
+		},
+		"wrong": {
+			token:         "secret",
+			method:        http.MethodDelete,
+			path:          "/api/url/ID",
+			authorization: "Bearer other",
+			wantStatus:    http.StatusUnauthorized,
+		},
+		"not bearer": {
+			token:         "secret",
+			method:        http.MethodDelete,
+			path:          "/api/url/ID",
+			authorization: "Basic secret",
+			wantStatus:    http.StatusUnauthorized,
+		},
+		"restore": {
+			token:      "secret",
+			method:     http.MethodPost,
+			path:       "/api/url/ID/restore",
+			wantStatus: http.StatusUnauthorized,
+		},
+		"audit": {
+			token:      "secret",
+			method:     http.MethodGet,
+			path:       "/api/audit",
+			wantStatus: http.StatusUnauthorized,
+		},
+		"audit export": {
+			token:      "secret",
+			method:     http.MethodGet,
+			path:       "/api/audit/export",
+			wantStatus: http.StatusUnauthorized,
+		},
+		"webhooks": {
+			token:      "secret",
+			method:     http.MethodGet,
+			path:       "/api/webhooks",
+			wantStatus: http.StatusUnauthorized,
+		},
+		"v2 delete": {
+			token:      "secret",
+			method:     http.MethodDelete,
+			path:       "/api/v2/links/ID",
+			wantStatus: http.StatusUnauthorized,
+		},
+		"v2 restore": {
+			token:      "secret",
+			method:     http.MethodPost,
+			path:       "/api/v2/links/ID/restore",
+			wantStatus: http.StatusUnauthorized,
+		},
+		"not an admin route": {
+			token:      "secret",
+			method:     http.MethodGet,
+			path:       "/api/url/ID",
+			wantStatus: http.StatusOK,
+		},
+		"v2 not admin route": {
+			token:      "secret",
+			method:     http.MethodGet,
+			path:       "/api/v2/links/ID",
+			wantStatus: http.StatusOK,
+		},
+		"redirection is open": {
+			token:      "secret",
+			method:     http.MethodGet,
+			path:       "/ID",
+			wantStatus: http.StatusTemporaryRedirect,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			testSvc := testService{id: "ID", url: "https://www.example.com"}
+			srv := httptest.NewServer(getRouter(&testSvc, router.WithAdminToken(tt.token)))
+			defer srv.Close()
+
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+			if err != nil {
+				t.Fatalf("could not create request: %s", err)
+			}
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+
+			res, err := noRedirectClient.Do(req)
+			if err != nil {
+				t.Fatalf("could not send request: %v", err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("wrong status code returned\nexpected=%d\ngot=%d", tt.wantStatus, res.StatusCode)
+			}
+			if res.StatusCode == http.StatusUnauthorized && !strings.HasPrefix(res.Header.Get("WWW-Authenticate"), "Bearer") {
+				t.Errorf("missing bearer challenge, got %q", res.Header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestListAuditEntries(t *testing.T) {
+	shortDomain := "sho.rt"
+	entry := url.AuditEntry{
+		ID:     7,
+		Time:   time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC),
+		Action: url.ActionDelete,
+		Short:  "ID",
+		Before: []byte(`{"Long":"url"}`),
+		Origin: url.Origin{Actor: "alice", RequestID: "req-1", Protocol: url.ProtocolGRPC},
+	}
+
 	tests := map[string]struct {
 		testSvc testService
+		query   string
 
 		wantStatus int
 		wantBody   []byte
+		wantFilter *url.AuditFilter
 	}{
-		"id not found": {
+		"invalid time": {
+			query:      "?from=yesterday",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"invalid audit query, times must be RFC 3339 and after and limit numbers"}`),
+		},
+		"invalid filter": {
 			testSvc: testService{
-				err: url.ErrNotFound,
+				err: url.ErrInvalidAuditFilter,
 			},
-			wantStatus: http.StatusNotFound,
-			wantBody:   []byte(`{"Code":"Not Found","Message":"` + url.ErrNotFound.Error() + `"}`),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"` + url.ErrInvalidAuditFilter.Error() + `"}`),
 		},
-		"svc error": {
+		"disabled": {
 			testSvc: testService{
-				err: errSvc,
+				err: url.ErrAuditDisabled,
 			},
-			wantStatus: http.StatusInternalServerError,
-			wantBody:   []byte(`{"Code":"Internal Server Error","Message":"` + errSvc.Error() + `"}`),
+			wantStatus: http.StatusNotImplemented,
+			wantBody:   []byte(`{"Code":"Not Implemented","Message":"` + url.ErrAuditDisabled.Error() + `"}`),
+		},
+		"empty": {
+			query:      "?after=3",
+			wantStatus: http.StatusOK,
+			wantBody:   []byte(`{"Entries":[],"NextAfter":3}`),
+		},
+		"domain": {
+			query:      "?domain=sho.rt&id=ID",
+			wantStatus: http.StatusOK,
+			wantBody:   []byte(`{"Entries":[],"NextAfter":0}`),
+			wantFilter: &url.AuditFilter{Domain: &shortDomain, Short: "ID"},
 		},
 		"success": {
 			testSvc: testService{
-				url: "url",
-				id:  "ID",
+				audit: []url.AuditEntry{entry},
 			},
+			query:      "?id=ID&actor=alice&from=2022-03-01T00:00:00Z&to=2022-03-02T00:00:00Z&limit=10",
 			wantStatus: http.StatusOK,
-			wantBody:   []byte(`{"URL":"url","ShortURL":"ID"}`),
+			wantBody: []byte(`{"Entries":[{"ID":7,"Time":"2022-03-01T12:00:00Z","Action":"delete","Domain":"","URLID":"ID",` +
+				`"Before":{"Long":"url"},"After":null,"Actor":"alice","RequestID":"req-1","Protocol":"grpc"}],"NextAfter":7}`),
 		},
 	}
 
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
 			srv := httptest.NewServer(getRouter(&tt.testSvc))
-			res, err := http.Get(srv.URL + path.Join("/api/url/ID"))
+			res, err := http.Get(srv.URL + "/api/audit" + tt.query)
 			if err != nil {
 				t.Errorf("could not send request: %v", err)
 				return
 			}
 
 			checkResponse(t, res, tt.wantStatus, tt.wantBody)
+			if tt.wantFilter != nil && !reflect.DeepEqual(tt.testSvc.auditFilter, *tt.wantFilter) {
+				t.Errorf("wrong audit filter\nexpected=%+v\ngot=%+v", *tt.wantFilter, tt.testSvc.auditFilter)
+			}
 		})
 	}
 }
 
-func TestDeleteURL(t *testing.T) {
+func TestExportAuditEntries(t *testing.T) {
 	tests := map[string]struct {
 		testSvc testService
 
 		wantStatus int
 		wantBody   []byte
 	}{
-		"id not found": {
-			testSvc: testService{
-				err: url.ErrNotFound,
-			},
-			wantStatus: http.StatusNotFound,
-			wantBody:   []byte(`{"Code":"Not Found","Message":"` + url.ErrNotFound.Error() + `"}`),
-		},
 		"svc error": {
 			testSvc: testService{
 				err: errSvc,
@@ -220,67 +2960,185 @@ func TestDeleteURL(t *testing.T) {
 			wantStatus: http.StatusInternalServerError,
 			wantBody:   []byte(`{"Code":"Internal Server Error","Message":"` + errSvc.Error() + `"}`),
 		},
+		"empty": {
+			wantStatus: http.StatusOK,
+		},
 		"success": {
 			testSvc: testService{
-				url: "url",
+				audit: []url.AuditEntry{
+					{ID: 1, Action: url.ActionCreate, Short: "A", After: []byte(`{"Long":"url"}`)},
+					{ID: 2, Action: url.ActionPurge, Short: "A"},
+				},
 			},
-			wantStatus: http.StatusNoContent,
+			wantStatus: http.StatusOK,
+			wantBody: []byte(`{"ID":1,"Time":"0001-01-01T00:00:00Z","Action":"create","Domain":"","URLID":"A","Before":null,` +
+				`"After":{"Long":"url"},"Actor":"","RequestID":"","Protocol":""}` + "\n" +
+				`{"ID":2,"Time":"0001-01-01T00:00:00Z","Action":"purge","Domain":"","URLID":"A","Before":null,"After":null,` +
+				`"Actor":"","RequestID":"","Protocol":""}`),
 		},
 	}
 
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
 			srv := httptest.NewServer(getRouter(&tt.testSvc))
-			req, err := http.NewRequest(http.MethodDelete, srv.URL+path.Join("/api/url/ID"), nil)
-			if err != nil {
-				t.Errorf("could not create request: %s", err)
-				return
-			}
-			res, err := http.DefaultClient.Do(req)
+			res, err := http.Get(srv.URL + "/api/audit/export")
 			if err != nil {
 				t.Errorf("could not send request: %v", err)
 				return
 			}
 
+			if tt.wantStatus == http.StatusOK && res.Header.Get("Content-Type") != "application/x-ndjson" {
+				t.Errorf("wrong content type\nexpected=application/x-ndjson\ngot=%s", res.Header.Get("Content-Type"))
+			}
+
 			checkResponse(t, res, tt.wantStatus, tt.wantBody)
 		})
 	}
 }
 
-func TestGetCount(t *testing.T) {
+func TestWebhooks(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+
 	tests := map[string]struct {
 		testSvc testService
+		method  string
+		path    string
+		body    string
 
 		wantStatus int
 		wantBody   []byte
 	}{
-		"id not found": {
+		"add invalid body": {
+			method:     http.MethodPost,
+			path:       "/api/webhooks",
+			body:       `{"URL":`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"request body is not valid JSON: unexpected end"}`),
+		},
+		"add invalid webhook": {
 			testSvc: testService{
-				err: url.ErrNotFound,
+				err: url.ErrInvalidWebhook,
+			},
+			method:     http.MethodPost,
+			path:       "/api/webhooks",
+			body:       `{"URL":"ftp://example.com"}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"` + url.ErrInvalidWebhook.Error() + `"}`),
+		},
+		"add disabled": {
+			testSvc: testService{
+				err: url.ErrWebhooksDisabled,
+			},
+			method:     http.MethodPost,
+			path:       "/api/webhooks",
+			body:       `{"URL":"https://example.com"}`,
+			wantStatus: http.StatusNotImplemented,
+			wantBody:   []byte(`{"Code":"Not Implemented","Message":"` + url.ErrWebhooksDisabled.Error() + `"}`),
+		},
+		"add": {
+			method:     http.MethodPost,
+			path:       "/api/webhooks",
+			body:       `{"URL":"https://example.com","Events":["link.created"]}`,
+			wantStatus: http.StatusCreated,
+			wantBody: []byte(`{"ID":1,"URL":"https://example.com","Events":["link.created"],` +
+				`"CreatedAt":"2022-03-01T12:00:00Z","Secret":"generated"}`),
+		},
+		"list hides secrets": {
+			testSvc: testService{
+				webhooks: []url.Webhook{{ID: 1, URL: "https://example.com", Secret: "secret", CreatedAt: now}},
 			},
+			method:     http.MethodGet,
+			path:       "/api/webhooks",
+			wantStatus: http.StatusOK,
+			wantBody: []byte(`{"Webhooks":[{"ID":1,"URL":"https://example.com","Events":[],` +
+				`"CreatedAt":"2022-03-01T12:00:00Z","Secret":""}]}`),
+		},
+		"delete invalid id": {
+			method:     http.MethodDelete,
+			path:       "/api/webhooks/abc",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"invalid webhook or delivery id, it must be a number"}`),
+		},
+		"delete not found": {
+			testSvc: testService{
+				err: url.ErrWebhookNotFound,
+			},
+			method:     http.MethodDelete,
+			path:       "/api/webhooks/1",
 			wantStatus: http.StatusNotFound,
-			wantBody:   []byte(`{"Code":"Not Found","Message":"` + url.ErrNotFound.Error() + `"}`),
+			wantBody:   []byte(`{"Code":"Not Found","Message":"` + url.ErrWebhookNotFound.Error() + `"}`),
 		},
-		"svc error": {
+		"delete": {
+			method:     http.MethodDelete,
+			path:       "/api/webhooks/1",
+			wantStatus: http.StatusNoContent,
+			wantBody:   []byte{},
+		},
+		"deliveries invalid limit": {
+			method:     http.MethodGet,
+			path:       "/api/webhooks/1/deliveries?limit=all",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"invalid limit, it must be a number"}`),
+		},
+		"deliveries invalid filter": {
 			testSvc: testService{
-				err: errSvc,
+				err: url.ErrInvalidDeliveryFilter,
 			},
-			wantStatus: http.StatusInternalServerError,
-			wantBody:   []byte(`{"Code":"Internal Server Error","Message":"` + errSvc.Error() + `"}`),
+			method:     http.MethodGet,
+			path:       "/api/webhooks/1/deliveries?status=sent",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   []byte(`{"Code":"Bad Request","Message":"` + url.ErrInvalidDeliveryFilter.Error() + `"}`),
 		},
-		"success": {
+		"deliveries": {
 			testSvc: testService{
-				count: 10,
+				deliveries: []url.Delivery{
+					{ID: 2, Event: url.EventExpired, Payload: []byte(`{"ID":"ID"}`), CreatedAt: now,
+						Status: url.DeliveryPending, Attempts: 1, NextAttempt: now.Add(time.Minute), LastError: "timeout"},
+					{ID: 1, Event: url.EventCreated, Payload: []byte(`{"ID":"ID"}`), CreatedAt: now,
+						Status: url.DeliveryDelivered, Attempts: 1, NextAttempt: now},
+				},
 			},
+			method:     http.MethodGet,
+			path:       "/api/webhooks/1/deliveries?status=pending&limit=10",
 			wantStatus: http.StatusOK,
-			wantBody:   []byte(`{"ID":"ID","Count":10}`),
+			wantBody: []byte(`{"WebhookID":1,"Deliveries":[` +
+				`{"ID":2,"Event":"link.expired","Payload":{"ID":"ID"},"CreatedAt":"2022-03-01T12:00:00Z",` +
+				`"Status":"pending","Attempts":1,"NextAttempt":"2022-03-01T12:01:00Z","LastError":"timeout"},` +
+				`{"ID":1,"Event":"link.created","Payload":{"ID":"ID"},"CreatedAt":"2022-03-01T12:00:00Z",` +
+				`"Status":"delivered","Attempts":1,"NextAttempt":null,"LastError":""}]}`),
+		},
+		"attempts not found": {
+			testSvc: testService{
+				err: url.ErrDeliveryNotFound,
+			},
+			method:     http.MethodGet,
+			path:       "/api/webhooks/1/deliveries/2/attempts",
+			wantStatus: http.StatusNotFound,
+			wantBody:   []byte(`{"Code":"Not Found","Message":"` + url.ErrDeliveryNotFound.Error() + `"}`),
+		},
+		"attempts": {
+			testSvc: testService{
+				attempts: []url.DeliveryAttempt{{ID: 3, DeliveryID: 2, Time: now, StatusCode: http.StatusBadGateway,
+					Error: "unexpected status 502: ", Duration: 1500 * time.Millisecond}},
+			},
+			method:     http.MethodGet,
+			path:       "/api/webhooks/1/deliveries/2/attempts",
+			wantStatus: http.StatusOK,
+			wantBody: []byte(`{"DeliveryID":2,"Attempts":[{"ID":3,"Time":"2022-03-01T12:00:00Z","StatusCode":502,` +
+				`"Error":"unexpected status 502: ","DurationMs":1500}]}`),
 		},
 	}
 
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
 			srv := httptest.NewServer(getRouter(&tt.testSvc))
-			res, err := http.Get(srv.URL + path.Join("/api/url/ID/count"))
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("could not create request: %v", err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			res, err := http.DefaultClient.Do(req)
 			if err != nil {
 				t.Errorf("could not send request: %v", err)
 				return
@@ -291,9 +3149,9 @@ func TestGetCount(t *testing.T) {
 	}
 }
 
-func getRouter(svc router.URLService) *chi.Mux {
+func getRouter(svc router.URLService, opts ...router.Option) *chi.Mux {
 	r := chi.NewRouter()
-	urlRouter := router.NewURLRouter(svc)
+	urlRouter := router.NewURLRouter(svc, opts...)
 	urlRouter.Routes(r)
 
 	return r
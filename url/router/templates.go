@@ -0,0 +1,104 @@
+package router
+
+import "html/template"
+
+// PreviewHTML is the page showing where a shortened url goes before following it
+const PreviewHTML = `<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1" />
+    <meta name="robots" content="noindex" />
+    <title>{{if .Warn}}You are leaving{{else}}Link preview{{end}} - {{.ShortURL}}</title>
+    <style>
+      body { font-family: -apple-system, "Segoe UI", Roboto, Helvetica, Arial, sans-serif; background: #f4f5f7; color: #1f2328; margin: 0; }
+      main { max-width: 36rem; margin: 4rem auto; padding: 2rem; background: #fff; border-radius: 8px; box-shadow: 0 1px 3px rgba(0, 0, 0, .15); }
+      h1 { font-size: 1.4rem; margin-top: 0; }
+      dl { display: grid; grid-template-columns: max-content auto; gap: .5rem 1rem; }
+      dt { font-weight: bold; }
+      dd { margin: 0; word-break: break-all; }
+      a.button { display: inline-block; margin-top: 1rem; padding: .6rem 1.2rem; background: #0969da; color: #fff; border-radius: 6px; text-decoration: none; }
+    </style>
+  </head>
+  <body>
+    <main>
+      {{if .Warn}}
+      <h1>You are about to leave this site</h1>
+      <p>The link you followed redirects to an external destination. Check it before continuing.</p>
+      {{else}}
+      <h1>Link preview</h1>
+      {{end}}
+      <dl>
+        <dt>Short URL</dt>
+        <dd>{{.ShortURL}}</dd>
+        <dt>Destination</dt>
+        <dd>{{.Long}}</dd>
+        <dt>Created</dt>
+        <dd>{{if .CreatedAt.IsZero}}Unknown{{else}}{{.CreatedAt.Format "2006-01-02 15:04 MST"}}{{end}}</dd>
+        <dt>Clicks</dt>
+        <dd>{{.Count}}</dd>
+      </dl>
+      <a class="button" href="{{.ContinueURL}}" rel="nofollow">Continue</a>
+    </main>
+  </body>
+</html>`
+
+var previewTemplate = template.Must(template.New("preview").Parse(PreviewHTML))
+
+// PasswordHTML is the form asking for the password of a protected shortened url before redirecting
+const PasswordHTML = `<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1" />
+    <meta name="robots" content="noindex" />
+    <title>Password required - {{.ShortURL}}</title>
+    <style>
+      body { font-family: -apple-system, "Segoe UI", Roboto, Helvetica, Arial, sans-serif; background: #f4f5f7; color: #1f2328; margin: 0; }
+      main { max-width: 36rem; margin: 4rem auto; padding: 2rem; background: #fff; border-radius: 8px; box-shadow: 0 1px 3px rgba(0, 0, 0, .15); }
+      h1 { font-size: 1.4rem; margin-top: 0; }
+      input { display: block; width: 100%; box-sizing: border-box; margin-top: .5rem; padding: .6rem; border: 1px solid #d0d7de; border-radius: 6px; font-size: 1rem; }
+      button { margin-top: 1rem; padding: .6rem 1.2rem; background: #0969da; color: #fff; border: 0; border-radius: 6px; font-size: 1rem; cursor: pointer; }
+      .error { color: #cf222e; }
+    </style>
+  </head>
+  <body>
+    <main>
+      <h1>This link is password protected</h1>
+      <p>Enter the password of {{.ShortURL}} to continue.</p>
+      {{if .Error}}<p class="error" role="alert">{{.Error}}</p>{{end}}
+      <form method="post">
+        <label for="password">Password</label>
+        <input id="password" name="password" type="password" autocomplete="current-password" required autofocus />
+        <button type="submit">Continue</button>
+      </form>
+    </main>
+  </body>
+</html>`
+
+var passwordTemplate = template.Must(template.New("password").Parse(PasswordHTML))
+
+// ComingSoonHTML is the page shown when visiting a shortened url that is not active yet, see WithComingSoonPage
+const ComingSoonHTML = `<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1" />
+    <meta name="robots" content="noindex" />
+    <title>Coming soon - {{.ShortURL}}</title>
+    <style>
+      body { font-family: -apple-system, "Segoe UI", Roboto, Helvetica, Arial, sans-serif; background: #f4f5f7; color: #1f2328; margin: 0; }
+      main { max-width: 36rem; margin: 4rem auto; padding: 2rem; background: #fff; border-radius: 8px; box-shadow: 0 1px 3px rgba(0, 0, 0, .15); }
+      h1 { font-size: 1.4rem; margin-top: 0; }
+    </style>
+  </head>
+  <body>
+    <main>
+      <h1>Coming soon</h1>
+      <p>{{.ShortURL}} will be available on <time datetime="{{.NotBefore.Format "2006-01-02T15:04:05Z07:00"}}">{{.NotBefore.Format "2006-01-02 15:04 MST"}}</time>.</p>
+    </main>
+  </body>
+</html>`
+
+// ComingSoonTemplate is the default template of ComingSoonHTML
+var ComingSoonTemplate = template.Must(template.New("coming-soon").Parse(ComingSoonHTML))
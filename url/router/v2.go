@@ -0,0 +1,337 @@
+package router
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nerock/urlshort/server"
+	"github.com/nerock/urlshort/url"
+)
+
+// LinkRequestV2 is the request to create a new link in the v2 api
+type LinkRequestV2 struct {
+	URL string `json:"url"`
+	// Domain is the host of the short domain the link is created on, the default domain when it is not set
+	Domain       string `json:"domain"`
+	Warn         bool   `json:"warn"`
+	RedirectType int    `json:"redirectType"`
+	ForwardQuery string `json:"forwardQuery"`
+	ForwardPath  bool   `json:"forwardPath"`
+	// Campaign are the UTM parameters merged into the long url
+	Campaign *CampaignV2 `json:"campaign"`
+	// Password protects the link, visits must enter it before being redirected
+	Password string `json:"password"`
+	// MaxClicks is the number of redirections after which the link stops working, 0 is unlimited
+	MaxClicks int `json:"maxClicks"`
+	// NotBefore is the time the link starts working, it works right away when it is not set
+	NotBefore time.Time `json:"notBefore"`
+}
+
+// CampaignV2 are the UTM parameters of a link in the v2 api
+type CampaignV2 struct {
+	Source  string `json:"source"`
+	Medium  string `json:"medium,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Term    string `json:"term,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+// LinkV2 is a link with its details and counts in the v2 api
+type LinkV2 struct {
+	ID string `json:"id"`
+	// Domain is the host of the short domain of the link, empty for the default domain
+	Domain   string `json:"domain,omitempty"`
+	ShortURL string `json:"shortUrl"`
+	// LongURL is left out of password protected links
+	LongURL string `json:"longUrl,omitempty"`
+	// CreatedAt is left out when it is not known, like for links created when they could not be read back
+	CreatedAt       *time.Time  `json:"createdAt,omitempty"`
+	Clicks          int         `json:"clicks"`
+	MaxClicks       int         `json:"maxClicks,omitempty"`
+	RemainingClicks *int        `json:"remainingClicks,omitempty"`
+	RedirectType    int         `json:"redirectType"`
+	Warn            bool        `json:"warn"`
+	ForwardQuery    string      `json:"forwardQuery,omitempty"`
+	ForwardPath     bool        `json:"forwardPath"`
+	Campaign        *CampaignV2 `json:"campaign,omitempty"`
+	Protected       bool        `json:"protected"`
+	NotBefore       *time.Time  `json:"notBefore,omitempty"`
+	// Scheduled is false for created links that could not be read back, their NotBefore is still set
+	Scheduled bool        `json:"scheduled"`
+	Rules     []RuleV2    `json:"rules,omitempty"`
+	Variants  []VariantV2 `json:"variants,omitempty"`
+}
+
+// RuleV2 is a routing rule of a link in the v2 api
+type RuleV2 struct {
+	Platform string `json:"platform,omitempty"`
+	Language string `json:"language,omitempty"`
+	Country  string `json:"country,omitempty"`
+	// URL is left out of password protected links
+	URL string `json:"url,omitempty"`
+}
+
+// VariantV2 is a weighted variant of a link with its count of redirections in the v2 api
+type VariantV2 struct {
+	Name string `json:"name"`
+	// URL is left out of password protected links
+	URL    string `json:"url,omitempty"`
+	Weight int    `json:"weight"`
+	Clicks int    `json:"clicks"`
+}
+
+// CampaignMetaV2 is the meta of the links of a campaign in the v2 api
+type CampaignMetaV2 struct {
+	Campaign string `json:"campaign"`
+	Count    int    `json:"count"`
+	Clicks   int    `json:"clicks"`
+}
+
+// Validate checks the URL is set, the rest of the fields are checked by the service
+func (req LinkRequestV2) Validate() []server.FieldError {
+	if req.URL == "" {
+		return []server.FieldError{{Field: "url", Message: "is required"}}
+	}
+
+	return nil
+}
+
+// routesV2 adds the routes of the v2 api, v1 keeps working unchanged alongside it
+func (ur URLRouter) routesV2(r chi.Router) {
+	r.Route("/links", func(r chi.Router) {
+		r.Use(originHTTP, paramDomain)
+		r.Post("/", ur.createLinkV2)
+		r.Route("/{id}", func(r chi.Router) {
+			r.Get("/", ur.getLinkV2)
+			r.With(ur.adminV2).Delete("/", ur.deleteLinkV2)
+			r.With(ur.adminV2).Post("/restore", ur.restoreLinkV2)
+		})
+	})
+	r.Get("/campaigns/{campaign}/links", ur.listCampaignLinksV2)
+}
+
+func (ur URLRouter) createLinkV2(w http.ResponseWriter, r *http.Request) {
+	var req LinkRequestV2
+	if code, err := server.DecodeJSON(r, &req, ur.maxBodySize); err != nil {
+		server.RenderProblem(w, r, err, code)
+		return
+	}
+
+	ctx := r.Context()
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		ctx = url.WithIdempotencyKey(ctx, key)
+	}
+
+	opts := url.LinkOptions{
+		Domain:       req.Domain,
+		Warn:         req.Warn,
+		RedirectType: req.RedirectType,
+		ForwardQuery: req.ForwardQuery,
+		ForwardPath:  req.ForwardPath,
+		Password:     req.Password,
+		MaxClicks:    req.MaxClicks,
+		NotBefore:    req.NotBefore,
+	}
+	if req.Campaign != nil {
+		opts.Campaign = url.Campaign(*req.Campaign)
+	}
+
+	shortURL, err := ur.urlSvc.CreateURL(ctx, req.URL, opts)
+	if err != nil {
+		server.RenderProblem(w, r, err, statusV2(err))
+		return
+	}
+
+	// The link is read back for its details, the domain of the request selects it when it is not the default one.
+	// It is already created, so when it can not be read the response only has the details of the request
+	if req.Domain != "" {
+		ctx = url.WithDomain(ctx, req.Domain)
+	}
+	id := path.Base(shortURL)
+	var res LinkV2
+	if link, err := ur.urlSvc.GetLink(ctx, id); err != nil {
+		log.Printf("could not get created link %s: %s", shortURL, err)
+		res = requestLinkV2(req, id, shortURL)
+	} else {
+		res = toLinkV2(link)
+	}
+
+	location := "/api/v2/links/" + id
+	if req.Domain != "" {
+		location += "?" + neturl.Values{domainParam: {req.Domain}}.Encode()
+	}
+	w.Header().Set("Location", location)
+	server.RenderData(w, res, nil, http.StatusCreated)
+}
+
+func (ur URLRouter) getLinkV2(w http.ResponseWriter, r *http.Request) {
+	link, err := ur.urlSvc.GetLink(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		server.RenderProblem(w, r, err, statusV2(err))
+		return
+	}
+
+	server.RenderData(w, toLinkV2(link), nil, http.StatusOK)
+}
+
+func (ur URLRouter) deleteLinkV2(w http.ResponseWriter, r *http.Request) {
+	if err := ur.urlSvc.DeleteURL(r.Context(), chi.URLParam(r, "id")); err != nil {
+		server.RenderProblem(w, r, err, statusV2(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ur URLRouter) restoreLinkV2(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := ur.urlSvc.RestoreURL(r.Context(), id); err != nil {
+		server.RenderProblem(w, r, err, statusV2(err))
+		return
+	}
+
+	link, err := ur.urlSvc.GetLink(r.Context(), id)
+	if err != nil {
+		server.RenderProblem(w, r, err, statusV2(err))
+		return
+	}
+
+	server.RenderData(w, toLinkV2(link), nil, http.StatusOK)
+}
+
+func (ur URLRouter) listCampaignLinksV2(w http.ResponseWriter, r *http.Request) {
+	campaign := chi.URLParam(r, "campaign")
+	links, err := ur.urlSvc.ListURLsByCampaign(r.Context(), campaign)
+	if err != nil {
+		server.RenderProblem(w, r, err, statusV2(err))
+		return
+	}
+
+	meta := CampaignMetaV2{Campaign: campaign, Count: len(links)}
+	res := make([]LinkV2, 0, len(links))
+	for _, link := range links {
+		meta.Clicks += link.Count
+		res = append(res, toLinkV2(link))
+	}
+
+	server.RenderData(w, res, meta, http.StatusOK)
+}
+
+// requestLinkV2 is the link created by the request with the details it sets, the ones set by the service like
+// its creation time are left out. Scheduled is false since the service clock decides it, NotBefore is kept
+func requestLinkV2(req LinkRequestV2, id, shortURL string) LinkV2 {
+	res := LinkV2{
+		ID:           id,
+		Domain:       req.Domain,
+		ShortURL:     shortURL,
+		LongURL:      req.URL,
+		MaxClicks:    req.MaxClicks,
+		RedirectType: req.RedirectType,
+		Warn:         req.Warn,
+		ForwardQuery: req.ForwardQuery,
+		ForwardPath:  req.ForwardPath,
+		Campaign:     req.Campaign,
+		Protected:    req.Password != "",
+		NotBefore:    optionalTime(req.NotBefore),
+	}
+	// The long url of campaigns has the UTM parameters merged by the service
+	if res.Protected || res.Campaign != nil {
+		res.LongURL = ""
+	}
+	if res.RedirectType == 0 {
+		res.RedirectType = url.DefaultRedirectType
+	}
+	if req.MaxClicks > 0 {
+		remaining := req.MaxClicks
+		res.RemainingClicks = &remaining
+	}
+
+	return res
+}
+
+func toLinkV2(link url.Link) LinkV2 {
+	res := LinkV2{
+		ID:           link.Short,
+		Domain:       link.Domain,
+		ShortURL:     link.ShortURL,
+		LongURL:      link.Long,
+		CreatedAt:    optionalTime(link.CreatedAt),
+		Clicks:       link.Count,
+		MaxClicks:    link.MaxClicks,
+		RedirectType: link.RedirectType,
+		Warn:         link.Warn,
+		ForwardQuery: link.ForwardQuery,
+		ForwardPath:  link.ForwardPath,
+		Protected:    link.Protected(),
+		NotBefore:    optionalTime(link.NotBefore),
+		Scheduled:    link.Scheduled,
+	}
+	if res.Protected {
+		res.LongURL = ""
+	}
+	if res.RedirectType == 0 {
+		res.RedirectType = url.DefaultRedirectType
+	}
+	if link.MaxClicks > 0 {
+		remaining := link.MaxClicks - link.Count
+		if remaining < 0 {
+			remaining = 0
+		}
+		res.RemainingClicks = &remaining
+	}
+	if !link.Campaign.IsZero() {
+		campaign := CampaignV2(link.Campaign)
+		res.Campaign = &campaign
+	}
+	// The targets of rules and variants reveal the destinations of protected links like their long url
+	for _, rule := range link.Rules {
+		res.Rules = append(res.Rules, RuleV2{
+			Platform: rule.Platform,
+			Language: rule.Language,
+			Country:  rule.Country,
+			URL:      protectedTarget(res.Protected, rule.Target),
+		})
+	}
+	for _, variant := range link.Split.Variants {
+		res.Variants = append(res.Variants, VariantV2{
+			Name:   variant.Name,
+			URL:    protectedTarget(res.Protected, variant.Target),
+			Weight: variant.Weight,
+			Clicks: variant.Count,
+		})
+	}
+
+	return res
+}
+
+// protectedTarget returns the target of a rule or variant, empty for password protected links
+func protectedTarget(protected bool, target string) string {
+	if protected {
+		return ""
+	}
+
+	return target
+}
+
+// statusV2 returns the HTTP status code of the service errors in the v2 api
+func statusV2(err error) int {
+	switch {
+	case errors.Is(err, url.ErrNotFound), errors.Is(err, url.ErrNotActive):
+		return http.StatusNotFound
+	case errors.Is(err, url.ErrIdempotencyConflict), errors.Is(err, url.ErrIdempotencyInProgress):
+		return http.StatusConflict
+	case errors.Is(err, url.ErrInvalidURL), errors.Is(err, url.ErrSelfReference), errors.Is(err, url.ErrBlockedHost),
+		errors.Is(err, url.ErrInvalidRedirectType), errors.Is(err, url.ErrInvalidQueryMode),
+		errors.Is(err, url.ErrInvalidCampaign), errors.Is(err, url.ErrInvalidPassword),
+		errors.Is(err, url.ErrInvalidMaxClicks), errors.Is(err, url.ErrUnknownDomain),
+		errors.Is(err, url.ErrInvalidIdempotencyKey):
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
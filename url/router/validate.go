@@ -0,0 +1,58 @@
+package router
+
+import (
+	"fmt"
+
+	"github.com/nerock/urlshort/server"
+)
+
+// Validate checks the URL is set, the rest of the fields are checked by the service
+func (req URLRequest) Validate() []server.FieldError {
+	if req.URL == "" {
+		return []server.FieldError{{Field: "URL", Message: "is required"}}
+	}
+
+	return nil
+}
+
+// Validate checks the password is set
+func (req UnlockRequest) Validate() []server.FieldError {
+	if req.Password == "" {
+		return []server.FieldError{{Field: "Password", Message: "is required"}}
+	}
+
+	return nil
+}
+
+// Validate checks every rule has a URL, their conditions are checked by the service
+func (req RulesRequest) Validate() []server.FieldError {
+	var fields []server.FieldError
+	for i, rule := range req.Rules {
+		if rule.URL == "" {
+			fields = append(fields, server.FieldError{Field: fmt.Sprintf("Rules[%d].URL", i), Message: "is required"})
+		}
+	}
+
+	return fields
+}
+
+// Validate checks every variant has a URL, their names and weights are checked by the service
+func (req VariantsRequest) Validate() []server.FieldError {
+	var fields []server.FieldError
+	for i, variant := range req.Variants {
+		if variant.URL == "" {
+			fields = append(fields, server.FieldError{Field: fmt.Sprintf("Variants[%d].URL", i), Message: "is required"})
+		}
+	}
+
+	return fields
+}
+
+// Validate checks the URL of the webhook is set
+func (req WebhookRequest) Validate() []server.FieldError {
+	if req.URL == "" {
+		return []server.FieldError{{Field: "URL", Message: "is required"}}
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package router
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nerock/urlshort/url"
+)
+
+// CountryResolver resolves the country of the IP address of a visit
+type CountryResolver interface {
+	Country(net.IP) (string, error)
+}
+
+// visit gets the information of a redirection request that routing rules are matched against
+func (ur URLRouter) visit(r *http.Request) url.Visit {
+	return url.Visit{
+		Platform: platform(r),
+		Language: preferredLanguage(r.Header.Get("Accept-Language")),
+		Country:  ur.country(r),
+	}
+}
+
+func (ur URLRouter) country(r *http.Request) string {
+	if ur.countries == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+
+	country, err := ur.countries.Country(ip)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return country
+}
+
+// platform detects the platform of a visit from its client hints or its user agent
+func platform(r *http.Request) string {
+	switch strings.ToLower(strings.Trim(r.Header.Get("Sec-CH-UA-Platform"), `"`)) {
+	case "ios":
+		return url.PlatformIOS
+	case "android":
+		return url.PlatformAndroid
+	case "windows":
+		return url.PlatformWindows
+	case "macos":
+		return url.PlatformMacOS
+	case "linux", "chrome os", "chromeos":
+		return url.PlatformLinux
+	}
+
+	agent := r.UserAgent()
+	switch {
+	case strings.Contains(agent, "iPhone"), strings.Contains(agent, "iPad"), strings.Contains(agent, "iPod"):
+		return url.PlatformIOS
+	case strings.Contains(agent, "Android"):
+		return url.PlatformAndroid
+	case strings.Contains(agent, "Windows"):
+		return url.PlatformWindows
+	case strings.Contains(agent, "Macintosh"), strings.Contains(agent, "Mac OS X"):
+		return url.PlatformMacOS
+	case strings.Contains(agent, "Linux"), strings.Contains(agent, "X11"), strings.Contains(agent, "CrOS"):
+		return url.PlatformLinux
+	default:
+		return ""
+	}
+}
+
+// preferredLanguage returns the language tag with the highest quality of an Accept-Language header
+func preferredLanguage(acceptLanguage string) string {
+	type language struct {
+		tag     string
+		quality float64
+	}
+
+	var languages []language
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag == "" || tag == "*" {
+			continue
+		}
+
+		quality := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if parsed, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err == nil {
+				quality = parsed
+			}
+		}
+
+		if quality > 0 {
+			languages = append(languages, language{tag, quality})
+		}
+	}
+
+	if len(languages) == 0 {
+		return ""
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+
+	return languages[0].tag
+}
@@ -0,0 +1,230 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nerock/urlshort/server"
+	"github.com/nerock/urlshort/url"
+)
+
+var (
+	errInvalidWebhookID = errors.New("invalid webhook or delivery id, it must be a number")
+	errInvalidLimit     = errors.New("invalid limit, it must be a number")
+)
+
+// WebhookRequest is the request to register a webhook
+type WebhookRequest struct {
+	URL string
+	// Events are the events sent to the webhook: link.created, link.deleted, link.expired or link.clicks,
+	// empty subscribes it to all of them
+	Events []string
+	// Secret signs the payloads sent to the webhook, a random one is generated when it is not set
+	Secret string
+}
+
+// WebhookResponse is the response with the details of a webhook
+type WebhookResponse struct {
+	ID        int64
+	URL       string
+	Events    []string
+	CreatedAt time.Time
+	// Secret is only returned when the webhook is registered
+	Secret string
+}
+
+// WebhooksResponse is the response with the registered webhooks
+type WebhooksResponse struct {
+	Webhooks []WebhookResponse
+}
+
+// DeliveriesResponse is the response with the deliveries of a webhook from the newest
+type DeliveriesResponse struct {
+	WebhookID  int64
+	Deliveries []DeliveryResponse
+}
+
+// DeliveryResponse is the response with the details of a delivery of an event to a webhook
+type DeliveryResponse struct {
+	ID        int64
+	Event     string
+	Payload   json.RawMessage
+	CreatedAt time.Time
+	// Status is pending, delivered or failed
+	Status   string
+	Attempts int
+	// NextAttempt is null unless the delivery is pending
+	NextAttempt *time.Time
+	LastError   string
+}
+
+// DeliveryAttemptsResponse is the response with the attempts made to send a delivery
+type DeliveryAttemptsResponse struct {
+	DeliveryID int64
+	Attempts   []DeliveryAttemptResponse
+}
+
+// DeliveryAttemptResponse is the response with the outcome of an attempt to send a delivery
+type DeliveryAttemptResponse struct {
+	ID   int64
+	Time time.Time
+	// StatusCode is 0 when the webhook did not respond
+	StatusCode int
+	Error      string
+	DurationMs int64
+}
+
+func (ur URLRouter) addWebhook(w http.ResponseWriter, r *http.Request) {
+	var req WebhookRequest
+	if code, err := server.DecodeJSON(r, &req, ur.maxBodySize); err != nil {
+		server.RenderError(w, err, code)
+		return
+	}
+
+	webhook, err := ur.urlSvc.AddWebhook(r.Context(), url.Webhook{URL: req.URL, Events: req.Events, Secret: req.Secret})
+	if err != nil {
+		renderWebhookError(w, err)
+		return
+	}
+
+	res := toWebhookResponse(webhook)
+	res.Secret = webhook.Secret
+
+	server.RenderSuccess(w, res, http.StatusCreated)
+}
+
+func (ur URLRouter) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := ur.urlSvc.ListWebhooks(r.Context())
+	if err != nil {
+		renderWebhookError(w, err)
+		return
+	}
+
+	res := WebhooksResponse{Webhooks: make([]WebhookResponse, 0, len(webhooks))}
+	for _, webhook := range webhooks {
+		res.Webhooks = append(res.Webhooks, toWebhookResponse(webhook))
+	}
+
+	server.RenderSuccess(w, res, http.StatusOK)
+}
+
+func (ur URLRouter) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "webhookID"), 10, 64)
+	if err != nil {
+		server.RenderError(w, errInvalidWebhookID, http.StatusBadRequest)
+		return
+	}
+
+	if err := ur.urlSvc.DeleteWebhook(r.Context(), id); err != nil {
+		renderWebhookError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ur URLRouter) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "webhookID"), 10, 64)
+	if err != nil {
+		server.RenderError(w, errInvalidWebhookID, http.StatusBadRequest)
+		return
+	}
+
+	filter := url.DeliveryFilter{Status: r.URL.Query().Get("status")}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			server.RenderError(w, errInvalidLimit, http.StatusBadRequest)
+			return
+		}
+	}
+
+	deliveries, err := ur.urlSvc.ListDeliveries(r.Context(), id, filter)
+	if err != nil {
+		renderWebhookError(w, err)
+		return
+	}
+
+	res := DeliveriesResponse{WebhookID: id, Deliveries: make([]DeliveryResponse, 0, len(deliveries))}
+	for _, delivery := range deliveries {
+		d := DeliveryResponse{
+			ID:        delivery.ID,
+			Event:     delivery.Event,
+			Payload:   delivery.Payload,
+			CreatedAt: delivery.CreatedAt,
+			Status:    delivery.Status,
+			Attempts:  delivery.Attempts,
+			LastError: delivery.LastError,
+		}
+		if delivery.Status == url.DeliveryPending {
+			d.NextAttempt = optionalTime(delivery.NextAttempt)
+		}
+		res.Deliveries = append(res.Deliveries, d)
+	}
+
+	server.RenderSuccess(w, res, http.StatusOK)
+}
+
+func (ur URLRouter) listDeliveryAttempts(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := strconv.ParseInt(chi.URLParam(r, "webhookID"), 10, 64)
+	if err != nil {
+		server.RenderError(w, errInvalidWebhookID, http.StatusBadRequest)
+		return
+	}
+
+	deliveryID, err := strconv.ParseInt(chi.URLParam(r, "deliveryID"), 10, 64)
+	if err != nil {
+		server.RenderError(w, errInvalidWebhookID, http.StatusBadRequest)
+		return
+	}
+
+	attempts, err := ur.urlSvc.ListDeliveryAttempts(r.Context(), webhookID, deliveryID)
+	if err != nil {
+		renderWebhookError(w, err)
+		return
+	}
+
+	res := DeliveryAttemptsResponse{DeliveryID: deliveryID, Attempts: make([]DeliveryAttemptResponse, 0, len(attempts))}
+	for _, attempt := range attempts {
+		res.Attempts = append(res.Attempts, DeliveryAttemptResponse{
+			ID:         attempt.ID,
+			Time:       attempt.Time,
+			StatusCode: attempt.StatusCode,
+			Error:      attempt.Error,
+			DurationMs: attempt.Duration.Milliseconds(),
+		})
+	}
+
+	server.RenderSuccess(w, res, http.StatusOK)
+}
+
+func renderWebhookError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, url.ErrInvalidWebhook), errors.Is(err, url.ErrForbiddenWebhookHost),
+		errors.Is(err, url.ErrInvalidDeliveryFilter):
+		server.RenderError(w, err, http.StatusBadRequest)
+	case errors.Is(err, url.ErrWebhookNotFound), errors.Is(err, url.ErrDeliveryNotFound):
+		server.RenderError(w, err, http.StatusNotFound)
+	case errors.Is(err, url.ErrWebhooksDisabled):
+		server.RenderError(w, err, http.StatusNotImplemented)
+	default:
+		server.RenderError(w, err, http.StatusInternalServerError)
+	}
+}
+
+func toWebhookResponse(webhook url.Webhook) WebhookResponse {
+	events := webhook.Events
+	if events == nil {
+		events = []string{}
+	}
+
+	return WebhookResponse{
+		ID:        webhook.ID,
+		URL:       webhook.URL,
+		Events:    events,
+		CreatedAt: webhook.CreatedAt,
+	}
+}
@@ -0,0 +1,110 @@
+package url
+
+import "strings"
+
+// Platforms matched by routing rules
+const (
+	PlatformIOS     = "ios"
+	PlatformAndroid = "android"
+	PlatformWindows = "windows"
+	PlatformMacOS   = "macos"
+	PlatformLinux   = "linux"
+)
+
+// MaxRules is the maximum number of routing rules of a link
+const MaxRules = 50
+
+// Rule routes the visits matching all its conditions to its target instead of the long url,
+// empty conditions match any visit but at least one condition is required
+type Rule struct {
+	Platform string
+	// Language is a language tag matched against the preferred language of the visit, "es" matches "es-MX"
+	Language string
+	// Country is an ISO 3166-1 alpha-2 country code
+	Country string
+	Target  string
+}
+
+// Visit is the information of a redirection request rules are matched against
+type Visit struct {
+	Platform string
+	Language string
+	Country  string
+}
+
+// Matches checks if the visit meets all the rule conditions
+func (r Rule) Matches(v Visit) bool {
+	if r.Platform != "" && r.Platform != strings.ToLower(v.Platform) {
+		return false
+	}
+
+	if r.Country != "" && r.Country != strings.ToUpper(v.Country) {
+		return false
+	}
+
+	if r.Language != "" {
+		language := strings.ToLower(v.Language)
+		if language != r.Language && !strings.HasPrefix(language, r.Language+"-") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MatchRules returns the target of the first rule matching the visit
+func MatchRules(rules []Rule, v Visit) (string, bool) {
+	for _, rule := range rules {
+		if rule.Matches(v) {
+			return rule.Target, true
+		}
+	}
+
+	return "", false
+}
+
+func validRule(r Rule) (Rule, error) {
+	r = Rule{
+		Platform: strings.ToLower(strings.TrimSpace(r.Platform)),
+		Language: strings.ToLower(strings.TrimSpace(r.Language)),
+		Country:  strings.ToUpper(strings.TrimSpace(r.Country)),
+		Target:   strings.TrimSpace(r.Target),
+	}
+
+	if r.Platform == "" && r.Language == "" && r.Country == "" {
+		return Rule{}, ErrInvalidRule
+	}
+
+	switch r.Platform {
+	case "", PlatformIOS, PlatformAndroid, PlatformWindows, PlatformMacOS, PlatformLinux:
+	default:
+		return Rule{}, ErrInvalidRule
+	}
+
+	if r.Country != "" && !isLetters(r.Country, 2) {
+		return Rule{}, ErrInvalidRule
+	}
+
+	if r.Language != "" {
+		primary, _, _ := strings.Cut(r.Language, "-")
+		if len(primary) < 2 || len(primary) > 3 || !isLetters(primary, len(primary)) {
+			return Rule{}, ErrInvalidRule
+		}
+	}
+
+	return r, nil
+}
+
+func isLetters(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+
+	return true
+}
@@ -4,13 +4,65 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
-	"path"
+	"strings"
+	"time"
 )
 
 var (
-	ErrInvalidURL = errors.New("invalid URL provided")
-	ErrNotFound   = errors.New("URL not found")
+	ErrInvalidURL     = errors.New("invalid URL provided")
+	ErrNotFound       = errors.New("URL not found")
+	ErrSelfReference  = errors.New("URL points to this URL shortener")
+	ErrBlockedHost    = errors.New("URL points to a blocked URL shortener")
+	ErrInvalidBaseURL = errors.New("invalid base URL, it must be an http or https URL with a host and an optional " +
+		"path prefix")
+	ErrUnknownDomain = errors.New("unknown short domain")
+
+	ErrInvalidRedirectType = errors.New("invalid redirect type, must be 301, 302, 307 or 308")
+	ErrInvalidQueryMode    = errors.New("invalid query forwarding mode, must be merge or override")
+	ErrInvalidCampaign     = errors.New("invalid campaign, the source is required")
+	ErrInvalidRule         = errors.New("invalid routing rule, it needs a valid platform, language or country")
+	ErrTooManyRules        = fmt.Errorf("too many routing rules, the maximum is %d", MaxRules)
+	ErrInvalidVariant      = fmt.Errorf("invalid variants, they need unique names and weights up to %d", MaxVariantWeight)
+	ErrTooManyVariants     = fmt.Errorf("too many variants, the maximum is %d", MaxVariants)
+
+	ErrInvalidPassword = fmt.Errorf("invalid password, it must be between %d and %d bytes",
+		MinPasswordLength, MaxPasswordLength)
+	ErrPasswordRequired = errors.New("URL is password protected")
+	ErrWrongPassword    = errors.New("wrong password")
+	ErrTooManyAttempts  = errors.New("too many password attempts, try again later")
+
+	ErrInvalidMaxClicks = errors.New("invalid max clicks, it must be positive or 0 for unlimited clicks")
+	ErrExhausted        = errors.New("URL reached its maximum number of clicks")
+	ErrNotActive        = errors.New("URL is not active yet")
+
+	ErrDuplicateID = errors.New("short URL id already in use")
+
+	ErrInvalidIdempotencyKey = fmt.Errorf("invalid idempotency key, it must be at most %d bytes",
+		MaxIdempotencyKeyLength)
+	ErrIdempotencyConflict   = errors.New("idempotency key already used with a different request")
+	ErrIdempotencyInProgress = errors.New("a request with the same idempotency key is in progress")
+
+	ErrAuditDisabled      = errors.New("audit log is not enabled")
+	ErrInvalidAuditFilter = errors.New("invalid audit filter, the time range must not be empty and the limit at most 1000")
+
+	ErrWebhooksDisabled      = errors.New("webhooks are not enabled")
+	ErrInvalidWebhook        = errors.New("invalid webhook, it needs an http or https URL and known events")
+	ErrForbiddenWebhookHost  = errors.New("webhook host resolves to a private, loopback or link-local address")
+	ErrWebhookNotFound       = errors.New("webhook not found")
+	ErrDeliveryNotFound      = errors.New("webhook delivery not found")
+	ErrInvalidDeliveryFilter = fmt.Errorf("invalid delivery filter, the status must be pending, delivered or failed "+
+		"and the limit at most %d", MaxDeliveryLimit)
+)
+
+const (
+	// DefaultRetention is how long deleted urls are kept in the trash before being purged
+	DefaultRetention = 30 * 24 * time.Hour
+
+	// maxGenerateAttempts is the number of ids generated for a new url before giving up
+	// when they are already in use, including by deleted urls that were not purged yet
+	maxGenerateAttempts = 5
 )
 
 // Generator is the interface for a short id generator
@@ -18,13 +70,99 @@ type Generator interface {
 	Generate() (string, error)
 }
 
-// Store is the interface for a storage engine for urls
+// Store is the interface for a storage engine for urls, they are identified by their domain and short id
 type Store interface {
-	AddURL(ctx context.Context, short, long string) error
-	GetURL(ctx context.Context, short string) (string, error)
-	DeleteURL(ctx context.Context, short string) error
-	IncrementRedirectionCount(ctx context.Context, short string) error
-	GetRedirectionCount(ctx context.Context, short string) (int, error)
+	// AddURL returns ErrDuplicateID when the short id is in use by another url, deleted or not. The events are
+	// queued for the webhooks in the same transaction as the url
+	AddURL(ctx context.Context, link Link, events ...Event) error
+	GetURL(ctx context.Context, domain, short string) (string, error)
+	GetLink(ctx context.Context, domain, short string) (Link, error)
+	// ListURLsByCampaign lists the urls of the campaign on every domain
+	ListURLsByCampaign(ctx context.Context, campaign string) ([]Link, error)
+	SetRules(ctx context.Context, domain, short string, rules []Rule) error
+	GetRules(ctx context.Context, domain, short string) ([]Rule, error)
+	SetSplit(ctx context.Context, domain, short string, split Split) error
+	GetSplit(ctx context.Context, domain, short string) (Split, error)
+	IncrementVariantCount(ctx context.Context, domain, short, variant string) error
+	// DeleteURL moves the url to the trash until PurgeDeletedURLs removes it, RestoreURL takes it out. The events
+	// are queued for the webhooks in the same transaction
+	DeleteURL(ctx context.Context, domain, short string, deletedAt time.Time, events ...Event) error
+	RestoreURL(ctx context.Context, domain, short string) error
+	// PurgeDeletedURLs returns the urls removed with only their domain and id
+	PurgeDeletedURLs(ctx context.Context, before time.Time) ([]Link, error)
+	// IncrementRedirectionCount increments the count unless the url reached its maximum number of clicks,
+	// returning ErrExhausted, checking and incrementing atomically. It returns the new count and remaining clicks,
+	// the events returned for them by the function, when it is not nil, are queued in the same transaction
+	IncrementRedirectionCount(ctx context.Context, domain, short string,
+		events func(count, remaining int) []Event) (count int, remaining int, err error)
+	GetRedirectionCount(ctx context.Context, domain, short string) (int, error)
+	// GetRemainingClicks returns UnlimitedClicks for urls without a maximum number of clicks
+	GetRemainingClicks(ctx context.Context, domain, short string) (int, error)
+}
+
+// Option configures optional Service behaviour
+type Option func(*Service)
+
+// WithBlockedHosts refuses to shorten urls pointing to any of the provided hosts or their subdomains,
+// meant for known third-party URL shorteners
+func WithBlockedHosts(hosts ...string) Option {
+	return func(s *Service) {
+		for _, host := range hosts {
+			if host = normalizeHost(host, ""); host != "" {
+				s.blockedHosts[host] = struct{}{}
+			}
+		}
+	}
+}
+
+// WithPasswordAttempts limits the password attempts of each protected url in a time window
+func WithPasswordAttempts(max int, window time.Duration) Option {
+	return func(s *Service) {
+		s.attempts = newAttempts(max, window)
+	}
+}
+
+// WithClock replaces the clock used for every time check of the Service
+func WithClock(now func() time.Time) Option {
+	return func(s *Service) {
+		s.now = now
+	}
+}
+
+// WithRetention sets how long deleted urls are kept in the trash before being purged
+func WithRetention(retention time.Duration) Option {
+	return func(s *Service) {
+		s.retention = retention
+	}
+}
+
+// WithAuditLog records every change made to shortened urls in the audit log
+func WithAuditLog(auditLog AuditLog) Option {
+	return func(s *Service) {
+		s.auditLog = auditLog
+	}
+}
+
+// WithWebhooks sends events about shortened urls to the webhooks of the store
+func WithWebhooks(webhooks WebhookStore) Option {
+	return func(s *Service) {
+		s.webhooks = webhooks
+	}
+}
+
+// WithWebhookNetworks replaces the check of the addresses webhooks can be registered with, by default only public
+// addresses resolved with the default resolver are allowed
+func WithWebhookNetworks(networks WebhookNetworks) Option {
+	return func(s *Service) {
+		s.webhookNetworks = networks
+	}
+}
+
+// WithClickThresholds sets the redirection counts sending EventClicks
+func WithClickThresholds(thresholds ...int) Option {
+	return func(s *Service) {
+		s.clickThresholds = thresholds
+	}
 }
 
 // Service manages shortened urls
@@ -32,39 +170,189 @@ type Service struct {
 	store     Store
 	generator Generator
 
-	domain string
+	base     BaseURL
+	baseHost string
+	// domains are the other short domains by their normalized host
+	domains map[string]BaseURL
+
+	blockedHosts map[string]struct{}
+	attempts     *attempts
+	now          func() time.Time
+	retention    time.Duration
+	auditLog     AuditLog
+
+	webhooks        WebhookStore
+	webhookNetworks WebhookNetworks
+	clickThresholds []int
+
+	idempotency       IdempotencyStore
+	idempotencyWindow time.Duration
 }
 
-// NewService creates a Service to manage shortened urls
-func NewService(domain string, urlGenerator Generator, store Store) Service {
-	return Service{
-		domain:    domain,
-		store:     store,
-		generator: urlGenerator,
+// NewService creates a Service to manage shortened urls building their short urls from the base url
+func NewService(base BaseURL, urlGenerator Generator, store Store, opts ...Option) Service {
+	s := Service{
+		base:         base,
+		baseHost:     normalizeHost(base.host, base.scheme),
+		domains:      make(map[string]BaseURL),
+		store:        store,
+		generator:    urlGenerator,
+		blockedHosts: make(map[string]struct{}),
+		attempts:     newAttempts(DefaultPasswordAttempts, DefaultPasswordWindow),
+		now:          time.Now,
+		retention:    DefaultRetention,
+
+		webhookNetworks:   NewWebhookNetworks(net.DefaultResolver),
+		clickThresholds:   DefaultClickThresholds,
+		idempotencyWindow: DefaultIdempotencyWindow,
+	}
+
+	for _, opt := range opts {
+		opt(&s)
 	}
+
+	return s
 }
 
-// CreateURL creates a shortened url
-func (s Service) CreateURL(ctx context.Context, long string) (string, error) {
-	if _, err := url.ParseRequestURI(long); err != nil {
+// CreateURL creates a shortened url on the domain of the options or the one selected by the context
+func (s Service) CreateURL(ctx context.Context, long string, opts LinkOptions) (string, error) {
+	requested := long
+	u, err := url.ParseRequestURI(long)
+	if err != nil {
 		return "", ErrInvalidURL
 	}
 
-	short, err := s.generator.Generate()
+	var (
+		domain string
+		base   BaseURL
+	)
+	if opts.Domain != "" {
+		var ok bool
+		if domain, base, ok = s.lookupDomain(opts.Domain, ""); !ok {
+			return "", ErrUnknownDomain
+		}
+	} else if domain, base, err = s.domain(ctx); err != nil {
+		return "", err
+	}
+
+	redirectType, err := validRedirectType(opts.RedirectType)
+	if err != nil {
+		return "", err
+	}
+
+	if err := validQueryMode(opts.ForwardQuery); err != nil {
+		return "", err
+	}
+
+	if opts.MaxClicks < 0 {
+		return "", ErrInvalidMaxClicks
+	}
+
+	campaign, err := validCampaign(opts.Campaign)
+	if err != nil {
+		return "", err
+	}
+
+	long, err = s.resolveTarget(ctx, long, u)
 	if err != nil {
-		return "", fmt.Errorf("could not generate URL: %w", err)
+		return "", err
+	}
+
+	if !campaign.IsZero() {
+		if long, err = campaign.apply(long); err != nil {
+			return "", err
+		}
+	}
+
+	var passwordHash string
+	if opts.Password != "" {
+		if passwordHash, err = hashPassword(opts.Password); err != nil {
+			if err == ErrInvalidPassword {
+				return "", ErrInvalidPassword
+			}
+
+			return "", fmt.Errorf("could not hash password: %w", err)
+		}
 	}
 
-	if err := s.store.AddURL(ctx, short, long); err != nil {
-		return "", fmt.Errorf("could not save URL in database: %w", err)
+	// Repeated requests are detected once they are valid, invalid ones fail again without using the key
+	reservation, shortURL, err := s.reserveIdempotencyKey(ctx, requested, domain, opts)
+	if err != nil || shortURL != "" {
+		return shortURL, err
 	}
 
-	return path.Join(s.domain, short), nil
+	link := Link{
+		Domain:       domain,
+		Long:         long,
+		CreatedAt:    s.now().UTC(),
+		Warn:         opts.Warn,
+		RedirectType: redirectType,
+		ForwardQuery: opts.ForwardQuery,
+		ForwardPath:  opts.ForwardPath,
+		Campaign:     campaign,
+		PasswordHash: passwordHash,
+		MaxClicks:    opts.MaxClicks,
+		NotBefore:    opts.NotBefore.UTC(),
+	}
+	for i := 0; ; i++ {
+		if link.Short, err = s.generator.Generate(); err != nil {
+			s.completeIdempotencyKey(ctx, reservation, link, false)
+			return "", fmt.Errorf("could not generate URL: %w", err)
+		}
+
+		err = s.store.AddURL(ctx, link, s.events(EventCreated, link)...)
+		if err == nil {
+			break
+		}
+
+		if err != ErrDuplicateID || i+1 >= maxGenerateAttempts {
+			s.completeIdempotencyKey(ctx, reservation, link, false)
+			return "", fmt.Errorf("could not save URL in database: %w", err)
+		}
+	}
+	s.completeIdempotencyKey(ctx, reservation, link, true)
+
+	s.audit(ctx, ActionCreate, domain, link.Short, nil, toAuditLink(link))
+
+	return base.ShortURL(link.Short), nil
 }
 
-// GetURL gets a long url from the short url id
+// GetURL gets a long url from the short url id, password protected urls return ErrPasswordRequired
+// and urls scheduled for later ErrNotActive
 func (s Service) GetURL(ctx context.Context, short string) (string, string, error) {
-	long, err := s.store.GetURL(ctx, short)
+	domain, base, err := s.domain(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	link, err := s.store.GetLink(ctx, domain, short)
+	if err != nil {
+		if err == ErrNotFound {
+			return "", "", ErrNotFound
+		}
+
+		return "", "", fmt.Errorf("could not retrieve URL from database: %w", err)
+	}
+
+	if s.scheduled(link) {
+		return "", "", ErrNotActive
+	}
+
+	if link.Protected() {
+		return "", "", ErrPasswordRequired
+	}
+
+	return link.Long, base.ShortURL(short), nil
+}
+
+// UnlockURL gets a long url from the short url id checking its password, the attempts of each url are throttled
+func (s Service) UnlockURL(ctx context.Context, short, password string) (string, string, error) {
+	domain, base, err := s.domain(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	link, err := s.store.GetLink(ctx, domain, short)
 	if err != nil {
 		if err == ErrNotFound {
 			return "", "", ErrNotFound
@@ -73,38 +361,353 @@ func (s Service) GetURL(ctx context.Context, short string) (string, string, erro
 		return "", "", fmt.Errorf("could not retrieve URL from database: %w", err)
 	}
 
-	return long, path.Join(s.domain, short), nil
+	if s.scheduled(link) {
+		return "", "", ErrNotActive
+	}
+
+	if link.Protected() {
+		key := base.ShortURL(short)
+		if !s.attempts.try(key, s.now()) {
+			return "", "", ErrTooManyAttempts
+		}
+
+		if !link.CheckPassword(password) {
+			return "", "", ErrWrongPassword
+		}
+		s.attempts.reset(key)
+	}
+
+	return link.Long, base.ShortURL(short), nil
+}
+
+// GetLink gets a shortened url with all its details from the short url id
+func (s Service) GetLink(ctx context.Context, short string) (Link, error) {
+	domain, base, err := s.domain(ctx)
+	if err != nil {
+		return Link{}, err
+	}
+
+	link, err := s.store.GetLink(ctx, domain, short)
+	if err != nil {
+		if err == ErrNotFound {
+			return Link{}, ErrNotFound
+		}
+
+		return Link{}, fmt.Errorf("could not retrieve URL from database: %w", err)
+	}
+	link.ShortURL = base.ShortURL(short)
+	link.Scheduled = s.scheduled(link)
+
+	if link.Rules, err = s.GetRules(ctx, short); err != nil {
+		return Link{}, err
+	}
+
+	if link.Split, err = s.GetSplit(ctx, short); err != nil {
+		return Link{}, err
+	}
+
+	return link, nil
+}
+
+// SetRules replaces the routing rules of a shortened url, they are evaluated in order on every redirection
+func (s Service) SetRules(ctx context.Context, short string, rules []Rule) error {
+	if len(rules) > MaxRules {
+		return ErrTooManyRules
+	}
+
+	valid := make([]Rule, 0, len(rules))
+	for _, rule := range rules {
+		rule, err := validRule(rule)
+		if err != nil {
+			return err
+		}
+
+		u, err := url.ParseRequestURI(rule.Target)
+		if err != nil {
+			return ErrInvalidURL
+		}
+
+		if rule.Target, err = s.resolveTarget(ctx, rule.Target, u); err != nil {
+			return err
+		}
+		valid = append(valid, rule)
+	}
+
+	domain, _, err := s.domain(ctx)
+	if err != nil {
+		return err
+	}
+
+	var before []Rule
+	if s.auditLog != nil {
+		before, _ = s.store.GetRules(ctx, domain, short)
+	}
+
+	if err := s.store.SetRules(ctx, domain, short, valid); err != nil {
+		if err == ErrNotFound {
+			return ErrNotFound
+		}
+
+		return fmt.Errorf("could not save rules in database: %w", err)
+	}
+	s.audit(ctx, ActionSetRules, domain, short, before, valid)
+
+	return nil
 }
 
-// DeleteURL deletes an url
+// GetRules gets the routing rules of a shortened url
+func (s Service) GetRules(ctx context.Context, short string) ([]Rule, error) {
+	domain, _, err := s.domain(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := s.store.GetRules(ctx, domain, short)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrNotFound
+		}
+
+		return nil, fmt.Errorf("could not retrieve rules from database: %w", err)
+	}
+
+	return rules, nil
+}
+
+// SetSplit replaces the variants a shortened url splits its visits across, the counts of the variants
+// kept with the same name are preserved
+func (s Service) SetSplit(ctx context.Context, short string, split Split) error {
+	split, err := validSplit(split)
+	if err != nil {
+		return err
+	}
+
+	for i, variant := range split.Variants {
+		u, err := url.ParseRequestURI(variant.Target)
+		if err != nil {
+			return ErrInvalidURL
+		}
+
+		if split.Variants[i].Target, err = s.resolveTarget(ctx, variant.Target, u); err != nil {
+			return err
+		}
+	}
+
+	domain, _, err := s.domain(ctx)
+	if err != nil {
+		return err
+	}
+
+	var before Split
+	if s.auditLog != nil {
+		before, _ = s.store.GetSplit(ctx, domain, short)
+	}
+
+	if err := s.store.SetSplit(ctx, domain, short, split); err != nil {
+		if err == ErrNotFound {
+			return ErrNotFound
+		}
+
+		return fmt.Errorf("could not save variants in database: %w", err)
+	}
+	s.audit(ctx, ActionSetVariants, domain, short, before, split)
+
+	return nil
+}
+
+// GetSplit gets the variants of a shortened url with their counts
+func (s Service) GetSplit(ctx context.Context, short string) (Split, error) {
+	domain, _, err := s.domain(ctx)
+	if err != nil {
+		return Split{}, err
+	}
+
+	split, err := s.store.GetSplit(ctx, domain, short)
+	if err != nil {
+		if err == ErrNotFound {
+			return Split{}, ErrNotFound
+		}
+
+		return Split{}, fmt.Errorf("could not retrieve variants from database: %w", err)
+	}
+
+	return split, nil
+}
+
+// IncrementVariantCount increments the redirection count of a variant of a shortened url
+func (s Service) IncrementVariantCount(ctx context.Context, short, variant string) error {
+	domain, _, err := s.domain(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.IncrementVariantCount(ctx, domain, short, variant); err != nil {
+		if err == ErrNotFound {
+			return ErrNotFound
+		}
+
+		return fmt.Errorf("could not save variant count in database: %w", err)
+	}
+
+	return nil
+}
+
+// GetStats gets the count of redirections of a shortened url and each of its variants, its remaining clicks
+// and whether it is scheduled for later
+func (s Service) GetStats(ctx context.Context, short string) (Stats, error) {
+	domain, _, err := s.domain(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	link, err := s.store.GetLink(ctx, domain, short)
+	if err != nil {
+		if err == ErrNotFound {
+			return Stats{}, ErrNotFound
+		}
+
+		return Stats{}, fmt.Errorf("could not retrieve URL from database: %w", err)
+	}
+
+	remaining, err := s.store.GetRemainingClicks(ctx, domain, short)
+	if err != nil {
+		if err == ErrNotFound {
+			return Stats{}, ErrNotFound
+		}
+
+		return Stats{}, fmt.Errorf("could not get URL remaining clicks from database: %w", err)
+	}
+
+	split, err := s.GetSplit(ctx, short)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	return Stats{
+		Count:     link.Count,
+		Remaining: remaining,
+		Variants:  split.Variants,
+		NotBefore: link.NotBefore,
+		Scheduled: s.scheduled(link),
+	}, nil
+}
+
+// ListURLsByCampaign lists the shortened urls created for a campaign on every domain
+func (s Service) ListURLsByCampaign(ctx context.Context, campaign string) ([]Link, error) {
+	links, err := s.store.ListURLsByCampaign(ctx, campaign)
+	if err != nil {
+		return nil, fmt.Errorf("could not list URLs from database: %w", err)
+	}
+
+	for i := range links {
+		links[i].ShortURL = s.baseURL(links[i].Domain).ShortURL(links[i].Short)
+		links[i].Scheduled = s.scheduled(links[i])
+		if links[i].Protected() {
+			links[i].Long = ""
+		}
+	}
+
+	return links, nil
+}
+
+// DeleteURL moves an url to the trash, it can be restored until it is purged after the retention period
 func (s Service) DeleteURL(ctx context.Context, short string) error {
-	if err := s.store.DeleteURL(ctx, short); err != nil {
+	domain, _, err := s.domain(ctx)
+	if err != nil {
+		return err
+	}
+
+	var (
+		before any
+		link   = Link{Domain: domain, Short: short}
+	)
+	if s.auditLog != nil || s.webhooks != nil {
+		if current, err := s.store.GetLink(ctx, domain, short); err == nil {
+			link, before = current, toAuditLink(current)
+		}
+	}
+
+	if err := s.store.DeleteURL(ctx, domain, short, s.now().UTC(), s.events(EventDeleted, link)...); err != nil {
 		if err == ErrNotFound {
 			return ErrNotFound
 		}
 
 		return fmt.Errorf("could not delete URL from database: %w", err)
 	}
+	s.audit(ctx, ActionDelete, domain, short, before, nil)
 
 	return nil
 }
 
-// IncrementRedirectionCount increments the redirection count of a shortened url
-func (s Service) IncrementRedirectionCount(ctx context.Context, short string) error {
-	if err := s.store.IncrementRedirectionCount(ctx, short); err != nil {
+// RestoreURL takes a deleted url out of the trash
+func (s Service) RestoreURL(ctx context.Context, short string) error {
+	domain, _, err := s.domain(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.RestoreURL(ctx, domain, short); err != nil {
 		if err == ErrNotFound {
 			return ErrNotFound
 		}
 
-		return fmt.Errorf("could not delete URL from database: %w", err)
+		return fmt.Errorf("could not restore URL in database: %w", err)
+	}
+
+	var after any
+	if s.auditLog != nil {
+		if link, err := s.store.GetLink(ctx, domain, short); err == nil {
+			after = toAuditLink(link)
+		}
 	}
+	s.audit(ctx, ActionRestore, domain, short, nil, after)
 
 	return nil
 }
 
+// PurgeDeletedURLs removes the urls deleted longer than the retention period ago, freeing their ids,
+// it returns the number of urls removed
+func (s Service) PurgeDeletedURLs(ctx context.Context) (int, error) {
+	purged, err := s.store.PurgeDeletedURLs(ctx, s.now().UTC().Add(-s.retention))
+	if err != nil {
+		return 0, fmt.Errorf("could not purge URLs from database: %w", err)
+	}
+
+	for _, link := range purged {
+		s.audit(ctx, ActionPurge, link.Domain, link.Short, nil, nil)
+	}
+
+	return len(purged), nil
+}
+
+// IncrementRedirectionCount increments the redirection count of a shortened url returning the new count,
+// urls that reached their maximum number of clicks return ErrExhausted
+func (s Service) IncrementRedirectionCount(ctx context.Context, short string) (int, error) {
+	domain, _, err := s.domain(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count, _, err := s.store.IncrementRedirectionCount(ctx, domain, short, s.clickEvents(domain, short))
+	if err != nil {
+		if err == ErrNotFound || err == ErrExhausted {
+			return 0, err
+		}
+
+		return 0, fmt.Errorf("could not delete URL from database: %w", err)
+	}
+
+	return count, nil
+}
+
 // GetRedirectionCount gets the count of redirections of a shortened url
 func (s Service) GetRedirectionCount(ctx context.Context, short string) (int, error) {
-	count, err := s.store.GetRedirectionCount(ctx, short)
+	domain, _, err := s.domain(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := s.store.GetRedirectionCount(ctx, domain, short)
 	if err != nil {
 		if err == ErrNotFound {
 			return 0, ErrNotFound
@@ -115,3 +718,82 @@ func (s Service) GetRedirectionCount(ctx context.Context, short string) (int, er
 
 	return count, nil
 }
+
+// resolveTarget prevents redirect chains and loops. Urls pointing to any short domain of this service are resolved
+// to the final target when they are one of our short urls and rejected otherwise, urls pointing to blocked hosts
+// are rejected.
+// Password protected and scheduled short urls are rejected too so their target is not revealed
+func (s Service) resolveTarget(ctx context.Context, long string, u *url.URL) (string, error) {
+	host := normalizeHost(u.Host, u.Scheme)
+	if s.isBlocked(host) {
+		return "", ErrBlockedHost
+	}
+
+	domain, base, ok := s.lookupDomain(u.Host, u.Scheme)
+	if !ok {
+		return long, nil
+	}
+
+	short, ok := base.short(u)
+	if !ok {
+		return "", ErrSelfReference
+	}
+
+	target, err := s.store.GetLink(ctx, domain, short)
+	if err != nil {
+		if err == ErrNotFound {
+			return "", ErrSelfReference
+		}
+
+		return "", fmt.Errorf("could not retrieve URL from database: %w", err)
+	}
+
+	if target.Protected() || s.scheduled(target) {
+		return "", ErrSelfReference
+	}
+
+	return target.Long, nil
+}
+
+// scheduled checks if the link is not active yet
+func (s Service) scheduled(link Link) bool {
+	return !link.NotBefore.IsZero() && s.now().Before(link.NotBefore)
+}
+
+func (s Service) isBlocked(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for host != "" {
+		if _, ok := s.blockedHosts[host]; ok {
+			return true
+		}
+
+		_, parent, found := strings.Cut(host, ".")
+		if !found {
+			break
+		}
+		host = parent
+	}
+
+	return false
+}
+
+// normalizeHost lowercases the host and strips the www prefix, trailing dots and default ports
+// so equivalent hosts can be compared
+func normalizeHost(host, scheme string) string {
+	host = strings.ToLower(host)
+	switch {
+	case scheme == "http" && strings.HasSuffix(host, ":80"):
+		host = strings.TrimSuffix(host, ":80")
+	case scheme == "https" && strings.HasSuffix(host, ":443"):
+		host = strings.TrimSuffix(host, ":443")
+	}
+
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		return net.JoinHostPort(strings.TrimPrefix(strings.TrimSuffix(h, "."), "www."), port)
+	}
+
+	return strings.TrimPrefix(strings.TrimSuffix(host, "."), "www.")
+}
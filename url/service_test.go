@@ -3,11 +3,21 @@ package url_test
 import (
 	"context"
 	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/nerock/urlshort/url"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// baseURL is where the service is deployed in the tests
+var baseURL = url.MustParseBaseURL("localhost:8080")
+
 var (
 	errGenerator = errors.New("generator error")
 	errStore     = errors.New("store error")
@@ -26,33 +36,304 @@ type testStore struct {
 	url   string
 	err   error
 	count int
+	links []url.Link
+	rules []url.Rule
+	split url.Split
+	// passwordHash protects the link returned by GetLink
+	passwordHash string
+	remaining    int
+	notBefore    time.Time
+	purged       []url.Link
+
+	added        *url.Link
+	events       *[]url.Event
+	addedRules   *[]url.Rule
+	addedSplit   *url.Split
+	purgedBefore *time.Time
+}
+
+func (t testStore) SetRules(ctx context.Context, domain, short string, rules []url.Rule) error {
+	if t.addedRules != nil {
+		*t.addedRules = rules
+	}
+
+	return t.err
+}
+
+func (t testStore) GetRules(ctx context.Context, domain, short string) ([]url.Rule, error) {
+	return t.rules, t.err
+}
+
+func (t testStore) SetSplit(ctx context.Context, domain, short string, split url.Split) error {
+	if t.addedSplit != nil {
+		*t.addedSplit = split
+	}
+
+	return t.err
+}
+
+func (t testStore) GetSplit(ctx context.Context, domain, short string) (url.Split, error) {
+	return t.split, t.err
 }
 
-func (t testStore) AddURL(ctx context.Context, short, long string) error {
+func (t testStore) IncrementVariantCount(ctx context.Context, domain, short, variant string) error {
 	return t.err
 }
 
-func (t testStore) GetURL(ctx context.Context, short string) (string, error) {
+func (t testStore) AddURL(ctx context.Context, link url.Link, events ...url.Event) error {
+	if t.added != nil {
+		*t.added = link
+	}
+
+	return t.queue(events)
+}
+
+func (t testStore) ListURLsByCampaign(ctx context.Context, campaign string) ([]url.Link, error) {
+	return t.links, t.err
+}
+
+func (t testStore) GetURL(ctx context.Context, domain, short string) (string, error) {
 	return t.url, t.err
 }
 
-func (t testStore) DeleteURL(ctx context.Context, short string) error {
+func (t testStore) GetLink(ctx context.Context, domain, short string) (url.Link, error) {
+	if t.err != nil {
+		return url.Link{}, t.err
+	}
+
+	return url.Link{Domain: domain, Short: short, Long: t.url, Count: t.count, PasswordHash: t.passwordHash,
+		NotBefore: t.notBefore}, nil
+}
+
+func (t testStore) DeleteURL(ctx context.Context, domain, short string, deletedAt time.Time, events ...url.Event) error {
+	return t.queue(events)
+}
+
+func (t testStore) RestoreURL(ctx context.Context, domain, short string) error {
 	return t.err
 }
 
-func (t testStore) IncrementRedirectionCount(ctx context.Context, short string) error {
+func (t testStore) PurgeDeletedURLs(ctx context.Context, before time.Time) ([]url.Link, error) {
+	if t.purgedBefore != nil {
+		*t.purgedBefore = before
+	}
+
+	return t.purged, t.err
+}
+
+func (t testStore) IncrementRedirectionCount(ctx context.Context, domain, short string,
+	events func(count, remaining int) []url.Event) (int, int, error) {
+	if events != nil {
+		if err := t.queue(events(t.count, t.remaining)); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return t.count, t.remaining, t.err
+}
+
+// queue records the events queued with a change unless it fails
+func (t testStore) queue(events []url.Event) error {
+	if t.err == nil && t.events != nil {
+		*t.events = append(*t.events, events...)
+	}
+
 	return t.err
 }
 
-func (t testStore) GetRedirectionCount(ctx context.Context, short string) (int, error) {
+func (t testStore) GetRemainingClicks(ctx context.Context, domain, short string) (int, error) {
+	return t.remaining, t.err
+}
+
+func (t testStore) GetRedirectionCount(ctx context.Context, domain, short string) (int, error) {
 	return t.count, t.err
 }
 
+type testAuditLog struct {
+	entries *[]url.AuditEntry
+	filter  *url.AuditFilter
+	err     error
+}
+
+func (t testAuditLog) AddAuditEntry(ctx context.Context, entry url.AuditEntry) error {
+	if t.err != nil {
+		return t.err
+	}
+
+	entry.ID = int64(len(*t.entries) + 1)
+	*t.entries = append(*t.entries, entry)
+
+	return nil
+}
+
+func (t testAuditLog) ListAuditEntries(ctx context.Context, filter url.AuditFilter) ([]url.AuditEntry, error) {
+	if t.filter != nil {
+		*t.filter = filter
+	}
+
+	var entries []url.AuditEntry
+	for _, entry := range *t.entries {
+		if entry.ID > filter.AfterID && len(entries) < filter.Limit {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, t.err
+}
+
+type testWebhooks struct {
+	webhooks   []url.Webhook
+	deliveries []url.Delivery
+	attempts   []url.DeliveryAttempt
+	err        error
+
+	added  *url.Webhook
+	filter *url.DeliveryFilter
+}
+
+func (t testWebhooks) AddWebhook(ctx context.Context, webhook url.Webhook) (int64, error) {
+	if t.added != nil {
+		*t.added = webhook
+	}
+
+	return 1, t.err
+}
+
+func (t testWebhooks) ListWebhooks(ctx context.Context) ([]url.Webhook, error) {
+	return t.webhooks, t.err
+}
+
+func (t testWebhooks) DeleteWebhook(ctx context.Context, id int64) error {
+	return t.err
+}
+
+func (t testWebhooks) ListDeliveries(ctx context.Context, webhookID int64, filter url.DeliveryFilter) ([]url.Delivery, error) {
+	if t.filter != nil {
+		*t.filter = filter
+	}
+
+	return t.deliveries, t.err
+}
+
+func (t testWebhooks) ListDeliveryAttempts(ctx context.Context, webhookID, deliveryID int64) ([]url.DeliveryAttempt, error) {
+	return t.attempts, t.err
+}
+
+// testResolver resolves the hosts of the webhooks
+type testResolver map[string][]netip.Addr
+
+func (t testResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, ok := t[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return addrs, nil
+}
+
+// webhookHosts are the hosts of the webhooks in the tests
+var webhookHosts = testResolver{
+	"example.com":          {netip.MustParseAddr("93.184.216.34")},
+	"internal.example.com": {netip.MustParseAddr("10.0.0.5")},
+	"mixed.example.com":    {netip.MustParseAddr("93.184.216.34"), netip.MustParseAddr("127.0.0.1")},
+}
+
+type testIdempotency struct {
+	records map[string]url.IdempotencyRecord
+	err     error
+}
+
+func (t testIdempotency) ReserveIdempotencyKey(ctx context.Context, record url.IdempotencyRecord, since, leaseSince time.Time) (url.IdempotencyRecord, bool, error) {
+	if t.err != nil {
+		return url.IdempotencyRecord{}, false, t.err
+	}
+
+	if saved, ok := t.records[record.Key]; ok && !saved.CreatedAt.Before(since) &&
+		(saved.Short != "" || !saved.CreatedAt.Before(leaseSince)) {
+		return saved, false, nil
+	}
+
+	t.records[record.Key] = record
+	return record, true, nil
+}
+
+func (t testIdempotency) CompleteIdempotencyKey(ctx context.Context, record url.IdempotencyRecord) error {
+	saved, ok := t.records[record.Key]
+	if !ok || saved.Short != "" || saved.RequestHash != record.RequestHash || !saved.CreatedAt.Equal(record.CreatedAt) {
+		return url.ErrIdempotencyConflict
+	}
+	t.records[record.Key] = record
+
+	return nil
+}
+
+func (t testIdempotency) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	delete(t.records, key)
+	return nil
+}
+
+func (t testIdempotency) PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int, error) {
+	var n int
+	for key, record := range t.records {
+		if record.CreatedAt.Before(before) {
+			delete(t.records, key)
+			n++
+		}
+	}
+
+	return n, t.err
+}
+
+func TestParseBaseURL(t *testing.T) {
+	tests := map[string]struct {
+		raw string
+
+		base string
+		path string
+		err  error
+	}{
+		"host":             {raw: "localhost:8080", base: "http://localhost:8080/", path: "/"},
+		"https":            {raw: "https://Go.Example.com", base: "https://go.example.com/", path: "/"},
+		"path prefix":      {raw: "https://go.example.com/s", base: "https://go.example.com/s/", path: "/s/"},
+		"cleaned prefix":   {raw: "go.example.com//a/../s/", base: "http://go.example.com/s/", path: "/s/"},
+		"ip":               {raw: "127.0.0.1:80/", base: "http://127.0.0.1:80/", path: "/"},
+		"invalid scheme":   {raw: "ftp://go.example.com", err: url.ErrInvalidBaseURL},
+		"invalid host":     {raw: "go_example.com", err: url.ErrInvalidBaseURL},
+		"invalid port":     {raw: "go.example.com:70000", err: url.ErrInvalidBaseURL},
+		"with user":        {raw: "https://user@go.example.com", err: url.ErrInvalidBaseURL},
+		"with query":       {raw: "go.example.com/?a=b", err: url.ErrInvalidBaseURL},
+		"with empty query": {raw: "go.example.com/?", err: url.ErrInvalidBaseURL},
+		"with fragment":    {raw: "go.example.com/#s", err: url.ErrInvalidBaseURL},
+		"empty":            {raw: "", err: url.ErrInvalidBaseURL},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			base, err := url.ParseBaseURL(tt.raw)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("wrong error returned\nexpected=%v\ngot=%v", tt.err, err)
+			}
+
+			if tt.err != nil {
+				return
+			}
+
+			if base.String() != tt.base || base.Path() != tt.path {
+				t.Errorf("wrong base url\nexpected=%s %s\ngot=%s %s", tt.base, tt.path, base, base.Path())
+			}
+
+			if short := base.ShortURL("ID"); short != tt.base+"ID" {
+				t.Errorf("wrong short url\nexpected=%s\ngot=%s", tt.base+"ID", short)
+			}
+		})
+	}
+}
+
 func TestCreate(t *testing.T) {
 	validURL := "https://www.google.es"
 	invalidURL := "invalidURL"
 
-	domain := "localhost:8080/"
+	domain := baseURL
 
 	validID := "ID"
 	invalidID := ""
@@ -61,7 +342,8 @@ func TestCreate(t *testing.T) {
 		store     testStore
 		generator testGenerator
 
-		url string
+		url  string
+		opts url.LinkOptions
 
 		id  string
 		err error
@@ -97,6 +379,69 @@ func TestCreate(t *testing.T) {
 			url: invalidURL,
 			err: url.ErrInvalidURL,
 		},
+		"self reference to missing short url": {
+			store: testStore{
+				err: url.ErrNotFound,
+			},
+			generator: testGenerator{
+				id: validID,
+			},
+			url: "http://localhost:8080/" + validID,
+			err: url.ErrSelfReference,
+		},
+		"self reference to non short url": {
+			store: testStore{
+				url: validURL,
+			},
+			generator: testGenerator{
+				id: validID,
+			},
+			url: "http://www.LOCALHOST:8080/api/url/" + validID,
+			err: url.ErrSelfReference,
+		},
+		"invalid redirect type": {
+			store: testStore{
+				url: validURL,
+			},
+			generator: testGenerator{
+				id: validID,
+			},
+			url:  validURL,
+			opts: url.LinkOptions{RedirectType: http.StatusNotModified},
+			err:  url.ErrInvalidRedirectType,
+		},
+		"invalid max clicks": {
+			store: testStore{
+				url: validURL,
+			},
+			generator: testGenerator{
+				id: validID,
+			},
+			url:  validURL,
+			opts: url.LinkOptions{MaxClicks: -1},
+			err:  url.ErrInvalidMaxClicks,
+		},
+		"invalid query mode": {
+			store: testStore{
+				url: validURL,
+			},
+			generator: testGenerator{
+				id: validID,
+			},
+			url:  validURL,
+			opts: url.LinkOptions{ForwardQuery: "append"},
+			err:  url.ErrInvalidQueryMode,
+		},
+		"blocked host": {
+			store: testStore{
+				url: validURL,
+			},
+			generator: testGenerator{
+				id: validID,
+			},
+			url: "https://www.bit.ly:443/" + validID,
+			err: url.ErrBlockedHost,
+		},
 		"success": {
 			store: testStore{
 				url: validURL,
@@ -105,14 +450,35 @@ func TestCreate(t *testing.T) {
 				id: validID,
 			},
 			url: validURL,
-			id:  domain + validID,
+			id:  domain.ShortURL(validID),
+		},
+		"success with redirect type": {
+			store: testStore{
+				url: validURL,
+			},
+			generator: testGenerator{
+				id: validID,
+			},
+			url:  validURL,
+			opts: url.LinkOptions{RedirectType: http.StatusPermanentRedirect},
+			id:   domain.ShortURL(validID),
+		},
+		"success resolving self reference": {
+			store: testStore{
+				url: validURL,
+			},
+			generator: testGenerator{
+				id: validID,
+			},
+			url: "http://localhost:8080/other",
+			id:  domain.ShortURL(validID),
 		},
 	}
 
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
-			svc := url.NewService(domain, tt.generator, tt.store)
-			id, err := svc.CreateURL(context.Background(), tt.url)
+			svc := url.NewService(domain, tt.generator, tt.store, url.WithBlockedHosts("bit.ly"))
+			id, err := svc.CreateURL(context.Background(), tt.url, tt.opts)
 
 			if !errors.Is(err, tt.err) {
 				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
@@ -125,110 +491,1154 @@ func TestCreate(t *testing.T) {
 	}
 }
 
-func TestGet(t *testing.T) {
-	long := "https://www.google.es"
-	short := "ID"
-
+func TestCreateIdempotent(t *testing.T) {
+	const window = time.Hour
 	tests := map[string]struct {
-		store testStore
+		key string
+		// first is the url created by a previous request with the key and its options, elapsed is the time since it
+		first      string
+		firstOpts  url.LinkOptions
+		opts       url.LinkOptions
+		elapsed    time.Duration
+		inProgress bool
+		storeErr   error
+		err        error
 
-		short string
-
-		url string
-		err error
+		shortURL string
+		added    bool
+		// saved is the short url id kept for the key after the request, empty when none is
+		saved string
 	}{
-		"store error": {
-			store: testStore{
-				err: errStore,
-			},
-			short: short,
-			url:   "",
-			err:   errStore,
+		"no key": {
+			shortURL: "http://localhost:8080/ID",
+			added:    true,
 		},
-		"success": {
-			store: testStore{
-				url: long,
-			},
-			short: short,
-			url:   long,
+		"new key": {
+			key:      "key",
+			shortURL: "http://localhost:8080/ID",
+			added:    true,
+			saved:    "ID",
+		},
+		"repeated": {
+			key:      "key",
+			first:    "https://www.google.es",
+			elapsed:  window - time.Second,
+			shortURL: "http://localhost:8080/FIRST",
+			saved:    "FIRST",
+		},
+		"expired": {
+			key:      "key",
+			first:    "https://www.google.es",
+			elapsed:  window + time.Second,
+			shortURL: "http://localhost:8080/ID",
+			added:    true,
+			saved:    "ID",
+		},
+		"reused with another request": {
+			key:   "key",
+			first: "https://www.google.com",
+			saved: "FIRST",
+			err:   url.ErrIdempotencyConflict,
+		},
+		"reused with another password": {
+			key:       "key",
+			first:     "https://www.google.es",
+			firstOpts: url.LinkOptions{Password: "secret"},
+			opts:      url.LinkOptions{Password: "other"},
+			saved:     "FIRST",
+			err:       url.ErrIdempotencyConflict,
+		},
+		"repeated with password": {
+			key:       "key",
+			first:     "https://www.google.es",
+			firstOpts: url.LinkOptions{Password: "secret"},
+			opts:      url.LinkOptions{Password: "secret"},
+			shortURL:  "http://localhost:8080/FIRST",
+			saved:     "FIRST",
+		},
+		"in progress": {
+			key:        "key",
+			first:      "https://www.google.es",
+			inProgress: true,
+			elapsed:    url.IdempotencyLease - time.Second,
+			err:        url.ErrIdempotencyInProgress,
+		},
+		"abandoned": {
+			key:        "key",
+			first:      "https://www.google.es",
+			inProgress: true,
+			elapsed:    url.IdempotencyLease + time.Second,
+			shortURL:   "http://localhost:8080/ID",
+			added:      true,
+			saved:      "ID",
+		},
+		"key too long": {
+			key: strings.Repeat("k", url.MaxIdempotencyKeyLength+1),
+			err: url.ErrInvalidIdempotencyKey,
+		},
+		"store error": {
+			key:      "key",
+			storeErr: errStore,
+			added:    true,
+			err:      errStore,
 		},
 	}
 
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
-			svc := url.NewService("", nil, tt.store)
-			long, err := svc.GetURL(context.Background(), tt.url)
+			now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+			clock := url.WithClock(func() time.Time { return now })
+			idempotency := testIdempotency{records: map[string]url.IdempotencyRecord{}}
+			ctx := url.WithIdempotencyKey(context.Background(), tt.key)
+
+			if tt.first != "" {
+				first := url.NewService(baseURL, testGenerator{id: "FIRST"}, testStore{}, clock,
+					url.WithIdempotency(idempotency, window))
+				if _, err := first.CreateURL(ctx, tt.first, tt.firstOpts); err != nil {
+					t.Fatalf("could not create first url: %s", err)
+				}
+				if tt.inProgress {
+					idempotency.records[tt.key] = url.IdempotencyRecord{Key: tt.key,
+						RequestHash: idempotency.records[tt.key].RequestHash, CreatedAt: now}
+				}
+				now = now.Add(tt.elapsed)
+			}
+
+			var added url.Link
+			svc := url.NewService(baseURL, testGenerator{id: "ID"}, testStore{added: &added, err: tt.storeErr}, clock,
+				url.WithIdempotency(idempotency, window))
+			shortURL, err := svc.CreateURL(ctx, "https://www.google.es", tt.opts)
 
 			if !errors.Is(err, tt.err) {
 				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
 			}
 
-			if long != tt.url {
-				t.Errorf("wrong id returned\nexpected=%s\ngot=%s", tt.url, long)
+			if shortURL != tt.shortURL {
+				t.Errorf("wrong short url returned\nexpected=%s\ngot=%s", tt.shortURL, shortURL)
+			}
+
+			if (added.Short != "") != tt.added {
+				t.Errorf("wrong url saved\nexpected=%t\ngot=%+v", tt.added, added)
+			}
+
+			if saved := idempotency.records[tt.key].Short; saved != tt.saved {
+				t.Errorf("wrong url kept for the key\nexpected=%s\ngot=%s", tt.saved, saved)
 			}
 		})
 	}
 }
 
-func TestDelete(t *testing.T) {
+func TestCreateOnDomain(t *testing.T) {
 	tests := map[string]struct {
-		store testStore
+		host string
+		url  string
+		opts url.LinkOptions
 
-		err error
+		domain string
+		long   string
+		id     string
+		err    error
 	}{
-		"store error": {
-			store: testStore{
-				err: errStore,
-			},
-			err: errStore,
+		"default domain": {
+			url:  "https://www.google.es",
+			long: "https://www.google.es",
+			id:   "http://localhost:8080/ID",
 		},
-		"success": {
-			err: nil,
+		"domain option": {
+			url:    "https://www.google.es",
+			opts:   url.LinkOptions{Domain: "ACME.link"},
+			domain: "acme.link",
+			long:   "https://www.google.es",
+			id:     "https://acme.link/ID",
+		},
+		"domain option over context": {
+			host:   "go.acme.com",
+			url:    "https://www.google.es",
+			opts:   url.LinkOptions{Domain: "acme.link"},
+			domain: "acme.link",
+			long:   "https://www.google.es",
+			id:     "https://acme.link/ID",
+		},
+		"context domain": {
+			host:   "go.acme.com",
+			url:    "https://www.google.es",
+			domain: "go.acme.com",
+			long:   "https://www.google.es",
+			id:     "https://go.acme.com/s/ID",
+		},
+		"unknown context domain": {
+			host: "other.example.com",
+			url:  "https://www.google.es",
+			err:  url.ErrUnknownDomain,
+		},
+		"unknown domain option": {
+			url:  "https://www.google.es",
+			opts: url.LinkOptions{Domain: "other.example.com"},
+			err:  url.ErrUnknownDomain,
+		},
+		"self reference to other domain": {
+			url:  "https://acme.link/other",
+			long: "https://www.google.es/target",
+			id:   "http://localhost:8080/ID",
+		},
+		"self reference outside domain prefix": {
+			url: "https://go.acme.com/other",
+			err: url.ErrSelfReference,
 		},
 	}
 
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
-			svc := url.NewService("", nil, tt.store)
-			err := svc.DeleteURL(context.Background(), "")
+			var added url.Link
+			store := testStore{url: "https://www.google.es/target", added: &added}
+			svc := url.NewService(baseURL, testGenerator{id: "ID"}, store, url.WithDomains(
+				url.MustParseBaseURL("https://acme.link"), url.MustParseBaseURL("https://go.acme.com/s/")))
+
+			ctx := context.Background()
+			if tt.host != "" {
+				ctx = url.WithDomain(ctx, tt.host)
+			}
 
+			id, err := svc.CreateURL(ctx, tt.url, tt.opts)
 			if !errors.Is(err, tt.err) {
-				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+				t.Fatalf("wrong error returned\nexpected=%v\ngot=%v", tt.err, err)
+			}
+
+			if id != tt.id {
+				t.Errorf("wrong id returned\nexpected=%s\ngot=%s", tt.id, id)
+			}
+
+			if err == nil && (added.Domain != tt.domain || added.Long != tt.long) {
+				t.Errorf("wrong link added\nexpected=%s %s\ngot=%s %s", tt.domain, tt.long, added.Domain, added.Long)
 			}
 		})
 	}
 }
 
-func TestIncrementCount(t *testing.T) {
+func TestGetURLOnDomain(t *testing.T) {
 	tests := map[string]struct {
-		store testStore
+		host        string
+		requestHost bool
 
-		err error
+		shortURL string
+		err      error
 	}{
-		"store error": {
-			store: testStore{
-				err: errStore,
-			},
-			err: errStore,
-		},
-		"success": {
-			err: nil,
-		},
+		"default domain":       {shortURL: "http://localhost:8080/ID"},
+		"host":                 {host: "acme.link", shortURL: "https://acme.link/ID"},
+		"host with port":       {host: "acme.link:443", shortURL: "https://acme.link/ID"},
+		"www host":             {host: "www.acme.link", shortURL: "https://acme.link/ID"},
+		"unknown host":         {host: "other.example.com", err: url.ErrUnknownDomain},
+		"request host":         {host: "acme.link:443", requestHost: true, shortURL: "https://acme.link/ID"},
+		"unknown request host": {host: "other.example.com", requestHost: true, shortURL: "http://localhost:8080/ID"},
 	}
 
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
-			svc := url.NewService("", nil, tt.store)
-			err := svc.IncrementRedirectionCount(context.Background(), "")
+			svc := url.NewService(baseURL, nil, testStore{url: "https://www.google.es"},
+				url.WithDomains(url.MustParseBaseURL("https://acme.link")))
+
+			ctx := url.WithDomain(context.Background(), tt.host)
+			if tt.requestHost {
+				ctx = url.WithHost(context.Background(), tt.host)
+			}
 
+			_, shortURL, err := svc.GetURL(ctx, "ID")
 			if !errors.Is(err, tt.err) {
-				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+				t.Fatalf("wrong error returned\nexpected=%v\ngot=%v", tt.err, err)
+			}
+
+			if shortURL != tt.shortURL {
+				t.Errorf("wrong short url\nexpected=%s\ngot=%s", tt.shortURL, shortURL)
 			}
 		})
 	}
 }
 
-func TestGetCount(t *testing.T) {
+func TestCreateCampaign(t *testing.T) {
+	tests := map[string]struct {
+		url      string
+		campaign url.Campaign
+
+		long string
+		err  error
+	}{
+		"missing source": {
+			url:      "https://www.google.es",
+			campaign: url.Campaign{Medium: "email"},
+			err:      url.ErrInvalidCampaign,
+		},
+		"no campaign": {
+			url:  "https://www.google.es?q=go",
+			long: "https://www.google.es?q=go",
+		},
+		"campaign merged": {
+			url: "https://www.google.es/search?q=go&utm_source=old",
+			campaign: url.Campaign{
+				Source:  " newsletter ",
+				Medium:  "email",
+				Name:    "spring sale",
+				Content: "a&b",
+			},
+			long: "https://www.google.es/search?q=go&utm_campaign=spring+sale&utm_content=a%26b&utm_medium=email&utm_source=newsletter",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var added url.Link
+			svc := url.NewService(baseURL, testGenerator{id: "ID"}, testStore{added: &added})
+			_, err := svc.CreateURL(context.Background(), tt.url, url.LinkOptions{Campaign: tt.campaign})
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if added.Long != tt.long {
+				t.Errorf("wrong long url saved\nexpected=%s\ngot=%s", tt.long, added.Long)
+			}
+
+			if err == nil && added.Campaign.Source != strings.TrimSpace(tt.campaign.Source) {
+				t.Errorf("wrong campaign saved\nexpected=%+v\ngot=%+v", tt.campaign, added.Campaign)
+			}
+		})
+	}
+}
+
+func TestGet(t *testing.T) {
+	long := "https://www.google.es"
+	short := "ID"
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		store testStore
+
+		short string
+
+		url string
+		err error
+	}{
+		"store error": {
+			store: testStore{
+				err: errStore,
+			},
+			short: short,
+			url:   "",
+			err:   errStore,
+		},
+		"password protected": {
+			store: testStore{
+				url:          long,
+				passwordHash: hashPassword(t, "secret"),
+			},
+			short: short,
+			err:   url.ErrPasswordRequired,
+		},
+		"scheduled": {
+			store: testStore{
+				url:       long,
+				notBefore: now.Add(time.Hour),
+			},
+			short: short,
+			err:   url.ErrNotActive,
+		},
+		"active": {
+			store: testStore{
+				url:       long,
+				notBefore: now,
+			},
+			short: short,
+			url:   long,
+		},
+		"success": {
+			store: testStore{
+				url: long,
+			},
+			short: short,
+			url:   long,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			svc := url.NewService(url.BaseURL{}, nil, tt.store, url.WithClock(func() time.Time { return now }))
+			long, _, err := svc.GetURL(context.Background(), tt.url)
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if long != tt.url {
+				t.Errorf("wrong id returned\nexpected=%s\ngot=%s", tt.url, long)
+			}
+		})
+	}
+}
+
+func TestCreatePassword(t *testing.T) {
+	tests := map[string]struct {
+		password string
+
+		protected bool
+		err       error
+	}{
+		"no password": {},
+		"too short": {
+			password: "abc",
+			err:      url.ErrInvalidPassword,
+		},
+		"too long": {
+			password: strings.Repeat("a", url.MaxPasswordLength+1),
+			err:      url.ErrInvalidPassword,
+		},
+		"success": {
+			password:  "correct horse battery staple",
+			protected: true,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var added url.Link
+			svc := url.NewService(baseURL, testGenerator{id: "ID"}, testStore{added: &added})
+			_, err := svc.CreateURL(context.Background(), "https://www.google.es", url.LinkOptions{Password: tt.password})
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if added.Protected() != tt.protected {
+				t.Errorf("wrong protection saved\nexpected=%t\ngot=%t", tt.protected, added.Protected())
+			}
+
+			if tt.protected && (added.PasswordHash == tt.password || !added.CheckPassword(tt.password)) {
+				t.Errorf("wrong password hash saved: %s", added.PasswordHash)
+			}
+		})
+	}
+}
+
+func TestUnlockURL(t *testing.T) {
+	long := "https://www.google.es"
+	hash := hashPassword(t, "secret")
+
+	tests := map[string]struct {
+		store     testStore
+		passwords []string
+
+		url string
+		err error
+	}{
+		"not found": {
+			store: testStore{
+				err: url.ErrNotFound,
+			},
+			passwords: []string{"secret"},
+			err:       url.ErrNotFound,
+		},
+		"not protected": {
+			store: testStore{
+				url: long,
+			},
+			passwords: []string{""},
+			url:       long,
+		},
+		"wrong password": {
+			store: testStore{
+				url:          long,
+				passwordHash: hash,
+			},
+			passwords: []string{"Secret"},
+			err:       url.ErrWrongPassword,
+		},
+		"right password": {
+			store: testStore{
+				url:          long,
+				passwordHash: hash,
+			},
+			passwords: []string{"secret"},
+			url:       long,
+		},
+		"right password after failed attempts": {
+			store: testStore{
+				url:          long,
+				passwordHash: hash,
+			},
+			passwords: []string{"guess", "secret"},
+			url:       long,
+		},
+		"too many attempts": {
+			store: testStore{
+				url:          long,
+				passwordHash: hash,
+			},
+			passwords: []string{"guess", "guess", "secret"},
+			err:       url.ErrTooManyAttempts,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			svc := url.NewService(baseURL, nil, tt.store, url.WithPasswordAttempts(2, time.Minute))
+
+			var (
+				long string
+				err  error
+			)
+			for _, password := range tt.passwords {
+				long, _, err = svc.UnlockURL(context.Background(), "ID", password)
+			}
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if long != tt.url {
+				t.Errorf("wrong url returned\nexpected=%s\ngot=%s", tt.url, long)
+			}
+		})
+	}
+}
+
+func hashPassword(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("could not hash password: %s", err)
+	}
+
+	return string(hash)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestGetLink(t *testing.T) {
+	long := "https://www.google.es"
+	short := "ID"
+	domain := baseURL
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		store testStore
+
+		short string
+
+		link url.Link
+		err  error
+	}{
+		"not found": {
+			store: testStore{
+				err: url.ErrNotFound,
+			},
+			short: short,
+			err:   url.ErrNotFound,
+		},
+		"store error": {
+			store: testStore{
+				err: errStore,
+			},
+			short: short,
+			err:   errStore,
+		},
+		"success": {
+			store: testStore{
+				url:   long,
+				count: 10,
+				rules: []url.Rule{{Platform: url.PlatformIOS, Target: long}},
+				split: url.Split{Sticky: true, Variants: []url.Variant{{Name: "a", Target: long, Weight: 1}}},
+			},
+			short: short,
+			link: url.Link{
+				Short:    short,
+				Long:     long,
+				ShortURL: domain.ShortURL(short),
+				Count:    10,
+				Rules:    []url.Rule{{Platform: url.PlatformIOS, Target: long}},
+				Split:    url.Split{Sticky: true, Variants: []url.Variant{{Name: "a", Target: long, Weight: 1}}},
+			},
+		},
+		"scheduled": {
+			store: testStore{
+				url:       long,
+				notBefore: now.Add(time.Second),
+			},
+			short: short,
+			link: url.Link{
+				Short:     short,
+				Long:      long,
+				ShortURL:  domain.ShortURL(short),
+				NotBefore: now.Add(time.Second),
+				Scheduled: true,
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			svc := url.NewService(domain, nil, tt.store, url.WithClock(func() time.Time { return now }))
+			link, err := svc.GetLink(context.Background(), tt.short)
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if !reflect.DeepEqual(link, tt.link) {
+				t.Errorf("wrong link returned\nexpected=%+v\ngot=%+v", tt.link, link)
+			}
+		})
+	}
+}
+
+func TestSetRules(t *testing.T) {
+	appStore := "https://apps.apple.com/app/id1"
+
+	tests := map[string]struct {
+		store testStore
+		rules []url.Rule
+
+		saved []url.Rule
+		err   error
+	}{
+		"rule without conditions": {
+			rules: []url.Rule{{Target: appStore}},
+			err:   url.ErrInvalidRule,
+		},
+		"invalid platform": {
+			rules: []url.Rule{{Platform: "symbian", Target: appStore}},
+			err:   url.ErrInvalidRule,
+		},
+		"invalid country": {
+			rules: []url.Rule{{Country: "ESP", Target: appStore}},
+			err:   url.ErrInvalidRule,
+		},
+		"invalid language": {
+			rules: []url.Rule{{Language: "e", Target: appStore}},
+			err:   url.ErrInvalidRule,
+		},
+		"invalid target": {
+			rules: []url.Rule{{Platform: url.PlatformIOS, Target: "app store"}},
+			err:   url.ErrInvalidURL,
+		},
+		"self reference target": {
+			store: testStore{
+				err: url.ErrNotFound,
+			},
+			rules: []url.Rule{{Platform: url.PlatformIOS, Target: "http://localhost:8080/ID"}},
+			err:   url.ErrSelfReference,
+		},
+		"too many rules": {
+			rules: make([]url.Rule, url.MaxRules+1),
+			err:   url.ErrTooManyRules,
+		},
+		"not found": {
+			store: testStore{
+				err: url.ErrNotFound,
+			},
+			rules: []url.Rule{{Platform: url.PlatformIOS, Target: appStore}},
+			err:   url.ErrNotFound,
+		},
+		"store error": {
+			store: testStore{
+				err: errStore,
+			},
+			rules: []url.Rule{{Platform: url.PlatformIOS, Target: appStore}},
+			err:   errStore,
+		},
+		"success": {
+			rules: []url.Rule{
+				{Platform: " iOS ", Target: appStore},
+				{Language: "PT-br", Country: "br", Target: "https://www.google.com.br"},
+			},
+			saved: []url.Rule{
+				{Platform: url.PlatformIOS, Target: appStore},
+				{Language: "pt-br", Country: "BR", Target: "https://www.google.com.br"},
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var saved []url.Rule
+			tt.store.addedRules = &saved
+
+			svc := url.NewService(baseURL, nil, tt.store)
+			err := svc.SetRules(context.Background(), "ID", tt.rules)
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if tt.saved != nil && !reflect.DeepEqual(saved, tt.saved) {
+				t.Errorf("wrong rules saved\nexpected=%+v\ngot=%+v", tt.saved, saved)
+			}
+		})
+	}
+}
+
+func TestSetSplit(t *testing.T) {
+	a := "https://www.google.es/a"
+	b := "https://www.google.es/b"
+
+	tests := map[string]struct {
+		store testStore
+		split url.Split
+
+		saved *url.Split
+		err   error
+	}{
+		"negative weight": {
+			split: url.Split{Variants: []url.Variant{{Target: a, Weight: -1}, {Target: b, Weight: 2}}},
+			err:   url.ErrInvalidVariant,
+		},
+		"weight too high": {
+			split: url.Split{Variants: []url.Variant{{Target: a, Weight: url.MaxVariantWeight + 1}}},
+			err:   url.ErrInvalidVariant,
+		},
+		"all paused": {
+			split: url.Split{Variants: []url.Variant{{Target: a}, {Target: b}}},
+			err:   url.ErrInvalidVariant,
+		},
+		"duplicated name": {
+			split: url.Split{Variants: []url.Variant{{Name: "x", Target: a, Weight: 1}, {Name: "X", Target: b, Weight: 1}}},
+			err:   url.ErrInvalidVariant,
+		},
+		"invalid name": {
+			split: url.Split{Variants: []url.Variant{{Name: "new home", Target: a, Weight: 1}}},
+			err:   url.ErrInvalidVariant,
+		},
+		"too many variants": {
+			split: url.Split{Variants: make([]url.Variant, url.MaxVariants+1)},
+			err:   url.ErrTooManyVariants,
+		},
+		"invalid target": {
+			split: url.Split{Variants: []url.Variant{{Target: "variant a", Weight: 1}}},
+			err:   url.ErrInvalidURL,
+		},
+		"not found": {
+			store: testStore{
+				err: url.ErrNotFound,
+			},
+			split: url.Split{Variants: []url.Variant{{Target: a, Weight: 1}}},
+			err:   url.ErrNotFound,
+		},
+		"store error": {
+			store: testStore{
+				err: errStore,
+			},
+			split: url.Split{Variants: []url.Variant{{Target: a, Weight: 1}}},
+			err:   errStore,
+		},
+		"success": {
+			split: url.Split{
+				Sticky:   true,
+				Variants: []url.Variant{{Target: a, Weight: 70, Count: 5}, {Name: " New ", Target: b, Weight: 30}},
+			},
+			saved: &url.Split{
+				Sticky:   true,
+				Variants: []url.Variant{{Name: "a", Target: a, Weight: 70}, {Name: "new", Target: b, Weight: 30}},
+			},
+		},
+		"remove variants": {
+			split: url.Split{},
+			saved: &url.Split{Variants: []url.Variant{}},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var saved url.Split
+			tt.store.addedSplit = &saved
+
+			svc := url.NewService(baseURL, nil, tt.store)
+			err := svc.SetSplit(context.Background(), "ID", tt.split)
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if tt.saved != nil && !reflect.DeepEqual(saved, *tt.saved) {
+				t.Errorf("wrong variants saved\nexpected=%+v\ngot=%+v", *tt.saved, saved)
+			}
+		})
+	}
+}
+
+func TestPickVariant(t *testing.T) {
+	split := url.Split{Variants: []url.Variant{
+		{Name: "a", Weight: 70},
+		{Name: "paused", Weight: 0},
+		{Name: "b", Weight: 30},
+	}}
+
+	tests := map[string]struct {
+		n int
+
+		variant string
+	}{
+		"first variant start":  {n: 0, variant: "a"},
+		"first variant end":    {n: 69, variant: "a"},
+		"second variant start": {n: 70, variant: "b"},
+		"second variant end":   {n: 99, variant: "b"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			variant, ok := split.Pick(func(n int) int {
+				if n != 100 {
+					t.Errorf("wrong total weight\nexpected=100\ngot=%d", n)
+				}
+
+				return tt.n
+			})
+
+			if !ok || variant.Name != tt.variant {
+				t.Errorf("wrong variant picked\nexpected=%s\ngot=%s", tt.variant, variant.Name)
+			}
+		})
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		store testStore
+
+		stats url.Stats
+		err   error
+	}{
+		"not found": {
+			store: testStore{
+				err: url.ErrNotFound,
+			},
+			err: url.ErrNotFound,
+		},
+		"store error": {
+			store: testStore{
+				err: errStore,
+			},
+			err: errStore,
+		},
+		"success": {
+			store: testStore{
+				count: 10,
+				split: url.Split{Variants: []url.Variant{{Name: "a", Weight: 1, Count: 6}, {Name: "b", Weight: 1, Count: 4}}},
+			},
+			stats: url.Stats{
+				Count:    10,
+				Variants: []url.Variant{{Name: "a", Weight: 1, Count: 6}, {Name: "b", Weight: 1, Count: 4}},
+			},
+		},
+		"limited clicks": {
+			store: testStore{
+				count:     3,
+				remaining: 2,
+			},
+			stats: url.Stats{
+				Count:     3,
+				Remaining: 2,
+			},
+		},
+		"scheduled": {
+			store: testStore{
+				notBefore: now.Add(time.Minute),
+			},
+			stats: url.Stats{
+				NotBefore: now.Add(time.Minute),
+				Scheduled: true,
+			},
+		},
+		"started": {
+			store: testStore{
+				count:     1,
+				notBefore: now.Add(-time.Minute),
+			},
+			stats: url.Stats{
+				Count:     1,
+				NotBefore: now.Add(-time.Minute),
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			svc := url.NewService(baseURL, nil, tt.store, url.WithClock(func() time.Time { return now }))
+			stats, err := svc.GetStats(context.Background(), "ID")
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if !reflect.DeepEqual(stats, tt.stats) {
+				t.Errorf("wrong stats returned\nexpected=%+v\ngot=%+v", tt.stats, stats)
+			}
+		})
+	}
+}
+
+func TestMatchRules(t *testing.T) {
+	rules := []url.Rule{
+		{Platform: url.PlatformIOS, Target: "ios"},
+		{Platform: url.PlatformAndroid, Country: "ES", Target: "android-es"},
+		{Platform: url.PlatformAndroid, Target: "android"},
+		{Language: "es", Target: "es"},
+	}
+
+	tests := map[string]struct {
+		visit url.Visit
+
+		target string
+		ok     bool
+	}{
+		"first matching rule": {
+			visit:  url.Visit{Platform: url.PlatformIOS, Language: "es"},
+			target: "ios",
+			ok:     true,
+		},
+		"all conditions": {
+			visit:  url.Visit{Platform: url.PlatformAndroid, Country: "es"},
+			target: "android-es",
+			ok:     true,
+		},
+		"partial conditions": {
+			visit:  url.Visit{Platform: url.PlatformAndroid, Country: "FR"},
+			target: "android",
+			ok:     true,
+		},
+		"language region": {
+			visit:  url.Visit{Platform: url.PlatformWindows, Language: "es-MX"},
+			target: "es",
+			ok:     true,
+		},
+		"language prefix is not a match": {
+			visit: url.Visit{Language: "est"},
+		},
+		"no match": {
+			visit: url.Visit{Platform: url.PlatformLinux, Language: "en"},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			target, ok := url.MatchRules(rules, tt.visit)
+
+			if ok != tt.ok || target != tt.target {
+				t.Errorf("wrong rule matched\nexpected=%s %t\ngot=%s %t", tt.target, tt.ok, target, ok)
+			}
+		})
+	}
+}
+
+func TestListURLsByCampaign(t *testing.T) {
+	domain := baseURL
+
+	tests := map[string]struct {
+		store testStore
+
+		links []url.Link
+		err   error
+	}{
+		"store error": {
+			store: testStore{
+				err: errStore,
+			},
+			err: errStore,
+		},
+		"success": {
+			store: testStore{
+				links: []url.Link{{Short: "A"}, {Short: "B"}},
+			},
+			links: []url.Link{{Short: "A", ShortURL: domain.ShortURL("A")}, {Short: "B", ShortURL: domain.ShortURL("B")}},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			svc := url.NewService(domain, nil, tt.store)
+			links, err := svc.ListURLsByCampaign(context.Background(), "campaign")
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if !reflect.DeepEqual(links, tt.links) {
+				t.Errorf("wrong links returned\nexpected=%+v\ngot=%+v", tt.links, links)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	tests := map[string]struct {
+		store testStore
+
+		err error
+	}{
+		"not found": {
+			store: testStore{
+				err: url.ErrNotFound,
+			},
+			err: url.ErrNotFound,
+		},
+		"store error": {
+			store: testStore{
+				err: errStore,
+			},
+			err: errStore,
+		},
+		"success": {
+			err: nil,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			svc := url.NewService(url.BaseURL{}, nil, tt.store)
+			err := svc.DeleteURL(context.Background(), "")
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	tests := map[string]struct {
+		store testStore
+
+		err error
+	}{
+		"not found": {
+			store: testStore{
+				err: url.ErrNotFound,
+			},
+			err: url.ErrNotFound,
+		},
+		"store error": {
+			store: testStore{
+				err: errStore,
+			},
+			err: errStore,
+		},
+		"success": {
+			err: nil,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			svc := url.NewService(url.BaseURL{}, nil, tt.store)
+			err := svc.RestoreURL(context.Background(), "ID")
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestPurgeDeletedURLs(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		store     testStore
+		retention time.Duration
+
+		before time.Time
+		purged int
+		err    error
+	}{
+		"store error": {
+			store: testStore{
+				err: errStore,
+			},
+			err: errStore,
+		},
+		"default retention": {
+			store: testStore{
+				purged: []url.Link{{Short: "A"}, {Domain: "acme.link", Short: "B"}},
+			},
+			before: now.Add(-url.DefaultRetention),
+			purged: 2,
+		},
+		"retention": {
+			store: testStore{
+				purged: []url.Link{{Short: "A"}},
+			},
+			retention: time.Hour,
+			before:    now.Add(-time.Hour),
+			purged:    1,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var before time.Time
+			tt.store.purgedBefore = &before
+			opts := []url.Option{url.WithClock(func() time.Time { return now })}
+			if tt.retention > 0 {
+				opts = append(opts, url.WithRetention(tt.retention))
+			}
+
+			svc := url.NewService(url.BaseURL{}, nil, tt.store, opts...)
+			purged, err := svc.PurgeDeletedURLs(context.Background())
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if err == nil && (purged != tt.purged || !before.Equal(tt.before)) {
+				t.Errorf("wrong purge\nexpected=%d before %s\ngot=%d before %s", tt.purged, tt.before, purged, before)
+			}
+		})
+	}
+}
+
+func TestIncrementCount(t *testing.T) {
+	tests := map[string]struct {
+		store testStore
+
+		count int
+		err   error
+	}{
+		"store error": {
+			store: testStore{
+				err: errStore,
+			},
+			err: errStore,
+		},
+		"exhausted": {
+			store: testStore{
+				err: url.ErrExhausted,
+			},
+			err: url.ErrExhausted,
+		},
+		"success": {
+			store: testStore{
+				count:     5,
+				remaining: url.UnlimitedClicks,
+			},
+			count: 5,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			svc := url.NewService(url.BaseURL{}, nil, tt.store)
+			count, err := svc.IncrementRedirectionCount(context.Background(), "")
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if count != tt.count {
+				t.Errorf("wrong count returned\nexpected=%d\ngot=%d", tt.count, count)
+			}
+		})
+	}
+}
+
+func TestGetCount(t *testing.T) {
 	count := 100
 
 	tests := map[string]struct {
@@ -255,7 +1665,7 @@ func TestGetCount(t *testing.T) {
 
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
-			svc := url.NewService("", nil, tt.store)
+			svc := url.NewService(url.BaseURL{}, nil, tt.store)
 			count, err := svc.GetRedirectionCount(context.Background(), "")
 
 			if !errors.Is(err, tt.err) {
@@ -268,3 +1678,501 @@ func TestGetCount(t *testing.T) {
 		})
 	}
 }
+
+func TestAudit(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	origin := url.Origin{Actor: "alice", RequestID: "req-1", Protocol: url.ProtocolHTTP}
+	rules := []url.Rule{{Platform: url.PlatformIOS, Target: "https://www.apple.com"}}
+
+	tests := map[string]struct {
+		store testStore
+		call  func(ctx context.Context, svc url.Service) error
+
+		entries []url.AuditEntry
+	}{
+		"create": {
+			call: func(ctx context.Context, svc url.Service) error {
+				_, err := svc.CreateURL(ctx, "https://www.google.es", url.LinkOptions{Password: "secret"})
+				return err
+			},
+			entries: []url.AuditEntry{{
+				ID:     1,
+				Time:   now,
+				Action: url.ActionCreate,
+				Short:  "ID",
+				After: []byte(`{"Long":"https://www.google.es","Warn":false,"RedirectType":307,"ForwardQuery":"",` +
+					`"ForwardPath":false,"Campaign":{"Source":"","Medium":"","Name":"","Term":"","Content":""},` +
+					`"Protected":true,"MaxClicks":0,"NotBefore":"0001-01-01T00:00:00Z"}`),
+				Origin: origin,
+			}},
+		},
+		"set rules": {
+			store: testStore{
+				rules: []url.Rule{{Language: "es", Target: "https://www.google.es"}},
+			},
+			call: func(ctx context.Context, svc url.Service) error {
+				return svc.SetRules(ctx, "ID", rules)
+			},
+			entries: []url.AuditEntry{{
+				ID:     1,
+				Time:   now,
+				Action: url.ActionSetRules,
+				Short:  "ID",
+				Before: []byte(`[{"Platform":"","Language":"es","Country":"","Target":"https://www.google.es"}]`),
+				After:  []byte(`[{"Platform":"ios","Language":"","Country":"","Target":"https://www.apple.com"}]`),
+				Origin: origin,
+			}},
+		},
+		"delete": {
+			store: testStore{
+				url: "https://www.google.es",
+			},
+			call: func(ctx context.Context, svc url.Service) error {
+				return svc.DeleteURL(ctx, "ID")
+			},
+			entries: []url.AuditEntry{{
+				ID:     1,
+				Time:   now,
+				Action: url.ActionDelete,
+				Short:  "ID",
+				Before: []byte(`{"Long":"https://www.google.es","Warn":false,"RedirectType":0,"ForwardQuery":"",` +
+					`"ForwardPath":false,"Campaign":{"Source":"","Medium":"","Name":"","Term":"","Content":""},` +
+					`"Protected":false,"MaxClicks":0,"NotBefore":"0001-01-01T00:00:00Z"}`),
+				Origin: origin,
+			}},
+		},
+		"failed change": {
+			store: testStore{
+				err: url.ErrNotFound,
+			},
+			call: func(ctx context.Context, svc url.Service) error {
+				return svc.DeleteURL(ctx, "ID")
+			},
+		},
+		"purge": {
+			store: testStore{
+				purged: []url.Link{{Short: "A"}, {Domain: "acme.link", Short: "B"}},
+			},
+			call: func(ctx context.Context, svc url.Service) error {
+				_, err := svc.PurgeDeletedURLs(context.Background())
+				return err
+			},
+			entries: []url.AuditEntry{
+				{ID: 1, Time: now, Action: url.ActionPurge, Short: "A", Origin: url.Origin{Actor: "system", Protocol: url.ProtocolSystem}},
+				{ID: 2, Time: now, Action: url.ActionPurge, Domain: "acme.link", Short: "B",
+					Origin: url.Origin{Actor: "system", Protocol: url.ProtocolSystem}},
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var entries []url.AuditEntry
+			svc := url.NewService(baseURL, testGenerator{id: "ID"}, tt.store,
+				url.WithClock(func() time.Time { return now }), url.WithAuditLog(testAuditLog{entries: &entries}))
+
+			err := tt.call(url.WithOrigin(context.Background(), origin), svc)
+			if err != nil && tt.entries != nil {
+				t.Fatalf("could not make change: %s", err)
+			}
+
+			if !reflect.DeepEqual(entries, tt.entries) {
+				t.Errorf("wrong audit entries\nexpected=%+v\ngot=%+v", tt.entries, entries)
+			}
+		})
+	}
+}
+
+func TestListAuditEntries(t *testing.T) {
+	from := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		auditLog url.AuditLog
+		filter   url.AuditFilter
+
+		wantFilter url.AuditFilter
+		err        error
+	}{
+		"disabled": {
+			err: url.ErrAuditDisabled,
+		},
+		"empty time range": {
+			auditLog: testAuditLog{entries: &[]url.AuditEntry{}},
+			filter:   url.AuditFilter{From: from, To: from},
+			err:      url.ErrInvalidAuditFilter,
+		},
+		"limit too big": {
+			auditLog: testAuditLog{entries: &[]url.AuditEntry{}},
+			filter:   url.AuditFilter{Limit: url.MaxAuditLimit + 1},
+			err:      url.ErrInvalidAuditFilter,
+		},
+		"store error": {
+			auditLog: testAuditLog{entries: &[]url.AuditEntry{}, err: errStore},
+			err:      errStore,
+		},
+		"default limit": {
+			auditLog:   testAuditLog{entries: &[]url.AuditEntry{}},
+			filter:     url.AuditFilter{Actor: "alice", From: from, To: from.Add(time.Hour)},
+			wantFilter: url.AuditFilter{Actor: "alice", From: from, To: from.Add(time.Hour), Limit: url.DefaultAuditLimit},
+		},
+		"domain": {
+			auditLog:   testAuditLog{entries: &[]url.AuditEntry{}},
+			filter:     url.AuditFilter{Domain: stringPtr("ACME.link:443")},
+			wantFilter: url.AuditFilter{Domain: stringPtr("acme.link"), Limit: url.DefaultAuditLimit},
+		},
+		"default domain": {
+			auditLog:   testAuditLog{entries: &[]url.AuditEntry{}},
+			filter:     url.AuditFilter{Domain: stringPtr("short.io")},
+			wantFilter: url.AuditFilter{Domain: stringPtr(""), Limit: url.DefaultAuditLimit},
+		},
+		"removed domain": {
+			auditLog:   testAuditLog{entries: &[]url.AuditEntry{}},
+			filter:     url.AuditFilter{Domain: stringPtr("Old.link")},
+			wantFilter: url.AuditFilter{Domain: stringPtr("old.link"), Limit: url.DefaultAuditLimit},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var filter url.AuditFilter
+			var opts []url.Option
+			if auditLog, ok := tt.auditLog.(testAuditLog); ok {
+				auditLog.filter = &filter
+				opts = append(opts, url.WithAuditLog(auditLog))
+			}
+
+			opts = append(opts, url.WithDomains(url.MustParseBaseURL("https://acme.link")))
+			svc := url.NewService(url.MustParseBaseURL("https://short.io"), nil, testStore{}, opts...)
+			_, err := svc.ListAuditEntries(context.Background(), tt.filter)
+
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if err == nil && !reflect.DeepEqual(filter, tt.wantFilter) {
+				t.Errorf("wrong filter\nexpected=%+v\ngot=%+v", tt.wantFilter, filter)
+			}
+		})
+	}
+}
+
+func TestExportAuditEntries(t *testing.T) {
+	entries := make([]url.AuditEntry, url.MaxAuditLimit+5)
+	for i := range entries {
+		entries[i] = url.AuditEntry{ID: int64(i + 1), Action: url.ActionCreate}
+	}
+
+	svc := url.NewService(url.BaseURL{}, nil, testStore{}, url.WithAuditLog(testAuditLog{entries: &entries}))
+	var exported []int64
+	err := svc.ExportAuditEntries(context.Background(), url.AuditFilter{Limit: 10}, func(entry url.AuditEntry) error {
+		exported = append(exported, entry.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not export audit entries: %s", err)
+	}
+
+	if len(exported) != len(entries) || exported[0] != 1 || exported[len(exported)-1] != int64(len(entries)) {
+		t.Errorf("wrong audit entries exported\nexpected=%d from 1\ngot=%d", len(entries), len(exported))
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		store testStore
+		call  func(ctx context.Context, svc url.Service) error
+
+		events []url.Event
+	}{
+		"create": {
+			call: func(ctx context.Context, svc url.Service) error {
+				_, err := svc.CreateURL(ctx, "https://www.google.es", url.LinkOptions{})
+				return err
+			},
+			events: []url.Event{{Type: url.EventCreated, Time: now, ID: "ID", ShortURL: "http://localhost:8080/ID",
+				URL: "https://www.google.es"}},
+		},
+		"create protected": {
+			call: func(ctx context.Context, svc url.Service) error {
+				_, err := svc.CreateURL(ctx, "https://www.google.es", url.LinkOptions{Password: "secret"})
+				return err
+			},
+			events: []url.Event{{Type: url.EventCreated, Time: now, ID: "ID", ShortURL: "http://localhost:8080/ID"}},
+		},
+		"delete": {
+			store: testStore{
+				url:   "https://www.google.es",
+				count: 3,
+			},
+			call: func(ctx context.Context, svc url.Service) error {
+				return svc.DeleteURL(ctx, "ID")
+			},
+			events: []url.Event{{Type: url.EventDeleted, Time: now, ID: "ID", ShortURL: "http://localhost:8080/ID",
+				URL: "https://www.google.es", Count: 3}},
+		},
+		"delete not found": {
+			store: testStore{
+				err: url.ErrNotFound,
+			},
+			call: func(ctx context.Context, svc url.Service) error {
+				return svc.DeleteURL(ctx, "ID")
+			},
+		},
+		"click below threshold": {
+			store: testStore{
+				count:     9,
+				remaining: url.UnlimitedClicks,
+			},
+			call: func(ctx context.Context, svc url.Service) error {
+				_, err := svc.IncrementRedirectionCount(ctx, "ID")
+				return err
+			},
+		},
+		"click threshold": {
+			store: testStore{
+				count:     10,
+				remaining: url.UnlimitedClicks,
+			},
+			call: func(ctx context.Context, svc url.Service) error {
+				_, err := svc.IncrementRedirectionCount(ctx, "ID")
+				return err
+			},
+			events: []url.Event{{Type: url.EventClicks, Time: now, ID: "ID", ShortURL: "http://localhost:8080/ID", Count: 10}},
+		},
+		"last click": {
+			store: testStore{
+				count:     3,
+				remaining: 0,
+			},
+			call: func(ctx context.Context, svc url.Service) error {
+				_, err := svc.IncrementRedirectionCount(ctx, "ID")
+				return err
+			},
+			events: []url.Event{{Type: url.EventExpired, Time: now, ID: "ID", ShortURL: "http://localhost:8080/ID", Count: 3}},
+		},
+		"last click on threshold": {
+			store: testStore{
+				count:     10,
+				remaining: 0,
+			},
+			call: func(ctx context.Context, svc url.Service) error {
+				_, err := svc.IncrementRedirectionCount(ctx, "ID")
+				return err
+			},
+			events: []url.Event{
+				{Type: url.EventClicks, Time: now, ID: "ID", ShortURL: "http://localhost:8080/ID", Count: 10},
+				{Type: url.EventExpired, Time: now, ID: "ID", ShortURL: "http://localhost:8080/ID", Count: 10},
+			},
+		},
+		"exhausted": {
+			store: testStore{
+				err: url.ErrExhausted,
+			},
+			call: func(ctx context.Context, svc url.Service) error {
+				_, err := svc.IncrementRedirectionCount(ctx, "ID")
+				return err
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var events []url.Event
+			tt.store.events = &events
+			svc := url.NewService(baseURL, testGenerator{id: "ID"}, tt.store,
+				url.WithClock(func() time.Time { return now }), url.WithWebhooks(testWebhooks{}),
+				url.WithClickThresholds(10, 100))
+
+			err := tt.call(context.Background(), svc)
+			if err != nil && tt.events != nil {
+				t.Fatalf("could not make change: %s", err)
+			}
+
+			if !reflect.DeepEqual(events, tt.events) {
+				t.Errorf("wrong events\nexpected=%+v\ngot=%+v", tt.events, events)
+			}
+		})
+	}
+}
+
+func TestAddWebhook(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		webhooks *testWebhooks
+		webhook  url.Webhook
+		allowed  []netip.Prefix
+
+		added url.Webhook
+		err   error
+	}{
+		"disabled": {
+			webhook: url.Webhook{URL: "https://example.com/hook"},
+			err:     url.ErrWebhooksDisabled,
+		},
+		"invalid url": {
+			webhooks: &testWebhooks{},
+			webhook:  url.Webhook{URL: "example.com/hook"},
+			err:      url.ErrInvalidWebhook,
+		},
+		"invalid scheme": {
+			webhooks: &testWebhooks{},
+			webhook:  url.Webhook{URL: "ftp://example.com/hook"},
+			err:      url.ErrInvalidWebhook,
+		},
+		"unknown event": {
+			webhooks: &testWebhooks{},
+			webhook:  url.Webhook{URL: "https://example.com/hook", Events: []string{"link.visited"}},
+			err:      url.ErrInvalidWebhook,
+		},
+		"private address": {
+			webhooks: &testWebhooks{},
+			webhook:  url.Webhook{URL: "http://10.0.0.1/hook"},
+			err:      url.ErrForbiddenWebhookHost,
+		},
+		"loopback address": {
+			webhooks: &testWebhooks{},
+			webhook:  url.Webhook{URL: "http://[::1]:8080/hook"},
+			err:      url.ErrForbiddenWebhookHost,
+		},
+		"link-local address": {
+			webhooks: &testWebhooks{},
+			webhook:  url.Webhook{URL: "http://169.254.169.254/latest/meta-data"},
+			err:      url.ErrForbiddenWebhookHost,
+		},
+		"resolves to private address": {
+			webhooks: &testWebhooks{},
+			webhook:  url.Webhook{URL: "https://internal.example.com/hook"},
+			err:      url.ErrForbiddenWebhookHost,
+		},
+		"one address private": {
+			webhooks: &testWebhooks{},
+			webhook:  url.Webhook{URL: "https://mixed.example.com/hook"},
+			err:      url.ErrForbiddenWebhookHost,
+		},
+		"other network allowed": {
+			webhooks: &testWebhooks{},
+			webhook:  url.Webhook{URL: "https://internal.example.com/hook"},
+			allowed:  []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")},
+			err:      url.ErrForbiddenWebhookHost,
+		},
+		"unresolvable host": {
+			webhooks: &testWebhooks{},
+			webhook:  url.Webhook{URL: "https://unknown.example.com/hook"},
+			err:      url.ErrInvalidWebhook,
+		},
+		"allowed network": {
+			webhooks: &testWebhooks{},
+			webhook:  url.Webhook{URL: "https://internal.example.com/hook", Secret: "secret"},
+			allowed:  []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			added: url.Webhook{ID: 1, URL: "https://internal.example.com/hook", Secret: "secret", Events: []string{},
+				CreatedAt: now},
+		},
+		"store error": {
+			webhooks: &testWebhooks{err: errStore},
+			webhook:  url.Webhook{URL: "https://example.com/hook"},
+			err:      errStore,
+		},
+		"success": {
+			webhooks: &testWebhooks{},
+			webhook: url.Webhook{URL: " https://example.com/hook ", Secret: "secret",
+				Events: []string{url.EventCreated, url.EventExpired, url.EventCreated}},
+			added: url.Webhook{ID: 1, URL: "https://example.com/hook", Secret: "secret",
+				Events: []string{url.EventCreated, url.EventExpired}, CreatedAt: now},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			opts := []url.Option{url.WithClock(func() time.Time { return now }),
+				url.WithWebhookNetworks(url.NewWebhookNetworks(webhookHosts, tt.allowed...))}
+			var added url.Webhook
+			if tt.webhooks != nil {
+				tt.webhooks.added = &added
+				opts = append(opts, url.WithWebhooks(*tt.webhooks))
+			}
+
+			svc := url.NewService(url.BaseURL{}, nil, testStore{}, opts...)
+			webhook, err := svc.AddWebhook(context.Background(), tt.webhook)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if tt.err != nil {
+				return
+			}
+
+			if !reflect.DeepEqual(webhook, tt.added) {
+				t.Errorf("wrong webhook returned\nexpected=%+v\ngot=%+v", tt.added, webhook)
+			}
+		})
+	}
+
+	t.Run("generated secret", func(t *testing.T) {
+		svc := url.NewService(url.BaseURL{}, nil, testStore{}, url.WithWebhooks(testWebhooks{}),
+			url.WithWebhookNetworks(url.NewWebhookNetworks(webhookHosts)))
+		first, err := svc.AddWebhook(context.Background(), url.Webhook{URL: "https://example.com/hook"})
+		if err != nil {
+			t.Fatalf("could not add webhook: %s", err)
+		}
+
+		second, err := svc.AddWebhook(context.Background(), url.Webhook{URL: "https://example.com/hook"})
+		if err != nil {
+			t.Fatalf("could not add webhook: %s", err)
+		}
+
+		if len(first.Secret) != 64 || first.Secret == second.Secret {
+			t.Errorf("wrong generated secrets %q and %q", first.Secret, second.Secret)
+		}
+	})
+}
+
+func TestListDeliveries(t *testing.T) {
+	tests := map[string]struct {
+		webhooks testWebhooks
+		filter   url.DeliveryFilter
+
+		storeFilter url.DeliveryFilter
+		err         error
+	}{
+		"invalid status": {
+			filter: url.DeliveryFilter{Status: "sent"},
+			err:    url.ErrInvalidDeliveryFilter,
+		},
+		"limit too big": {
+			filter: url.DeliveryFilter{Limit: url.MaxDeliveryLimit + 1},
+			err:    url.ErrInvalidDeliveryFilter,
+		},
+		"not found": {
+			webhooks: testWebhooks{err: url.ErrWebhookNotFound},
+			err:      url.ErrWebhookNotFound,
+		},
+		"store error": {
+			webhooks: testWebhooks{err: errStore},
+			err:      errStore,
+		},
+		"default limit": {
+			filter:      url.DeliveryFilter{Status: url.DeliveryFailed},
+			storeFilter: url.DeliveryFilter{Status: url.DeliveryFailed, Limit: url.DefaultDeliveryLimit},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var filter url.DeliveryFilter
+			tt.webhooks.filter = &filter
+			svc := url.NewService(url.BaseURL{}, nil, testStore{}, url.WithWebhooks(tt.webhooks))
+
+			_, err := svc.ListDeliveries(context.Background(), 1, tt.filter)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if tt.err == nil && filter != tt.storeFilter {
+				t.Errorf("wrong filter\nexpected=%+v\ngot=%+v", tt.storeFilter, filter)
+			}
+		})
+	}
+}
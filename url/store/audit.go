@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/nerock/urlshort/url"
+)
+
+const (
+	createAuditEntry = `INSERT INTO url_audit (time, action, domain, short, before_value, after_value, actor,
+		request_id, protocol) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	listAuditEntries = `SELECT id, time, action, domain, short, before_value, after_value, actor, request_id, protocol
+		FROM url_audit WHERE id > ?`
+)
+
+// AddAuditEntry appends an entry to the audit log, entries can not be updated or deleted
+func (u URLStore) AddAuditEntry(ctx context.Context, entry url.AuditEntry) error {
+	if _, err := u.db.ExecContext(ctx, createAuditEntry, entry.Time.UTC(), entry.Action, entry.Domain, entry.Short,
+		nullJSON(entry.Before), nullJSON(entry.After), entry.Actor, entry.RequestID, entry.Protocol); err != nil {
+		return fmt.Errorf("save audit entry in database: %w", err)
+	}
+
+	return nil
+}
+
+// ListAuditEntries lists the audit entries matching the filter in the order they were added
+func (u URLStore) ListAuditEntries(ctx context.Context, filter url.AuditFilter) ([]url.AuditEntry, error) {
+	var (
+		query strings.Builder
+		args  = []any{filter.AfterID}
+	)
+	query.WriteString(listAuditEntries)
+	if filter.Domain != nil {
+		query.WriteString(` AND domain = ?`)
+		args = append(args, *filter.Domain)
+	}
+	if filter.Short != "" {
+		query.WriteString(` AND short = ?`)
+		args = append(args, filter.Short)
+	}
+	if filter.Actor != "" {
+		query.WriteString(` AND actor = ?`)
+		args = append(args, filter.Actor)
+	}
+	if !filter.From.IsZero() {
+		query.WriteString(` AND time >= ?`)
+		args = append(args, filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		query.WriteString(` AND time < ?`)
+		args = append(args, filter.To.UTC())
+	}
+	query.WriteString(` ORDER BY id LIMIT ?`)
+	args = append(args, filter.Limit)
+
+	rows, err := u.db.QueryContext(ctx, query.String(), args...)
+	if err != nil {
+		return nil, fmt.Errorf("list audit entries from database: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []url.AuditEntry
+	for rows.Next() {
+		var (
+			entry         url.AuditEntry
+			before, after sql.NullString
+		)
+		if err := rows.Scan(&entry.ID, &entry.Time, &entry.Action, &entry.Domain, &entry.Short, &before, &after,
+			&entry.Actor, &entry.RequestID, &entry.Protocol); err != nil {
+			return nil, fmt.Errorf("parse audit entry from database: %w", err)
+		}
+		if before.Valid {
+			entry.Before = []byte(before.String)
+		}
+		if after.Valid {
+			entry.After = []byte(after.String)
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list audit entries from database: %w", err)
+	}
+
+	return entries, nil
+}
+
+func nullJSON(value []byte) sql.NullString {
+	return sql.NullString{String: string(value), Valid: value != nil}
+}
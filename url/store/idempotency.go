@@ -0,0 +1,88 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nerock/urlshort/url"
+)
+
+const (
+	// reserveIdempotencyKey replaces the records of the key saved before the window and the ones in progress
+	// saved before their lease, so it only changes a row when the key is reserved
+	reserveIdempotencyKey = `INSERT INTO idempotency_key (key, request_hash, created_at) VALUES (?1, ?2, ?3)
+		ON CONFLICT (key) DO UPDATE SET request_hash = ?2, domain = '', short = '', created_at = ?3
+		WHERE created_at < ?4 OR (short = '' AND created_at < ?5)`
+	getIdempotencyKey      = `SELECT key, request_hash, domain, short, created_at FROM idempotency_key WHERE key = ?`
+	completeIdempotencyKey = `UPDATE idempotency_key SET domain = ?, short = ?
+		WHERE key = ? AND request_hash = ? AND created_at = ? AND short = ''`
+	releaseIdempotencyKey = `DELETE FROM idempotency_key WHERE key = ? AND short = ''`
+	purgeIdempotencyKeys  = `DELETE FROM idempotency_key WHERE created_at < ?`
+)
+
+// ReserveIdempotencyKey saves the record unless its key was saved at or after since, or after leaseSince while
+// it is in progress, it returns the saved record and whether it was saved by this call
+func (u URLStore) ReserveIdempotencyKey(ctx context.Context, record url.IdempotencyRecord, since, leaseSince time.Time) (url.IdempotencyRecord, bool, error) {
+	res, err := u.db.ExecContext(ctx, reserveIdempotencyKey, record.Key, record.RequestHash, record.CreatedAt.UTC(),
+		since.UTC(), leaseSince.UTC())
+	if err != nil {
+		return url.IdempotencyRecord{}, false, fmt.Errorf("save idempotency key in database: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return url.IdempotencyRecord{}, false, fmt.Errorf("save idempotency key in database: %w", err)
+	} else if n > 0 {
+		return record, true, nil
+	}
+
+	var saved url.IdempotencyRecord
+	if err := u.db.QueryRowContext(ctx, getIdempotencyKey, record.Key).Scan(&saved.Key, &saved.RequestHash,
+		&saved.Domain, &saved.Short, &saved.CreatedAt); err != nil {
+		return url.IdempotencyRecord{}, false, fmt.Errorf("get idempotency key from database: %w", err)
+	}
+
+	return saved, false, nil
+}
+
+// CompleteIdempotencyKey saves the url created by the request of the record while the saved record has its
+// request hash and creation time, it returns url.ErrIdempotencyConflict when the key is no longer reserved by it
+func (u URLStore) CompleteIdempotencyKey(ctx context.Context, record url.IdempotencyRecord) error {
+	res, err := u.db.ExecContext(ctx, completeIdempotencyKey, record.Domain, record.Short, record.Key,
+		record.RequestHash, record.CreatedAt.UTC())
+	if err != nil {
+		return fmt.Errorf("update idempotency key in database: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("update idempotency key in database: %w", err)
+	} else if n == 0 {
+		return url.ErrIdempotencyConflict
+	}
+
+	return nil
+}
+
+// ReleaseIdempotencyKey removes the key while its request is in progress
+func (u URLStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	if _, err := u.db.ExecContext(ctx, releaseIdempotencyKey, key); err != nil {
+		return fmt.Errorf("delete idempotency key from database: %w", err)
+	}
+
+	return nil
+}
+
+// PurgeIdempotencyKeys removes the keys saved before the time returning how many were removed
+func (u URLStore) PurgeIdempotencyKeys(ctx context.Context, before time.Time) (int, error) {
+	res, err := u.db.ExecContext(ctx, purgeIdempotencyKeys, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("delete idempotency keys from database: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete idempotency keys from database: %w", err)
+	}
+
+	return int(n), nil
+}
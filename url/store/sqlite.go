@@ -5,7 +5,9 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 
+	"github.com/mattn/go-sqlite3"
 	"github.com/nerock/urlshort/url"
 )
 
@@ -16,35 +18,216 @@ type URLStore struct {
 const (
 	createURLTable = `CREATE TABLE IF NOT EXISTS url (short TEXT NOT NULL PRIMARY KEY, long TEXT NOT NULL, count INTEGER DEFAULT 0)`
 
-	createURL = `INSERT INTO url (short, long) VALUES (?, ?)`
-	getURL    = `SELECT long FROM url WHERE short = ?`
-	deleteURL = `DELETE FROM url WHERE short = ?`
+	getSchemaVersion = `PRAGMA user_version`
+	setSchemaVersion = `PRAGMA user_version = %d`
 
-	incrementRedirectionCount = `UPDATE url SET count = count + 1 WHERE short = ?`
-	getRedirectiontCount      = `SELECT count FROM url WHERE short = ?`
+	linkColumns = `domain, short, long, count, created_at, warn, redirect_type, forward_query, forward_path,
+		utm_source, utm_medium, utm_campaign, utm_term, utm_content, password_hash, max_clicks, not_before`
+
+	createURL = `INSERT INTO url (domain, short, long, created_at, warn, redirect_type, forward_query, forward_path,
+		utm_source, utm_medium, utm_campaign, utm_term, utm_content, password_hash, max_clicks, not_before)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	getURL             = `SELECT long FROM url WHERE domain = ? AND short = ? AND deleted_at IS NULL`
+	getLink            = `SELECT ` + linkColumns + ` FROM url WHERE domain = ? AND short = ? AND deleted_at IS NULL`
+	listURLsByCampaign = `SELECT ` + linkColumns + ` FROM url WHERE utm_campaign = ? AND deleted_at IS NULL
+		ORDER BY created_at, domain, short`
+	existsURL = `SELECT EXISTS (SELECT 1 FROM url WHERE domain = ? AND short = ? AND deleted_at IS NULL)`
+
+	// Deleted urls are kept in the trash with their rules and variants until they are purged,
+	// their ids are still taken so they can be restored
+	deleteURL      = `UPDATE url SET deleted_at = ? WHERE domain = ? AND short = ? AND deleted_at IS NULL`
+	restoreURL     = `UPDATE url SET deleted_at = NULL WHERE domain = ? AND short = ? AND deleted_at IS NOT NULL`
+	listPurgedURLs = `SELECT domain, short FROM url WHERE deleted_at < ?`
+	purgeURLs      = `DELETE FROM url WHERE deleted_at < ?`
+	purgeRules     = `DELETE FROM url_rule WHERE (domain, short) IN (SELECT domain, short FROM url WHERE deleted_at < ?)`
+	purgeVariants  = `DELETE FROM url_variant WHERE (domain, short) IN
+		(SELECT domain, short FROM url WHERE deleted_at < ?)`
+
+	createRule = `INSERT INTO url_rule (domain, short, position, platform, language, country, target)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	getRules = `SELECT platform, language, country, target FROM url_rule WHERE domain = ? AND short = ?
+		ORDER BY position`
+	deleteRules = `DELETE FROM url_rule WHERE domain = ? AND short = ?`
+
+	createVariant = `INSERT INTO url_variant (domain, short, position, name, target, weight, count)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	getVariants = `SELECT name, target, weight, count FROM url_variant WHERE domain = ? AND short = ?
+		ORDER BY position`
+	deleteVariants        = `DELETE FROM url_variant WHERE domain = ? AND short = ?`
+	getStickyVariants     = `SELECT sticky_variants FROM url WHERE domain = ? AND short = ? AND deleted_at IS NULL`
+	setStickyVariants     = `UPDATE url SET sticky_variants = ? WHERE domain = ? AND short = ? AND deleted_at IS NULL`
+	incrementVariantCount = `UPDATE url_variant SET count = count + 1 WHERE domain = ?1 AND short = ?2 AND name = ?3
+		AND EXISTS (SELECT 1 FROM url WHERE domain = ?1 AND short = ?2 AND deleted_at IS NULL)`
+
+	// incrementRedirectionCount checks the maximum number of clicks in the same statement so concurrent
+	// redirections can not exceed it
+	incrementRedirectionCount = `UPDATE url SET count = count + 1 WHERE domain = ? AND short = ? AND deleted_at IS NULL
+		AND (max_clicks = 0 OR count < max_clicks) RETURNING count, max_clicks`
+	getRedirectiontCount = `SELECT count FROM url WHERE domain = ? AND short = ? AND deleted_at IS NULL`
+	getClicks            = `SELECT count, max_clicks FROM url WHERE domain = ? AND short = ? AND deleted_at IS NULL`
 )
 
+// migrations are applied in order after creating the url table,
+// the number of applied migrations is tracked in the sqlite user_version
+var migrations = []string{
+	`ALTER TABLE url ADD COLUMN created_at DATETIME`,
+	`ALTER TABLE url ADD COLUMN warn INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE url ADD COLUMN redirect_type INTEGER NOT NULL DEFAULT 307`,
+	`ALTER TABLE url ADD COLUMN forward_query TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE url ADD COLUMN forward_path INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE url ADD COLUMN utm_source TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE url ADD COLUMN utm_medium TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE url ADD COLUMN utm_campaign TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE url ADD COLUMN utm_term TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE url ADD COLUMN utm_content TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX url_utm_campaign ON url (utm_campaign)`,
+	`CREATE TABLE url_rule (short TEXT NOT NULL, position INTEGER NOT NULL, platform TEXT NOT NULL,
+		language TEXT NOT NULL, country TEXT NOT NULL, target TEXT NOT NULL, PRIMARY KEY (short, position))`,
+	`ALTER TABLE url ADD COLUMN sticky_variants INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE url_variant (short TEXT NOT NULL, position INTEGER NOT NULL, name TEXT NOT NULL,
+		target TEXT NOT NULL, weight INTEGER NOT NULL, count INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (short, name))`,
+	`ALTER TABLE url ADD COLUMN password_hash TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE url ADD COLUMN max_clicks INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE url ADD COLUMN not_before DATETIME`,
+	`ALTER TABLE url ADD COLUMN deleted_at DATETIME`,
+	`CREATE INDEX url_deleted_at ON url (deleted_at)`,
+	`CREATE TABLE url_audit (id INTEGER PRIMARY KEY AUTOINCREMENT, time DATETIME NOT NULL, action TEXT NOT NULL,
+		short TEXT NOT NULL, before_value TEXT, after_value TEXT, actor TEXT NOT NULL, request_id TEXT NOT NULL,
+		protocol TEXT NOT NULL)`,
+	`CREATE INDEX url_audit_short ON url_audit (short)`,
+	`CREATE INDEX url_audit_actor ON url_audit (actor)`,
+	`CREATE INDEX url_audit_time ON url_audit (time)`,
+	`CREATE TRIGGER url_audit_no_update BEFORE UPDATE ON url_audit
+		BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END`,
+	`CREATE TRIGGER url_audit_no_delete BEFORE DELETE ON url_audit
+		BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END`,
+	`CREATE TABLE webhook (id INTEGER PRIMARY KEY AUTOINCREMENT, url TEXT NOT NULL, secret TEXT NOT NULL,
+		events TEXT NOT NULL, created_at DATETIME NOT NULL)`,
+	`CREATE TABLE webhook_delivery (id INTEGER PRIMARY KEY AUTOINCREMENT, webhook_id INTEGER NOT NULL,
+		event TEXT NOT NULL, payload TEXT NOT NULL, created_at DATETIME NOT NULL, status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0, next_attempt_at DATETIME NOT NULL, last_error TEXT NOT NULL DEFAULT '')`,
+	`CREATE INDEX webhook_delivery_webhook ON webhook_delivery (webhook_id)`,
+	`CREATE INDEX webhook_delivery_pending ON webhook_delivery (status, next_attempt_at)`,
+	`CREATE TABLE webhook_attempt (id INTEGER PRIMARY KEY AUTOINCREMENT, delivery_id INTEGER NOT NULL,
+		time DATETIME NOT NULL, status_code INTEGER NOT NULL, error TEXT NOT NULL, duration_ms INTEGER NOT NULL)`,
+	`CREATE INDEX webhook_attempt_delivery ON webhook_attempt (delivery_id)`,
+	// The tables of urls are rebuilt to identify them by their domain and short id, urls of the default domain
+	// have an empty domain
+	`CREATE TABLE url_by_domain (domain TEXT NOT NULL DEFAULT '', short TEXT NOT NULL, long TEXT NOT NULL,
+		count INTEGER DEFAULT 0, created_at DATETIME, warn INTEGER NOT NULL DEFAULT 0,
+		redirect_type INTEGER NOT NULL DEFAULT 307, forward_query TEXT NOT NULL DEFAULT '',
+		forward_path INTEGER NOT NULL DEFAULT 0, utm_source TEXT NOT NULL DEFAULT '',
+		utm_medium TEXT NOT NULL DEFAULT '', utm_campaign TEXT NOT NULL DEFAULT '', utm_term TEXT NOT NULL DEFAULT '',
+		utm_content TEXT NOT NULL DEFAULT '', sticky_variants INTEGER NOT NULL DEFAULT 0,
+		password_hash TEXT NOT NULL DEFAULT '', max_clicks INTEGER NOT NULL DEFAULT 0, not_before DATETIME,
+		deleted_at DATETIME, PRIMARY KEY (domain, short))`,
+	`INSERT INTO url_by_domain (short, long, count, created_at, warn, redirect_type, forward_query, forward_path,
+		utm_source, utm_medium, utm_campaign, utm_term, utm_content, sticky_variants, password_hash, max_clicks,
+		not_before, deleted_at)
+		SELECT short, long, count, created_at, warn, redirect_type, forward_query, forward_path, utm_source,
+		utm_medium, utm_campaign, utm_term, utm_content, sticky_variants, password_hash, max_clicks, not_before,
+		deleted_at FROM url`,
+	`DROP TABLE url`,
+	`ALTER TABLE url_by_domain RENAME TO url`,
+	`CREATE INDEX url_utm_campaign ON url (utm_campaign)`,
+	`CREATE INDEX url_deleted_at ON url (deleted_at)`,
+	`CREATE TABLE url_rule_by_domain (domain TEXT NOT NULL DEFAULT '', short TEXT NOT NULL,
+		position INTEGER NOT NULL, platform TEXT NOT NULL, language TEXT NOT NULL, country TEXT NOT NULL,
+		target TEXT NOT NULL, PRIMARY KEY (domain, short, position))`,
+	`INSERT INTO url_rule_by_domain (short, position, platform, language, country, target)
+		SELECT short, position, platform, language, country, target FROM url_rule`,
+	`DROP TABLE url_rule`,
+	`ALTER TABLE url_rule_by_domain RENAME TO url_rule`,
+	`CREATE TABLE url_variant_by_domain (domain TEXT NOT NULL DEFAULT '', short TEXT NOT NULL,
+		position INTEGER NOT NULL, name TEXT NOT NULL, target TEXT NOT NULL, weight INTEGER NOT NULL,
+		count INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (domain, short, name))`,
+	`INSERT INTO url_variant_by_domain (short, position, name, target, weight, count)
+		SELECT short, position, name, target, weight, count FROM url_variant`,
+	`DROP TABLE url_variant`,
+	`ALTER TABLE url_variant_by_domain RENAME TO url_variant`,
+	`ALTER TABLE url_audit ADD COLUMN domain TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE idempotency_key (key TEXT NOT NULL PRIMARY KEY, request_hash TEXT NOT NULL,
+		domain TEXT NOT NULL DEFAULT '', short TEXT NOT NULL DEFAULT '', created_at DATETIME NOT NULL)`,
+	`CREATE INDEX idempotency_key_created_at ON idempotency_key (created_at)`,
+}
+
+// scanner is implemented by both sql.Row and sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
 // NewURLStore instantiates a new url store with sqlite
 func NewURLStore(db *sql.DB) (URLStore, error) {
 	if _, err := db.Exec(createURLTable); err != nil {
 		return URLStore{}, fmt.Errorf("could not create url table: %w", err)
 	}
 
+	if err := migrate(db); err != nil {
+		return URLStore{}, fmt.Errorf("could not migrate url table: %w", err)
+	}
+
 	return URLStore{db}, nil
 }
 
-// AddURL saves a new url
-func (u URLStore) AddURL(ctx context.Context, short, long string) error {
-	if _, err := u.db.ExecContext(ctx, createURL, short, long); err != nil {
+func migrate(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow(getSchemaVersion).Scan(&version); err != nil {
+		return fmt.Errorf("get schema version: %w", err)
+	}
+
+	if version >= len(migrations) {
+		return nil
+	}
+
+	for i, migration := range migrations[version:] {
+		if _, err := tx.Exec(migration); err != nil {
+			return fmt.Errorf("apply migration %d: %w", version+i+1, err)
+		}
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf(setSchemaVersion, len(migrations))); err != nil {
+		return fmt.Errorf("set schema version: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// AddURL saves a new url and queues the deliveries of the events in the same transaction
+func (u URLStore) AddURL(ctx context.Context, link url.Link, events ...url.Event) error {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, createURL, link.Domain, link.Short, link.Long, link.CreatedAt, link.Warn, link.RedirectType,
+		link.ForwardQuery, link.ForwardPath, link.Campaign.Source, link.Campaign.Medium, link.Campaign.Name,
+		link.Campaign.Term, link.Campaign.Content, link.PasswordHash, link.MaxClicks,
+		sql.NullTime{Time: link.NotBefore, Valid: !link.NotBefore.IsZero()}); err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			return url.ErrDuplicateID
+		}
+
 		return fmt.Errorf("save url in database: %w", err)
 	}
 
-	return nil
+	if err := addEvents(ctx, tx, events); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-// GetURL gets a long url from the id
-func (u URLStore) GetURL(ctx context.Context, short string) (string, error) {
-	row := u.db.QueryRowContext(ctx, getURL, short)
+// GetURL gets a long url from the domain and id
+func (u URLStore) GetURL(ctx context.Context, domain, short string) (string, error) {
+	row := u.db.QueryRowContext(ctx, getURL, domain, short)
 	if row.Err() != nil {
 		return "", fmt.Errorf("get url from database: %w", row.Err())
 	}
@@ -61,27 +244,410 @@ func (u URLStore) GetURL(ctx context.Context, short string) (string, error) {
 	return long, nil
 }
 
-// DeleteURL deletes an url from the id
-func (u URLStore) DeleteURL(ctx context.Context, short string) error {
-	if _, err := u.db.ExecContext(ctx, deleteURL, short); err != nil {
+// GetLink gets an url with all its details from the domain and id
+func (u URLStore) GetLink(ctx context.Context, domain, short string) (url.Link, error) {
+	row := u.db.QueryRowContext(ctx, getLink, domain, short)
+	if row.Err() != nil {
+		return url.Link{}, fmt.Errorf("get url from database: %w", row.Err())
+	}
+
+	link, err := scanLink(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return url.Link{}, url.ErrNotFound
+		}
+
+		return url.Link{}, fmt.Errorf("parse url from database: %w", err)
+	}
+
+	return link, nil
+}
+
+// ListURLsByCampaign gets all the urls with the UTM campaign on every domain
+func (u URLStore) ListURLsByCampaign(ctx context.Context, campaign string) ([]url.Link, error) {
+	rows, err := u.db.QueryContext(ctx, listURLsByCampaign, campaign)
+	if err != nil {
+		return nil, fmt.Errorf("list urls from database: %w", err)
+	}
+	defer rows.Close()
+
+	var links []url.Link
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return nil, fmt.Errorf("parse url from database: %w", err)
+		}
+		links = append(links, link)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list urls from database: %w", err)
+	}
+
+	return links, nil
+}
+
+func scanLink(row scanner) (url.Link, error) {
+	var (
+		link      url.Link
+		createdAt sql.NullTime
+		notBefore sql.NullTime
+	)
+	if err := row.Scan(&link.Domain, &link.Short, &link.Long, &link.Count, &createdAt, &link.Warn, &link.RedirectType,
+		&link.ForwardQuery, &link.ForwardPath, &link.Campaign.Source, &link.Campaign.Medium, &link.Campaign.Name,
+		&link.Campaign.Term, &link.Campaign.Content, &link.PasswordHash, &link.MaxClicks, &notBefore); err != nil {
+		return url.Link{}, err
+	}
+	link.CreatedAt = createdAt.Time
+	link.NotBefore = notBefore.Time
+
+	return link, nil
+}
+
+// DeleteURL moves an url to the trash and queues the deliveries of the events in the same transaction
+func (u URLStore) DeleteURL(ctx context.Context, domain, short string, deletedAt time.Time, events ...url.Event) error {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, deleteURL, deletedAt, domain, short)
+	if err != nil {
+		return fmt.Errorf("delete url from database: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
 		return fmt.Errorf("delete url from database: %w", err)
 	}
 
+	if n == 0 {
+		return url.ErrNotFound
+	}
+
+	if err := addEvents(ctx, tx, events); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RestoreURL takes an url out of the trash
+func (u URLStore) RestoreURL(ctx context.Context, domain, short string) error {
+	res, err := u.db.ExecContext(ctx, restoreURL, domain, short)
+	if err != nil {
+		return fmt.Errorf("restore url in database: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("restore url in database: %w", err)
+	}
+
+	if n == 0 {
+		return url.ErrNotFound
+	}
+
 	return nil
 }
 
-// IncrementRedirectionCount increments the count by one
-func (u URLStore) IncrementRedirectionCount(ctx context.Context, short string) error {
-	if _, err := u.db.ExecContext(ctx, incrementRedirectionCount, short); err != nil {
+// PurgeDeletedURLs removes the urls deleted before the time with their rules and variants,
+// it returns the urls removed with only their domain and id
+func (u URLStore) PurgeDeletedURLs(ctx context.Context, before time.Time) ([]url.Link, error) {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	purged, err := queryKeys(ctx, tx, listPurgedURLs, before)
+	if err != nil {
+		return nil, fmt.Errorf("list deleted urls from database: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, purgeRules, before); err != nil {
+		return nil, fmt.Errorf("delete rules from database: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, purgeVariants, before); err != nil {
+		return nil, fmt.Errorf("delete variants from database: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, purgeURLs, before); err != nil {
+		return nil, fmt.Errorf("delete urls from database: %w", err)
+	}
+
+	return purged, tx.Commit()
+}
+
+// queryKeys lists the urls of the query selecting their domain and id
+func queryKeys(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]url.Link, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []url.Link
+	for rows.Next() {
+		var link url.Link
+		if err := rows.Scan(&link.Domain, &link.Short); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+// SetRules replaces the routing rules of an url
+func (u URLStore) SetRules(ctx context.Context, domain, short string, rules []url.Rule) error {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := exists(ctx, tx, domain, short); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, deleteRules, domain, short); err != nil {
+		return fmt.Errorf("delete rules from database: %w", err)
+	}
+
+	for i, rule := range rules {
+		if _, err := tx.ExecContext(ctx, createRule, domain, short, i, rule.Platform, rule.Language, rule.Country,
+			rule.Target); err != nil {
+			return fmt.Errorf("save rule in database: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetRules gets the routing rules of an url in order
+func (u URLStore) GetRules(ctx context.Context, domain, short string) ([]url.Rule, error) {
+	tx, err := u.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := exists(ctx, tx, domain, short); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, getRules, domain, short)
+	if err != nil {
+		return nil, fmt.Errorf("get rules from database: %w", err)
+	}
+	defer rows.Close()
+
+	var rules []url.Rule
+	for rows.Next() {
+		var rule url.Rule
+		if err := rows.Scan(&rule.Platform, &rule.Language, &rule.Country, &rule.Target); err != nil {
+			return nil, fmt.Errorf("parse rule from database: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("get rules from database: %w", err)
+	}
+
+	return rules, nil
+}
+
+// SetSplit replaces the variants of an url keeping the count of the variants with the same name
+func (u URLStore) SetSplit(ctx context.Context, domain, short string, split url.Split) error {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := exists(ctx, tx, domain, short); err != nil {
+		return err
+	}
+
+	current, err := queryVariants(ctx, tx, domain, short)
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int, len(current))
+	for _, variant := range current {
+		counts[variant.Name] = variant.Count
+	}
+
+	if _, err := tx.ExecContext(ctx, deleteVariants, domain, short); err != nil {
+		return fmt.Errorf("delete variants from database: %w", err)
+	}
+
+	for i, variant := range split.Variants {
+		if _, err := tx.ExecContext(ctx, createVariant, domain, short, i, variant.Name, variant.Target, variant.Weight,
+			counts[variant.Name]); err != nil {
+			return fmt.Errorf("save variant in database: %w", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, setStickyVariants, split.Sticky, domain, short); err != nil {
 		return fmt.Errorf("save url in database: %w", err)
 	}
 
+	return tx.Commit()
+}
+
+// GetSplit gets the variants of an url in order
+func (u URLStore) GetSplit(ctx context.Context, domain, short string) (url.Split, error) {
+	tx, err := u.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return url.Split{}, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var split url.Split
+	if err := tx.QueryRowContext(ctx, getStickyVariants, domain, short).Scan(&split.Sticky); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return url.Split{}, url.ErrNotFound
+		}
+
+		return url.Split{}, fmt.Errorf("get url from database: %w", err)
+	}
+
+	if split.Variants, err = queryVariants(ctx, tx, domain, short); err != nil {
+		return url.Split{}, err
+	}
+
+	return split, nil
+}
+
+func queryVariants(ctx context.Context, tx *sql.Tx, domain, short string) ([]url.Variant, error) {
+	rows, err := tx.QueryContext(ctx, getVariants, domain, short)
+	if err != nil {
+		return nil, fmt.Errorf("get variants from database: %w", err)
+	}
+	defer rows.Close()
+
+	var variants []url.Variant
+	for rows.Next() {
+		var variant url.Variant
+		if err := rows.Scan(&variant.Name, &variant.Target, &variant.Weight, &variant.Count); err != nil {
+			return nil, fmt.Errorf("parse variant from database: %w", err)
+		}
+		variants = append(variants, variant)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("get variants from database: %w", err)
+	}
+
+	return variants, nil
+}
+
+// IncrementVariantCount increments the count of a variant of an url by one
+func (u URLStore) IncrementVariantCount(ctx context.Context, domain, short, variant string) error {
+	res, err := u.db.ExecContext(ctx, incrementVariantCount, domain, short, variant)
+	if err != nil {
+		return fmt.Errorf("save variant in database: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return url.ErrNotFound
+	}
+
+	return nil
+}
+
+// exists checks the url exists returning url.ErrNotFound otherwise
+func exists(ctx context.Context, tx *sql.Tx, domain, short string) error {
+	var found bool
+	if err := tx.QueryRowContext(ctx, existsURL, domain, short).Scan(&found); err != nil {
+		return fmt.Errorf("check url in database: %w", err)
+	}
+
+	if !found {
+		return url.ErrNotFound
+	}
+
 	return nil
 }
 
+// IncrementRedirectionCount increments the count by one unless it reached the maximum number of clicks,
+// it returns the new count and the remaining clicks or url.UnlimitedClicks. The deliveries of the events
+// returned for them are queued in the same transaction
+func (u URLStore) IncrementRedirectionCount(ctx context.Context, domain, short string,
+	events func(count, remaining int) []url.Event) (int, int, error) {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var count, maxClicks int
+	err = tx.QueryRowContext(ctx, incrementRedirectionCount, domain, short).Scan(&count, &maxClicks)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, 0, fmt.Errorf("save url in database: %w", err)
+		}
+
+		if err := tx.QueryRowContext(ctx, getRedirectiontCount, domain, short).Scan(&count); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return 0, 0, url.ErrNotFound
+			}
+
+			return 0, 0, fmt.Errorf("get redirection count from database: %w", err)
+		}
+
+		return 0, 0, url.ErrExhausted
+	}
+
+	remaining := remainingClicks(count, maxClicks)
+	if events != nil {
+		if err := addEvents(ctx, tx, events(count, remaining)); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("save url in database: %w", err)
+	}
+
+	return count, remaining, nil
+}
+
+// GetRemainingClicks gets the clicks left before the url reaches its maximum or url.UnlimitedClicks
+func (u URLStore) GetRemainingClicks(ctx context.Context, domain, short string) (int, error) {
+	var count, maxClicks int
+	if err := u.db.QueryRowContext(ctx, getClicks, domain, short).Scan(&count, &maxClicks); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, url.ErrNotFound
+		}
+
+		return 0, fmt.Errorf("get clicks from database: %w", err)
+	}
+
+	return remainingClicks(count, maxClicks), nil
+}
+
+func remainingClicks(count, maxClicks int) int {
+	if maxClicks == 0 {
+		return url.UnlimitedClicks
+	}
+
+	if count >= maxClicks {
+		return 0
+	}
+
+	return maxClicks - count
+}
+
 // GetRedirectionCount gets the count of a url
-func (u URLStore) GetRedirectionCount(ctx context.Context, short string) (int, error) {
-	row := u.db.QueryRowContext(ctx, getRedirectiontCount, short)
+func (u URLStore) GetRedirectionCount(ctx context.Context, domain, short string) (int, error) {
+	row := u.db.QueryRowContext(ctx, getRedirectiontCount, domain, short)
 	if row.Err() != nil {
 		return 0, fmt.Errorf("get redirection count from database: %w", row.Err())
 	}
@@ -0,0 +1,648 @@
+package store_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nerock/urlshort/url"
+	"github.com/nerock/urlshort/url/router"
+	"github.com/nerock/urlshort/url/store"
+)
+
+// noRedirectClient returns redirection responses instead of following them
+var noRedirectClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+type testGenerator string
+
+func (t testGenerator) Generate() (string, error) {
+	return string(t), nil
+}
+
+func TestIncrementRedirectionCount(t *testing.T) {
+	tests := map[string]struct {
+		short     string
+		maxClicks int
+		count     int
+
+		err           error
+		wantCount     int
+		wantRemaining int
+	}{
+		"not found": {
+			short: "missing",
+			err:   url.ErrNotFound,
+		},
+		"unlimited": {
+			short:         "ID",
+			count:         10,
+			wantCount:     11,
+			wantRemaining: url.UnlimitedClicks,
+		},
+		"limited": {
+			short:         "ID",
+			maxClicks:     3,
+			count:         1,
+			wantCount:     2,
+			wantRemaining: 1,
+		},
+		"last click": {
+			short:         "ID",
+			maxClicks:     3,
+			count:         2,
+			wantCount:     3,
+			wantRemaining: 0,
+		},
+		"exhausted": {
+			short:         "ID",
+			maxClicks:     3,
+			count:         3,
+			err:           url.ErrExhausted,
+			wantCount:     3,
+			wantRemaining: 0,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			ctx := context.Background()
+			if err := s.AddURL(ctx, url.Link{Short: "ID", Long: "https://www.google.es", MaxClicks: tt.maxClicks}); err != nil {
+				t.Fatalf("could not add url: %s", err)
+			}
+			for i := 0; i < tt.count; i++ {
+				if _, _, err := s.IncrementRedirectionCount(ctx, "", "ID", nil); err != nil {
+					t.Fatalf("could not increment count: %s", err)
+				}
+			}
+
+			gotCount, gotRemaining, err := s.IncrementRedirectionCount(ctx, "", tt.short, nil)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("wrong error returned\nexpected=%s\ngot=%s", tt.err, err)
+			}
+
+			if tt.err == url.ErrNotFound {
+				return
+			}
+
+			if tt.err == nil && (gotCount != tt.wantCount || gotRemaining != tt.wantRemaining) {
+				t.Errorf("wrong returned clicks\nexpected=%d and %d remaining\ngot=%d and %d remaining",
+					tt.wantCount, tt.wantRemaining, gotCount, gotRemaining)
+			}
+
+			count, err := s.GetRedirectionCount(ctx, "", tt.short)
+			if err != nil || count != tt.wantCount {
+				t.Errorf("wrong redirection count\nexpected=%d\ngot=%d (%v)", tt.wantCount, count, err)
+			}
+
+			remaining, err := s.GetRemainingClicks(ctx, "", tt.short)
+			if err != nil || remaining != tt.wantRemaining {
+				t.Errorf("wrong remaining clicks\nexpected=%d\ngot=%d (%v)", tt.wantRemaining, remaining, err)
+			}
+		})
+	}
+}
+
+func TestNotBefore(t *testing.T) {
+	notBefore := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		notBefore time.Time
+	}{
+		"not scheduled": {},
+		"scheduled": {
+			notBefore: notBefore,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := newStore(t)
+			ctx := context.Background()
+			if err := s.AddURL(ctx, url.Link{Short: "ID", Long: "https://www.google.es", NotBefore: tt.notBefore}); err != nil {
+				t.Fatalf("could not add url: %s", err)
+			}
+
+			link, err := s.GetLink(ctx, "", "ID")
+			if err != nil {
+				t.Fatalf("could not get url: %s", err)
+			}
+
+			if !link.NotBefore.Equal(tt.notBefore) {
+				t.Errorf("wrong not before time\nexpected=%s\ngot=%s", tt.notBefore, link.NotBefore)
+			}
+		})
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := newStore(t)
+	svc := url.NewService(url.MustParseBaseURL("localhost:8080"), testGenerator("ID"), s,
+		url.WithClock(func() time.Time { return now }), url.WithRetention(time.Hour))
+
+	if _, err := svc.CreateURL(ctx, "https://www.google.es", url.LinkOptions{}); err != nil {
+		t.Fatalf("could not create url: %s", err)
+	}
+	rules := []url.Rule{{Platform: url.PlatformIOS, Target: "https://www.apple.com"}}
+	if err := svc.SetRules(ctx, "ID", rules); err != nil {
+		t.Fatalf("could not set rules: %s", err)
+	}
+
+	if err := svc.DeleteURL(ctx, "ID"); err != nil {
+		t.Fatalf("could not delete url: %s", err)
+	}
+
+	if _, err := svc.GetLink(ctx, "ID"); !errors.Is(err, url.ErrNotFound) {
+		t.Errorf("deleted url found\nexpected=%s\ngot=%v", url.ErrNotFound, err)
+	}
+
+	if err := svc.DeleteURL(ctx, "ID"); !errors.Is(err, url.ErrNotFound) {
+		t.Errorf("deleted url deleted again\nexpected=%s\ngot=%v", url.ErrNotFound, err)
+	}
+
+	if _, err := svc.CreateURL(ctx, "https://www.google.com", url.LinkOptions{}); !errors.Is(err, url.ErrDuplicateID) {
+		t.Errorf("deleted url id reissued\nexpected=%s\ngot=%v", url.ErrDuplicateID, err)
+	}
+
+	if err := svc.RestoreURL(ctx, "ID"); err != nil {
+		t.Fatalf("could not restore url: %s", err)
+	}
+
+	link, err := svc.GetLink(ctx, "ID")
+	if err != nil || link.Long != "https://www.google.es" || len(link.Rules) != len(rules) {
+		t.Errorf("url not restored with its rules\ngot=%+v (%v)", link, err)
+	}
+
+	if err := svc.RestoreURL(ctx, "ID"); !errors.Is(err, url.ErrNotFound) {
+		t.Errorf("url not in the trash restored\nexpected=%s\ngot=%v", url.ErrNotFound, err)
+	}
+
+	if err := svc.DeleteURL(ctx, "ID"); err != nil {
+		t.Fatalf("could not delete url: %s", err)
+	}
+
+	if n, err := svc.PurgeDeletedURLs(ctx); err != nil || n != 0 {
+		t.Errorf("url purged before its retention\nexpected=0\ngot=%d (%v)", n, err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if n, err := svc.PurgeDeletedURLs(ctx); err != nil || n != 1 {
+		t.Errorf("url not purged after its retention\nexpected=1\ngot=%d (%v)", n, err)
+	}
+
+	if err := svc.RestoreURL(ctx, "ID"); !errors.Is(err, url.ErrNotFound) {
+		t.Errorf("purged url restored\nexpected=%s\ngot=%v", url.ErrNotFound, err)
+	}
+
+	if _, err := svc.CreateURL(ctx, "https://www.google.com", url.LinkOptions{}); err != nil {
+		t.Errorf("purged url id not reissued: %s", err)
+	}
+
+	if link, err := svc.GetLink(ctx, "ID"); err != nil || len(link.Rules) != 0 {
+		t.Errorf("purged url rules kept\ngot=%+v (%v)", link, err)
+	}
+}
+
+func TestDomains(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := newStore(t)
+	svc := url.NewService(url.MustParseBaseURL("localhost:8080"), testGenerator("ID"), s,
+		url.WithDomains(url.MustParseBaseURL("https://acme.link")), url.WithClock(func() time.Time { return now }),
+		url.WithRetention(time.Hour))
+
+	ctx := context.Background()
+	acme := url.WithDomain(ctx, "acme.link")
+
+	if _, err := svc.CreateURL(ctx, "https://www.google.es", url.LinkOptions{}); err != nil {
+		t.Fatalf("could not create url: %s", err)
+	}
+
+	shortURL, err := svc.CreateURL(ctx, "https://www.google.com", url.LinkOptions{Domain: "acme.link"})
+	if err != nil || shortURL != "https://acme.link/ID" {
+		t.Fatalf("could not create url with the same id on another domain\nexpected=https://acme.link/ID\ngot=%s (%v)",
+			shortURL, err)
+	}
+
+	if _, err := svc.CreateURL(acme, "https://www.google.fr", url.LinkOptions{}); !errors.Is(err, url.ErrDuplicateID) {
+		t.Errorf("url id reissued on its domain\nexpected=%s\ngot=%v", url.ErrDuplicateID, err)
+	}
+
+	rules := []url.Rule{{Platform: url.PlatformIOS, Target: "https://www.apple.com"}}
+	if err := svc.SetRules(acme, "ID", rules); err != nil {
+		t.Fatalf("could not set rules: %s", err)
+	}
+
+	if _, err := svc.IncrementRedirectionCount(acme, "ID"); err != nil {
+		t.Fatalf("could not increment count: %s", err)
+	}
+
+	link, err := svc.GetLink(ctx, "ID")
+	if err != nil || link.Long != "https://www.google.es" || link.Count != 0 || len(link.Rules) != 0 {
+		t.Errorf("wrong url on the default domain\ngot=%+v (%v)", link, err)
+	}
+
+	link, err = svc.GetLink(acme, "ID")
+	if err != nil || link.Long != "https://www.google.com" || link.Count != 1 || len(link.Rules) != len(rules) ||
+		link.ShortURL != shortURL {
+		t.Errorf("wrong url on the other domain\ngot=%+v (%v)", link, err)
+	}
+
+	if err := svc.DeleteURL(acme, "ID"); err != nil {
+		t.Fatalf("could not delete url: %s", err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if n, err := svc.PurgeDeletedURLs(ctx); err != nil || n != 1 {
+		t.Errorf("wrong urls purged\nexpected=1\ngot=%d (%v)", n, err)
+	}
+
+	if _, err := svc.GetLink(ctx, "ID"); err != nil {
+		t.Errorf("url of the default domain purged: %s", err)
+	}
+
+	if _, err := svc.CreateURL(acme, "https://www.google.fr", url.LinkOptions{}); err != nil {
+		t.Errorf("purged url id not reissued on its domain: %s", err)
+	}
+
+	if link, err := svc.GetLink(acme, "ID"); err != nil || len(link.Rules) != 0 {
+		t.Errorf("purged url rules kept\ngot=%+v (%v)", link, err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	s, db := newStoreDB(t)
+
+	for i, entry := range []url.AuditEntry{
+		{Action: url.ActionCreate, Short: "A", After: []byte(`{"Long":"a"}`), Origin: url.Origin{Actor: "alice"}},
+		{Action: url.ActionCreate, Domain: "sho.rt", Short: "B", After: []byte(`{"Long":"b"}`), Origin: url.Origin{Actor: "bob"}},
+		{Action: url.ActionDelete, Short: "A", Before: []byte(`{"Long":"a"}`), Origin: url.Origin{Actor: "bob"}},
+	} {
+		entry.Time = start.Add(time.Duration(i) * time.Hour)
+		if err := s.AddAuditEntry(ctx, entry); err != nil {
+			t.Fatalf("could not add audit entry: %s", err)
+		}
+	}
+
+	shortDomain, defaultDomain := "sho.rt", ""
+	tests := map[string]struct {
+		filter url.AuditFilter
+
+		ids []int64
+	}{
+		"all":        {filter: url.AuditFilter{Limit: 10}, ids: []int64{1, 2, 3}},
+		"by link":    {filter: url.AuditFilter{Short: "A", Limit: 10}, ids: []int64{1, 3}},
+		"by actor":   {filter: url.AuditFilter{Actor: "bob", Limit: 10}, ids: []int64{2, 3}},
+		"time range": {filter: url.AuditFilter{From: start.Add(time.Hour), To: start.Add(2 * time.Hour), Limit: 10}, ids: []int64{2}},
+		"page":       {filter: url.AuditFilter{AfterID: 1, Limit: 1}, ids: []int64{2}},
+		"by domain":  {filter: url.AuditFilter{Domain: &shortDomain, Limit: 10}, ids: []int64{2}},
+		"default":    {filter: url.AuditFilter{Domain: &defaultDomain, Limit: 10}, ids: []int64{1, 3}},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			entries, err := s.ListAuditEntries(ctx, tt.filter)
+			if err != nil {
+				t.Fatalf("could not list audit entries: %s", err)
+			}
+
+			ids := make([]int64, 0, len(entries))
+			for _, entry := range entries {
+				ids = append(ids, entry.ID)
+			}
+
+			if !reflect.DeepEqual(ids, tt.ids) {
+				t.Errorf("wrong audit entries\nexpected=%v\ngot=%v", tt.ids, ids)
+			}
+		})
+	}
+
+	entries, err := s.ListAuditEntries(ctx, url.AuditFilter{Short: "A", Limit: 1})
+	if err != nil || len(entries) != 1 || string(entries[0].After) != `{"Long":"a"}` || entries[0].Before != nil ||
+		!entries[0].Time.Equal(start) {
+		t.Errorf("wrong audit entry\ngot=%+v (%v)", entries, err)
+	}
+
+	if _, err := db.Exec(`UPDATE url_audit SET actor = 'mallory'`); err == nil {
+		t.Error("audit entries updated")
+	}
+
+	if _, err := db.Exec(`DELETE FROM url_audit`); err == nil {
+		t.Error("audit entries deleted")
+	}
+}
+
+func TestWebhookOutbox(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	s, db := newStoreDB(t)
+
+	all, err := s.AddWebhook(ctx, url.Webhook{URL: "https://a.example.com", Secret: "a", CreatedAt: now})
+	if err != nil {
+		t.Fatalf("could not add webhook: %s", err)
+	}
+
+	expired, err := s.AddWebhook(ctx, url.Webhook{URL: "https://b.example.com", Secret: "b",
+		Events: []string{url.EventExpired, url.EventDeleted}, CreatedAt: now})
+	if err != nil {
+		t.Fatalf("could not add webhook: %s", err)
+	}
+
+	webhooks, err := s.ListWebhooks(ctx)
+	if err != nil || len(webhooks) != 2 || webhooks[0].Events != nil ||
+		!reflect.DeepEqual(webhooks[1].Events, []string{url.EventExpired, url.EventDeleted}) {
+		t.Fatalf("wrong webhooks\ngot=%+v (%v)", webhooks, err)
+	}
+
+	svc := url.NewService(url.MustParseBaseURL("localhost:8080"), testGenerator("ID"), s, url.WithWebhooks(s),
+		url.WithClock(func() time.Time { return now }))
+	if _, err := svc.CreateURL(ctx, "https://www.google.es", url.LinkOptions{MaxClicks: 1}); err != nil {
+		t.Fatalf("could not create url: %s", err)
+	}
+
+	// Events are only queued with the changes sending them
+	if err := s.AddURL(ctx, url.Link{Short: "ID", Long: "https://www.google.com"},
+		url.Event{Type: url.EventCreated, Time: now, ID: "ID"}); err != url.ErrDuplicateID {
+		t.Fatalf("wrong error returned\nexpected=%s\ngot=%s", url.ErrDuplicateID, err)
+	}
+	if err := s.DeleteURL(ctx, "", "missing", now,
+		url.Event{Type: url.EventDeleted, Time: now, ID: "missing"}); err != url.ErrNotFound {
+		t.Fatalf("wrong error returned\nexpected=%s\ngot=%s", url.ErrNotFound, err)
+	}
+
+	if _, err := svc.IncrementRedirectionCount(ctx, "ID"); err != nil {
+		t.Fatalf("could not increment count: %s", err)
+	}
+
+	if _, err := svc.IncrementRedirectionCount(ctx, "ID"); err != url.ErrExhausted {
+		t.Fatalf("wrong error returned\nexpected=%s\ngot=%s", url.ErrExhausted, err)
+	}
+
+	// The outbox survives a restart
+	if s, err = store.NewURLStore(db); err != nil {
+		t.Fatalf("could not reopen store: %s", err)
+	}
+
+	pending, err := s.PendingDeliveries(ctx, now, 10)
+	if err != nil {
+		t.Fatalf("could not list pending deliveries: %s", err)
+	}
+
+	var got []string
+	for _, delivery := range pending {
+		got = append(got, delivery.URL+" "+delivery.Event)
+	}
+	want := []string{
+		"https://a.example.com " + url.EventCreated,
+		"https://a.example.com " + url.EventExpired,
+		"https://b.example.com " + url.EventExpired,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong pending deliveries\nexpected=%v\ngot=%v", want, got)
+	}
+
+	if string(pending[0].Payload) != `{"Type":"link.created","Time":"2022-03-01T12:00:00Z","ID":"ID",`+
+		`"ShortURL":"http://localhost:8080/ID","URL":"https://www.google.es","Count":0}` || pending[0].Secret != "a" {
+		t.Errorf("wrong delivery\ngot=%+v", pending[0])
+	}
+
+	retried := pending[2]
+	retried.Attempts, retried.NextAttempt, retried.LastError = 1, now.Add(time.Minute), "unexpected status 500"
+	if err := s.RecordDeliveryAttempt(ctx, retried, url.DeliveryAttempt{Time: now, StatusCode: http.StatusInternalServerError,
+		Error: retried.LastError, Duration: 20 * time.Millisecond}); err != nil {
+		t.Fatalf("could not record attempt: %s", err)
+	}
+
+	delivered := pending[0]
+	delivered.Attempts, delivered.Status = 1, url.DeliveryDelivered
+	if err := s.RecordDeliveryAttempt(ctx, delivered, url.DeliveryAttempt{Time: now, StatusCode: http.StatusOK}); err != nil {
+		t.Fatalf("could not record attempt: %s", err)
+	}
+
+	if due, err := s.PendingDeliveries(ctx, now, 10); err != nil || len(due) != 1 || due[0].ID != pending[1].ID {
+		t.Errorf("wrong pending deliveries before the retry\ngot=%+v (%v)", due, err)
+	}
+
+	if due, err := s.PendingDeliveries(ctx, now.Add(time.Minute), 10); err != nil || len(due) != 2 {
+		t.Errorf("wrong pending deliveries after the backoff\ngot=%+v (%v)", due, err)
+	}
+
+	deliveries, err := s.ListDeliveries(ctx, all, url.DeliveryFilter{Status: url.DeliveryDelivered, Limit: 10})
+	if err != nil || len(deliveries) != 1 || deliveries[0].ID != delivered.ID || deliveries[0].Attempts != 1 {
+		t.Errorf("wrong delivered deliveries\ngot=%+v (%v)", deliveries, err)
+	}
+
+	attempts, err := s.ListDeliveryAttempts(ctx, expired, retried.ID)
+	if err != nil || len(attempts) != 1 || attempts[0].StatusCode != http.StatusInternalServerError ||
+		attempts[0].Duration != 20*time.Millisecond || !attempts[0].Time.Equal(now) {
+		t.Errorf("wrong attempts\ngot=%+v (%v)", attempts, err)
+	}
+
+	if _, err := s.ListDeliveryAttempts(ctx, all, retried.ID); err != url.ErrDeliveryNotFound {
+		t.Errorf("wrong error returned\nexpected=%s\ngot=%s", url.ErrDeliveryNotFound, err)
+	}
+
+	if err := s.DeleteWebhook(ctx, expired); err != nil {
+		t.Fatalf("could not delete webhook: %s", err)
+	}
+
+	if err := s.DeleteWebhook(ctx, expired); err != url.ErrWebhookNotFound {
+		t.Errorf("wrong error returned\nexpected=%s\ngot=%s", url.ErrWebhookNotFound, err)
+	}
+
+	if _, err := s.ListDeliveries(ctx, expired, url.DeliveryFilter{Limit: 10}); err != url.ErrWebhookNotFound {
+		t.Errorf("wrong error returned\nexpected=%s\ngot=%s", url.ErrWebhookNotFound, err)
+	}
+
+	var orphans int
+	if err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM webhook_delivery WHERE webhook_id = ?1) +
+		(SELECT COUNT(*) FROM webhook_attempt WHERE delivery_id = ?2)`, expired, retried.ID).Scan(&orphans); err != nil || orphans != 0 {
+		t.Errorf("deleted webhook deliveries kept\ngot=%d (%v)", orphans, err)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := newStore(t)
+	svc := url.NewService(url.MustParseBaseURL("localhost:8080"), testGenerator("ID"), s,
+		url.WithDomains(url.MustParseBaseURL("https://acme.link")), url.WithClock(func() time.Time { return now }),
+		url.WithIdempotency(s, time.Hour))
+
+	ctx := url.WithIdempotencyKey(context.Background(), "key")
+	opts := url.LinkOptions{Domain: "acme.link"}
+
+	shortURL, err := svc.CreateURL(ctx, "https://www.google.com", opts)
+	if err != nil || shortURL != "https://acme.link/ID" {
+		t.Fatalf("could not create url\nexpected=https://acme.link/ID\ngot=%s (%v)", shortURL, err)
+	}
+
+	now = now.Add(30 * time.Minute)
+	if repeated, err := svc.CreateURL(ctx, "https://www.google.com", opts); err != nil || repeated != shortURL {
+		t.Errorf("repeated request not replayed\nexpected=%s\ngot=%s (%v)", shortURL, repeated, err)
+	}
+
+	if _, err := svc.CreateURL(ctx, "https://www.google.es", opts); !errors.Is(err, url.ErrIdempotencyConflict) {
+		t.Errorf("key reused with another url\nexpected=%s\ngot=%v", url.ErrIdempotencyConflict, err)
+	}
+
+	if _, err := svc.CreateURL(url.WithIdempotencyKey(context.Background(), "other"), "https://www.google.com",
+		opts); !errors.Is(err, url.ErrDuplicateID) {
+		t.Errorf("url created again with another key\nexpected=%s\ngot=%v", url.ErrDuplicateID, err)
+	}
+
+	if _, err := svc.CreateURL(url.WithIdempotencyKey(context.Background(), "other"), "https://www.google.fr",
+		url.LinkOptions{}); err != nil {
+		t.Errorf("key of a failed request not released: %s", err)
+	}
+
+	if n, err := svc.PurgeIdempotencyKeys(ctx); err != nil || n != 0 {
+		t.Errorf("keys purged before their window\nexpected=0\ngot=%d (%v)", n, err)
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := svc.CreateURL(ctx, "https://www.google.es", opts); !errors.Is(err, url.ErrDuplicateID) {
+		t.Errorf("expired key not reused\nexpected=%s\ngot=%v", url.ErrDuplicateID, err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if n, err := svc.PurgeIdempotencyKeys(ctx); err != nil || n != 1 {
+		t.Errorf("key not purged after its window\nexpected=1\ngot=%d (%v)", n, err)
+	}
+}
+
+func TestAbandonedIdempotencyKey(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := newStore(t)
+	svc := url.NewService(url.MustParseBaseURL("localhost:8080"), testGenerator("ID"), s,
+		url.WithClock(func() time.Time { return now }), url.WithIdempotency(s, time.Hour))
+
+	// The request reserving the key never completes nor releases it, like when the server crashes
+	ctx := url.WithIdempotencyKey(context.Background(), "key")
+	abandoned, reserved, err := s.ReserveIdempotencyKey(ctx, url.IdempotencyRecord{Key: "key", RequestHash: "hash",
+		CreatedAt: now}, now.Add(-time.Hour), now.Add(-url.IdempotencyLease))
+	if err != nil || !reserved {
+		t.Fatalf("could not reserve key: %t (%v)", reserved, err)
+	}
+
+	now = now.Add(url.IdempotencyLease - time.Second)
+	if _, err := svc.CreateURL(ctx, "https://www.google.es", url.LinkOptions{}); !errors.Is(err, url.ErrIdempotencyConflict) {
+		t.Errorf("key taken over during its lease\nexpected=%s\ngot=%v", url.ErrIdempotencyConflict, err)
+	}
+
+	now = now.Add(2 * time.Second)
+	shortURL, err := svc.CreateURL(ctx, "https://www.google.es", url.LinkOptions{})
+	if err != nil || shortURL != "http://localhost:8080/ID" {
+		t.Fatalf("abandoned key not taken over\nexpected=http://localhost:8080/ID\ngot=%s (%v)", shortURL, err)
+	}
+
+	// The abandoned request finishing late does not overwrite the url of the request that took the key over
+	abandoned.Short = "LATE"
+	if err := s.CompleteIdempotencyKey(ctx, abandoned); !errors.Is(err, url.ErrIdempotencyConflict) {
+		t.Errorf("key completed by the abandoned request\nexpected=%s\ngot=%v", url.ErrIdempotencyConflict, err)
+	}
+	if repeated, err := svc.CreateURL(ctx, "https://www.google.es", url.LinkOptions{}); err != nil || repeated != shortURL {
+		t.Errorf("repeated request not replayed\nexpected=%s\ngot=%s (%v)", shortURL, repeated, err)
+	}
+
+	// Completed keys are kept for the whole window
+	now = now.Add(2 * url.IdempotencyLease)
+	if _, err := svc.CreateURL(ctx, "https://www.google.fr", url.LinkOptions{}); !errors.Is(err, url.ErrIdempotencyConflict) {
+		t.Errorf("completed key taken over after the lease\nexpected=%s\ngot=%v", url.ErrIdempotencyConflict, err)
+	}
+}
+
+func TestConcurrentRedirects(t *testing.T) {
+	const (
+		maxClicks = 5
+		visits    = 50
+	)
+
+	s := newStore(t)
+	svc := url.NewService(url.MustParseBaseURL("localhost:8080"), testGenerator("ID"), s)
+	if _, err := svc.CreateURL(context.Background(), "https://www.google.es", url.LinkOptions{MaxClicks: maxClicks}); err != nil {
+		t.Fatalf("could not create url: %s", err)
+	}
+
+	r := chi.NewRouter()
+	router.NewURLRouter(svc).Routes(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		codes = make(map[int]int)
+	)
+	for i := 0; i < visits; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res, err := noRedirectClient.Get(srv.URL + "/ID")
+			if err != nil {
+				t.Errorf("could not send request: %v", err)
+				return
+			}
+			res.Body.Close()
+
+			mu.Lock()
+			codes[res.StatusCode]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if codes[http.StatusTemporaryRedirect] != maxClicks || codes[http.StatusGone] != visits-maxClicks {
+		t.Errorf("wrong responses\nexpected=%d redirections and %d gone\ngot=%v", maxClicks, visits-maxClicks, codes)
+	}
+
+	stats, err := svc.GetStats(context.Background(), "ID")
+	if err != nil {
+		t.Fatalf("could not get stats: %s", err)
+	}
+
+	if stats.Count != maxClicks || stats.Remaining != 0 {
+		t.Errorf("wrong stats\nexpected=count %d and 0 remaining\ngot=%+v", maxClicks, stats)
+	}
+}
+
+func newStore(t *testing.T) store.URLStore {
+	t.Helper()
+
+	s, _ := newStoreDB(t)
+
+	return s
+}
+
+func newStoreDB(t *testing.T) (store.URLStore, *sql.DB) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "urlshort.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("could not open db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	s, err := store.NewURLStore(db)
+	if err != nil {
+		t.Fatalf("could not create store: %s", err)
+	}
+
+	return s, db
+}
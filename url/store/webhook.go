@@ -0,0 +1,287 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nerock/urlshort/url"
+)
+
+const (
+	createWebhook = `INSERT INTO webhook (url, secret, events, created_at) VALUES (?, ?, ?, ?)`
+	listWebhooks  = `SELECT id, url, secret, events, created_at FROM webhook ORDER BY id`
+	existsWebhook = `SELECT EXISTS (SELECT 1 FROM webhook WHERE id = ?)`
+	deleteWebhook = `DELETE FROM webhook WHERE id = ?`
+
+	deleteWebhookAttempts = `DELETE FROM webhook_attempt
+		WHERE delivery_id IN (SELECT id FROM webhook_delivery WHERE webhook_id = ?)`
+	deleteWebhookDeliveries = `DELETE FROM webhook_delivery WHERE webhook_id = ?`
+
+	// createDeliveries fans an event out to the webhooks subscribed to it, the events of a webhook
+	// are stored comma separated and empty when it is subscribed to all of them
+	createDeliveries = `INSERT INTO webhook_delivery (webhook_id, event, payload, created_at, status, next_attempt_at)
+		SELECT id, ?1, ?2, ?3, ?4, ?3 FROM webhook
+		WHERE events = '' OR instr(',' || events || ',', ',' || ?1 || ',') > 0`
+
+	deliveryColumns = `d.id, d.webhook_id, d.event, d.payload, d.created_at, d.status, d.attempts,
+		d.next_attempt_at, d.last_error`
+	listDeliveries = `SELECT ` + deliveryColumns + ` FROM webhook_delivery d WHERE d.webhook_id = ?`
+	listPending    = `SELECT ` + deliveryColumns + `, w.url, w.secret
+		FROM webhook_delivery d JOIN webhook w ON w.id = d.webhook_id
+		WHERE d.status = ? AND d.next_attempt_at <= ? ORDER BY d.id LIMIT ?`
+	updateDelivery = `UPDATE webhook_delivery SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ?
+		WHERE id = ?`
+	existsDelivery = `SELECT EXISTS (SELECT 1 FROM webhook_delivery WHERE id = ? AND webhook_id = ?)`
+
+	createAttempt = `INSERT INTO webhook_attempt (delivery_id, time, status_code, error, duration_ms)
+		VALUES (?, ?, ?, ?, ?)`
+	listAttempts = `SELECT id, delivery_id, time, status_code, error, duration_ms FROM webhook_attempt
+		WHERE delivery_id = ? ORDER BY id`
+)
+
+// AddWebhook saves a new webhook returning its id
+func (u URLStore) AddWebhook(ctx context.Context, webhook url.Webhook) (int64, error) {
+	res, err := u.db.ExecContext(ctx, createWebhook, webhook.URL, webhook.Secret, strings.Join(webhook.Events, ","),
+		webhook.CreatedAt.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("save webhook in database: %w", err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("save webhook in database: %w", err)
+	}
+
+	return id, nil
+}
+
+// ListWebhooks gets all the webhooks in the order they were added
+func (u URLStore) ListWebhooks(ctx context.Context) ([]url.Webhook, error) {
+	rows, err := u.db.QueryContext(ctx, listWebhooks)
+	if err != nil {
+		return nil, fmt.Errorf("list webhooks from database: %w", err)
+	}
+	defer rows.Close()
+
+	var webhooks []url.Webhook
+	for rows.Next() {
+		var (
+			webhook url.Webhook
+			events  string
+		)
+		if err := rows.Scan(&webhook.ID, &webhook.URL, &webhook.Secret, &events, &webhook.CreatedAt); err != nil {
+			return nil, fmt.Errorf("parse webhook from database: %w", err)
+		}
+		if events != "" {
+			webhook.Events = strings.Split(events, ",")
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list webhooks from database: %w", err)
+	}
+
+	return webhooks, nil
+}
+
+// DeleteWebhook removes a webhook with its deliveries and their attempts
+func (u URLStore) DeleteWebhook(ctx context.Context, id int64) error {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, deleteWebhook, id)
+	if err != nil {
+		return fmt.Errorf("delete webhook from database: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("delete webhook from database: %w", err)
+	} else if n == 0 {
+		return url.ErrWebhookNotFound
+	}
+
+	if _, err := tx.ExecContext(ctx, deleteWebhookAttempts, id); err != nil {
+		return fmt.Errorf("delete webhook attempts from database: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, deleteWebhookDeliveries, id); err != nil {
+		return fmt.Errorf("delete webhook deliveries from database: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// addEvents queues a pending delivery of each event as JSON to every webhook subscribed to it in the
+// transaction of the change sending them
+func addEvents(ctx context.Context, tx *sql.Tx, events []url.Event) error {
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("encode event: %w", err)
+		}
+
+		if _, err := tx.ExecContext(ctx, createDeliveries, event.Type, string(payload), event.Time.UTC(),
+			url.DeliveryPending); err != nil {
+			return fmt.Errorf("save webhook deliveries in database: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ListDeliveries lists the deliveries of a webhook matching the filter from the newest
+func (u URLStore) ListDeliveries(ctx context.Context, webhookID int64, filter url.DeliveryFilter) ([]url.Delivery, error) {
+	tx, err := u.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var found bool
+	if err := tx.QueryRowContext(ctx, existsWebhook, webhookID).Scan(&found); err != nil {
+		return nil, fmt.Errorf("check webhook in database: %w", err)
+	}
+
+	if !found {
+		return nil, url.ErrWebhookNotFound
+	}
+
+	query, args := listDeliveries, []any{webhookID}
+	if filter.Status != "" {
+		query += ` AND d.status = ?`
+		args = append(args, filter.Status)
+	}
+	query += ` ORDER BY d.id DESC LIMIT ?`
+	args = append(args, filter.Limit)
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list webhook deliveries from database: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []url.Delivery
+	for rows.Next() {
+		var delivery url.Delivery
+		if err := scanDelivery(rows, &delivery); err != nil {
+			return nil, fmt.Errorf("parse webhook delivery from database: %w", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list webhook deliveries from database: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+// PendingDeliveries lists up to limit pending deliveries due at the time from the oldest,
+// with the url and secret of their webhook
+func (u URLStore) PendingDeliveries(ctx context.Context, now time.Time, limit int) ([]url.Delivery, error) {
+	rows, err := u.db.QueryContext(ctx, listPending, url.DeliveryPending, now.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("list pending webhook deliveries from database: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []url.Delivery
+	for rows.Next() {
+		var delivery url.Delivery
+		if err := scanDelivery(rows, &delivery, &delivery.URL, &delivery.Secret); err != nil {
+			return nil, fmt.Errorf("parse webhook delivery from database: %w", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list pending webhook deliveries from database: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+func scanDelivery(row scanner, delivery *url.Delivery, extra ...any) error {
+	var payload string
+	dest := append([]any{&delivery.ID, &delivery.WebhookID, &delivery.Event, &payload, &delivery.CreatedAt,
+		&delivery.Status, &delivery.Attempts, &delivery.NextAttempt, &delivery.LastError}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	delivery.Payload = json.RawMessage(payload)
+
+	return nil
+}
+
+// RecordDeliveryAttempt saves an attempt to send a delivery together with the new status of the delivery
+func (u URLStore) RecordDeliveryAttempt(ctx context.Context, delivery url.Delivery, attempt url.DeliveryAttempt) error {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, createAttempt, delivery.ID, attempt.Time.UTC(), attempt.StatusCode, attempt.Error,
+		attempt.Duration.Milliseconds()); err != nil {
+		return fmt.Errorf("save webhook attempt in database: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, updateDelivery, delivery.Status, delivery.Attempts, delivery.NextAttempt.UTC(),
+		delivery.LastError, delivery.ID); err != nil {
+		return fmt.Errorf("save webhook delivery in database: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// ListDeliveryAttempts lists the attempts to send a delivery of a webhook in the order they were made
+func (u URLStore) ListDeliveryAttempts(ctx context.Context, webhookID, deliveryID int64) ([]url.DeliveryAttempt, error) {
+	tx, err := u.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var found bool
+	if err := tx.QueryRowContext(ctx, existsDelivery, deliveryID, webhookID).Scan(&found); err != nil {
+		return nil, fmt.Errorf("check webhook delivery in database: %w", err)
+	}
+
+	if !found {
+		return nil, url.ErrDeliveryNotFound
+	}
+
+	rows, err := tx.QueryContext(ctx, listAttempts, deliveryID)
+	if err != nil {
+		return nil, fmt.Errorf("list webhook attempts from database: %w", err)
+	}
+	defer rows.Close()
+
+	var attempts []url.DeliveryAttempt
+	for rows.Next() {
+		var (
+			attempt    url.DeliveryAttempt
+			durationMs int64
+		)
+		if err := rows.Scan(&attempt.ID, &attempt.DeliveryID, &attempt.Time, &attempt.StatusCode, &attempt.Error,
+			&durationMs); err != nil {
+			return nil, fmt.Errorf("parse webhook attempt from database: %w", err)
+		}
+		attempt.Duration = time.Duration(durationMs) * time.Millisecond
+		attempts = append(attempts, attempt)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list webhook attempts from database: %w", err)
+	}
+
+	return attempts, nil
+}
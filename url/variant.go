@@ -0,0 +1,130 @@
+package url
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// MaxVariants is the maximum number of variants a shortened url splits its traffic across
+	MaxVariants = 10
+	// MaxVariantWeight is the maximum weight of a variant
+	MaxVariantWeight = 1000
+	// maxVariantName is the maximum length of a variant name
+	maxVariantName = 32
+)
+
+// Split spreads the visits of a shortened url across weighted variants, the long url is the fallback
+// when it has no variants or all of them are paused
+type Split struct {
+	// Sticky sends returning visitors to the variant they got the first time
+	Sticky   bool
+	Variants []Variant
+}
+
+// Variant is one of the weighted destinations of a shortened url
+type Variant struct {
+	// Name identifies the variant in stats and sticky visits, it defaults to its position letter: a, b, c...
+	Name   string
+	Target string
+	// Weight is the share of visits relative to the total weight of the variants, 0 pauses the variant
+	Weight int
+	// Count is the number of redirections to the variant
+	Count int
+}
+
+// Stats are the redirection counts of a shortened url
+type Stats struct {
+	Count int
+	// Remaining is the number of clicks left before the url stops working or UnlimitedClicks
+	Remaining int
+	Variants  []Variant
+	// NotBefore is the time the url starts working and Scheduled whether it is still in the future
+	NotBefore time.Time
+	Scheduled bool
+}
+
+// Variant returns the active variant with the name
+func (s Split) Variant(name string) (Variant, bool) {
+	for _, v := range s.Variants {
+		if v.Name == name && v.Weight > 0 {
+			return v, true
+		}
+	}
+
+	return Variant{}, false
+}
+
+// Pick chooses a variant at random according to their weights, intn returns a random number in [0, n)
+func (s Split) Pick(intn func(n int) int) (Variant, bool) {
+	total := 0
+	for _, v := range s.Variants {
+		total += v.Weight
+	}
+
+	if total <= 0 {
+		return Variant{}, false
+	}
+
+	n := intn(total)
+	for _, v := range s.Variants {
+		if n < v.Weight {
+			return v, true
+		}
+		n -= v.Weight
+	}
+
+	return Variant{}, false
+}
+
+func validSplit(s Split) (Split, error) {
+	if len(s.Variants) > MaxVariants {
+		return Split{}, ErrTooManyVariants
+	}
+
+	valid := Split{Sticky: s.Sticky, Variants: make([]Variant, 0, len(s.Variants))}
+	names := make(map[string]struct{}, len(s.Variants))
+	total := 0
+	for i, v := range s.Variants {
+		v = Variant{
+			Name:   strings.ToLower(strings.TrimSpace(v.Name)),
+			Target: strings.TrimSpace(v.Target),
+			Weight: v.Weight,
+		}
+		if v.Name == "" {
+			v.Name = string(rune('a' + i))
+		}
+
+		if !validVariantName(v.Name) || v.Weight < 0 || v.Weight > MaxVariantWeight {
+			return Split{}, ErrInvalidVariant
+		}
+
+		if _, ok := names[v.Name]; ok {
+			return Split{}, ErrInvalidVariant
+		}
+		names[v.Name] = struct{}{}
+
+		total += v.Weight
+		valid.Variants = append(valid.Variants, v)
+	}
+
+	if len(valid.Variants) > 0 && total == 0 {
+		return Split{}, ErrInvalidVariant
+	}
+
+	return valid, nil
+}
+
+func validVariantName(name string) bool {
+	if len(name) > maxVariantName {
+		return false
+	}
+
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
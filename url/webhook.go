@@ -0,0 +1,365 @@
+package url
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Events sent to webhooks
+const (
+	EventCreated = "link.created"
+	EventDeleted = "link.deleted"
+	// EventExpired is sent when a link reaches its maximum number of clicks
+	EventExpired = "link.expired"
+	// EventClicks is sent when the count of a link reaches one of the click thresholds
+	EventClicks = "link.clicks"
+)
+
+// Statuses of a webhook delivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// DeliveryFailed deliveries ran out of attempts
+	DeliveryFailed = "failed"
+)
+
+const (
+	// DefaultDeliveryLimit is the number of deliveries listed when the filter does not set a limit
+	DefaultDeliveryLimit = 100
+	// MaxDeliveryLimit is the maximum number of deliveries listed at once
+	MaxDeliveryLimit = 1000
+
+	// webhookSecretBytes is the number of random bytes of the generated webhook secrets
+	webhookSecretBytes = 32
+)
+
+// DefaultClickThresholds are the counts sending EventClicks when no thresholds are set
+var DefaultClickThresholds = []int{100, 1000, 10000}
+
+// WebhookStore is the storage of webhooks and their deliveries, the Store queues the deliveries of the events in
+// the same transaction as the changes sending them
+type WebhookStore interface {
+	// AddWebhook returns the id of the new webhook
+	AddWebhook(ctx context.Context, webhook Webhook) (int64, error)
+	ListWebhooks(ctx context.Context) ([]Webhook, error)
+	// DeleteWebhook removes the webhook with its deliveries, returning ErrWebhookNotFound when it does not exist
+	DeleteWebhook(ctx context.Context, id int64) error
+	// ListDeliveries lists the deliveries of a webhook from the newest, returning ErrWebhookNotFound
+	// when it does not exist
+	ListDeliveries(ctx context.Context, webhookID int64, filter DeliveryFilter) ([]Delivery, error)
+	// ListDeliveryAttempts lists the attempts of a delivery of a webhook from the oldest, returning
+	// ErrDeliveryNotFound when the webhook has no such delivery
+	ListDeliveryAttempts(ctx context.Context, webhookID, deliveryID int64) ([]DeliveryAttempt, error)
+}
+
+// Webhook is an endpoint receiving the events it is subscribed to as signed JSON payloads
+type Webhook struct {
+	ID  int64
+	URL string
+	// Secret signs the payloads sent to the webhook
+	Secret string
+	// Events are the events sent to the webhook, empty subscribes it to all of them
+	Events    []string
+	CreatedAt time.Time
+}
+
+// Event is the payload sent to webhooks when something happens to a shortened url
+type Event struct {
+	Type     string
+	Time     time.Time
+	ID       string
+	ShortURL string
+	// URL is the long url, empty for password protected urls and click events
+	URL   string
+	Count int
+}
+
+// Delivery is the sending of an event to a webhook, retried until it succeeds or runs out of attempts
+type Delivery struct {
+	ID        int64
+	WebhookID int64
+	Event     string
+	Payload   json.RawMessage
+	CreatedAt time.Time
+	Status    string
+	Attempts  int
+	// NextAttempt is when a pending delivery is sent again
+	NextAttempt time.Time
+	LastError   string
+
+	// URL and Secret are the ones of the webhook, only set for the pending deliveries being sent
+	URL    string
+	Secret string
+}
+
+// DeliveryAttempt is one try to send a delivery to its webhook
+type DeliveryAttempt struct {
+	ID         int64
+	DeliveryID int64
+	Time       time.Time
+	// StatusCode is the response status code, 0 when no response was received
+	StatusCode int
+	Error      string
+	Duration   time.Duration
+}
+
+// DeliveryFilter selects the deliveries of a webhook, an empty status matches all of them
+type DeliveryFilter struct {
+	Status string
+	Limit  int
+}
+
+// events returns the event of a change of the link, queued by the store with the change, none without webhooks
+func (s Service) events(eventType string, link Link) []Event {
+	if s.webhooks == nil {
+		return nil
+	}
+
+	return []Event{s.event(eventType, link)}
+}
+
+func (s Service) event(eventType string, link Link) Event {
+	event := Event{
+		Type:     eventType,
+		Time:     s.now().UTC(),
+		ID:       link.Short,
+		ShortURL: s.baseURL(link.Domain).ShortURL(link.Short),
+		URL:      link.Long,
+		Count:    link.Count,
+	}
+	if link.Protected() {
+		event.URL = ""
+	}
+
+	return event
+}
+
+// clickEvents returns the function giving the events of a redirection of the url from its new count and
+// remaining clicks, queued by the store with the count. It is nil without webhooks
+func (s Service) clickEvents(domain, short string) func(count, remaining int) []Event {
+	if s.webhooks == nil {
+		return nil
+	}
+
+	return func(count, remaining int) []Event {
+		var events []Event
+		link := Link{Domain: domain, Short: short, Count: count}
+		for _, threshold := range s.clickThresholds {
+			if count == threshold {
+				events = append(events, s.event(EventClicks, link))
+				break
+			}
+		}
+
+		if remaining == 0 {
+			events = append(events, s.event(EventExpired, link))
+		}
+
+		return events
+	}
+}
+
+// Resolver resolves the addresses of a host, *net.Resolver is one
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// WebhookNetworks checks the addresses webhooks are sent to so they can not reach internal services: private,
+// loopback, link-local and unspecified addresses are refused unless they are in one of the allowed networks
+type WebhookNetworks struct {
+	resolver Resolver
+	allowed  []netip.Prefix
+}
+
+// NewWebhookNetworks creates WebhookNetworks resolving hosts with the resolver and allowing the networks
+func NewWebhookNetworks(resolver Resolver, allowed ...netip.Prefix) WebhookNetworks {
+	return WebhookNetworks{resolver: resolver, allowed: allowed}
+}
+
+// Allowed checks webhooks can be sent to the address
+func (n WebhookNetworks) Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, network := range n.allowed {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+
+	return addr.IsValid() && !addr.IsPrivate() && !addr.IsLoopback() && !addr.IsLinkLocalUnicast() &&
+		!addr.IsLinkLocalMulticast() && !addr.IsInterfaceLocalMulticast() && !addr.IsUnspecified()
+}
+
+// CheckHost resolves the host and checks webhooks can be sent to every one of its addresses, returning
+// ErrForbiddenWebhookHost when they can not
+func (n WebhookNetworks) CheckHost(ctx context.Context, host string) error {
+	addr, err := netip.ParseAddr(host)
+	addrs := []netip.Addr{addr}
+	if err != nil {
+		if addrs, err = n.resolver.LookupNetIP(ctx, "ip", host); err != nil {
+			return fmt.Errorf("could not resolve webhook host %s: %w", host, err)
+		}
+	}
+
+	for _, addr := range addrs {
+		if !n.Allowed(addr) {
+			return fmt.Errorf("%w: %s is %s", ErrForbiddenWebhookHost, host, addr)
+		}
+	}
+
+	return nil
+}
+
+func validWebhook(webhook Webhook) (Webhook, error) {
+	u, err := url.ParseRequestURI(strings.TrimSpace(webhook.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, ErrInvalidWebhook
+	}
+
+	valid := Webhook{URL: u.String(), Secret: webhook.Secret, Events: make([]string, 0, len(webhook.Events))}
+	seen := make(map[string]struct{}, len(webhook.Events))
+	for _, event := range webhook.Events {
+		switch event {
+		case EventCreated, EventDeleted, EventExpired, EventClicks:
+		default:
+			return Webhook{}, ErrInvalidWebhook
+		}
+
+		if _, ok := seen[event]; !ok {
+			seen[event] = struct{}{}
+			valid.Events = append(valid.Events, event)
+		}
+	}
+
+	return valid, nil
+}
+
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, webhookSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
+}
+
+// AddWebhook registers a webhook, a secret is generated when it does not have one
+func (s Service) AddWebhook(ctx context.Context, webhook Webhook) (Webhook, error) {
+	if s.webhooks == nil {
+		return Webhook{}, ErrWebhooksDisabled
+	}
+
+	webhook, err := validWebhook(webhook)
+	if err != nil {
+		return Webhook{}, err
+	}
+
+	// The host is checked again when delivering since it can resolve to other addresses later
+	u, _ := url.Parse(webhook.URL)
+	if err := s.webhookNetworks.CheckHost(ctx, u.Hostname()); errors.Is(err, ErrForbiddenWebhookHost) {
+		return Webhook{}, err
+	} else if err != nil {
+		return Webhook{}, fmt.Errorf("%w: %s", ErrInvalidWebhook, err)
+	}
+
+	if webhook.Secret == "" {
+		if webhook.Secret, err = newWebhookSecret(); err != nil {
+			return Webhook{}, fmt.Errorf("could not generate webhook secret: %w", err)
+		}
+	}
+	webhook.CreatedAt = s.now().UTC()
+
+	if webhook.ID, err = s.webhooks.AddWebhook(ctx, webhook); err != nil {
+		return Webhook{}, fmt.Errorf("could not save webhook in database: %w", err)
+	}
+
+	return webhook, nil
+}
+
+// ListWebhooks lists the registered webhooks
+func (s Service) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	if s.webhooks == nil {
+		return nil, ErrWebhooksDisabled
+	}
+
+	webhooks, err := s.webhooks.ListWebhooks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list webhooks from database: %w", err)
+	}
+
+	return webhooks, nil
+}
+
+// DeleteWebhook removes a webhook with its pending deliveries and their history
+func (s Service) DeleteWebhook(ctx context.Context, id int64) error {
+	if s.webhooks == nil {
+		return ErrWebhooksDisabled
+	}
+
+	if err := s.webhooks.DeleteWebhook(ctx, id); err != nil {
+		if err == ErrWebhookNotFound {
+			return ErrWebhookNotFound
+		}
+
+		return fmt.Errorf("could not delete webhook from database: %w", err)
+	}
+
+	return nil
+}
+
+// ListDeliveries lists the deliveries of a webhook matching the filter from the newest
+func (s Service) ListDeliveries(ctx context.Context, webhookID int64, filter DeliveryFilter) ([]Delivery, error) {
+	if s.webhooks == nil {
+		return nil, ErrWebhooksDisabled
+	}
+
+	switch filter.Status {
+	case "", DeliveryPending, DeliveryDelivered, DeliveryFailed:
+	default:
+		return nil, ErrInvalidDeliveryFilter
+	}
+
+	if filter.Limit < 0 || filter.Limit > MaxDeliveryLimit {
+		return nil, ErrInvalidDeliveryFilter
+	}
+
+	if filter.Limit == 0 {
+		filter.Limit = DefaultDeliveryLimit
+	}
+
+	deliveries, err := s.webhooks.ListDeliveries(ctx, webhookID, filter)
+	if err != nil {
+		if err == ErrWebhookNotFound {
+			return nil, ErrWebhookNotFound
+		}
+
+		return nil, fmt.Errorf("could not list webhook deliveries from database: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+// ListDeliveryAttempts lists the attempts made to send a delivery of a webhook from the oldest
+func (s Service) ListDeliveryAttempts(ctx context.Context, webhookID, deliveryID int64) ([]DeliveryAttempt, error) {
+	if s.webhooks == nil {
+		return nil, ErrWebhooksDisabled
+	}
+
+	attempts, err := s.webhooks.ListDeliveryAttempts(ctx, webhookID, deliveryID)
+	if err != nil {
+		if err == ErrDeliveryNotFound {
+			return nil, ErrDeliveryNotFound
+		}
+
+		return nil, fmt.Errorf("could not list webhook delivery attempts from database: %w", err)
+	}
+
+	return attempts, nil
+}
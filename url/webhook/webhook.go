@@ -0,0 +1,273 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	neturl "net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/nerock/urlshort/url"
+)
+
+// Headers of the requests sent to webhooks
+const (
+	// SignatureHeader is the hex HMAC-SHA256 of the timestamp, a dot and the body, keyed with the webhook secret
+	SignatureHeader = "X-Urlshort-Signature"
+	// TimestampHeader is the unix time the request was signed at, receivers should reject old ones
+	TimestampHeader = "X-Urlshort-Timestamp"
+	EventHeader     = "X-Urlshort-Event"
+	DeliveryHeader  = "X-Urlshort-Delivery"
+
+	signaturePrefix = "sha256="
+)
+
+const (
+	// DefaultMaxAttempts is the number of attempts to send a delivery before marking it as failed
+	DefaultMaxAttempts = 8
+	// DefaultBackoff is the wait after the first failed attempt, it doubles after every attempt
+	DefaultBackoff = 30 * time.Second
+	// DefaultMaxBackoff is the maximum wait between two attempts
+	DefaultMaxBackoff = time.Hour
+	// DefaultTimeout is how long a webhook has to respond
+	DefaultTimeout = 10 * time.Second
+	// DefaultBatchSize is the number of pending deliveries sent at once
+	DefaultBatchSize = 50
+
+	// maxErrorBody is the number of bytes of a failed response body kept as its error
+	maxErrorBody = 256
+)
+
+// Store is the outbox of the deliveries sent by the Dispatcher
+type Store interface {
+	// PendingDeliveries lists up to limit pending deliveries due at the time from the oldest,
+	// with the url and secret of their webhook
+	PendingDeliveries(ctx context.Context, now time.Time, limit int) ([]url.Delivery, error)
+	// RecordDeliveryAttempt saves an attempt together with the new status of its delivery
+	RecordDeliveryAttempt(ctx context.Context, delivery url.Delivery, attempt url.DeliveryAttempt) error
+}
+
+// Option configures optional Dispatcher behaviour
+type Option func(*Dispatcher)
+
+// WithHTTPClient replaces the client used to send deliveries, it should not follow redirections. The hosts are
+// still checked before sending, but only the default client checks the addresses it connects to
+func WithHTTPClient(client *http.Client) Option {
+	return func(d *Dispatcher) {
+		d.client = client
+	}
+}
+
+// WithClock replaces the clock used to sign requests and schedule retries
+func WithClock(now func() time.Time) Option {
+	return func(d *Dispatcher) {
+		d.now = now
+	}
+}
+
+// WithNetworks replaces the check of the addresses deliveries can be sent to, by default only public addresses
+// resolved with the default resolver are allowed
+func WithNetworks(networks url.WebhookNetworks) Option {
+	return func(d *Dispatcher) {
+		d.networks = networks
+	}
+}
+
+// WithRetries sets the number of attempts of each delivery and the exponential backoff between them
+func WithRetries(maxAttempts int, backoff, maxBackoff time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.maxAttempts = maxAttempts
+		d.backoff = backoff
+		d.maxBackoff = maxBackoff
+	}
+}
+
+// Dispatcher sends the pending deliveries of the outbox to their webhooks, retrying the failed ones
+type Dispatcher struct {
+	store    Store
+	client   *http.Client
+	networks url.WebhookNetworks
+	now      func() time.Time
+
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+}
+
+// NewDispatcher creates a Dispatcher sending the deliveries of the store
+func NewDispatcher(store Store, opts ...Option) Dispatcher {
+	d := Dispatcher{
+		store:       store,
+		networks:    url.NewWebhookNetworks(net.DefaultResolver),
+		now:         time.Now,
+		maxAttempts: DefaultMaxAttempts,
+		backoff:     DefaultBackoff,
+		maxBackoff:  DefaultMaxBackoff,
+	}
+
+	for _, opt := range opts {
+		opt(&d)
+	}
+
+	if d.client == nil {
+		d.client = newClient(d.networks)
+	}
+
+	return d
+}
+
+// newClient creates the default client sending deliveries, it checks the address of every connection since
+// hosts can resolve to other addresses between the check of the host and the connection
+func newClient(networks url.WebhookNetworks) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: DefaultTimeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !networks.Allowed(addr.Addr()) {
+				return fmt.Errorf("%w: %s", url.ErrForbiddenWebhookHost, addr.Addr())
+			}
+
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Proxies are not used since the address connected to would be the one of the proxy
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   DefaultTimeout,
+		Transport: transport,
+		// Redirections are not followed so receivers can not bounce signed payloads elsewhere
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// DeliverPending sends a batch of the due pending deliveries, it returns the number of them delivered
+func (d Dispatcher) DeliverPending(ctx context.Context) (int, error) {
+	deliveries, err := d.store.PendingDeliveries(ctx, d.now(), DefaultBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("could not retrieve pending deliveries from database: %w", err)
+	}
+
+	delivered := 0
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			break
+		}
+
+		delivery, attempt := d.deliver(ctx, delivery)
+		if err := d.store.RecordDeliveryAttempt(ctx, delivery, attempt); err != nil {
+			return delivered, fmt.Errorf("could not save delivery attempt in database: %w", err)
+		}
+
+		if delivery.Status == url.DeliveryDelivered {
+			delivered++
+		}
+	}
+
+	return delivered, nil
+}
+
+// deliver sends the delivery once, returning it updated with the outcome of the attempt
+func (d Dispatcher) deliver(ctx context.Context, delivery url.Delivery) (url.Delivery, url.DeliveryAttempt) {
+	start := d.now()
+	attempt := url.DeliveryAttempt{DeliveryID: delivery.ID, Time: start.UTC()}
+
+	attempt.StatusCode, attempt.Error = d.send(ctx, delivery, start)
+	attempt.Duration = d.now().Sub(start)
+
+	delivery.Attempts++
+	delivery.LastError = attempt.Error
+	switch {
+	case attempt.Error == "":
+		delivery.Status = url.DeliveryDelivered
+	case delivery.Attempts >= d.maxAttempts:
+		delivery.Status = url.DeliveryFailed
+	default:
+		delivery.Status = url.DeliveryPending
+		delivery.NextAttempt = start.Add(Backoff(delivery.Attempts, d.backoff, d.maxBackoff)).UTC()
+	}
+
+	return delivery, attempt
+}
+
+// send posts the signed payload of the delivery returning the response status code and the error message
+// when it failed
+func (d Dispatcher) send(ctx context.Context, delivery url.Delivery, now time.Time) (int, string) {
+	u, err := neturl.Parse(delivery.URL)
+	if err != nil {
+		return 0, err.Error()
+	}
+	if err := d.networks.CheckHost(ctx, u.Hostname()); err != nil {
+		return 0, err.Error()
+	}
+
+	timestamp := now.Unix()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+		return res.StatusCode, fmt.Sprintf("unexpected status %d: %s", res.StatusCode, bytes.TrimSpace(body))
+	}
+
+	return res.StatusCode, ""
+}
+
+// Backoff is the wait after the attempt number of a delivery failed, doubling from backoff up to maxBackoff
+func Backoff(attempt int, backoff, maxBackoff time.Duration) time.Duration {
+	wait := backoff
+	for i := 1; i < attempt && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+
+	if wait > maxBackoff {
+		return maxBackoff
+	}
+
+	return wait
+}
+
+// Sign computes the signature of a payload sent at the unix timestamp with the webhook secret
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a payload sent at the unix timestamp in constant time, meant for receivers
+func Verify(secret string, timestamp int64, payload []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, payload)), []byte(signature))
+}
@@ -0,0 +1,257 @@
+package webhook_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nerock/urlshort/url"
+	"github.com/nerock/urlshort/url/webhook"
+)
+
+var errStore = errors.New("store error")
+
+// loopback allows the deliveries to the test servers
+var loopback = url.NewWebhookNetworks(net.DefaultResolver, netip.MustParsePrefix("127.0.0.0/8"))
+
+// testResolver resolves every host to the address
+type testResolver netip.Addr
+
+func (t testResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return []netip.Addr{netip.Addr(t)}, nil
+}
+
+type testStore struct {
+	deliveries []url.Delivery
+	err        error
+
+	recorded []url.Delivery
+	attempts []url.DeliveryAttempt
+}
+
+func (t *testStore) PendingDeliveries(ctx context.Context, now time.Time, limit int) ([]url.Delivery, error) {
+	return t.deliveries, t.err
+}
+
+func (t *testStore) RecordDeliveryAttempt(ctx context.Context, delivery url.Delivery, attempt url.DeliveryAttempt) error {
+	t.recorded = append(t.recorded, delivery)
+	t.attempts = append(t.attempts, attempt)
+
+	return nil
+}
+
+func TestDeliverPending(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	payload := []byte(`{"Type":"link.created","ID":"ID"}`)
+
+	tests := map[string]struct {
+		status   int
+		attempts int
+
+		delivered   int
+		wantStatus  string
+		nextAttempt time.Time
+		statusCode  int
+	}{
+		"delivered": {
+			status:     http.StatusNoContent,
+			delivered:  1,
+			wantStatus: url.DeliveryDelivered,
+			statusCode: http.StatusNoContent,
+		},
+		"first failure": {
+			status:      http.StatusInternalServerError,
+			wantStatus:  url.DeliveryPending,
+			nextAttempt: now.Add(time.Second),
+			statusCode:  http.StatusInternalServerError,
+		},
+		"third failure": {
+			status:      http.StatusServiceUnavailable,
+			attempts:    2,
+			wantStatus:  url.DeliveryPending,
+			nextAttempt: now.Add(4 * time.Second),
+			statusCode:  http.StatusServiceUnavailable,
+		},
+		"redirection": {
+			status:      http.StatusFound,
+			wantStatus:  url.DeliveryPending,
+			nextAttempt: now.Add(time.Second),
+			statusCode:  http.StatusFound,
+		},
+		"out of attempts": {
+			status:     http.StatusInternalServerError,
+			attempts:   4,
+			wantStatus: url.DeliveryFailed,
+			statusCode: http.StatusInternalServerError,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var received *http.Request
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				timestamp, _ := strconv.ParseInt(r.Header.Get(webhook.TimestampHeader), 10, 64)
+				if !webhook.Verify("secret", timestamp, body, r.Header.Get(webhook.SignatureHeader)) {
+					t.Errorf("wrong signature %q", r.Header.Get(webhook.SignatureHeader))
+				}
+				received = r
+
+				if tt.status == http.StatusFound {
+					w.Header().Set("Location", "https://example.com")
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			store := &testStore{deliveries: []url.Delivery{{ID: 7, WebhookID: 1, Event: url.EventCreated,
+				Payload: payload, Status: url.DeliveryPending, Attempts: tt.attempts, URL: srv.URL, Secret: "secret"}}}
+			d := webhook.NewDispatcher(store, webhook.WithClock(func() time.Time { return now }),
+				webhook.WithRetries(5, time.Second, time.Minute), webhook.WithNetworks(loopback))
+
+			delivered, err := d.DeliverPending(context.Background())
+			if err != nil {
+				t.Fatalf("could not deliver: %s", err)
+			}
+
+			if delivered != tt.delivered {
+				t.Errorf("wrong delivered count\nexpected=%d\ngot=%d", tt.delivered, delivered)
+			}
+
+			if received == nil || received.Header.Get(webhook.EventHeader) != url.EventCreated ||
+				received.Header.Get(webhook.DeliveryHeader) != "7" ||
+				received.Header.Get(webhook.TimestampHeader) != strconv.FormatInt(now.Unix(), 10) {
+				t.Fatalf("wrong request received\ngot=%+v", received)
+			}
+
+			if len(store.recorded) != 1 {
+				t.Fatalf("wrong recorded attempts\ngot=%+v", store.recorded)
+			}
+
+			recorded, attempt := store.recorded[0], store.attempts[0]
+			if recorded.Status != tt.wantStatus || recorded.Attempts != tt.attempts+1 ||
+				!recorded.NextAttempt.Equal(tt.nextAttempt) {
+				t.Errorf("wrong delivery\nexpected=%s after %d attempts, next at %s\ngot=%+v",
+					tt.wantStatus, tt.attempts+1, tt.nextAttempt, recorded)
+			}
+
+			if attempt.DeliveryID != 7 || attempt.StatusCode != tt.statusCode || !attempt.Time.Equal(now) ||
+				(attempt.Error == "") != (tt.wantStatus == url.DeliveryDelivered) {
+				t.Errorf("wrong attempt\ngot=%+v", attempt)
+			}
+		})
+	}
+}
+
+func TestDeliverPendingUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	store := &testStore{deliveries: []url.Delivery{{ID: 1, Payload: []byte(`{}`), URL: srv.URL}}}
+	if _, err := webhook.NewDispatcher(store, webhook.WithNetworks(loopback)).DeliverPending(context.Background()); err != nil {
+		t.Fatalf("could not deliver: %s", err)
+	}
+
+	if len(store.attempts) != 1 || store.attempts[0].StatusCode != 0 || store.attempts[0].Error == "" ||
+		store.recorded[0].Status != url.DeliveryPending || store.recorded[0].LastError != store.attempts[0].Error {
+		t.Errorf("wrong attempt\ngot=%+v %+v", store.recorded, store.attempts)
+	}
+}
+
+func TestDeliverPendingForbiddenHost(t *testing.T) {
+	received := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = true
+	}))
+	defer srv.Close()
+
+	tests := map[string]struct {
+		url      string
+		networks url.WebhookNetworks
+	}{
+		"loopback address": {url: srv.URL, networks: url.NewWebhookNetworks(net.DefaultResolver)},
+		"not allowed network": {url: srv.URL,
+			networks: url.NewWebhookNetworks(net.DefaultResolver, netip.MustParsePrefix("10.0.0.0/8"))},
+		// The host resolved to a public address when checked but connects to a loopback one
+		"rebinding": {url: strings.Replace(srv.URL, "127.0.0.1", "localhost", 1),
+			networks: url.NewWebhookNetworks(testResolver(netip.MustParseAddr("93.184.216.34")))},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			store := &testStore{deliveries: []url.Delivery{{ID: 1, Payload: []byte(`{}`), URL: tt.url}}}
+			d := webhook.NewDispatcher(store, webhook.WithNetworks(tt.networks))
+			if _, err := d.DeliverPending(context.Background()); err != nil {
+				t.Fatalf("could not deliver: %s", err)
+			}
+
+			if received {
+				t.Fatal("delivery sent to a forbidden address")
+			}
+
+			if len(store.attempts) != 1 || !strings.Contains(store.attempts[0].Error, url.ErrForbiddenWebhookHost.Error()) ||
+				store.recorded[0].Status != url.DeliveryPending {
+				t.Errorf("wrong attempt\ngot=%+v %+v", store.recorded, store.attempts)
+			}
+		})
+	}
+}
+
+func TestDeliverPendingStoreError(t *testing.T) {
+	_, err := webhook.NewDispatcher(&testStore{err: errStore}).DeliverPending(context.Background())
+	if !errors.Is(err, errStore) {
+		t.Errorf("wrong error returned\nexpected=%s\ngot=%s", errStore, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		8:  time.Hour,
+		50: time.Hour,
+	}
+
+	for attempt, want := range tests {
+		if got := webhook.Backoff(attempt, webhook.DefaultBackoff, webhook.DefaultMaxBackoff); got != want {
+			t.Errorf("wrong backoff after attempt %d\nexpected=%s\ngot=%s", attempt, want, got)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	payload := []byte(`{"Type":"link.created"}`)
+	signature := webhook.Sign("secret", 1646136000, payload)
+
+	tests := map[string]struct {
+		secret    string
+		timestamp int64
+		payload   []byte
+		signature string
+
+		valid bool
+	}{
+		"valid":             {secret: "secret", timestamp: 1646136000, payload: payload, signature: signature, valid: true},
+		"wrong secret":      {secret: "other", timestamp: 1646136000, payload: payload, signature: signature},
+		"wrong timestamp":   {secret: "secret", timestamp: 1646136001, payload: payload, signature: signature},
+		"tampered payload":  {secret: "secret", timestamp: 1646136000, payload: []byte(`{"Type":"link.deleted"}`), signature: signature},
+		"missing signature": {secret: "secret", timestamp: 1646136000, payload: payload},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if valid := webhook.Verify(tt.secret, tt.timestamp, tt.payload, tt.signature); valid != tt.valid {
+				t.Errorf("wrong verification\nexpected=%t\ngot=%t", tt.valid, valid)
+			}
+		})
+	}
+}